@@ -42,6 +42,10 @@ type buildParams struct {
 	claimsFile         string
 	excludeVerifyFiles []string
 	plugin             string
+	wasmOptimize       string
+	wasmCompact        bool
+	wasmBuildInfo      bool
+	wasmCacheDir       string
 }
 
 func newBuildParams() buildParams {
@@ -102,7 +106,8 @@ The -O flag controls the optimization level. By default, optimization is disable
 When optimization is enabled the 'build' command generates a bundle that is semantically
 equivalent to the input files however the structure of the files in the bundle may have
 been changed by rewriting, inlining, pruning, etc. Higher optimization levels may result
-in longer build times.
+in longer build times. For the 'wasm' and 'plan' targets, the planned policy is optimized
+too: constant expressions are evaluated and branches that cannot succeed are removed.
 
 The 'build' command supports targets (specified by -t):
 
@@ -230,6 +235,10 @@ against OPA v0.22.0:
 	buildCommand.Flags().BoolVar(&buildParams.pruneUnused, "prune-unused", false, "exclude dependents of entrypoints")
 	buildCommand.Flags().BoolVar(&buildParams.debug, "debug", false, "enable debug output")
 	buildCommand.Flags().IntVarP(&buildParams.optimizationLevel, "optimize", "O", 0, "set optimization level")
+	buildCommand.Flags().StringVar(&buildParams.wasmOptimize, "wasm-optimize", "", "optimize the wasm module with wasm-opt at the given level (O0, O2, O3, Os, Oz), for the wasm target")
+	buildCommand.Flags().BoolVar(&buildParams.wasmCompact, "wasm-compact-unused-code", false, "remove unused functions from the wasm module, instead of stubbing them, for the wasm target")
+	buildCommand.Flags().StringVar(&buildParams.wasmCacheDir, "wasm-cache-dir", "", "cache compiled wasm modules in the given directory, keyed by the plan and the wasm options, for the wasm target")
+	buildCommand.Flags().BoolVar(&buildParams.wasmBuildInfo, "wasm-build-info", false, "embed the OPA version, bundle revision, entrypoints, and plan digest into the wasm module, for the wasm target")
 	buildCommand.Flags().VarP(&buildParams.entrypoints, "entrypoint", "e", "set slash separated entrypoint path")
 	buildCommand.Flags().VarP(&buildParams.revision, "revision", "r", "set output bundle revision")
 	buildCommand.Flags().StringVarP(&buildParams.outputFile, "output", "o", "bundle.tar.gz", "set the output filename")
@@ -294,7 +303,14 @@ func dobuild(params buildParams, args []string) error {
 		WithPaths(args...).
 		WithFilter(buildCommandLoaderFilter(params.bundleMode, params.ignore)).
 		WithBundleVerificationConfig(bvc).
-		WithBundleSigningConfig(bsc)
+		WithBundleSigningConfig(bsc).
+		WithWasmCompactUnusedCode(params.wasmCompact).
+		WithWasmBuildInfo(params.wasmBuildInfo).
+		WithWasmCacheDir(params.wasmCacheDir)
+
+	if params.wasmOptimize != "" {
+		compiler = compiler.WithWasmOptimization(true, params.wasmOptimize)
+	}
 
 	if params.revision.isSet {
 		compiler = compiler.WithRevision(*params.revision.v)
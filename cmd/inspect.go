@@ -11,10 +11,12 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	ib "github.com/open-policy-agent/opa/internal/bundle/inspect"
+	"github.com/open-policy-agent/opa/internal/compiler/wasm"
 	pr "github.com/open-policy-agent/opa/internal/presentation"
 	iStrs "github.com/open-policy-agent/opa/internal/strings"
 	"github.com/open-policy-agent/opa/util"
@@ -109,6 +111,10 @@ func doInspect(params inspectCommandParams, path string, out io.Writer) error {
 			}
 		}
 
+		if err := populateWasmBuildInfo(out, info.WasmModules); err != nil {
+			return err
+		}
+
 		if params.listAnnotations && len(info.Annotations) != 0 {
 			if err := populateAnnotations(out, info.Annotations); err != nil {
 				return err
@@ -198,6 +204,42 @@ func populateNamespaces(out io.Writer, n map[string][]string) error {
 	return nil
 }
 
+func populateWasmBuildInfo(out io.Writer, ms []map[string]interface{}) error {
+	t := generateTableWithKeys(out, "module", "field", "value")
+	t.SetAutoMergeCells(false)
+	t.SetAutoMergeCellsByColumnIndex([]int{0})
+	var lines [][]string
+
+	for _, m := range ms {
+		bi, ok := m["build_info"].(*wasm.BuildInfo)
+		if !ok {
+			continue
+		}
+		path, _ := m["path"].(string)
+		path = truncateFileName(path)
+		lines = append(lines, []string{path, "Version", bi.Version})
+		lines = append(lines, []string{path, "Timestamp", bi.Timestamp.Format(time.RFC3339)})
+		if bi.Revision != "" {
+			lines = append(lines, []string{path, "Revision", truncateTableStr(bi.Revision)})
+		}
+		for _, ep := range bi.Entrypoints {
+			lines = append(lines, []string{path, "Entrypoint", truncateTableStr(ep)})
+		}
+		if bi.Digest != "" {
+			// not truncated, so it can be compared
+			lines = append(lines, []string{path, "Digest", bi.Digest})
+		}
+	}
+
+	t.AppendBulk(lines)
+	if t.NumLines() > 0 {
+		fmt.Fprintln(out, "WASM BUILD INFO:")
+		t.Render()
+	}
+
+	return nil
+}
+
 func populateAnnotations(out io.Writer, refs []*ast.AnnotationsRef) error {
 	if len(refs) > 0 {
 		fmt.Fprintln(out, "ANNOTATIONS:")
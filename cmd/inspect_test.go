@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -199,6 +200,39 @@ MANIFEST:
 	})
 }
 
+func TestDoInspectPrettyWasmBuildInfo(t *testing.T) {
+	files := map[string]string{
+		"test.rego": "package test\np = true",
+	}
+
+	test.WithTempFS(files, func(root string) {
+		params := newBuildParams()
+		if err := params.target.Set("wasm"); err != nil {
+			t.Fatal(err)
+		}
+		if err := params.revision.Set("rev1"); err != nil {
+			t.Fatal(err)
+		}
+		params.outputFile = path.Join(root, "bundle.tar.gz")
+		params.entrypoints.v = []string{"test/p"}
+		params.wasmBuildInfo = true
+		if err := dobuild(params, []string{path.Join(root, "test.rego")}); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if err := doInspect(newInspectCommandParams(), params.outputFile, &out); err != nil {
+			t.Fatal(err)
+		}
+		output := out.String()
+		for _, exp := range []string{"WASM BUILD INFO:", "| /policy.wasm | Version", "| Revision   | rev1", "| Entrypoint | test/p", "| Digest     | "} {
+			if !strings.Contains(output, exp) {
+				t.Errorf("expected output to contain %q, got:\n%s", exp, output)
+			}
+		}
+	})
+}
+
 func TestInspectMultiBundleError(t *testing.T) {
 	params := newInspectCommandParams()
 	err := validateInspectParams(&params, []string{"foo", "bar"})
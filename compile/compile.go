@@ -8,10 +8,13 @@ package compile
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -20,6 +23,7 @@ import (
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/internal/compiler/wasm"
+	"github.com/open-policy-agent/opa/internal/compiler/wasm/opa"
 	"github.com/open-policy-agent/opa/internal/debug"
 	"github.com/open-policy-agent/opa/internal/planner"
 	"github.com/open-policy-agent/opa/internal/ref"
@@ -30,6 +34,7 @@ import (
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/storage"
 	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/version"
 )
 
 const (
@@ -79,6 +84,13 @@ type Compiler struct {
 	bsc                          *bundle.SigningConfig      // represents the key configuration used to generate a signed bundle
 	keyID                        string                     // represents the name of the default key used to verify a signed bundle
 	metadata                     *map[string]interface{}    // represents additional data included in .manifest file
+	wasmAnnotations              bool                       // embed entrypoint annotations into the wasm module
+	wasmOptimize                 bool                       // optimize the wasm module with wasm-opt
+	wasmOptLevel                 string                     // wasm-opt optimization level, if not the default
+	wasmOptArgs                  []string                   // wasm-opt arguments, if not the default
+	wasmCompact                  bool                       // remove unused functions from the wasm module
+	wasmBuildInfo                bool                       // embed build provenance into the wasm module
+	wasmCacheDir                 string                     // directory caching compiled wasm modules
 }
 
 // New returns a new compiler instance that can be invoked.
@@ -220,6 +232,59 @@ func (c *Compiler) WithMetadata(metadata *map[string]interface{}) *Compiler {
 	return c
 }
 
+// WithWasmAnnotations toggles embedding the annotations of entrypoint rules
+// into a custom section of the compiled wasm module, so they can be read
+// without access to the policy source.
+func (c *Compiler) WithWasmAnnotations(enabled bool) *Compiler {
+	c.wasmAnnotations = enabled
+	return c
+}
+
+// WithWasmOptimization toggles optimizing the compiled wasm module with
+// wasm-opt, at the given level, like "Oz", or the default level if empty.
+// The wasm-opt binary must be found in PATH, regardless of the
+// EXPERIMENTAL_WASM_OPT environment variable. A level set here takes
+// precedence over EXPERIMENTAL_WASM_OPT_ARGS.
+func (c *Compiler) WithWasmOptimization(enabled bool, level string) *Compiler {
+	c.wasmOptimize = enabled
+	c.wasmOptLevel = level
+	return c
+}
+
+// WithWasmOptArgs sets the arguments passed to wasm-opt when optimizing the
+// compiled wasm module, replacing the defaults and the optimization level.
+// They take precedence over EXPERIMENTAL_WASM_OPT_ARGS.
+func (c *Compiler) WithWasmOptArgs(args ...string) *Compiler {
+	c.wasmOptArgs = args
+	return c
+}
+
+// WithWasmCompactUnusedCode toggles removing the unused functions from the
+// compiled wasm module altogether, instead of replacing their bodies with
+// `unreachable`, renumbering the references to the functions retained.
+func (c *Compiler) WithWasmCompactUnusedCode(enabled bool) *Compiler {
+	c.wasmCompact = enabled
+	return c
+}
+
+// WithWasmBuildInfo toggles embedding build provenance into a custom section
+// of the compiled wasm module: the OPA version, the bundle revision, the
+// entrypoints, and the digest of the plan the module is compiled from.
+func (c *Compiler) WithWasmBuildInfo(enabled bool) *Compiler {
+	c.wasmBuildInfo = enabled
+	return c
+}
+
+// WithWasmCacheDir sets a directory for caching compiled wasm modules, keyed
+// by a digest of the plan and the wasm compilation options, so that building
+// an unchanged policy again skips compiling and optimizing the module. The
+// directory is created if it doesn't exist. Failures to read from or write
+// to the cache are logged, and don't fail the build.
+func (c *Compiler) WithWasmCacheDir(dir string) *Compiler {
+	c.wasmCacheDir = dir
+	return c
+}
+
 func addEntrypointsFromAnnotations(c *Compiler, ar []*ast.AnnotationsRef) error {
 	for _, ref := range ar {
 		var entrypoint ast.Ref
@@ -410,7 +475,7 @@ func (c *Compiler) initBundle() error {
 	// TODO(tsandall): the metrics object should passed through here so we that
 	// we can track read and parse times.
 
-	load, err := initload.LoadPaths(c.paths, c.filter, c.asBundle, c.bvc, false, c.useRegoAnnotationEntrypoints, c.capabilities)
+	load, err := initload.LoadPaths(c.paths, c.filter, c.asBundle, c.bvc, false, c.useRegoAnnotationEntrypoints || c.wasmAnnotations, c.capabilities)
 	if err != nil {
 		return fmt.Errorf("load error: %w", err)
 	}
@@ -579,6 +644,7 @@ func (c *Compiler) compilePlan(context.Context) error {
 		WithQueries(queries).
 		WithModules(modules).
 		WithBuiltinDecls(builtins).
+		WithOptimizationLevel(c.optimizationLevel).
 		WithDebug(c.debug.Writer())
 	policy, err := p.Plan()
 	if err != nil {
@@ -623,15 +689,64 @@ func (c *Compiler) compileWasm(ctx context.Context) error {
 		return err
 	}
 
-	// Compile the policy into a wasm binary.
-	m, err := compiler.WithPolicy(c.policy).WithDebug(c.debug.Writer()).Compile()
-	if err != nil {
-		return err
+	flattenedAnnotations := c.compiler.GetAnnotationSet().Flatten()
+	annotations := make(map[string][]*ast.Annotations, len(c.entrypointrefs))
+	for i, e := range c.entrypointrefs {
+		if !c.isPackage(e) {
+			annotations[c.entrypoints[i]] = findAnnotationsForTerm(e, flattenedAnnotations)
+		}
+	}
+	if c.wasmAnnotations {
+		compiler.WithAnnotations(annotations)
+	}
+	if c.wasmCompact {
+		compiler.WithCompactUnusedCode(true)
+	}
+	if c.wasmBuildInfo {
+		rev := c.bundle.Manifest.Revision
+		if c.revision != nil {
+			rev = *c.revision
+		}
+		compiler.WithBuildInfo(true).WithBuildRevision(rev)
+	}
+	if c.wasmOptimize {
+		compiler.WithRequireWasmOpt(true)
+		if c.wasmOptLevel != "" {
+			level, err := wasm.ParseOptLevel(c.wasmOptLevel)
+			if err != nil {
+				return err
+			}
+			compiler.WithOptLevel(level)
+		}
+		if c.wasmOptArgs != nil {
+			compiler.WithWasmOptArgs(c.wasmOptArgs...)
+		}
 	}
 
-	var buf bytes.Buffer
-	if err := encoding.WriteModule(&buf, m); err != nil {
-		return err
+	var cacheFile string
+	if c.wasmCacheDir != "" {
+		key, err := c.wasmCacheKey(ctx, compiler, annotations)
+		if err != nil {
+			return err
+		}
+		if key != "" {
+			cacheFile = filepath.Join(c.wasmCacheDir, key+".wasm")
+		}
+	}
+	raw, ok := c.readWasmCache(cacheFile)
+	if !ok {
+		// Compile the policy into a wasm binary.
+		m, err := compiler.WithPolicy(c.policy).WithDebug(c.debug.Writer()).CompileContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := encoding.WriteModule(&buf, m); err != nil {
+			return err
+		}
+		raw = buf.Bytes()
+		c.writeWasmCache(cacheFile, raw)
 	}
 
 	modulePath := bundle.WasmFile
@@ -639,24 +754,17 @@ func (c *Compiler) compileWasm(ctx context.Context) error {
 	c.bundle.WasmModules = []bundle.WasmModuleFile{{
 		URL:  modulePath,
 		Path: modulePath,
-		Raw:  buf.Bytes(),
+		Raw:  raw,
 	}}
 
-	flattenedAnnotations := c.compiler.GetAnnotationSet().Flatten()
-
 	// Each entrypoint needs an entry in the manifest
-	for i, e := range c.entrypointrefs {
+	for i := range c.entrypointrefs {
 		entrypointPath := c.entrypoints[i]
 
-		var annotations []*ast.Annotations
-		if !c.isPackage(e) {
-			annotations = findAnnotationsForTerm(e, flattenedAnnotations)
-		}
-
 		c.bundle.Manifest.WasmResolvers = append(c.bundle.Manifest.WasmResolvers, bundle.WasmResolver{
 			Module:      "/" + strings.TrimLeft(modulePath, "/"),
 			Entrypoint:  entrypointPath,
-			Annotations: annotations,
+			Annotations: annotations[entrypointPath],
 		})
 	}
 
@@ -664,6 +772,110 @@ func (c *Compiler) compileWasm(ctx context.Context) error {
 	return pruneBundleEntrypoints(c.bundle, c.entrypointrefs)
 }
 
+// wasmCacheKey returns the digest of everything the compiled wasm module
+// depends on: the plan, the options passed to the wasm compiler, the OPA
+// version and its wasm library, and how wasm-opt is run, as resolved from
+// the options and the EXPERIMENTAL_WASM_OPT* environment variables. If the
+// latter can't be resolved, the key is empty, and the module isn't cached:
+// compiling it reports the error, or compiles without them.
+func (c *Compiler) wasmCacheKey(ctx context.Context, compiler *wasm.Compiler, annotations map[string][]*ast.Annotations) (string, error) {
+	lib := sha256.Sum256(opa.Bytes()) // the VCS revision is unset in dev builds
+	key := struct {
+		Version         string                        `json:"version"`
+		Vcs             string                        `json:"vcs"`
+		Library         string                        `json:"library"`
+		Plan            *ir.Policy                    `json:"plan"`
+		Annotations     map[string][]*ast.Annotations `json:"annotations,omitempty"`
+		Compact         bool                          `json:"compact"`
+		BuildInfo       bool                          `json:"build_info"`
+		Revision        string                        `json:"revision,omitempty"`
+		SourceDateEpoch string                        `json:"source_date_epoch,omitempty"`
+		WasmOpt         wasm.WasmOptSettings          `json:"wasm_opt"`
+	}{
+		Version: version.Version,
+		Vcs:     version.Vcs,
+		Library: hex.EncodeToString(lib[:]),
+		Plan:    c.policy,
+		Compact: c.wasmCompact,
+	}
+	if c.wasmAnnotations {
+		key.Annotations = annotations
+	}
+	if c.wasmBuildInfo {
+		key.BuildInfo = true
+		key.Revision = c.bundle.Manifest.Revision
+		if c.revision != nil {
+			key.Revision = *c.revision
+		}
+		// the build info's timestamp is that of the cached module, unless
+		// it's fixed
+		key.SourceDateEpoch = os.Getenv("SOURCE_DATE_EPOCH")
+	}
+	wopt, err := compiler.WasmOptSettings(ctx)
+	if err != nil {
+		c.debug.Printf("wasm cache: skipped, could not resolve wasm-opt settings: %v", err)
+		return "", nil
+	}
+	key.WasmOpt = wopt
+	bs, err := json.Marshal(key)
+	if err != nil {
+		return "", fmt.Errorf("wasm cache key: %w", err)
+	}
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readWasmCache returns the module cached in file, if any.
+func (c *Compiler) readWasmCache(file string) ([]byte, bool) {
+	if file == "" {
+		return nil, false
+	}
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.debug.Printf("wasm cache: %v", err)
+		}
+		return nil, false
+	}
+	if _, err := encoding.ReadModule(bytes.NewReader(bs)); err != nil {
+		c.debug.Printf("wasm cache: ignoring %s: %v", file, err)
+		return nil, false
+	}
+	c.debug.Printf("wasm cache: using %s", file)
+	return bs, true
+}
+
+// writeWasmCache stores the module in file, via a temporary file, so that
+// concurrent builds never read a partially written module.
+func (c *Compiler) writeWasmCache(file string, bs []byte) {
+	if file == "" {
+		return
+	}
+	err := func() error {
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.Write(bs); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), file)
+	}()
+	if err != nil {
+		c.debug.Printf("wasm cache: could not store module: %v", err)
+		return
+	}
+	c.debug.Printf("wasm cache: stored %s", file)
+}
+
 func (c *Compiler) isPackage(term *ast.Term) bool {
 	for _, m := range c.compiler.Modules {
 		if m.Package.Path.Equal(term.Value) {
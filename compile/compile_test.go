@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
@@ -16,7 +17,9 @@ import (
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/format"
+	"github.com/open-policy-agent/opa/internal/compiler/wasm"
 	"github.com/open-policy-agent/opa/internal/ref"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
 	"github.com/open-policy-agent/opa/ir"
 	"github.com/open-policy-agent/opa/loader"
 	"github.com/open-policy-agent/opa/util"
@@ -531,6 +534,86 @@ func TestCompilerWasmTarget(t *testing.T) {
 	})
 }
 
+func TestCompilerWasmCompactUnusedCode(t *testing.T) {
+	files := map[string]string{
+		"test.rego": `package test
+
+		p = 7`,
+	}
+
+	test.WithTempFS(files, func(root string) {
+		build := func(compact bool) []byte {
+			t.Helper()
+			compiler := New().WithPaths(root).WithTarget("wasm").WithEntrypoints("test/p").
+				WithWasmCompactUnusedCode(compact)
+			if err := compiler.Build(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			return compiler.bundle.WasmModules[0].Raw
+		}
+		def, compacted := build(false), build(true)
+		if len(compacted) >= len(def) {
+			t.Fatalf("expected compacted module (%d bytes) to be smaller than default (%d bytes)", len(compacted), len(def))
+		}
+		if _, err := encoding.ReadModule(bytes.NewReader(compacted)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCompilerWasmOptimization(t *testing.T) {
+	files := map[string]string{
+		"test.rego": `package test
+
+		p = 7`,
+	}
+
+	// The fake wasm-opt records its arguments, and passes the module through.
+	dir := t.TempDir()
+	out := path.Join(dir, "args")
+	script := "#!/bin/sh\n[ \"$1\" = \"--version\" ] && exit 0\necho \"$@\" > " + out + "\nexec cat\n"
+	if err := os.WriteFile(path.Join(dir, "wasm-opt"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "")
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "")
+
+	test.WithTempFS(files, func(root string) {
+		for _, tc := range []struct {
+			note  string
+			level string
+			args  []string
+			exp   string
+		}{
+			{note: "default level", exp: "-O2 --debuginfo -o -"},
+			{note: "level", level: "Oz", exp: "-Oz --debuginfo -o -"},
+			{note: "args", level: "Oz", args: []string{"-O1"}, exp: "-O1 -o -"},
+		} {
+			t.Run(tc.note, func(t *testing.T) {
+				compiler := New().WithPaths(root).WithTarget("wasm").WithEntrypoints("test/p").
+					WithWasmOptimization(true, tc.level).WithWasmOptArgs(tc.args...)
+				if err := compiler.Build(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				bs, err := os.ReadFile(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if act := strings.TrimSpace(string(bs)); act != tc.exp {
+					t.Errorf("expected arguments %q, got %q", tc.exp, act)
+				}
+			})
+		}
+
+		err := New().WithPaths(root).WithTarget("wasm").WithEntrypoints("test/p").
+			WithWasmOptimization(true, "O9").Build(context.Background())
+		if err == nil || err.Error() != `unknown optimization level "O9"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
 // If we're building a wasm bundle, and the `opa` binary we use to do that
 // does not support wasm _itself_, then it shouldn't bother.
 func TestCompilerWasmTargetWithCapabilitiesUnset(t *testing.T) {
@@ -710,6 +793,192 @@ q = true`,
 	})
 }
 
+func TestCompilerWasmBuildInfo(t *testing.T) {
+	files := map[string]string{
+		"test.rego": `package test
+
+q = true
+
+p = true`,
+	}
+
+	test.WithTempFS(files, func(root string) {
+		compiler := New().WithPaths(root).WithTarget("wasm").
+			WithEntrypoints("test/q", "test/p").
+			WithRevision("abc").
+			WithWasmBuildInfo(true)
+		if err := compiler.Build(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := encoding.ReadModule(bytes.NewReader(compiler.bundle.WasmModules[0].Raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := wasm.ReadBuildInfo(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info == nil {
+			t.Fatal("expected build info")
+		}
+		if info.Revision != "abc" {
+			t.Errorf("expected revision abc, got %q", info.Revision)
+		}
+		if exp, act := []string{"test/p", "test/q"}, info.Entrypoints; !reflect.DeepEqual(exp, act) {
+			t.Errorf("expected entrypoints %v, got %v", exp, act)
+		}
+		if info.Digest == "" {
+			t.Error("expected digest")
+		}
+	})
+}
+
+func TestCompilerWasmCache(t *testing.T) {
+	files := map[string]string{
+		"test.rego": `package test
+
+p = 7`,
+	}
+
+	test.WithTempFS(files, func(root string) {
+		cacheDir := filepath.Join(root, "cache")
+		build := func(entrypoint string) ([]byte, string) {
+			t.Helper()
+			var debug bytes.Buffer
+			compiler := New().WithPaths(filepath.Join(root, "test.rego")).WithTarget("wasm").
+				WithEntrypoints(entrypoint).
+				WithWasmCacheDir(cacheDir).
+				WithDebug(&debug)
+			if err := compiler.Build(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			return compiler.bundle.WasmModules[0].Raw, debug.String()
+		}
+		cached := func() []string {
+			t.Helper()
+			fs, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fs
+		}
+
+		first, out := build("test/p")
+		if !strings.Contains(out, "wasm cache: stored") {
+			t.Errorf("expected module to be stored, got:\n%s", out)
+		}
+		fs := cached()
+		if len(fs) != 1 || !strings.HasSuffix(fs[0], ".wasm") {
+			t.Fatalf("expected one cached module, got %v", fs)
+		}
+
+		second, out := build("test/p")
+		if !strings.Contains(out, "wasm cache: using") {
+			t.Errorf("expected cached module to be used, got:\n%s", out)
+		}
+		if !bytes.Equal(first, second) {
+			t.Error("expected cached module to equal the compiled one")
+		}
+
+		// a corrupted module is recompiled, and replaced
+		if err := os.WriteFile(fs[0], []byte("garbage"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		third, out := build("test/p")
+		if !strings.Contains(out, "wasm cache: ignoring") || !bytes.Equal(first, third) {
+			t.Errorf("expected corrupted module to be recompiled, got:\n%s", out)
+		}
+
+		if _, out := build("test"); strings.Contains(out, "wasm cache: using") {
+			t.Errorf("expected different plan to be compiled, got:\n%s", out)
+		}
+		if fs := cached(); len(fs) != 2 {
+			t.Errorf("expected two cached modules, got %v", fs)
+		}
+
+		// the environment's wasm-opt settings are part of the key, even if
+		// wasm-opt isn't found
+		t.Setenv("EXPERIMENTAL_WASM_OPT_BIN", filepath.Join(root, "wasm-opt"))
+		t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "-O1")
+		if _, out := build("test/p"); strings.Contains(out, "wasm cache: using") {
+			t.Errorf("expected wasm-opt arguments to change the key, got:\n%s", out)
+		}
+		t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "-O3")
+		if _, out := build("test/p"); strings.Contains(out, "wasm cache: using") {
+			t.Errorf("expected wasm-opt arguments to change the key, got:\n%s", out)
+		}
+		if _, out := build("test/p"); !strings.Contains(out, "wasm cache: using") {
+			t.Errorf("expected cached module to be used, got:\n%s", out)
+		}
+
+		// settings that can't be resolved don't fall back to the module
+		// cached without wasm-opt, but fail as they do without a cache
+		t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "'-O1")
+		var debug bytes.Buffer
+		err := New().WithPaths(filepath.Join(root, "test.rego")).WithTarget("wasm").
+			WithEntrypoints("test/p").
+			WithWasmCacheDir(cacheDir).
+			WithDebug(&debug).
+			Build(context.Background())
+		if out := debug.String(); !strings.Contains(out, "wasm cache: skipped") || strings.Contains(out, "wasm cache: using") {
+			t.Errorf("expected cache to be skipped, got:\n%s", out)
+		}
+		exp := New().WithPaths(filepath.Join(root, "test.rego")).WithTarget("wasm").
+			WithEntrypoints("test/p").
+			Build(context.Background())
+		if exp == nil || err == nil || err.Error() != exp.Error() {
+			t.Errorf("expected error %v, got %v", exp, err)
+		}
+	})
+}
+
+func TestCompilerWasmTargetAnnotationsSection(t *testing.T) {
+	files := map[string]string{
+		"test.rego": `package test
+
+# METADATA
+# title: My P rule
+# description: Allows everything
+# custom:
+#  severity: high
+p = true
+
+q = true`,
+	}
+
+	test.WithTempFS(files, func(root string) {
+		compiler := New().WithPaths(root).WithTarget("wasm").
+			WithEntrypoints("test/p", "test/q").
+			WithWasmAnnotations(true)
+		if err := compiler.Build(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := encoding.ReadModule(bytes.NewReader(compiler.bundle.WasmModules[0].Raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		act, err := wasm.ReadAnnotations(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := map[string][]map[string]interface{}{
+			"test/p": {
+				{
+					"scope":       "rule",
+					"title":       "My P rule",
+					"description": "Allows everything",
+					"custom":      map[string]interface{}{"severity": "high"},
+				},
+			},
+		}
+		if !reflect.DeepEqual(exp, act) {
+			t.Errorf("expected %v, got %v", exp, act)
+		}
+	})
+}
+
 func TestCompilerWasmTargetEntrypointDependents(t *testing.T) {
 	files := map[string]string{
 		"test.rego": `package test
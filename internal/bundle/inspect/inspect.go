@@ -14,7 +14,9 @@ import (
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/internal/compiler/wasm"
 	initload "github.com/open-policy-agent/opa/internal/runtime/init"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
 	"github.com/open-policy-agent/opa/loader"
 	"github.com/open-policy-agent/opa/util"
 )
@@ -90,6 +92,10 @@ func File(path string, includeAnnotations bool) (*Info, error) {
 		}
 		wasmModule["entrypoints"] = entrypoints
 
+		if info := wasmBuildInfo(w.Raw); info != nil {
+			wasmModule["build_info"] = info
+		}
+
 		wasmModules = append(wasmModules, wasmModule)
 	}
 	bi.WasmModules = wasmModules
@@ -97,6 +103,21 @@ func File(path string, includeAnnotations bool) (*Info, error) {
 	return bi, nil
 }
 
+// wasmBuildInfo returns the build info embedded into the wasm module, see
+// `opa build --wasm-build-info`, or nil if there is none or the module can't
+// be decoded.
+func wasmBuildInfo(raw []byte) *wasm.BuildInfo {
+	m, err := encoding.ReadModule(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	info, err := wasm.ReadBuildInfo(m)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
 func (bi *Info) getBundleDataWasmAndSignatures(name string) error {
 
 	load, err := initload.WalkPaths([]string{name}, nil, true)
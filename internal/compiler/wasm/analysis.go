@@ -0,0 +1,105 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/opcode"
+)
+
+// FunctionsUsing returns the sorted names of the compiled functions whose
+// bodies contain an instruction with the given opcode, e.g.
+// opcode.CallIndirect. Functions of the pre-compiled OPA module are not
+// considered.
+func (c *Compiler) FunctionsUsing(op opcode.Opcode) []string {
+	var ret []string
+	for _, f := range c.funcsCode {
+		if containsOp(f.code.Func.Expr.Instrs, op) {
+			ret = append(ret, f.name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func containsOp(is []instruction.Instruction, op opcode.Opcode) bool {
+	for _, i := range is {
+		if i.Op() == op {
+			return true
+		}
+		if s, ok := i.(instruction.StructuredInstruction); ok && containsOp(s.Instructions(), op) {
+			return true
+		}
+	}
+	return false
+}
+
+// InstructionStats describes the instructions of the compiled functions.
+type InstructionStats struct {
+	Counts   map[string]int `json:"counts"`    // by instruction type, e.g. "I32Const"
+	Total    int            `json:"total"`     // all instructions, nested ones included
+	MaxDepth int            `json:"max_depth"` // deepest nesting of blocks, loops and ifs
+}
+
+// InstructionStats returns the statistics of the instructions in the bodies
+// of the compiled functions. Functions of the pre-compiled OPA module are not
+// considered.
+func (c *Compiler) InstructionStats() InstructionStats {
+	s := InstructionStats{Counts: map[string]int{}}
+	for _, f := range c.funcsCode {
+		s.add(f.code.Func.Expr.Instrs, 0)
+	}
+	return s
+}
+
+func (s *InstructionStats) add(is []instruction.Instruction, depth int) {
+	if depth > s.MaxDepth {
+		s.MaxDepth = depth
+	}
+	for _, i := range is {
+		s.Counts[reflect.TypeOf(i).Name()]++
+		s.Total++
+		if si, ok := i.(instruction.StructuredInstruction); ok {
+			s.add(si.Instructions(), depth+1)
+		}
+	}
+}
+
+// Signature is the type of an exported function.
+type Signature struct {
+	Name    string   `json:"name"`
+	Params  []string `json:"params"`
+	Results []string `json:"results"`
+}
+
+func (s Signature) String() string {
+	return fmt.Sprintf("export %s: (%s) -> (%s)", s.Name, strings.Join(s.Params, ", "), strings.Join(s.Results, ", "))
+}
+
+// ExportSignatures returns the signatures of all functions exported by the
+// module, resolved via its type section, sorted by export name.
+func (c *Compiler) ExportSignatures() ([]Signature, error) {
+	var ret []Signature
+	for _, exp := range c.module.Export.Exports {
+		if exp.Descriptor.Type != module.FunctionExportType {
+			continue
+		}
+		tpe, ok := c.functionType(exp.Descriptor.Index)
+		if !ok {
+			return nil, fmt.Errorf("export %s: type of function %d not found", exp.Name, exp.Descriptor.Index)
+		}
+		sig := Signature{Name: exp.Name}
+		sig.Params, sig.Results = typeStrings(tpe)
+		ret = append(ret, sig)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
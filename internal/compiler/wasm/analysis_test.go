@@ -0,0 +1,135 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/opcode"
+)
+
+func codeEntry(is ...instruction.Instruction) *module.CodeEntry {
+	return &module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: is}}}
+}
+
+func TestFunctionsUsing(t *testing.T) {
+	c := New()
+	c.funcsCode = []funcCode{
+		{name: "direct", code: codeEntry(instruction.Call{Index: 1})},
+		{name: "nested", code: codeEntry(
+			instruction.Block{Instrs: []instruction.Instruction{
+				instruction.Loop{Instrs: []instruction.Instruction{
+					instruction.I32Const{Value: 0},
+					instruction.CallIndirect{Index: 0},
+				}},
+			}},
+		)},
+		{name: "indirect", code: codeEntry(
+			instruction.I32Const{Value: 0},
+			instruction.CallIndirect{Index: 0},
+		)},
+	}
+
+	for _, tc := range []struct {
+		op  opcode.Opcode
+		exp []string
+	}{
+		{op: opcode.CallIndirect, exp: []string{"indirect", "nested"}},
+		{op: opcode.Call, exp: []string{"direct"}},
+		{op: opcode.Loop, exp: []string{"nested"}},
+		{op: opcode.Return},
+	} {
+		if act := c.FunctionsUsing(tc.op); !reflect.DeepEqual(tc.exp, act) {
+			t.Errorf("opcode %x: expected %v, got %v", tc.op, tc.exp, act)
+		}
+	}
+}
+
+func TestInstructionStats(t *testing.T) {
+	c := New()
+	c.funcsCode = []funcCode{
+		{name: "flat", code: codeEntry(instruction.I32Const{Value: 1}, instruction.Drop{})},
+		{name: "nested", code: codeEntry(
+			instruction.Block{Instrs: []instruction.Instruction{
+				instruction.Loop{Instrs: []instruction.Instruction{
+					instruction.I32Const{Value: 0},
+					instruction.BrIf{Index: 1},
+				}},
+			}},
+			instruction.Return{},
+		)},
+	}
+	exp := InstructionStats{
+		Counts: map[string]int{
+			"I32Const": 2,
+			"Drop":     1,
+			"Block":    1,
+			"Loop":     1,
+			"BrIf":     1,
+			"Return":   1,
+		},
+		Total:    7,
+		MaxDepth: 2,
+	}
+	if act := c.InstructionStats(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %+v, got %+v", exp, act)
+	}
+}
+
+func TestInstructionStatsCompiled(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	s := c.InstructionStats()
+	var n int
+	for _, f := range c.funcsCode {
+		n += countInstrs(f.code.Func.Expr.Instrs)
+	}
+	if s.Total != n || s.Counts["Call"] == 0 || s.MaxDepth == 0 {
+		t.Errorf("unexpected stats for %d instructions: %+v", n, s)
+	}
+}
+
+func TestExportSignatures(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	sigs, err := c.ExportSignatures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	act := map[string]Signature{}
+	for i, sig := range sigs {
+		if i > 0 && sigs[i-1].Name >= sig.Name {
+			t.Errorf("expected signatures sorted by name, got %s before %s", sigs[i-1].Name, sig.Name)
+		}
+		act[sig.Name] = sig
+	}
+	for _, exp := range []Signature{
+		{Name: "eval", Params: []string{"i32"}, Results: []string{"i32"}},
+		{Name: "opa_heap_ptr_get", Params: []string{}, Results: []string{"i32"}},
+		{Name: "opa_malloc", Params: []string{"i32"}, Results: []string{"i32"}},
+		{Name: "opa_eval", Params: []string{"i32", "i32", "i32", "i32", "i32", "i32", "i32"}, Results: []string{"i32"}},
+	} {
+		if !reflect.DeepEqual(exp, act[exp.Name]) {
+			t.Errorf("expected %v, got %v", exp, act[exp.Name])
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// Names of the files contained in a signed artifact archive.
+const (
+	ArtifactModuleFile            = "policy.wasm.gz"
+	ArtifactSignatureFile         = "policy.wasm.gz.sig"
+	ArtifactManifestFile          = "manifest.json"
+	ArtifactManifestSignatureFile = "manifest.json.sig"
+)
+
+// SignFunc returns a signature over the passed bytes.
+type SignFunc func([]byte) ([]byte, error)
+
+// VerifyFunc returns an error if sig is not a valid signature over bs.
+type VerifyFunc func(bs, sig []byte) error
+
+// ArtifactManifest describes the module contained in a signed artifact.
+type ArtifactManifest struct {
+	Entrypoints map[string]int32 `json:"entrypoints"`
+	Digest      string           `json:"sha256"` // of the uncompressed module
+	Size        int              `json:"size"`   // of the uncompressed module
+}
+
+// CompileSignedArtifact compiles the policy and writes a tar archive to w,
+// containing the gzip-compressed module and a manifest, each along with a
+// signature obtained from sign: the signature of the manifest, which holds
+// the module's digest, covers both.
+func (c *Compiler) CompileSignedArtifact(w io.Writer, sign SignFunc) error {
+	mod, err := c.Compile()
+	if err != nil {
+		return err
+	}
+
+	var raw bytes.Buffer
+	if err := encoding.WriteModule(&raw, mod); err != nil {
+		return fmt.Errorf("encode module: %w", err)
+	}
+	digest := sha256.Sum256(raw.Bytes())
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(raw.Bytes()); err != nil {
+		return fmt.Errorf("compress module: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("compress module: %w", err)
+	}
+
+	sig, err := sign(gz.Bytes())
+	if err != nil {
+		return fmt.Errorf("sign module: %w", err)
+	}
+
+	manifest, err := json.Marshal(ArtifactManifest{
+		Entrypoints: c.Entrypoints(),
+		Digest:      hex.EncodeToString(digest[:]),
+		Size:        raw.Len(),
+	})
+	if err != nil {
+		return fmt.Errorf("encode manifest: %w", err)
+	}
+	manifestSig, err := sign(manifest)
+	if err != nil {
+		return fmt.Errorf("sign manifest: %w", err)
+	}
+
+	return writeArtifact(w, []artifactFile{
+		{ArtifactManifestFile, manifest},
+		{ArtifactManifestSignatureFile, manifestSig},
+		{ArtifactModuleFile, gz.Bytes()},
+		{ArtifactSignatureFile, sig},
+	})
+}
+
+type artifactFile struct {
+	name string
+	data []byte
+}
+
+func writeArtifact(w io.Writer, files []artifactFile) error {
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.name,
+			Mode:     0644,
+			Size:     int64(len(f.data)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("write %s: %w", f.name, err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return fmt.Errorf("write %s: %w", f.name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// VerifyArtifact reads an archive written by CompileSignedArtifact, checks
+// the signatures of the module and the manifest using verify, and returns
+// the decoded module and the manifest. The module is only decompressed up to
+// the size recorded in the manifest.
+func VerifyArtifact(r io.Reader, verify VerifyFunc) (*module.Module, *ArtifactManifest, error) {
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("read archive: %w", err)
+		}
+		bs, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s: %w", hdr.Name, err)
+		}
+		files[hdr.Name] = bs
+	}
+	for _, name := range []string{ArtifactManifestFile, ArtifactManifestSignatureFile, ArtifactModuleFile, ArtifactSignatureFile} {
+		if _, ok := files[name]; !ok {
+			return nil, nil, fmt.Errorf("archive: missing %s", name)
+		}
+	}
+
+	gz := files[ArtifactModuleFile]
+	if err := verify(gz, files[ArtifactSignatureFile]); err != nil {
+		return nil, nil, fmt.Errorf("verify signature: %w", err)
+	}
+
+	if err := verify(files[ArtifactManifestFile], files[ArtifactManifestSignatureFile]); err != nil {
+		return nil, nil, fmt.Errorf("verify manifest signature: %w", err)
+	}
+	var manifest ArtifactManifest
+	if err := json.Unmarshal(files[ArtifactManifestFile], &manifest); err != nil {
+		return nil, nil, fmt.Errorf("decode manifest: %w", err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, nil, fmt.Errorf("decompress module: %w", err)
+	}
+	raw, err := io.ReadAll(io.LimitReader(zr, int64(manifest.Size)+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("decompress module: %w", err)
+	}
+	if len(raw) > manifest.Size {
+		return nil, nil, fmt.Errorf("module exceeds manifest size of %d bytes", manifest.Size)
+	}
+	digest := sha256.Sum256(raw)
+	if hex.EncodeToString(digest[:]) != manifest.Digest || len(raw) != manifest.Size {
+		return nil, nil, errors.New("module does not match manifest digest")
+	}
+
+	mod, err := encoding.ReadModule(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode module: %w", err)
+	}
+	return mod, &manifest, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+)
+
+func TestSignedArtifact(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(bs []byte) ([]byte, error) {
+		return ed25519.Sign(priv, bs), nil
+	}
+	verify := func(bs, sig []byte) error {
+		if !ed25519.Verify(pub, bs, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	c := New().WithPolicy(policy)
+	if err := c.CompileSignedArtifact(&buf, sign); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	mod, manifest, err := VerifyArtifact(bytes.NewReader(archive), verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mod.Code.Segments) == 0 {
+		t.Error("expected decoded module to have code")
+	}
+	if exp, act := map[string]int32{"test": 0}, manifest.Entrypoints; !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected entrypoints %v, got %v", exp, act)
+	}
+
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = VerifyArtifact(bytes.NewReader(archive), func(bs, sig []byte) error {
+		if !ed25519.Verify(otherPub, bs, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "verify signature: bad signature") {
+		t.Errorf("expected signature error, got %v", err)
+	}
+}
+
+func TestSignedArtifactManifest(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(bs []byte) ([]byte, error) {
+		return ed25519.Sign(priv, bs), nil
+	}
+	verify := func(bs, sig []byte) error {
+		if !ed25519.Verify(pub, bs, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := New().WithPolicy(policy).CompileSignedArtifact(&buf, sign); err != nil {
+		t.Fatal(err)
+	}
+	files := readArtifactFiles(t, buf.Bytes())
+	rewrite := func(change func(*ArtifactManifest), resign bool) []byte {
+		var m ArtifactManifest
+		if err := json.Unmarshal(files[ArtifactManifestFile], &m); err != nil {
+			t.Fatal(err)
+		}
+		change(&m)
+		bs, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := files[ArtifactManifestSignatureFile]
+		if resign {
+			sig = ed25519.Sign(priv, bs)
+		}
+		var out bytes.Buffer
+		if err := writeArtifact(&out, []artifactFile{
+			{ArtifactManifestFile, bs},
+			{ArtifactManifestSignatureFile, sig},
+			{ArtifactModuleFile, files[ArtifactModuleFile]},
+			{ArtifactSignatureFile, files[ArtifactSignatureFile]},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+
+	// tampered entrypoints
+	tampered := rewrite(func(m *ArtifactManifest) { m.Entrypoints = map[string]int32{"other": 0} }, false)
+	_, _, err = VerifyArtifact(bytes.NewReader(tampered), verify)
+	if err == nil || !strings.Contains(err.Error(), "verify manifest signature: bad signature") {
+		t.Errorf("expected manifest signature error, got %v", err)
+	}
+
+	// the module is decompressed up to the manifest's size only
+	short := rewrite(func(m *ArtifactManifest) { m.Size = 16 }, true)
+	_, _, err = VerifyArtifact(bytes.NewReader(short), verify)
+	if err == nil || err.Error() != "module exceeds manifest size of 16 bytes" {
+		t.Errorf("expected size error, got %v", err)
+	}
+}
+
+func readArtifactFiles(t *testing.T, archive []byte) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = bs
+	}
+}
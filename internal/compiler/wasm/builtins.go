@@ -0,0 +1,170 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+)
+
+// WithDeniedBuiltins sets built-in functions that must not be referenced by
+// the compiled module. If any of them is, compilation fails.
+func (c *Compiler) WithDeniedBuiltins(names ...string) *Compiler {
+	c.deniedBuiltins = append(c.deniedBuiltins, names...)
+	return c
+}
+
+// Builtins returns the sorted names of the built-in functions referenced by
+// the compiled module. Built-ins implemented in the module are reported if
+// any of the compiled functions calls them, built-ins provided by the host
+// if any of the compiled functions dispatches to them. It's populated by
+// Compile.
+func (c *Compiler) Builtins() []string {
+	uses := c.builtinUses()
+	ret := make([]string, 0, len(uses))
+	for name := range uses {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// HostBuiltins returns the sorted names of the built-in functions referenced
+// by the compiled module that the host has to provide: they're called back
+// into the host when evaluating the policy. Like Builtins, it's populated by
+// Compile.
+func (c *Compiler) HostBuiltins() []string {
+	var ret []string
+	for _, name := range c.Builtins() {
+		if _, ok := c.externalFuncs[name]; ok {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// WithSelfContained toggles requiring the compiled module to be
+// self-contained: if any built-in function referenced needs to be provided
+// by the host, see HostBuiltins, compilation fails. Such modules can be
+// evaluated by hosts that don't implement any of OPA's built-ins.
+func (c *Compiler) WithSelfContained(enabled bool) *Compiler {
+	c.selfContained = enabled
+	return c
+}
+
+// builtinUses maps the names of referenced built-in functions to the
+// sorted names of the compiled functions referencing them.
+func (c *Compiler) builtinUses() map[string][]string {
+	native := map[uint32][]string{} // runtime function index -> builtin names
+	for _, decl := range c.policy.Static.BuiltinFuncs {
+		if fn, ok := builtinsFunctions[decl.Name]; ok {
+			if idx, ok := c.funcs[fn]; ok {
+				native[idx] = append(native[idx], decl.Name)
+			}
+		}
+	}
+	external := map[int32]string{} // builtin id -> builtin name
+	for name, ef := range c.externalFuncs {
+		external[ef.ID] = name
+	}
+	dispatchers := map[uint32]int{} // function index -> arity
+	for i, name := range builtinDispatchers {
+		dispatchers[c.function(name)] = i
+	}
+
+	uses := map[string]map[string]struct{}{}
+	use := func(builtin, fn string) {
+		if uses[builtin] == nil {
+			uses[builtin] = map[string]struct{}{}
+		}
+		uses[builtin][fn] = struct{}{}
+	}
+	for _, f := range c.funcsCode {
+		for _, callee := range c.callGraph[c.funcs[f.name]] {
+			for _, name := range native[callee] {
+				use(name, f.name)
+			}
+		}
+		for _, id := range dispatchedBuiltins(f.code.Func.Expr.Instrs, dispatchers) {
+			if name, ok := external[id]; ok {
+				use(name, f.name)
+			}
+		}
+	}
+
+	ret := make(map[string][]string, len(uses))
+	for builtin, fns := range uses {
+		for fn := range fns {
+			ret[builtin] = append(ret[builtin], fn)
+		}
+		sort.Strings(ret[builtin])
+	}
+	return ret
+}
+
+// dispatchedBuiltins returns the IDs of host-provided built-ins that are
+// called via the builtin dispatchers: these calls are compiled as
+//
+//	i32.const <id>, i32.const 0, <arg 1>, ..., <arg n>, call opa_builtin<n>
+//
+// where each argument is pushed by a single instruction.
+func dispatchedBuiltins(is []instruction.Instruction, dispatchers map[uint32]int) []int32 {
+	var ret []int32
+	for j, i := range is {
+		switch i := i.(type) {
+		case instruction.Call, instruction.ReturnCall:
+			arity, ok := dispatchers[callIndex(i)]
+			if !ok || j < arity+2 {
+				continue
+			}
+			if id, ok := is[j-arity-2].(instruction.I32Const); ok {
+				ret = append(ret, id.Value)
+			}
+		case instruction.StructuredInstruction:
+			ret = append(ret, dispatchedBuiltins(i.Instructions(), dispatchers)...)
+		}
+	}
+	return ret
+}
+
+// callIndex returns the index of the function called by a call or
+// return_call instruction.
+func callIndex(i instruction.Instruction) uint32 {
+	if rc, ok := i.(instruction.ReturnCall); ok {
+		return rc.Index
+	}
+	return i.(instruction.Call).Index
+}
+
+// checkDeniedBuiltins fails compilation if any of the denied built-ins is
+// referenced by the compiled functions.
+func (c *Compiler) checkDeniedBuiltins() error {
+	if len(c.deniedBuiltins) == 0 {
+		return nil
+	}
+	uses := c.builtinUses()
+	for _, name := range c.deniedBuiltins {
+		if fns, ok := uses[name]; ok {
+			return fmt.Errorf("denied built-in %q referenced by func %s", name, fns[0])
+		}
+	}
+	return nil
+}
+
+// checkSelfContained fails compilation if a self-contained module is
+// required, but any of the compiled functions references a built-in
+// provided by the host.
+func (c *Compiler) checkSelfContained() error {
+	if !c.selfContained {
+		return nil
+	}
+	host := c.HostBuiltins()
+	if len(host) == 0 {
+		return nil
+	}
+	return fmt.Errorf("module not self-contained: built-in %q provided by the host, referenced by func %s", host[0], c.builtinUses()[host[0]][0])
+}
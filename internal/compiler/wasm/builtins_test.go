@@ -0,0 +1,99 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+)
+
+func TestBuiltins(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name: "test",
+		Queries: []ast.Body{
+			ast.MustParseBody(`count(input.xs, x); upper(input.s, y); time.now_ns(z)`),
+		},
+	})
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := []string{"count", "time.now_ns", "upper"}, c.Builtins(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
+
+func TestBuiltinsNone(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if act := c.Builtins(); len(act) != 0 {
+		t.Errorf("expected no built-ins, got %v", act)
+	}
+}
+
+func TestDeniedBuiltins(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`upper(input.s, y); time.now_ns(z)`)},
+	})
+
+	for _, tc := range []struct {
+		denied []string
+		err    string
+	}{
+		{denied: []string{"http.send", "lower"}},
+		{denied: []string{"http.send", "time.now_ns"}, err: `denied built-in "time.now_ns" referenced by func eval`},
+		{denied: []string{"upper"}, err: `denied built-in "upper" referenced by func eval`},
+	} {
+		_, err := New().WithPolicy(policy).WithDeniedBuiltins(tc.denied...).Compile()
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("denied %v: unexpected error: %v", tc.denied, err)
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("denied %v: expected error %q, got %v", tc.denied, tc.err, err)
+		}
+	}
+}
+
+func TestHostBuiltins(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name: "test",
+		Queries: []ast.Body{
+			ast.MustParseBody(`regex.match("^a", input.s); glob.match("*", [], input.s); json.unmarshal(input.j, v); time.now_ns(z)`),
+		},
+	})
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := []string{"time.now_ns"}, c.HostBuiltins(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+
+	_, err := New().WithPolicy(policy).WithSelfContained(true).Compile()
+	if exp := `module not self-contained: built-in "time.now_ns" provided by the host, referenced by func eval`; err == nil || err.Error() != exp {
+		t.Errorf("expected error %q, got %v", exp, err)
+	}
+
+	// regex, glob and JSON built-ins are implemented in the module
+	policy = planQueries(t, planner.QuerySet{
+		Name: "test",
+		Queries: []ast.Body{
+			ast.MustParseBody(`regex.match("^a", input.s); glob.match("*", [], input.s); json.unmarshal(input.j, v)`),
+		},
+	})
+	if _, err := New().WithPolicy(policy).WithSelfContained(true).Compile(); err != nil {
+		t.Error(err)
+	}
+}
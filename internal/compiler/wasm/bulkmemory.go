@@ -0,0 +1,92 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+)
+
+// WithBulkMemory toggles replacing the library's byte-by-byte memcpy,
+// memmove, and memset implementations, which all string and object copies
+// end up in, by memory.copy and memory.fill. It requires the BulkMemory
+// feature: if the target runtime doesn't support it, the library functions
+// are kept, which is logged. wasm-opt is passed --enable-bulk-memory for
+// the declared feature.
+func (c *Compiler) WithBulkMemory(enabled bool) *Compiler {
+	c.bulkMemory = enabled
+	return c
+}
+
+// bulkMemoryFuncs are the bodies replacing the library functions, which all
+// return their first argument, the destination.
+var bulkMemoryFuncs = []struct {
+	name   string
+	instrs []instruction.Instruction
+}{
+	{"memcpy", []instruction.Instruction{
+		instruction.GetLocal{Index: 0},
+		instruction.GetLocal{Index: 1},
+		instruction.GetLocal{Index: 2},
+		instruction.MemoryCopy{},
+		instruction.GetLocal{Index: 0},
+	}},
+	{"memmove", []instruction.Instruction{ // memory.copy handles overlapping ranges
+		instruction.GetLocal{Index: 0},
+		instruction.GetLocal{Index: 1},
+		instruction.GetLocal{Index: 2},
+		instruction.MemoryCopy{},
+		instruction.GetLocal{Index: 0},
+	}},
+	{"memset", []instruction.Instruction{
+		instruction.GetLocal{Index: 0},
+		instruction.GetLocal{Index: 1},
+		instruction.GetLocal{Index: 2},
+		instruction.MemoryFill{},
+		instruction.GetLocal{Index: 0},
+	}},
+}
+
+// emitBulkMemory replaces the library functions in bulkMemoryFuncs. It's run
+// before removing unused code, so that the functions only the replaced ones
+// called can be removed.
+func (c *Compiler) emitBulkMemory() error {
+	if !c.bulkMemory {
+		return nil
+	}
+	if !c.hasFeature(BulkMemory) {
+		c.debug.Printf("bulk memory operations require the %s feature, keeping library functions", BulkMemory)
+		return nil
+	}
+	memType := module.FunctionType{
+		Params:  []types.ValueType{types.I32, types.I32, types.I32},
+		Results: []types.ValueType{types.I32},
+	}
+	imports := uint32(c.functionImportCount())
+	for _, f := range bulkMemoryFuncs {
+		name := f.name
+		idx, ok := c.funcs[name]
+		if !ok || idx < imports {
+			c.debug.Printf("bulk memory: no library function %s", name)
+			continue
+		}
+		if tpe, ok := c.functionType(idx); !ok || !tpe.Equal(memType) {
+			return fmt.Errorf("bulk memory: unexpected type of %s", name)
+		}
+		var buf bytes.Buffer
+		entry := &module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: f.instrs}}}
+		if err := encoding.WriteCodeEntry(&buf, entry); err != nil {
+			return fmt.Errorf("encode %s: %w", name, err)
+		}
+		c.module.Code.Segments[idx-imports].Code = buf.Bytes()
+		c.debug.Printf("bulk memory: replaced %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+)
+
+func TestBulkMemory(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`concat(",", [input.a, input.b], x)`)},
+	})
+	code := func(c *Compiler, name string) []byte {
+		t.Helper()
+		return c.module.Code.Segments[c.function(name)-uint32(c.functionImportCount())].Code
+	}
+	replaced := func(name string, bs []byte) bool {
+		t.Helper()
+		entry, err := encoding.ReadCodeEntry(bytes.NewReader(bs))
+		if err != nil { // the library's code uses instructions the reader doesn't know
+			return false
+		}
+		for _, f := range bulkMemoryFuncs {
+			if f.name == name {
+				return reflect.DeepEqual(f.instrs, entry.Func.Expr.Instrs)
+			}
+		}
+		return false
+	}
+
+	c := New().WithPolicy(policy).WithBulkMemory(true).WithFeatures(BulkMemory)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range bulkMemoryFuncs {
+		if !replaced(f.name, code(c, f.name)) {
+			t.Errorf("expected %s to be replaced", f.name)
+		}
+	}
+
+	// without the feature, the library functions are kept
+	def := New().WithPolicy(policy)
+	if _, err := def.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	c = New().WithPolicy(policy).WithBulkMemory(true)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range bulkMemoryFuncs {
+		if !bytes.Equal(code(def, f.name), code(c, f.name)) {
+			t.Errorf("expected %s to be kept", f.name)
+		}
+	}
+}
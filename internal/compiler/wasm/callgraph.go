@@ -0,0 +1,152 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/open-policy-agent/opa/internal/compiler/wasm/opa"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// CallGraph is the JSON representation of the call graph of the functions
+// retained in the compiled module, see WithCallGraphWriter, or of the
+// library, see LibraryCallGraph.
+type CallGraph struct {
+	Nodes []CallGraphNode `json:"nodes"`
+	Edges []CallGraphEdge `json:"edges"`
+}
+
+// CallGraphNode is a function of the module.
+type CallGraphNode struct {
+	Index uint32 `json:"index"`
+	Name  string `json:"name"`
+}
+
+// CallGraphEdge is a direct call from one function to another.
+type CallGraphEdge struct {
+	Caller uint32 `json:"caller"`
+	Callee uint32 `json:"callee"`
+}
+
+// WithCallGraphWriter sets a writer that the call graph of the functions
+// retained after removing unused code is written to, encoded as JSON. The
+// indices are those of the module before wasm-opt is run.
+func (c *Compiler) WithCallGraphWriter(w io.Writer) *Compiler {
+	c.callGraphWriter = w
+	return c
+}
+
+// writeCallGraph writes the call graph. It's run after unused code has been
+// compacted, to refer to the final indices.
+func (c *Compiler) writeCallGraph() error {
+	if c.callGraphWriter == nil {
+		return nil
+	}
+	graph, keep, name := c.callGraph, c.keepFuncs, c.funcName
+	if c.compactedFuncs != nil {
+		graph, keep, name = compactedCallGraph(graph, keep, c.compactedFuncs, name)
+	}
+	cg := retainedCallGraph(graph, keep, name)
+	if err := json.NewEncoder(c.callGraphWriter).Encode(cg); err != nil {
+		return fmt.Errorf("write call graph: %w", err)
+	}
+	return nil
+}
+
+// retainedCallGraph restricts cg to the functions in keep. Nodes and edges
+// are sorted by function index, and duplicate edges are dropped.
+func retainedCallGraph(cg map[uint32][]uint32, keep map[uint32]struct{}, name func(uint32) string) CallGraph {
+	ret := CallGraph{
+		Nodes: make([]CallGraphNode, 0, len(keep)),
+		Edges: []CallGraphEdge{},
+	}
+	for idx := range keep {
+		ret.Nodes = append(ret.Nodes, CallGraphNode{Index: idx, Name: name(idx)})
+		seen := map[uint32]struct{}{}
+		for _, callee := range cg[idx] {
+			if _, ok := keep[callee]; !ok {
+				continue
+			}
+			if _, ok := seen[callee]; ok {
+				continue
+			}
+			seen[callee] = struct{}{}
+			ret.Edges = append(ret.Edges, CallGraphEdge{Caller: idx, Callee: callee})
+		}
+	}
+	sort.Slice(ret.Nodes, func(i, j int) bool { return ret.Nodes[i].Index < ret.Nodes[j].Index })
+	sort.Slice(ret.Edges, func(i, j int) bool {
+		if ret.Edges[i].Caller != ret.Edges[j].Caller {
+			return ret.Edges[i].Caller < ret.Edges[j].Caller
+		}
+		return ret.Edges[i].Callee < ret.Edges[j].Callee
+	})
+	return ret
+}
+
+// compactedCallGraph maps the indices of cg and keep through compacted, the
+// function indices before compaction to those after, dropping functions that
+// were removed. The returned name function takes indices after compaction.
+func compactedCallGraph(cg map[uint32][]uint32, keep map[uint32]struct{}, compacted map[uint32]uint32, name func(uint32) string) (map[uint32][]uint32, map[uint32]struct{}, func(uint32) string) {
+	orig := make(map[uint32]uint32, len(keep))
+	retained := make(map[uint32]struct{}, len(keep))
+	for idx := range keep {
+		if to, ok := compacted[idx]; ok {
+			retained[to], orig[to] = struct{}{}, idx
+		}
+	}
+	graph := make(map[uint32][]uint32, len(cg))
+	for caller, callees := range cg {
+		to, ok := compacted[caller]
+		if !ok {
+			continue
+		}
+		for _, callee := range callees {
+			if cto, ok := compacted[callee]; ok {
+				graph[to] = append(graph[to], cto)
+			}
+		}
+	}
+	return graph, retained, func(idx uint32) string { return name(orig[idx]) }
+}
+
+// LibraryCallGraph returns the call graph of the functions of the library
+// module that policies are compiled into, as used for removing unused code:
+// it's derived from the library's code. Calls via call_indirect aren't
+// included.
+func LibraryCallGraph() (CallGraph, error) {
+	lib := opa.Bytes()
+	m, err := encoding.ReadModule(bytes.NewReader(lib))
+	if err != nil {
+		return CallGraph{}, fmt.Errorf("library call graph: %w", err)
+	}
+	cg, err := codeCallGraph(lib)
+	if err != nil {
+		return CallGraph{}, fmt.Errorf("library call graph: %w", err)
+	}
+	names := make(map[uint32]string, len(m.Names.Functions))
+	for _, nm := range m.Names.Functions {
+		names[nm.Index] = nm.Name
+	}
+	all := map[uint32]struct{}{}
+	var idx uint32
+	for _, imp := range m.Import.Imports {
+		if imp.Descriptor.Kind() == module.FunctionImportType {
+			all[idx] = struct{}{}
+			idx++
+		}
+	}
+	for range m.Code.Segments {
+		all[idx] = struct{}{}
+		idx++
+	}
+	return retainedCallGraph(cg, all, func(idx uint32) string { return names[idx] }), nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/compiler/wasm/opa"
+	"github.com/open-policy-agent/opa/internal/planner"
+)
+
+func TestRetainedCallGraph(t *testing.T) {
+	cg := map[uint32][]uint32{
+		0: {2, 1, 2},
+		1: {3},
+		3: {4}, // 4 is not retained
+		5: {0}, // neither is 5
+	}
+	keep := map[uint32]struct{}{0: {}, 1: {}, 2: {}, 3: {}}
+	name := func(idx uint32) string { return fmt.Sprintf("f%d", idx) }
+
+	act := retainedCallGraph(cg, keep, name)
+	exp := CallGraph{
+		Nodes: []CallGraphNode{{0, "f0"}, {1, "f1"}, {2, "f2"}, {3, "f3"}},
+		Edges: []CallGraphEdge{{0, 1}, {0, 2}, {1, 3}},
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
+
+func TestCallGraphWriter(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	var buf bytes.Buffer
+	c := New().WithPolicy(policy).WithCallGraphWriter(&buf)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	var cg CallGraph
+	if err := json.Unmarshal(buf.Bytes(), &cg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cg.Nodes) != len(c.keepFuncs) {
+		t.Errorf("expected %d nodes, got %d", len(c.keepFuncs), len(cg.Nodes))
+	}
+	eval := c.function("eval")
+	var found bool
+	for _, e := range cg.Edges {
+		if _, ok := c.keepFuncs[e.Callee]; !ok {
+			t.Errorf("edge %v: callee not retained", e)
+		}
+		found = found || e.Caller == eval
+	}
+	if !found {
+		t.Error("expected edges from eval")
+	}
+}
+
+func TestCallGraphWriterCompacted(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	var buf bytes.Buffer
+	c := New().WithPolicy(policy).WithCompactUnusedCode(true).WithCallGraphWriter(&buf)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cg CallGraph
+	if err := json.Unmarshal(buf.Bytes(), &cg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the indices are those of the compacted module
+	names := map[uint32]string{}
+	for _, nm := range mod.Names.Functions {
+		names[nm.Index] = nm.Name
+	}
+	total := uint32(c.functionImportCount() + len(mod.Function.TypeIndices))
+	var found bool
+	for _, n := range cg.Nodes {
+		if n.Index >= total {
+			t.Fatalf("node %v: index out of range %d", n, total)
+		}
+		if act, ok := names[n.Index]; ok && act != n.Name {
+			t.Errorf("node %v: module names function %q", n, act)
+		}
+		found = found || n.Name == "eval"
+	}
+	if !found {
+		t.Error("expected eval node")
+	}
+	for _, e := range cg.Edges {
+		if e.Caller >= total || e.Callee >= total {
+			t.Errorf("edge %v: index out of range %d", e, total)
+		}
+	}
+}
+
+func TestLibraryCallGraph(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the graph derived from the code has the calls of the embedded CSV
+	exp, err := c.parseCallGraph(opa.CallGraphCSV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	act, err := c.libraryCallGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := func(cg map[uint32][]uint32) map[[2]uint32]struct{} {
+		ret := map[[2]uint32]struct{}{}
+		for caller, callees := range cg {
+			for _, callee := range callees {
+				ret[[2]uint32{caller, callee}] = struct{}{}
+			}
+		}
+		return ret
+	}
+	if !reflect.DeepEqual(calls(exp), calls(act)) {
+		t.Errorf("expected %d calls of the CSV, got %d", len(calls(exp)), len(calls(act)))
+	}
+
+	cg, err := LibraryCallGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cg.Edges) != len(calls(exp)) {
+		t.Errorf("expected %d edges, got %d", len(calls(exp)), len(cg.Edges))
+	}
+	names := map[uint32]string{}
+	for _, n := range cg.Nodes {
+		names[n.Index] = n.Name
+	}
+	var found bool
+	for _, e := range cg.Edges {
+		found = found || names[e.Caller] == "opa_agg_count" && names[e.Callee] == "opa_value_type"
+	}
+	if !found {
+		t.Error("expected call opa_agg_count -> opa_value_type")
+	}
+}
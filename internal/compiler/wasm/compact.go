@@ -0,0 +1,211 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// WithCompactUnusedCode toggles removing the functions that were found to be
+// unused altogether, instead of replacing their bodies with `unreachable`.
+// The function types that are no longer used are removed, too, and all
+// references to functions and types are renumbered.
+//
+// Functions referenced from the table are kept, as the table's layout must
+// not change. Note that the compiler's analyses, like the call graph, the
+// dead code report, or the exclusive functions, refer to the function
+// indices before compaction.
+func (c *Compiler) WithCompactUnusedCode(enabled bool) *Compiler {
+	c.compact = enabled
+	return c
+}
+
+// WithPruneImports toggles removing the function imports that aren't
+// reachable from the exports, the compiled functions, or the table, so the
+// host doesn't have to provide them. By default, all function imports are
+// kept, along with everything they reach.
+//
+// Like WithCompactUnusedCode, this renumbers all references to functions,
+// and the compiler's analyses refer to the function indices before.
+func (c *Compiler) WithPruneImports(enabled bool) *Compiler {
+	c.pruneImports = enabled
+	return c
+}
+
+// compactUnusedCode removes the function imports not reached when removing
+// unused code, if pruning imports, and the functions stubbed by
+// removeUnusedCode, if compacting. The function types no longer used are
+// removed, too.
+func (c *Compiler) compactUnusedCode() error {
+	if !c.compacting() && !c.pruneImports || c.keepFuncs == nil {
+		return nil
+	}
+
+	pinned := map[uint32]struct{}{}
+	for _, seg := range c.module.Element.Segments {
+		for _, idx := range seg.Indices {
+			pinned[idx] = struct{}{}
+		}
+	}
+	for _, exp := range c.module.Export.Exports {
+		if exp.Descriptor.Type == module.FunctionExportType {
+			pinned[exp.Descriptor.Index] = struct{}{}
+		}
+	}
+	if start := c.module.Start.FuncIndex; start != nil {
+		pinned[*start] = struct{}{}
+	}
+
+	// Functions, including the imported ones, are renumbered in order.
+	funcs := map[uint32]uint32{}
+	var next, fidx uint32
+	var imps []module.Import
+	for _, imp := range c.module.Import.Imports {
+		if _, ok := imp.Descriptor.(module.FunctionImport); ok {
+			idx := fidx
+			fidx++
+			_, kept := c.keepFuncs[idx]
+			_, pin := pinned[idx]
+			if c.pruneImports && !kept && !pin {
+				continue
+			}
+			funcs[idx] = next
+			next++
+		}
+		imps = append(imps, imp)
+	}
+	imports := fidx
+	var segs []module.RawCodeSegment
+	var tidxs []uint32
+	for i, seg := range c.module.Code.Segments {
+		idx := imports + uint32(i)
+		_, kept := c.keepFuncs[idx]
+		_, pin := pinned[idx]
+		if c.compacting() && !kept && !pin && isStub(seg.Code) {
+			continue
+		}
+		funcs[idx] = next
+		next++
+		segs = append(segs, seg)
+		tidxs = append(tidxs, c.module.Function.TypeIndices[i])
+	}
+	mapFunc := func(idx uint32) (uint32, error) {
+		n, ok := funcs[idx]
+		if !ok {
+			return 0, fmt.Errorf("reference to removed func %s", c.funcName(idx))
+		}
+		return n, nil
+	}
+
+	// Find the types still in use: those of the remaining functions and of
+	// imported functions, plus the ones used by the code.
+	usedTypes := map[uint32]struct{}{}
+	useType := func(idx uint32) (uint32, error) {
+		usedTypes[idx] = struct{}{}
+		return idx, nil
+	}
+	for i := range segs {
+		code, err := encoding.RemapCodeIndices(segs[i].Code, mapFunc, useType)
+		if err != nil {
+			return fmt.Errorf("compact code segment %d: %w", i, err)
+		}
+		segs[i].Code = code
+	}
+	for _, tidx := range tidxs {
+		usedTypes[tidx] = struct{}{}
+	}
+	for _, imp := range imps {
+		if fi, ok := imp.Descriptor.(module.FunctionImport); ok {
+			usedTypes[fi.Func] = struct{}{}
+		}
+	}
+	typeMap := map[uint32]uint32{}
+	var tpes []module.FunctionType
+	for i, tpe := range c.module.Type.Functions {
+		if _, ok := usedTypes[uint32(i)]; ok {
+			typeMap[uint32(i)] = uint32(len(tpes))
+			tpes = append(tpes, tpe)
+		}
+	}
+	mapType := func(idx uint32) (uint32, error) {
+		return typeMap[idx], nil
+	}
+	identity := func(idx uint32) (uint32, error) { return idx, nil }
+	for i := range segs {
+		code, err := encoding.RemapCodeIndices(segs[i].Code, identity, mapType)
+		if err != nil {
+			return fmt.Errorf("compact code segment %d: %w", i, err)
+		}
+		segs[i].Code = code
+	}
+	for i := range tidxs {
+		tidxs[i] = typeMap[tidxs[i]]
+	}
+
+	removedImports := len(c.module.Import.Imports) - len(imps)
+	removedFuncs := len(c.module.Code.Segments) - len(segs)
+	removedTypes := len(c.module.Type.Functions) - len(tpes)
+	c.module.Import.Imports = imps
+	c.module.Code.Segments = segs
+	c.module.Function.TypeIndices = tidxs
+	c.module.Type.Functions = tpes
+	for i, imp := range c.module.Import.Imports {
+		if fi, ok := imp.Descriptor.(module.FunctionImport); ok {
+			c.module.Import.Imports[i].Descriptor = module.FunctionImport{Func: typeMap[fi.Func]}
+		}
+	}
+	c.remapFunctions(funcs)
+	c.compacted, c.compactedFuncs = true, funcs
+	c.debug.Printf("compacted unused code: removed %d imports, %d functions, %d types", removedImports, removedFuncs, removedTypes)
+	return nil
+}
+
+// remapFunctions renumbers all references to functions outside of the code
+// section, dropping the names of the functions that have been removed.
+func (c *Compiler) remapFunctions(funcs map[uint32]uint32) {
+	for i, exp := range c.module.Export.Exports {
+		if exp.Descriptor.Type == module.FunctionExportType {
+			c.module.Export.Exports[i].Descriptor.Index = funcs[exp.Descriptor.Index]
+		}
+	}
+	for i := range c.module.Element.Segments {
+		for j, idx := range c.module.Element.Segments[i].Indices {
+			c.module.Element.Segments[i].Indices[j] = funcs[idx]
+		}
+	}
+	if start := c.module.Start.FuncIndex; start != nil {
+		idx := funcs[*start]
+		c.module.Start.FuncIndex = &idx
+	}
+
+	// the names left after removing unused code are those of the retained
+	// functions: any others mean that the name section is out of sync
+	names := c.module.Names.Functions[:0]
+	var dropped []string
+	for _, nm := range c.module.Names.Functions {
+		if idx, ok := funcs[nm.Index]; ok {
+			nm.Index = idx
+			names = append(names, nm)
+		} else {
+			dropped = append(dropped, fmt.Sprintf("%s (%d)", nm.Name, nm.Index))
+		}
+	}
+	if len(dropped) > 0 {
+		c.debug.Printf("warning: name section refers to %d removed functions: %s", len(dropped), strings.Join(dropped, ", "))
+	}
+	c.module.Names.Functions = names
+	locals := c.module.Names.Locals[:0]
+	for _, lm := range c.module.Names.Locals {
+		if idx, ok := funcs[lm.FuncIndex]; ok {
+			lm.FuncIndex = idx
+			locals = append(locals, lm)
+		}
+	}
+	c.module.Names.Locals = locals
+}
@@ -0,0 +1,294 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+func TestCompactUnusedCode(t *testing.T) {
+	policy := planModules(t, "package test\np { input.x = 1; startswith(input.y, \"a\") }", planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test.p = x`)},
+	})
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New().WithPolicy(policy).WithCompactUnusedCode(true)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mod.Code.Segments) >= len(def.Code.Segments) {
+		t.Fatalf("expected fewer functions, got %d (default: %d)", len(mod.Code.Segments), len(def.Code.Segments))
+	}
+	if len(mod.Function.TypeIndices) != len(mod.Code.Segments) {
+		t.Fatalf("expected %d function declarations, got %d", len(mod.Code.Segments), len(mod.Function.TypeIndices))
+	}
+	defSize, err := encoding.EncodedSize(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := encoding.EncodedSize(mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size >= defSize {
+		t.Errorf("expected compacted module (%d bytes) to be smaller than default (%d bytes)", size, defSize)
+	}
+
+	// Only functions referenced from the table may remain stubbed.
+	table := map[uint32]struct{}{}
+	for _, seg := range mod.Element.Segments {
+		for _, idx := range seg.Indices {
+			table[idx] = struct{}{}
+		}
+	}
+	imports := c.functionImportCount()
+	for i, seg := range mod.Code.Segments {
+		if _, ok := table[uint32(i+imports)]; !ok && isStub(seg.Code) {
+			t.Errorf("func %d: expected unused function to be removed", i+imports)
+		}
+	}
+
+	// The module survives a roundtrip.
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, mod); err != nil {
+		t.Fatal(err)
+	}
+	mod2, err := encoding.ReadModule(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mod, mod2) {
+		t.Fatal("expected module to survive roundtrip")
+	}
+
+	// Exports, and the calls of all retained functions, still refer to the
+	// same functions, by name.
+	defNames, names := funcNames(def), funcNames(mod)
+	for _, exp := range mod.Export.Exports {
+		if exp.Descriptor.Type != module.FunctionExportType {
+			continue
+		}
+		want, got := defNames[exportIndex(def, exp.Name)], names[exp.Descriptor.Index]
+		if want != got {
+			t.Errorf("export %s: expected func %s, got %s", exp.Name, want, got)
+		}
+	}
+	defByName := map[string]uint32{}
+	for idx, n := range defNames {
+		defByName[n] = idx
+	}
+	for idx, n := range names {
+		if int(idx) < imports {
+			continue
+		}
+		exp := calledNames(t, def, defNames, defByName[n])
+		act := calledNames(t, mod, names, idx)
+		if !reflect.DeepEqual(exp, act) {
+			t.Errorf("func %s: expected calls %v, got %v", n, exp, act)
+		}
+	}
+}
+
+func funcNames(m *module.Module) map[uint32]string {
+	ret := make(map[uint32]string, len(m.Names.Functions))
+	for _, nm := range m.Names.Functions {
+		ret[nm.Index] = nm.Name
+	}
+	return ret
+}
+
+func exportIndex(m *module.Module, name string) uint32 {
+	for _, exp := range m.Export.Exports {
+		if exp.Name == name {
+			return exp.Descriptor.Index
+		}
+	}
+	return 0
+}
+
+// calledNames returns the names of the functions called by function idx
+// of m.
+func calledNames(t *testing.T, m *module.Module, names map[uint32]string, idx uint32) []string {
+	t.Helper()
+	imports := 0
+	for _, imp := range m.Import.Imports {
+		if _, ok := imp.Descriptor.(module.FunctionImport); ok {
+			imports++
+		}
+	}
+	var ret []string
+	record := func(callee uint32) (uint32, error) {
+		ret = append(ret, names[callee])
+		return callee, nil
+	}
+	identity := func(idx uint32) (uint32, error) { return idx, nil }
+	if _, err := encoding.RemapCodeIndices(m.Code.Segments[int(idx)-imports].Code, record, identity); err != nil {
+		t.Fatalf("func %s: %v", names[idx], err)
+	}
+	return ret
+}
+
+func TestCompactUnusedCodeRemovesTypes(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, err := New().WithPolicy(policy).WithCompactUnusedCode(true).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mod.Type.Functions) >= len(def.Type.Functions) {
+		t.Errorf("expected unused types to be removed, got %d (default: %d)", len(mod.Type.Functions), len(def.Type.Functions))
+	}
+	for i, tidx := range mod.Function.TypeIndices {
+		if int(tidx) >= len(mod.Type.Functions) {
+			t.Errorf("func %d: type %d out of range", i, tidx)
+		}
+	}
+}
+
+func TestPruneImports(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New().WithPolicy(policy).WithPruneImports(true)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imports := func(m *module.Module) map[string]struct{} {
+		ret := map[string]struct{}{}
+		for _, imp := range m.Import.Imports {
+			if _, ok := imp.Descriptor.(module.FunctionImport); ok {
+				ret[imp.Name] = struct{}{}
+			}
+		}
+		return ret
+	}
+	defImps, imps := imports(def), imports(mod)
+	if len(imps) >= len(defImps) {
+		t.Fatalf("expected fewer function imports, got %v (default: %v)", imps, defImps)
+	}
+	for name := range imps {
+		if _, ok := c.keepFuncs[c.funcs[name]]; !ok {
+			t.Errorf("expected only reachable imports to be kept, got %s", name)
+		}
+	}
+	if len(mod.Code.Segments) != len(def.Code.Segments) {
+		t.Errorf("expected unused functions to be stubbed only, got %d (default: %d)", len(mod.Code.Segments), len(def.Code.Segments))
+	}
+
+	// Exports, and the calls of all functions, still refer to the same
+	// functions, by name.
+	defNames, names := funcNames(def), funcNames(mod)
+	for _, exp := range mod.Export.Exports {
+		if exp.Descriptor.Type != module.FunctionExportType {
+			continue
+		}
+		want, got := defNames[exportIndex(def, exp.Name)], names[exp.Descriptor.Index]
+		if want != got {
+			t.Errorf("export %s: expected func %s, got %s", exp.Name, want, got)
+		}
+	}
+	defByName := map[string]uint32{}
+	for idx, n := range defNames {
+		defByName[n] = idx
+	}
+	for idx, n := range names {
+		if int(idx) < len(imps) {
+			continue
+		}
+		exp := calledNames(t, def, defNames, defByName[n])
+		act := calledNames(t, mod, names, idx)
+		if !reflect.DeepEqual(exp, act) {
+			t.Errorf("func %s: expected calls %v, got %v", n, exp, act)
+		}
+	}
+}
+
+func TestCompactUnusedCodeNameDrift(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	var buf bytes.Buffer
+	c := New().WithPolicy(policy).WithDebug(&buf)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	c.module.Names.Functions = append(c.module.Names.Functions, module.NameMap{Index: 99999, Name: "ghost"})
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	exp := "warning: name section refers to 1 functions the module doesn't have: ghost (99999)"
+	if !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", exp, buf.String())
+	}
+	kept := len(c.keepFuncs)
+
+	// a name left behind for a stubbed function is dropped when compacting
+	table := map[uint32]struct{}{}
+	for _, seg := range c.module.Element.Segments {
+		for _, idx := range seg.Indices {
+			table[idx] = struct{}{}
+		}
+	}
+	imports := c.functionImportCount()
+	stale := -1
+	for i, seg := range c.module.Code.Segments {
+		idx := uint32(i + imports)
+		_, ok := c.keepFuncs[idx]
+		_, pinned := table[idx]
+		if !ok && !pinned && isStub(seg.Code) {
+			stale = int(idx)
+			break
+		}
+	}
+	if stale < 0 {
+		t.Fatal("expected a stubbed function")
+	}
+	c.module.Names.Functions = append(c.module.Names.Functions, module.NameMap{Index: uint32(stale), Name: "stale"})
+	buf.Reset()
+	c.compact = true
+	if err := c.compactUnusedCode(); err != nil {
+		t.Fatal(err)
+	}
+	exp = fmt.Sprintf("warning: name section refers to 1 removed functions: stale (%d)", stale)
+	if !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", exp, buf.String())
+	}
+	if len(c.keepFuncs) != kept {
+		t.Errorf("expected %d functions kept, got %d", kept, len(c.keepFuncs))
+	}
+	for _, nm := range c.module.Names.Functions {
+		if nm.Name == "stale" || nm.Name == "ghost" {
+			t.Errorf("expected name %s to be dropped", nm.Name)
+		}
+	}
+}
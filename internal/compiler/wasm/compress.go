@@ -0,0 +1,76 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// CompressedModuleName is the file name recorded in the header of modules
+// written by WriteCompressed.
+const CompressedModuleName = "policy.wasm"
+
+// gzipMagic are the first bytes of any gzip stream (RFC 1952), and thus of
+// compressed modules; uncompressed modules start with "\x00asm".
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// WriteCompressed writes the compiled module to w as a gzip stream: it starts
+// with the gzip magic bytes 0x1f 0x8b, and its header names the contained
+// file CompressedModuleName. Call it after Compile; ReadCompressed reverses
+// it.
+func (c *Compiler) WriteCompressed(w io.Writer) error {
+	if c.module == nil {
+		return errors.New("no module compiled")
+	}
+	zw := gzip.NewWriter(w)
+	zw.Name = CompressedModuleName
+	if err := encoding.WriteModule(zw, c.module); err != nil {
+		return fmt.Errorf("compress module: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("compress module: %w", err)
+	}
+	return nil
+}
+
+// IsCompressed returns true if bs starts like a module written by
+// WriteCompressed.
+func IsCompressed(bs []byte) bool {
+	return bytes.HasPrefix(bs, gzipMagic)
+}
+
+// ReadCompressed decodes a module written by WriteCompressed. Uncompressed
+// modules are decoded as well, so callers don't have to tell them apart.
+func ReadCompressed(r io.Reader) (*module.Module, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read module: %w", err)
+	}
+	if !IsCompressed(magic) {
+		return encoding.ReadModule(br)
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("decompress module: %w", err)
+	}
+	mod, err := encoding.ReadModule(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decode module: %w", err)
+	}
+	// reading to the end verifies the checksum
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return nil, fmt.Errorf("decompress module: %w", err)
+	}
+	return mod, nil
+}
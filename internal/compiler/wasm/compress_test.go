@@ -0,0 +1,79 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+func TestWriteCompressed(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.WriteCompressed(&bytes.Buffer{}); err == nil {
+		t.Fatal("expected error before compilation")
+	}
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(m *module.Module) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := encoding.WriteModule(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	raw := encode(mod)
+
+	var buf bytes.Buffer
+	if err := c.WriteCompressed(&buf); err != nil {
+		t.Fatal(err)
+	}
+	gz := buf.Bytes()
+	if !IsCompressed(gz) || IsCompressed(raw) {
+		t.Fatal("expected only the compressed module to be detected as such")
+	}
+	if len(gz) >= len(raw) {
+		t.Errorf("expected compressed module to be smaller, got %d bytes (uncompressed: %d)", len(gz), len(raw))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.Name != CompressedModuleName {
+		t.Errorf("expected name %q, got %q", CompressedModuleName, zr.Name)
+	}
+
+	for name, bs := range map[string][]byte{"compressed": gz, "uncompressed": raw} {
+		t.Run(name, func(t *testing.T) {
+			m, err := ReadCompressed(bytes.NewReader(bs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(encode(m), raw) {
+				t.Error("expected module to round-trip")
+			}
+		})
+	}
+
+	t.Run("corrupt", func(t *testing.T) {
+		bad := append([]byte(nil), gz...)
+		bad[len(bad)-5] ^= 0xff // CRC-32 in the trailer
+		if _, err := ReadCompressed(bytes.NewReader(bad)); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
@@ -0,0 +1,310 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+	"github.com/open-policy-agent/opa/version"
+)
+
+// EntrypointTableSection is the name of the custom section holding the
+// mapping of entrypoint paths to entrypoint IDs, see WithEntrypointTable.
+const EntrypointTableSection = "opa_entrypoints"
+
+// WithEntrypointTable toggles the emission of a custom section containing
+// the mapping of entrypoint paths to the IDs used to invoke them via `eval`.
+// The section's contents are a JSON object, e.g. {"a/b": 0, "a/c": 1}.
+func (c *Compiler) WithEntrypointTable(enabled bool) *Compiler {
+	c.entrypointTable = enabled
+	return c
+}
+
+// Entrypoints returns the mapping of entrypoint paths to their IDs. It
+// is only populated after Compile has been called.
+func (c *Compiler) Entrypoints() map[string]int32 {
+	ret := make(map[string]int32, len(c.entrypoints))
+	for k, v := range c.entrypoints {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (c *Compiler) emitEntrypointTable() error {
+	if !c.entrypointTable {
+		return nil
+	}
+	// NOTE(sr): encoding/json sorts map keys, so the output is stable.
+	bs, err := json.Marshal(c.entrypoints)
+	if err != nil {
+		return fmt.Errorf("encode entrypoint table: %w", err)
+	}
+	c.module.Customs = append(c.module.Customs, module.CustomSection{
+		Name: EntrypointTableSection,
+		Data: bs,
+	})
+	return nil
+}
+
+// ReadEntrypointTable returns the entrypoint table embedded into m, if any.
+func ReadEntrypointTable(m *module.Module) (map[string]int32, error) {
+	for _, s := range m.Customs {
+		if s.Name == EntrypointTableSection {
+			var ret map[string]int32
+			if err := json.Unmarshal(s.Data, &ret); err != nil {
+				return nil, fmt.Errorf("decode entrypoint table: %w", err)
+			}
+			return ret, nil
+		}
+	}
+	return nil, nil
+}
+
+// memoryChecksumVar is the name of the exported global holding the checksum
+// of the module's initial memory contents, see WithMemoryChecksum.
+const memoryChecksumVar = "opa_memory_checksum"
+
+// WithMemoryChecksum toggles the emission of an exported, immutable i32
+// global ("opa_memory_checksum") holding the CRC-32 (IEEE) checksum of all
+// data segments' contents, concatenated in order of their offsets. Hosts
+// can use it to verify the initialized memory.
+func (c *Compiler) WithMemoryChecksum(enabled bool) *Compiler {
+	c.memoryChecksum = enabled
+	return c
+}
+
+// MemoryChecksum returns the checksum of the module's data segments, as
+// described in WithMemoryChecksum.
+func (c *Compiler) MemoryChecksum() (uint32, error) {
+	segs := c.module.Data.Segments
+	offsets := make([]int32, len(segs))
+	order := make([]int, len(segs))
+	for i := range segs {
+		start, _, err := dataSegmentRange(segs[i])
+		if err != nil {
+			return 0, fmt.Errorf("data segment %d: %w", i, err)
+		}
+		offsets[i] = start
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return offsets[order[i]] < offsets[order[j]] })
+
+	h := crc32.NewIEEE()
+	for _, i := range order {
+		h.Write(segs[i].Init)
+	}
+	return h.Sum32(), nil
+}
+
+// emitMemoryChecksum exports the checksum global. It's run after wasm-opt,
+// which may repack the data segments, and again by Optimize: a global
+// exported before is updated.
+func (c *Compiler) emitMemoryChecksum() error {
+	if !c.memoryChecksum {
+		return nil
+	}
+	sum, err := c.MemoryChecksum()
+	if err != nil {
+		return err
+	}
+	init := module.Expr{
+		Instrs: []instruction.Instruction{
+			instruction.I32Const{Value: int32(sum)},
+		},
+	}
+	// global indices start with the imported globals
+	var imported uint32
+	for _, imp := range c.module.Import.Imports {
+		if imp.Descriptor.Kind() == module.GlobalImportType {
+			imported++
+		}
+	}
+	for _, exp := range c.module.Export.Exports {
+		if exp.Name == memoryChecksumVar && exp.Descriptor.Type == module.GlobalExportType {
+			if i := exp.Descriptor.Index; i >= imported && int(i-imported) < len(c.module.Global.Globals) {
+				c.module.Global.Globals[i-imported].Init = init
+				return nil
+			}
+			return fmt.Errorf("%s: global %d not defined by the module", memoryChecksumVar, exp.Descriptor.Index)
+		}
+	}
+	c.module.Global.Globals = append(c.module.Global.Globals, module.Global{
+		Type: types.I32,
+		Init: init,
+	})
+	c.module.Export.Exports = append(c.module.Export.Exports, module.Export{
+		Name: memoryChecksumVar,
+		Descriptor: module.ExportDescriptor{
+			Type:  module.GlobalExportType,
+			Index: imported + uint32(len(c.module.Global.Globals)-1),
+		},
+	})
+	return nil
+}
+
+// BuildInfoSection is the name of the custom section holding information
+// about the compiler that produced the module, see WithBuildInfo.
+const BuildInfoSection = "opa_build_info"
+
+// BuildInfo is the content of the build info custom section.
+type BuildInfo struct {
+	Version     string    `json:"version"`
+	Timestamp   time.Time `json:"timestamp"`
+	Revision    string    `json:"revision,omitempty"`    // see WithBuildRevision
+	Entrypoints []string  `json:"entrypoints,omitempty"` // sorted
+	Digest      string    `json:"digest,omitempty"`      // hex-encoded SHA-256 of the JSON-encoded plan
+}
+
+// WithBuildInfo toggles the emission of a custom section recording the OPA
+// version, the time of compilation, the entrypoints, and the digest of the
+// plan the module is compiled from.
+func (c *Compiler) WithBuildInfo(enabled bool) *Compiler {
+	c.buildInfo = enabled
+	return c
+}
+
+// WithBuildRevision sets the revision, e.g. that of the bundle being built,
+// to be recorded in the build info custom section.
+func (c *Compiler) WithBuildRevision(rev string) *Compiler {
+	c.buildRevision = rev
+	return c
+}
+
+// WithSourceDateEpoch fixes all timestamps embedded into the module to the
+// passed Unix time, so that compiling the same policy twice yields identical
+// modules. If not set, the SOURCE_DATE_EPOCH environment variable is
+// consulted, and the current time is used if that isn't set either.
+func (c *Compiler) WithSourceDateEpoch(epoch int64) *Compiler {
+	c.epoch = &epoch
+	return c
+}
+
+// now returns the time to be embedded into the module.
+func (c *Compiler) now() (time.Time, error) {
+	if c.epoch != nil {
+		return time.Unix(*c.epoch, 0).UTC(), nil
+	}
+	if env := os.Getenv("SOURCE_DATE_EPOCH"); env != "" {
+		epoch, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("SOURCE_DATE_EPOCH: %w", err)
+		}
+		return time.Unix(epoch, 0).UTC(), nil
+	}
+	return time.Now().UTC(), nil
+}
+
+func (c *Compiler) emitBuildInfo() error {
+	if !c.buildInfo {
+		return nil
+	}
+	ts, err := c.now()
+	if err != nil {
+		return err
+	}
+	plan, err := json.Marshal(c.policy)
+	if err != nil {
+		return fmt.Errorf("encode plan: %w", err)
+	}
+	digest := sha256.Sum256(plan)
+	eps := make([]string, 0, len(c.entrypoints))
+	for ep := range c.entrypoints {
+		eps = append(eps, ep)
+	}
+	sort.Strings(eps)
+	bs, err := json.Marshal(BuildInfo{
+		Version:     version.Version,
+		Timestamp:   ts,
+		Revision:    c.buildRevision,
+		Entrypoints: eps,
+		Digest:      hex.EncodeToString(digest[:]),
+	})
+	if err != nil {
+		return fmt.Errorf("encode build info: %w", err)
+	}
+	c.module.Customs = append(c.module.Customs, module.CustomSection{
+		Name: BuildInfoSection,
+		Data: bs,
+	})
+	return nil
+}
+
+// ReadBuildInfo returns the build info embedded into m, if any.
+func ReadBuildInfo(m *module.Module) (*BuildInfo, error) {
+	for _, s := range m.Customs {
+		if s.Name == BuildInfoSection {
+			var ret BuildInfo
+			if err := json.Unmarshal(s.Data, &ret); err != nil {
+				return nil, fmt.Errorf("decode build info: %w", err)
+			}
+			return &ret, nil
+		}
+	}
+	return nil, nil
+}
+
+// AnnotationsSection is the name of the custom section holding the
+// annotations of the entrypoint rules, see WithAnnotations.
+const AnnotationsSection = "opa_annotations"
+
+// WithAnnotations sets the annotations of the entrypoints, keyed by their
+// path (e.g. "a/b"), to be embedded into a custom section as JSON object.
+// Annotations of paths that aren't entrypoints are ignored.
+func (c *Compiler) WithAnnotations(anns map[string][]*ast.Annotations) *Compiler {
+	c.annotations = anns
+	return c
+}
+
+func (c *Compiler) emitAnnotations() error {
+	if len(c.annotations) == 0 {
+		return nil
+	}
+	anns := make(map[string][]*ast.Annotations, len(c.annotations))
+	for path, as := range c.annotations {
+		if _, ok := c.entrypoints[path]; !ok {
+			c.debug.Printf("ignoring annotations of %s: not an entrypoint", path)
+			continue
+		}
+		if len(as) > 0 {
+			anns[path] = as
+		}
+	}
+	bs, err := json.Marshal(anns)
+	if err != nil {
+		return fmt.Errorf("encode annotations: %w", err)
+	}
+	c.module.Customs = append(c.module.Customs, module.CustomSection{
+		Name: AnnotationsSection,
+		Data: bs,
+	})
+	return nil
+}
+
+// ReadAnnotations returns the entrypoint annotations embedded into m, if
+// any, as the JSON objects they were encoded to, keyed by entrypoint path.
+func ReadAnnotations(m *module.Module) (map[string][]map[string]interface{}, error) {
+	for _, s := range m.Customs {
+		if s.Name == AnnotationsSection {
+			var ret map[string][]map[string]interface{}
+			if err := json.Unmarshal(s.Data, &ret); err != nil {
+				return nil, fmt.Errorf("decode annotations: %w", err)
+			}
+			return ret, nil
+		}
+	}
+	return nil, nil
+}
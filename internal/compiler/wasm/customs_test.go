@@ -0,0 +1,318 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"hash/crc32"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+	"github.com/open-policy-agent/opa/ir"
+)
+
+func TestEntrypointTable(t *testing.T) {
+	policy := planQueries(t,
+		planner.QuerySet{Name: "a/b", Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)}},
+		planner.QuerySet{Name: "a/c", Queries: []ast.Body{ast.MustParseBody(`input.bar = 2`)}},
+	)
+
+	var tables []map[string]int32
+	for i := 0; i < 2; i++ {
+		c := New().WithPolicy(policy).WithEntrypointTable(true)
+		mod, err := c.Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := encoding.WriteModule(&buf, mod); err != nil {
+			t.Fatal(err)
+		}
+		mod, err = encoding.ReadModule(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table, err := ReadEntrypointTable(mod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp, act := c.Entrypoints(), table; !reflect.DeepEqual(exp, act) {
+			t.Fatalf("expected %v, got %v", exp, act)
+		}
+		tables = append(tables, table)
+	}
+
+	exp := map[string]int32{"a/b": 0, "a/c": 1}
+	for _, table := range tables {
+		if !reflect.DeepEqual(exp, table) {
+			t.Errorf("expected %v, got %v", exp, table)
+		}
+	}
+}
+
+func TestEntrypointTableDisabled(t *testing.T) {
+	policy := planQueries(t,
+		planner.QuerySet{Name: "test", Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)}},
+	)
+	mod, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := ReadEntrypointTable(mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table != nil {
+		t.Errorf("expected no entrypoint table, got %v", table)
+	}
+}
+
+func TestMemoryChecksum(t *testing.T) {
+	policy := planQueries(t,
+		planner.QuerySet{Name: "test", Queries: []ast.Body{ast.MustParseBody(`input.foo = "bar"`)}},
+	)
+	c := New().WithPolicy(policy).WithMemoryChecksum(true)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segs := append([]module.DataSegment(nil), mod.Data.Segments...)
+	sort.SliceStable(segs, func(i, j int) bool {
+		return segs[i].Offset.Instrs[0].(instruction.I32Const).Value < segs[j].Offset.Instrs[0].(instruction.I32Const).Value
+	})
+	var data []byte
+	for _, seg := range segs {
+		data = append(data, seg.Init...)
+	}
+	exp := crc32.ChecksumIEEE(data)
+
+	act, err := c.MemoryChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp != act {
+		t.Errorf("expected checksum %x, got %x", exp, act)
+	}
+
+	var found bool
+	for _, e := range mod.Export.Exports {
+		if e.Name == "opa_memory_checksum" && e.Descriptor.Type == module.GlobalExportType {
+			found = true
+			v := mod.Global.Globals[e.Descriptor.Index].Init.Instrs[0].(instruction.I32Const).Value
+			if uint32(v) != exp {
+				t.Errorf("expected exported checksum %x, got %x", exp, uint32(v))
+			}
+		}
+	}
+	if !found {
+		t.Error("expected checksum global export")
+	}
+}
+
+func TestMemoryChecksumAfterWasmOpt(t *testing.T) {
+	policy := planQueries(t,
+		planner.QuerySet{Name: "test", Queries: []ast.Body{ast.MustParseBody(`input.foo = "bar"`)}},
+	)
+	// The runner truncates the last data segment, like wasm-opt's memory
+	// packing drops trailing zeros.
+	runner := func(_ context.Context, _ []string, bs []byte) ([]byte, []byte, error) {
+		mod, err := encoding.ReadModule(bytes.NewReader(bs))
+		if err != nil {
+			return nil, nil, err
+		}
+		last := &mod.Data.Segments[len(mod.Data.Segments)-1]
+		last.Init = last.Init[:len(last.Init)-1]
+		var buf bytes.Buffer
+		if err := encoding.WriteModule(&buf, mod); err != nil {
+			return nil, nil, err
+		}
+		return buf.Bytes(), nil, nil
+	}
+	c := New().WithPolicy(policy).WithMemoryChecksum(true).WithRequireWasmOpt(true).WithWasmOptRunner(runner)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := c.MemoryChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act := exportedChecksum(t, mod); act != exp {
+		t.Errorf("expected exported checksum %x of the optimized module, got %x", exp, act)
+	}
+
+	// optimizing again updates the global, instead of adding another one
+	globals := len(mod.Global.Globals)
+	if _, err := c.Optimize(context.Background(), OptimizeOptions{WasmOpt: true}); err != nil {
+		t.Fatal(err)
+	}
+	mod = c.Module()
+	if n := len(mod.Global.Globals); n != globals {
+		t.Errorf("expected %d globals, got %d", globals, n)
+	}
+	exp, err = c.MemoryChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act := exportedChecksum(t, mod); act != exp {
+		t.Errorf("expected exported checksum %x after Optimize, got %x", exp, act)
+	}
+}
+
+func TestMemoryChecksumImportedGlobals(t *testing.T) {
+	c := New().WithMemoryChecksum(true)
+	c.module = &module.Module{}
+	c.module.Import.Imports = []module.Import{
+		{Module: "env", Name: "g", Descriptor: module.GlobalImport{Type: types.I32}},
+	}
+	c.module.Global.Globals = []module.Global{{Type: types.I32, Init: module.Expr{Instrs: []instruction.Instruction{instruction.I32Const{}}}}}
+	for i := 0; i < 2; i++ { // the second run updates the global
+		if err := c.emitMemoryChecksum(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(c.module.Global.Globals); n != 2 {
+		t.Fatalf("expected 2 globals, got %d", n)
+	}
+	if exp, act := uint32(2), c.module.Export.Exports[0].Descriptor.Index; exp != act {
+		t.Errorf("expected global index %d, after the imported one, got %d", exp, act)
+	}
+}
+
+// exportedChecksum returns the value of the memory checksum global.
+func exportedChecksum(t *testing.T, mod *module.Module) uint32 {
+	t.Helper()
+	for _, e := range mod.Export.Exports {
+		if e.Name == "opa_memory_checksum" && e.Descriptor.Type == module.GlobalExportType {
+			return uint32(mod.Global.Globals[e.Descriptor.Index].Init.Instrs[0].(instruction.I32Const).Value)
+		}
+	}
+	t.Fatal("expected checksum global export")
+	return 0
+}
+
+func TestBuildInfoSourceDateEpoch(t *testing.T) {
+	policy := planQueries(t,
+		planner.QuerySet{Name: "test", Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)}},
+	)
+
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		mod, err := New().WithPolicy(policy).WithBuildInfo(true).WithSourceDateEpoch(1672531200).Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := ReadBuildInfo(mod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp, act := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), info.Timestamp; !exp.Equal(act) {
+			t.Errorf("expected timestamp %v, got %v", exp, act)
+		}
+		var buf bytes.Buffer
+		if err := encoding.WriteModule(&buf, mod); err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, buf.Bytes())
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Error("expected identical modules")
+	}
+}
+
+func TestBuildInfoSourceDateEpochEnv(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1672531200")
+	policy := planQueries(t,
+		planner.QuerySet{Name: "test", Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)}},
+	)
+	mod, err := New().WithPolicy(policy).WithBuildInfo(true).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadBuildInfo(mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := int64(1672531200), info.Timestamp.Unix(); exp != act {
+		t.Errorf("expected timestamp %v, got %v", exp, act)
+	}
+}
+
+func TestBuildInfoProvenance(t *testing.T) {
+	policy := planQueries(t,
+		planner.QuerySet{Name: "a/c", Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)}},
+		planner.QuerySet{Name: "a/b", Queries: []ast.Body{ast.MustParseBody(`input.foo = 2`)}},
+	)
+	other := planQueries(t,
+		planner.QuerySet{Name: "a/b", Queries: []ast.Body{ast.MustParseBody(`input.foo = 3`)}},
+	)
+
+	var digests []string
+	for _, p := range []*ir.Policy{policy, policy, other} {
+		mod, err := New().WithPolicy(p).WithBuildInfo(true).WithBuildRevision("rev1").Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := ReadBuildInfo(mod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Revision != "rev1" {
+			t.Errorf("expected revision rev1, got %q", info.Revision)
+		}
+		if len(info.Digest) != 64 {
+			t.Errorf("expected hex-encoded SHA-256 digest, got %q", info.Digest)
+		}
+		digests = append(digests, info.Digest)
+		if p == policy {
+			if exp, act := []string{"a/b", "a/c"}, info.Entrypoints; !reflect.DeepEqual(exp, act) {
+				t.Errorf("expected entrypoints %v, got %v", exp, act)
+			}
+		}
+	}
+	if digests[0] != digests[1] {
+		t.Errorf("expected identical digests for the same plan, got %s and %s", digests[0], digests[1])
+	}
+	if digests[0] == digests[2] {
+		t.Errorf("expected different digests for different plans")
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	policy := planQueries(t,
+		planner.QuerySet{Name: "a/b", Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)}},
+	)
+	anns := map[string][]*ast.Annotations{
+		"a/b": {{Scope: "rule", Title: "B", Organizations: []string{"Acme"}}},
+		"a/x": {{Scope: "rule", Title: "not an entrypoint"}},
+	}
+	mod, err := New().WithPolicy(policy).WithAnnotations(anns).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	act, err := ReadAnnotations(mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string][]map[string]interface{}{
+		"a/b": {{"scope": "rule", "title": "B", "organizations": []interface{}{"Acme"}}},
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DeadCodeReport describes what removing unused code did to the functions
+// defined in the module, i.e. not counting imported functions.
+type DeadCodeReport struct {
+	Total        int               `json:"total"`
+	Kept         int               `json:"kept"`
+	Removed      int               `json:"removed"`
+	RemovedBytes int               `json:"removed_bytes"` // encoded size of the removed bodies
+	RemovedFuncs []string          `json:"removed_funcs"` // sorted
+	KeptBy       map[string]string `json:"kept_by"`       // kept function -> root it's reachable from
+	Roots        map[string]string `json:"roots"`         // root -> "import", "export", "compiled", "keep" or "table"
+}
+
+// DeadCodeReport returns the report of the unused code removal. It's
+// populated by Compile, and nil before.
+func (c *Compiler) DeadCodeReport() *DeadCodeReport {
+	return c.deadCode
+}
+
+// reportDeadCode records the outcome of removeUnusedCode: keptBy maps the
+// kept functions to the roots they were first reached from, and roots maps
+// those to why they're kept. It must be called before the removed functions'
+// bodies are replaced.
+func (c *Compiler) reportDeadCode(keptBy map[uint32]uint32, roots map[uint32]string) {
+	r := &DeadCodeReport{
+		Total:  len(c.module.Code.Segments),
+		KeptBy: map[string]string{},
+		Roots:  map[string]string{},
+	}
+	imports := c.functionImportCount()
+	for i, seg := range c.module.Code.Segments {
+		idx := uint32(i + imports)
+		name := c.funcName(idx)
+		root, ok := keptBy[idx]
+		if !ok {
+			r.Removed++
+			r.RemovedBytes += len(seg.Code)
+			r.RemovedFuncs = append(r.RemovedFuncs, name)
+			continue
+		}
+		r.Kept++
+		r.KeptBy[name] = c.funcName(root)
+		r.Roots[c.funcName(root)] = roots[root]
+	}
+	sort.Strings(r.RemovedFuncs)
+	c.deadCode = r
+	c.debug.Printf("removing unused code: kept %d of %d functions, removed %d (%d bytes)",
+		r.Kept, r.Total, r.Removed, r.RemovedBytes)
+}
+
+// WhyKept explains why the function name survived the unused code removal:
+// it returns one of the shortest call chains from a root to the function,
+// like "export eval -> g0.data.test.p -> opa_value_get". It can be used once
+// unused code has been removed, by Compile or RemoveUnusedCode.
+func (c *Compiler) WhyKept(name string) (string, error) {
+	if c.callGraph == nil {
+		return "", fmt.Errorf("unused code has not been removed")
+	}
+	target, ok := c.funcs[name]
+	if !ok {
+		return "", fmt.Errorf("unknown function %q", name)
+	}
+
+	// breadth-first search starting at all roots at once, in index order
+	roots := make([]uint32, 0, len(c.roots))
+	for idx := range c.roots {
+		roots = append(roots, idx)
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i] < roots[j] })
+	parent := make(map[uint32]uint32, len(roots))
+	for _, idx := range roots {
+		parent[idx] = idx
+	}
+	for queue := roots; len(queue) > 0; queue = queue[1:] {
+		n := queue[0]
+		if n != target {
+			for _, callee := range c.callGraph[n] {
+				if _, ok := parent[callee]; !ok {
+					parent[callee] = n
+					queue = append(queue, callee)
+				}
+			}
+			continue
+		}
+		chain := []string{c.funcName(n)}
+		for parent[n] != n {
+			n = parent[n]
+			chain = append(chain, c.funcName(n))
+		}
+		for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+			chain[i], chain[j] = chain[j], chain[i]
+		}
+		return c.roots[n] + " " + strings.Join(chain, " -> "), nil
+	}
+	return "", fmt.Errorf("function %s is not kept", name)
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+)
+
+func TestDeadCodeReport(t *testing.T) {
+	policy := planModules(t, "package test\np { input.x = 1 }", planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test.p = x`)},
+	})
+	c := New().WithPolicy(policy)
+	if c.DeadCodeReport() != nil {
+		t.Fatal("expected no report before compilation")
+	}
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := c.DeadCodeReport()
+
+	if r.Total != len(mod.Code.Segments) || r.Kept+r.Removed != r.Total {
+		t.Errorf("inconsistent counts: total %d, kept %d, removed %d", r.Total, r.Kept, r.Removed)
+	}
+	if r.Removed != len(r.RemovedFuncs) || len(r.KeptBy) != r.Kept {
+		t.Errorf("expected %d removed and %d kept functions, got %d and %d", r.Removed, r.Kept, len(r.RemovedFuncs), len(r.KeptBy))
+	}
+	if r.RemovedBytes <= r.Removed*3 {
+		t.Errorf("expected removed bodies to be larger than their stubs, got %d bytes", r.RemovedBytes)
+	}
+
+	var re2 bool
+	for _, name := range r.RemovedFuncs {
+		re2 = re2 || strings.Contains(name, "re2::")
+		if _, ok := r.KeptBy[name]; ok {
+			t.Errorf("func %s reported as both kept and removed", name)
+		}
+	}
+	if !re2 {
+		t.Error("expected re2 functions to be removed")
+	}
+
+	for fn, root := range r.KeptBy {
+		if _, ok := r.Roots[root]; !ok {
+			t.Errorf("func %s kept by %s, which isn't a root", fn, root)
+		}
+	}
+	// The compiled functions are reached via opa_eval, which calls eval.
+	if root := r.KeptBy["g0.data.test.p"]; root != "opa_eval" {
+		t.Errorf("expected g0.data.test.p to be kept by opa_eval, got %q", root)
+	}
+	if root := r.KeptBy["opa_eval_ctx_new"]; root != "opa_eval_ctx_new" || r.Roots[root] != "export" {
+		t.Errorf("expected opa_eval_ctx_new to be kept as exported root, got %q (%s)", root, r.Roots[root])
+	}
+}
+
+func TestKeepFunctions(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.x = 1`)},
+	})
+	removed := func(r *DeadCodeReport, name string) bool {
+		for _, n := range r.RemovedFuncs {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	const fn = "opa_regex_match"
+
+	def := New().WithPolicy(policy)
+	if _, err := def.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !removed(def.DeadCodeReport(), fn) {
+		t.Fatalf("expected %s to be removed by default", fn)
+	}
+
+	c := New().WithPolicy(policy).WithKeepFunctions(fn)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	r := c.DeadCodeReport()
+	if root := r.KeptBy[fn]; root != fn || r.Roots[root] != "keep" {
+		t.Errorf("expected %s to be kept as requested, got %q (%s)", fn, root, r.Roots[root])
+	}
+	// What it calls is retained, too.
+	var callees int
+	for kept, root := range r.KeptBy {
+		if root == fn && kept != fn && removed(def.DeadCodeReport(), kept) {
+			callees++
+		}
+	}
+	if callees == 0 {
+		t.Errorf("expected otherwise unused callees of %s to be kept", fn)
+	}
+
+	_, err := New().WithPolicy(policy).WithKeepFunctions("opa_regex_mathc").Compile()
+	if exp := `keep function: unknown function "opa_regex_mathc"`; err == nil || err.Error() != exp {
+		t.Errorf("expected error %q, got %v", exp, err)
+	}
+}
+
+func TestWhyKept(t *testing.T) {
+	c := New()
+	if _, err := c.WhyKept("a"); err == nil {
+		t.Fatal("expected error before removing unused code")
+	}
+
+	// Two roots, eval (0) and a table entry (5):
+	//   eval -> a -> b -> c -> target
+	//   eval -> d -> c
+	//   tbl -> target
+	c.funcs = map[string]uint32{"eval": 0, "a": 1, "b": 2, "c": 3, "d": 4, "tbl": 5, "target": 6, "unused": 7}
+	c.callGraph = map[uint32][]uint32{
+		0: {1, 4},
+		1: {2},
+		2: {3},
+		3: {6},
+		4: {3},
+		5: {6},
+	}
+	c.roots = map[uint32]string{0: "export", 5: "table"}
+
+	for name, exp := range map[string]string{
+		"eval":   "export eval",
+		"c":      "export eval -> d -> c",
+		"target": "table tbl -> target",
+	} {
+		act, err := c.WhyKept(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act != exp {
+			t.Errorf("%s: expected %q, got %q", name, exp, act)
+		}
+	}
+
+	delete(c.roots, 5)
+	if act, err := c.WhyKept("target"); err != nil || act != "export eval -> d -> c -> target" {
+		t.Errorf("expected path via eval, got %q (err: %v)", act, err)
+	}
+	if _, err := c.WhyKept("unused"); err == nil || err.Error() != "function unused is not kept" {
+		t.Errorf("expected not kept error, got %v", err)
+	}
+	if _, err := c.WhyKept("missing"); err == nil {
+		t.Error("expected unknown function error")
+	}
+}
+
+func TestWhyKeptCompiled(t *testing.T) {
+	policy := planModules(t, "package test\np { input.x = 1 }", planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test.p = x`)},
+	})
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	why, err := c.WhyKept("g0.data.test.p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(why, "g0.data.test.p") {
+		t.Errorf("expected chain ending in g0.data.test.p, got %q", why)
+	}
+}
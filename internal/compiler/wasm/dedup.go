@@ -0,0 +1,168 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// WithDedupFunctions toggles merging the functions planned from the policy
+// that are identical: the same type, and the same encoded body. Calls of,
+// and table entries referring to, a duplicate are redirected to the
+// function found first, and the duplicates are then removed along with the
+// rest of the unused code. A duplicate that is kept nonetheless, e.g. via
+// WithKeepFunctions, calls the function it's merged into. Functions that
+// only become identical once the calls in their bodies have been redirected
+// are merged, too.
+func (c *Compiler) WithDedupFunctions(enabled bool) *Compiler {
+	c.dedupFuncs = enabled
+	return c
+}
+
+// dedupFunctions merges identical planned functions, see WithDedupFunctions.
+// It runs before removeUnusedCode, which then finds the duplicates unused.
+func (c *Compiler) dedupFunctions() error {
+	if !c.dedupEnabled() {
+		return nil
+	}
+	planned := make(map[string]struct{}, len(c.policy.Funcs.Funcs))
+	for _, fn := range c.policy.Funcs.Funcs {
+		planned[fn.Name] = struct{}{}
+	}
+	imports := uint32(c.functionImportCount())
+
+	merged := map[uint32]uint32{} // duplicate -> function it's merged into
+	resolve := func(idx uint32) uint32 {
+		for {
+			to, ok := merged[idx]
+			if !ok {
+				return idx
+			}
+			idx = to
+		}
+	}
+	redirect := Nested(func(is []instruction.Instruction) []instruction.Instruction {
+		for i, instr := range is {
+			switch call := instr.(type) {
+			case instruction.Call:
+				call.Index = resolve(call.Index)
+				is[i] = call
+			case instruction.ReturnCall:
+				call.Index = resolve(call.Index)
+				is[i] = call
+			}
+		}
+		return is
+	})
+
+	for {
+		seen := map[string]uint32{} // type and body -> first function found
+		var n int
+		for _, f := range c.funcsCode {
+			if _, ok := planned[f.name]; !ok {
+				continue
+			}
+			idx := c.funcs[f.name]
+			if _, ok := merged[idx]; ok {
+				continue
+			}
+			code := *f.code
+			code.Func.Expr.Instrs = c.withoutMemoKey(code.Func.Expr.Instrs, idx)
+			var buf bytes.Buffer
+			if err := encoding.WriteCodeEntry(&buf, &code); err != nil {
+				return fmt.Errorf("write function %s: %w", f.name, err)
+			}
+			key := fmt.Sprintf("%d:%s", c.module.Function.TypeIndices[idx-imports], buf.Bytes())
+			if first, ok := seen[key]; ok {
+				c.debug.Printf("merging function %s into %s", f.name, c.funcName(first))
+				merged[idx] = first
+				n++
+				continue
+			}
+			seen[key] = idx
+		}
+		if n == 0 {
+			break
+		}
+		for _, f := range c.funcsCode {
+			f.code.Func.Expr.Instrs = redirect(f.code.Func.Expr.Instrs)
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	funcs := c.funcsCode[:0]
+	for _, f := range c.funcsCode {
+		idx := c.funcs[f.name]
+		if _, ok := merged[idx]; !ok {
+			funcs = append(funcs, f)
+			continue
+		}
+		if err := c.forwardFunction(idx, resolve(idx)); err != nil {
+			return fmt.Errorf("function %s: %w", f.name, err)
+		}
+	}
+	c.funcsCode = funcs
+	for i := range c.module.Element.Segments {
+		for j, idx := range c.module.Element.Segments[i].Indices {
+			c.module.Element.Segments[i].Indices[j] = resolve(idx)
+		}
+	}
+	c.debug.Printf("merged %d duplicate functions", len(merged))
+	return nil
+}
+
+// forwardFunction sets the code of the function idx, which isn't emitted
+// with the compiled functions, to a call of the function to, passing on its
+// arguments: it has to have a valid body should it not be removed.
+func (c *Compiler) forwardFunction(idx, to uint32) error {
+	tpe, ok := c.functionType(idx)
+	if !ok {
+		return fmt.Errorf("unknown type of function %d", idx)
+	}
+	var entry module.CodeEntry
+	for i := range tpe.Params {
+		entry.Func.Expr.Instrs = append(entry.Func.Expr.Instrs, instruction.GetLocal{Index: uint32(i)})
+	}
+	entry.Func.Expr.Instrs = append(entry.Func.Expr.Instrs, instruction.Call{Index: to})
+	var buf bytes.Buffer
+	if err := encoding.WriteCodeEntry(&buf, &entry); err != nil {
+		return err
+	}
+	c.module.Code.Segments[idx-uint32(c.functionImportCount())].Code = buf.Bytes()
+	return nil
+}
+
+// withoutMemoKey returns a copy of the top-level instructions is of the
+// function idx, with its own index, which it uses as its memoization key
+// (see compileFunc), replaced by zero: functions that only differ in their
+// memoization key are identical, and can share the survivor's entries.
+func (c *Compiler) withoutMemoKey(is []instruction.Instruction, idx uint32) []instruction.Instruction {
+	get, insert := c.function(opaMemoizeGet), c.function(opaMemoizeInsert)
+	ret := make([]instruction.Instruction, len(is))
+	copy(ret, is)
+	for i := range ret {
+		if k, ok := ret[i].(instruction.I32Const); !ok || k.Value != int32(idx) {
+			continue
+		}
+		next := ret[i+1:]
+		if len(next) > 0 && isCall(next[0], get) ||
+			len(next) > 1 && isCall(next[1], insert) {
+			ret[i] = instruction.I32Const{}
+		}
+	}
+	return ret
+}
+
+func isCall(instr instruction.Instruction, idx uint32) bool {
+	call, ok := instr.(instruction.Call)
+	return ok && call.Index == idx
+}
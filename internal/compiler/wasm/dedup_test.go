@@ -0,0 +1,149 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+)
+
+const dedupModule = `package test
+s[x] { x := input.a }
+u[x] { x := input.a }
+v[x] { s[x] }
+w[x] { u[x] }`
+
+func TestDedupFunctions(t *testing.T) {
+	policy := planModules(t, dedupModule, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+	})
+	var buf bytes.Buffer
+	c := New().WithPolicy(policy).WithDedupFunctions(true).WithDebug(&buf)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := "merged 2 duplicate functions"; !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", exp, buf.String())
+	}
+
+	kept := map[string]bool{}
+	var v []instruction.Instruction
+	for _, f := range c.funcsCode {
+		kept[f.name] = true
+		if f.name == "g0.data.test.v" {
+			v = f.code.Func.Expr.Instrs
+		}
+	}
+	for name, exp := range map[string]bool{
+		"g0.data.test.s": true,
+		"g0.data.test.v": true,
+		"g0.data.test.u": false,
+		"g0.data.test.w": false,
+	} {
+		if kept[name] != exp {
+			t.Errorf("function %s: expected kept %v, got %v", name, exp, kept[name])
+		}
+	}
+
+	// the table entries must refer to the survivors
+	for _, seg := range c.module.Element.Segments {
+		for _, idx := range seg.Indices {
+			if name := c.funcName(idx); name == "g0.data.test.u" || name == "g0.data.test.w" {
+				t.Errorf("expected no table entry for %s", name)
+			}
+		}
+	}
+
+	// v's call of s must not have been redirected anywhere
+	var calls bool
+	Nested(func(is []instruction.Instruction) []instruction.Instruction {
+		for _, instr := range is {
+			if call, ok := instr.(instruction.Call); ok && call.Index == c.funcs["g0.data.test.s"] {
+				calls = true
+			}
+		}
+		return is
+	})(v)
+	if !calls {
+		t.Error("expected g0.data.test.v to call g0.data.test.s")
+	}
+}
+
+func TestDedupFunctionsTypes(t *testing.T) {
+	policy := planModules(t, dedupModule, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+	})
+	c := New().WithPolicy(policy).WithDedupFunctions(true)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	// give u a type of its own, identical to s's but with another index
+	idx := c.funcs["g0.data.test.u"] - uint32(c.functionImportCount())
+	c.module.Type.Functions = append(c.module.Type.Functions, c.module.Type.Functions[c.module.Function.TypeIndices[idx]])
+	c.module.Function.TypeIndices[idx] = uint32(len(c.module.Type.Functions) - 1)
+
+	if err := c.dedupFunctions(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, f := range c.funcsCode {
+		if strings.HasPrefix(f.name, "g0.data.test.") {
+			n++
+		}
+	}
+	if n != 4 {
+		t.Errorf("expected no functions merged, got %d left", n)
+	}
+}
+
+func TestDedupFunctionsKept(t *testing.T) {
+	policy := planModules(t, dedupModule, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+	})
+	for _, compact := range []bool{false, true} {
+		c := New().WithPolicy(policy).WithDedupFunctions(true).WithKeepFunctions("g0.data.test.u").WithCompactUnusedCode(compact)
+		mod, err := c.Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := encoding.WriteModule(&buf, mod); err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		r := wazero.NewRuntime(ctx)
+		if _, err := r.CompileModule(ctx, buf.Bytes()); err != nil {
+			t.Fatalf("compact %v: invalid module: %v", compact, err)
+		}
+		_ = r.Close(ctx)
+
+		// the kept duplicate calls the function it's merged into
+		u, s := c.function("g0.data.test.u"), c.function("g0.data.test.s")
+		if compact {
+			u, s = c.compactedFuncs[u], c.compactedFuncs[s]
+		}
+		entry, err := encoding.ReadCodeEntry(bytes.NewReader(mod.Code.Segments[u-uint32(c.functionImportCount())].Code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		instrs := entry.Func.Expr.Instrs
+		if call, ok := instrs[len(instrs)-1].(instruction.Call); !ok || call.Index != s {
+			t.Errorf("compact %v: expected g0.data.test.u to call g0.data.test.s, got %v", compact, instrs)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"sort"
+	"strings"
+)
+
+// WithMaxCallDepth sets the maximum length of the call chains starting at
+// an entrypoint: if the longest one, ignoring recursive calls, has more than
+// n calls, a warning naming the chain is issued. Zero, the default, means
+// no limit.
+func (c *Compiler) WithMaxCallDepth(n int) *Compiler {
+	c.maxCallDepth = n
+	return c
+}
+
+func (c *Compiler) checkCallDepth() error {
+	if c.maxCallDepth <= 0 {
+		return nil
+	}
+	names := make([]string, 0, len(c.entrypointCallees))
+	for name := range c.entrypointCallees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	memo := map[uint32][]uint32{}
+	for _, name := range names {
+		var longest []uint32
+		for _, callee := range c.entrypointCallees[name] {
+			if p := longestCallChain(c.callGraph, callee, memo, map[uint32]bool{}); len(p) > len(longest) {
+				longest = p
+			}
+		}
+		if depth := len(longest); depth > c.maxCallDepth {
+			chain := make([]string, 0, depth+1)
+			chain = append(chain, name)
+			for _, idx := range longest {
+				chain = append(chain, c.funcName(idx))
+			}
+			if err := c.warn("entrypoint %s: call depth %d exceeds limit of %d: %s",
+				name, depth, c.maxCallDepth, strings.Join(chain, " -> ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// longestCallChain returns the longest chain of functions called starting at
+// node, itself included. Calls to functions already on the chain are ignored,
+// so for recursive functions the result depends on where the recursion is
+// entered.
+func longestCallChain(cg map[uint32][]uint32, node uint32, memo map[uint32][]uint32, onChain map[uint32]bool) []uint32 {
+	if p, ok := memo[node]; ok {
+		return p
+	}
+	onChain[node] = true
+	var longest []uint32
+	for _, callee := range cg[node] {
+		if onChain[callee] {
+			continue
+		}
+		if p := longestCallChain(cg, callee, memo, onChain); len(p) > len(longest) {
+			longest = p
+		}
+	}
+	delete(onChain, node)
+
+	p := append([]uint32{node}, longest...)
+	memo[node] = p
+	return p
+}
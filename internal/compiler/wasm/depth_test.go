@@ -0,0 +1,63 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+)
+
+func TestCheckCallDepth(t *testing.T) {
+	// ep -> f1 -> f2 -> f3 -> f4 (-> f2), and f1 -> f5
+	cg := map[uint32][]uint32{
+		1: {5, 2},
+		2: {3},
+		3: {4},
+		4: {2},
+	}
+	funcs := map[string]uint32{"f1": 1, "f2": 2, "f3": 3, "f4": 4, "f5": 5}
+
+	if act, exp := longestCallChain(cg, 1, map[uint32][]uint32{}, map[uint32]bool{}), []uint32{1, 2, 3, 4}; !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected chain %v, got %v", exp, act)
+	}
+
+	for _, tc := range []struct {
+		limit int
+		err   string
+	}{
+		{limit: 4},
+		{limit: 3, err: "entrypoint ep: call depth 4 exceeds limit of 3: ep -> f1 -> f2 -> f3 -> f4"},
+	} {
+		c := New().WithStrict(true).WithMaxCallDepth(tc.limit)
+		c.funcs = funcs
+		c.callGraph = cg
+		c.entrypointCallees = map[string][]uint32{"ep": {1}}
+		err := c.checkCallDepth()
+		if tc.err == "" && err != nil {
+			t.Errorf("limit %d: unexpected error: %v", tc.limit, err)
+		}
+		if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("limit %d: expected error %q, got %v", tc.limit, tc.err, err)
+		}
+	}
+}
+
+func TestCheckCallDepthCompile(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	_, err := New().WithPolicy(policy).WithStrict(true).WithMaxCallDepth(1).Compile()
+	if err == nil || !strings.HasPrefix(err.Error(), "entrypoint test: call depth ") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := New().WithPolicy(policy).WithMaxCallDepth(1).Compile(); err != nil {
+		t.Fatalf("expected only a warning, got %v", err)
+	}
+}
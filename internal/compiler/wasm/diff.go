@@ -0,0 +1,112 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// ModuleDiff describes how two modules differ, see DiffModules.
+type ModuleDiff struct {
+	Added   []string `json:"added"`   // functions only in b, sorted
+	Removed []string `json:"removed"` // functions only in a, sorted
+	Changed []string `json:"changed"` // functions in both, with different bodies, sorted
+	Exports []string `json:"exports"` // "- export ..." (only in a), "+ export ..." (only in b)
+	Imports []string `json:"imports"` // "- import ..." (only in a), "+ import ..." (only in b)
+}
+
+// Empty returns true if there are no differences.
+func (d ModuleDiff) Empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Changed)+len(d.Exports)+len(d.Imports) == 0
+}
+
+// DiffModules compares module a to module b. Functions are matched by their
+// names in the name section, and their bodies are compared as encoded: a
+// body referring to functions by index changes when their indices shift.
+// Functions without a name aren't compared. Exports and imports are
+// described including their types, like in the module interface, so a
+// changed signature is reported as a removed and an added line.
+func DiffModules(a, b *module.Module) ModuleDiff {
+	var d ModuleDiff
+	as, bs := namedBodies(a), namedBodies(b)
+	for name, body := range as {
+		other, ok := bs[name]
+		switch {
+		case !ok:
+			d.Removed = append(d.Removed, name)
+		case !bytes.Equal(body, other):
+			d.Changed = append(d.Changed, name)
+		}
+	}
+	for name := range bs {
+		if _, ok := as[name]; !ok {
+			d.Added = append(d.Added, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+
+	ai, bi := moduleInterface(a), moduleInterface(b)
+	d.Exports = interfaceDiff(&Interface{Exports: ai.Exports}, &Interface{Exports: bi.Exports})
+	d.Imports = interfaceDiff(&Interface{Imports: ai.Imports}, &Interface{Imports: bi.Imports})
+	return d
+}
+
+// namedBodies maps the names of the functions defined in m to their encoded
+// bodies. Duplicate names get a ".1" suffix, like when initializing the
+// compiler's module.
+func namedBodies(m *module.Module) map[string][]byte {
+	var imports uint32
+	for _, imp := range m.Import.Imports {
+		if imp.Descriptor.Kind() == module.FunctionImportType {
+			imports++
+		}
+	}
+	ret := make(map[string][]byte, len(m.Names.Functions))
+	for _, nm := range m.Names.Functions {
+		if nm.Index < imports || int(nm.Index-imports) >= len(m.Code.Segments) {
+			continue
+		}
+		name := nm.Name
+		if _, ok := ret[name]; ok {
+			name += ".1"
+		}
+		ret[name] = m.Code.Segments[nm.Index-imports].Code
+	}
+	return ret
+}
+
+// moduleInterface returns the interface of m, like ModuleInterface, but
+// doesn't fail for types that can't be resolved: they're shown as "?".
+func moduleInterface(m *module.Module) *Interface {
+	c := &Compiler{module: m}
+	unknown := []string{"?"}
+	iface := &Interface{}
+	for _, exp := range m.Export.Exports {
+		if exp.Descriptor.Type != module.FunctionExportType {
+			continue
+		}
+		sig := Signature{Name: exp.Name, Params: unknown, Results: unknown}
+		if tpe, ok := c.functionType(exp.Descriptor.Index); ok {
+			sig.Params, sig.Results = typeStrings(tpe)
+		}
+		iface.Exports = append(iface.Exports, sig)
+	}
+	for _, imp := range m.Import.Imports {
+		i := Import{Module: imp.Module, Name: imp.Name, Kind: imp.Descriptor.Kind().String()}
+		if fi, ok := imp.Descriptor.(module.FunctionImport); ok {
+			i.Params, i.Results = unknown, unknown
+			if int(fi.Func) < len(m.Type.Functions) {
+				i.Params, i.Results = typeStrings(m.Type.Functions[fi.Func])
+			}
+		}
+		iface.Imports = append(iface.Imports, i)
+	}
+	return iface
+}
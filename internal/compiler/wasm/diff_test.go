@@ -0,0 +1,87 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+func TestDiffModules(t *testing.T) {
+	compile := func(rego string) *module.Module {
+		t.Helper()
+		policy := planModules(t, rego, planner.QuerySet{
+			Name:    "test",
+			Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+		})
+		mod, err := New().WithPolicy(policy).Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mod
+	}
+	a := compile(`package test
+p { input.x == 1 }
+q { input.y == 2 }`)
+	b := compile(`package test
+p { input.x == 1; input.w == 2 }
+r { input.z == 2 }`)
+
+	if d := DiffModules(a, a); !d.Empty() {
+		t.Errorf("expected no differences, got %+v", d)
+	}
+
+	d := DiffModules(a, b)
+	if exp := []string{"g0.data.test.r"}; !reflect.DeepEqual(exp, d.Added) {
+		t.Errorf("expected added %v, got %v", exp, d.Added)
+	}
+	if exp := []string{"g0.data.test.q"}; !reflect.DeepEqual(exp, d.Removed) {
+		t.Errorf("expected removed %v, got %v", exp, d.Removed)
+	}
+	var changed bool
+	for _, name := range d.Changed {
+		changed = changed || name == "g0.data.test.p"
+	}
+	if !changed {
+		t.Errorf("expected g0.data.test.p to be changed, got %v", d.Changed)
+	}
+	if len(d.Exports) != 0 || len(d.Imports) != 0 {
+		t.Errorf("expected same interface, got %v, %v", d.Exports, d.Imports)
+	}
+}
+
+func TestDiffModulesInterface(t *testing.T) {
+	a := &module.Module{
+		Type: module.TypeSection{Functions: []module.FunctionType{{}}},
+		Import: module.ImportSection{Imports: []module.Import{
+			{Module: "env", Name: "f", Descriptor: module.FunctionImport{Func: 0}},
+			{Module: "env", Name: "g", Descriptor: module.FunctionImport{Func: 0}},
+		}},
+		Export: module.ExportSection{Exports: []module.Export{
+			{Name: "h", Descriptor: module.ExportDescriptor{Type: module.FunctionExportType, Index: 0}},
+		}},
+	}
+	b := &module.Module{
+		Type: a.Type,
+		Import: module.ImportSection{Imports: []module.Import{
+			{Module: "env", Name: "f", Descriptor: module.FunctionImport{Func: 0}},
+			{Module: "env", Name: "g", Descriptor: module.FunctionImport{Func: 1}}, // bad type
+		}},
+		Export: module.ExportSection{Exports: []module.Export{
+			{Name: "i", Descriptor: module.ExportDescriptor{Type: module.FunctionExportType, Index: 1}},
+		}},
+	}
+	d := DiffModules(a, b)
+	if exp := []string{"- export h: () -> ()", "+ export i: (?) -> (?)"}; !reflect.DeepEqual(exp, d.Exports) {
+		t.Errorf("expected exports diff %q, got %q", exp, d.Exports)
+	}
+	if exp := []string{"- import env.g: func () -> ()", "+ import env.g: func (?) -> (?)"}; !reflect.DeepEqual(exp, d.Imports) {
+		t.Errorf("expected imports diff %q, got %q", exp, d.Imports)
+	}
+}
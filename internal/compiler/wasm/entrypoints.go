@@ -0,0 +1,106 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// WithEntrypointPasses registers instruction passes that are only applied
+// to the compiled functions exclusively reachable from the named entrypoint,
+// i.e. not reachable from any other entrypoint. This allows optimizing the
+// code of individual entrypoints for different goals, e.g. size or speed.
+func (c *Compiler) WithEntrypointPasses(entrypoint string, ps ...InstructionPass) *Compiler {
+	if c.entrypointPasses == nil {
+		c.entrypointPasses = map[string][]InstructionPass{}
+	}
+	c.entrypointPasses[entrypoint] = append(c.entrypointPasses[entrypoint], ps...)
+	return c
+}
+
+// ExclusiveFunctions returns, for each entrypoint, the sorted names of the
+// functions reachable from it, but from no other entrypoint. It's populated
+// by Compile.
+func (c *Compiler) ExclusiveFunctions() map[string][]string {
+	ret := make(map[string][]string, len(c.exclusiveFuncs))
+	for ep, idxs := range c.exclusiveFuncs {
+		names := make([]string, 0, len(idxs))
+		for _, idx := range idxs {
+			names = append(names, c.funcName(idx))
+		}
+		sort.Strings(names)
+		ret[ep] = names
+	}
+	return ret
+}
+
+// computeExclusiveFuncs determines the functions reachable from exactly one
+// entrypoint, using the call graph built when removing unused code.
+func (c *Compiler) computeExclusiveFuncs() {
+	count := map[uint32]int{}
+	reachable := make(map[string]map[uint32]struct{}, len(c.entrypointCallees))
+	for ep, callees := range c.entrypointCallees {
+		keep := map[uint32]struct{}{}
+		for _, callee := range callees {
+			reach(c.callGraph, keep, callee)
+		}
+		for idx := range keep {
+			count[idx]++
+		}
+		reachable[ep] = keep
+	}
+
+	c.exclusiveFuncs = make(map[string][]uint32, len(reachable))
+	for ep, keep := range reachable {
+		idxs := []uint32{}
+		for idx := range keep {
+			if count[idx] == 1 {
+				idxs = append(idxs, idx)
+			}
+		}
+		sort.Slice(idxs, func(i, j int) bool { return idxs[i] < idxs[j] })
+		c.exclusiveFuncs[ep] = idxs
+	}
+}
+
+// applyEntrypointPasses runs the entrypoint-specific instruction passes.
+func (c *Compiler) applyEntrypointPasses() error {
+	c.computeExclusiveFuncs()
+	for ep, ps := range c.entrypointPasses {
+		idxs, ok := c.exclusiveFuncs[ep]
+		if !ok {
+			return fmt.Errorf("instruction passes for unknown entrypoint %q", ep)
+		}
+		exclusive := make(map[uint32]struct{}, len(idxs))
+		for _, idx := range idxs {
+			exclusive[idx] = struct{}{}
+		}
+		for _, f := range c.funcsCode {
+			if _, ok := exclusive[c.funcs[f.name]]; !ok {
+				continue
+			}
+			for _, p := range ps {
+				f.code.Func.Expr.Instrs = p(f.code.Func.Expr.Instrs)
+			}
+		}
+	}
+	return nil
+}
+
+// funcName returns the name of the function at index idx, as recorded when
+// the module was initialized and the policy's functions were declared.
+func (c *Compiler) funcName(idx uint32) string {
+	if c.funcNames == nil || len(c.funcNames) != len(c.funcs) {
+		c.funcNames = make(map[uint32]string, len(c.funcs))
+		for name, i := range c.funcs {
+			c.funcNames[i] = name
+		}
+	}
+	if name, ok := c.funcNames[idx]; ok {
+		return name
+	}
+	return fmt.Sprintf("func[%d]", idx)
+}
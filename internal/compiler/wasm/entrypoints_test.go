@@ -0,0 +1,97 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/ir"
+)
+
+func planModules(t testing.TB, module string, qs ...planner.QuerySet) *ir.Policy {
+	t.Helper()
+	c := ast.NewCompiler()
+	c.Compile(map[string]*ast.Module{"test.rego": ast.MustParseModule(module)})
+	if c.Failed() {
+		t.Fatal(c.Errors)
+	}
+	modules := make([]*ast.Module, 0, len(c.Modules))
+	for _, m := range c.Modules {
+		modules = append(modules, m)
+	}
+	policy, err := planner.New().
+		WithQueries(qs).
+		WithModules(modules).
+		WithBuiltinDecls(ast.BuiltinMap).
+		Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+const overlappingEntrypoints = `package test
+p { r }
+q { r; s }
+r { input.x = 1 }
+s { input.y = 1 }
+`
+
+func TestExclusiveFunctions(t *testing.T) {
+	policy := planModules(t, overlappingEntrypoints,
+		planner.QuerySet{Name: "a", Queries: []ast.Body{ast.MustParseBody(`data.test.p = x`)}},
+		planner.QuerySet{Name: "b", Queries: []ast.Body{ast.MustParseBody(`data.test.q = x`)}},
+	)
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	act := map[string][]string{}
+	for ep, fns := range c.ExclusiveFunctions() {
+		act[ep] = []string{}
+		for _, fn := range fns {
+			if strings.HasPrefix(fn, "g0.") { // only consider compiled functions
+				act[ep] = append(act[ep], fn)
+			}
+		}
+	}
+	exp := map[string][]string{
+		"a": {"g0.data.test.p"},
+		"b": {"g0.data.test.q", "g0.data.test.s"},
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
+
+func TestEntrypointPasses(t *testing.T) {
+	policy := planModules(t, overlappingEntrypoints,
+		planner.QuerySet{Name: "a", Queries: []ast.Body{ast.MustParseBody(`data.test.p = x`)}},
+		planner.QuerySet{Name: "b", Queries: []ast.Body{ast.MustParseBody(`data.test.q = x`)}},
+	)
+	var n int
+	mark := func(is []instruction.Instruction) []instruction.Instruction {
+		n++
+		return is
+	}
+	c := New().WithPolicy(policy).WithEntrypointPasses("b", mark)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 { // g0.data.test.q and g0.data.test.s
+		t.Errorf("expected pass to run on 2 functions, ran on %d", n)
+	}
+
+	_, err := New().WithPolicy(policy).WithEntrypointPasses("c", mark).Compile()
+	if err == nil || err.Error() != `instruction passes for unknown entrypoint "c"` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// WithRemovedExports drops the named function exports from the module.
+// Functions that were only reachable through them are removed along with
+// the rest of the unused code.
+func (c *Compiler) WithRemovedExports(names ...string) *Compiler {
+	c.removedExports = append(c.removedExports, names...)
+	return c
+}
+
+// WithKeptExports drops all function exports but the named ones from the
+// module, like WithRemovedExports does for the named ones: a module only
+// used for a single decision can keep just what that needs. Other exports,
+// like the memory, are kept.
+func (c *Compiler) WithKeptExports(names ...string) *Compiler {
+	c.keptExports = append(c.keptExports, names...)
+	return c
+}
+
+// removeExports drops the requested exports, the ones not in the kept
+// exports, if any, and, for minimal modules, all non-ABI function exports.
+// It runs before removeUnusedCode, so that reachability is computed without
+// them.
+func (c *Compiler) removeExports() error {
+	if len(c.removedExports) == 0 && c.keptExports == nil && !c.minimal {
+		return nil
+	}
+	remove := make(map[string]struct{}, len(c.removedExports))
+	for _, name := range c.removedExports {
+		remove[name] = struct{}{}
+	}
+	if c.keptExports != nil {
+		keep := make(map[string]struct{}, len(c.keptExports))
+		for _, name := range c.keptExports {
+			keep[name] = struct{}{}
+		}
+		for _, exp := range c.module.Export.Exports {
+			if exp.Descriptor.Type != module.FunctionExportType {
+				continue
+			}
+			if _, ok := keep[exp.Name]; ok {
+				delete(keep, exp.Name)
+			} else {
+				remove[exp.Name] = struct{}{}
+			}
+		}
+		for _, name := range c.keptExports {
+			if _, ok := keep[name]; ok {
+				return fmt.Errorf("keep export: unknown function export %q", name)
+			}
+		}
+	}
+	if c.minimal {
+		for _, exp := range c.module.Export.Exports {
+			if _, ok := abiExports[exp.Name]; !ok && exp.Descriptor.Type == module.FunctionExportType {
+				remove[exp.Name] = struct{}{}
+			}
+		}
+	}
+
+	found := map[string]struct{}{}
+	exports := c.module.Export.Exports[:0]
+	for _, exp := range c.module.Export.Exports {
+		if _, ok := remove[exp.Name]; ok && exp.Descriptor.Type == module.FunctionExportType {
+			c.debug.Printf("removing export %s (%d)", exp.Name, exp.Descriptor.Index)
+			found[exp.Name] = struct{}{}
+			continue
+		}
+		exports = append(exports, exp)
+	}
+	for _, name := range c.removedExports {
+		if _, ok := found[name]; !ok {
+			return fmt.Errorf("remove export: unknown function export %q", name)
+		}
+	}
+	c.module.Export.Exports = exports
+	return nil
+}
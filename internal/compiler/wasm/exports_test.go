@@ -0,0 +1,117 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+func TestRemovedExports(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+
+	// opa_value_parse is exported, and called from opa_eval only
+	for _, tc := range []struct {
+		note    string
+		removed []string
+		pruned  bool
+	}{
+		{note: "all exports kept"},
+		{note: "still called", removed: []string{"opa_value_parse"}},
+		{note: "caller removed", removed: []string{"opa_eval", "opa_value_parse"}, pruned: true},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			c := New().WithPolicy(policy).WithRemovedExports(tc.removed...)
+			mod, err := c.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, exp := range mod.Export.Exports {
+				for _, name := range tc.removed {
+					if exp.Name == name {
+						t.Errorf("expected export %s to be removed", name)
+					}
+				}
+			}
+
+			if stubbed := isStubbed(c, mod, "opa_value_parse"); stubbed != tc.pruned {
+				t.Errorf("expected opa_value_parse pruned: %v, got %v", tc.pruned, stubbed)
+			}
+		})
+	}
+}
+
+// isStubbed returns true if the named function's body is only unreachable.
+func isStubbed(c *Compiler, mod *module.Module, name string) bool {
+	idx := c.function(name)
+	seg := mod.Code.Segments[int(idx)-c.functionImportCount()]
+	entry, err := encoding.ReadCodeEntry(bytes.NewReader(seg.Code))
+	return err == nil && reflect.DeepEqual(entry.Func.Expr.Instrs, []instruction.Instruction{instruction.Unreachable{}})
+}
+
+func TestKeptExports(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// of opa_eval, opa_value_add_path and opa_value_remove_path, only
+	// opa_eval is kept: the others are called from nowhere else
+	c := New().WithPolicy(policy).WithKeptExports("opa_eval")
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var funcs []string
+	var memory bool
+	for _, exp := range mod.Export.Exports {
+		switch exp.Descriptor.Type {
+		case module.FunctionExportType:
+			funcs = append(funcs, exp.Name)
+		case module.MemoryExportType:
+			memory = true
+		}
+	}
+	if exp := []string{"opa_eval"}; !reflect.DeepEqual(exp, funcs) {
+		t.Errorf("expected function exports %v, got %v", exp, funcs)
+	}
+	if !memory {
+		t.Error("expected memory export to be kept")
+	}
+	for name, exp := range map[string]bool{
+		"opa_eval":              false,
+		"opa_value_add_path":    true,
+		"opa_value_remove_path": true,
+	} {
+		if stubbed := isStubbed(c, mod, name); stubbed != exp {
+			t.Errorf("expected %s pruned: %v, got %v", name, exp, stubbed)
+		}
+	}
+
+	_, err = New().WithPolicy(policy).WithKeptExports("opa_eval", "opa_nope").Compile()
+	if err == nil || err.Error() != `keep export: unknown function export "opa_nope"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRemovedExportsUnknown(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	_, err := New().WithPolicy(policy).WithRemovedExports("opa_nope").Compile()
+	if err == nil || err.Error() != `remove export: unknown function export "opa_nope"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// Feature is a WebAssembly extension of the 1.0 (MVP) spec that the
+// compiled module may depend on.
+type Feature string
+
+// The features the compiler can make use of.
+const (
+	BulkMemory Feature = "bulk-memory"
+	TailCall   Feature = "tail-call"
+)
+
+// WithFeatures declares the features supported by the target runtime. They
+// are enabled for wasm-opt, too: --enable-<feature> is added to its
+// arguments.
+func (c *Compiler) WithFeatures(fs ...Feature) *Compiler {
+	if c.features == nil {
+		c.features = map[Feature]struct{}{}
+	}
+	for _, f := range fs {
+		c.features[f] = struct{}{}
+	}
+	return c
+}
+
+func (c *Compiler) hasFeature(f Feature) bool {
+	_, ok := c.features[f]
+	return ok
+}
+
+// WithPassiveElements toggles emitting the element segments as passive
+// segments, which initialize the table via table.init from the start
+// function, instead of active ones. It requires the BulkMemory feature.
+func (c *Compiler) WithPassiveElements(enabled bool) *Compiler {
+	c.passiveElements = enabled
+	return c
+}
+
+// tableInitFunc is the name of the start function initializing the table
+// from passive element segments.
+const tableInitFunc = "opa_table_init"
+
+// emitPassiveElements turns all active element segments into passive ones,
+// and adds a start function initializing the table from them. An existing
+// start function is called from the new one afterwards.
+func (c *Compiler) emitPassiveElements() error {
+	if !c.passiveElements {
+		return nil
+	}
+	if !c.hasFeature(BulkMemory) {
+		return fmt.Errorf("passive element segments require the %s feature", BulkMemory)
+	}
+
+	var is []instruction.Instruction
+	for i, seg := range c.module.Element.Segments {
+		if seg.Passive {
+			continue
+		}
+		if seg.Index != 0 {
+			return fmt.Errorf("element segment %d: unsupported table %d", i, seg.Index)
+		}
+		if len(seg.Offset.Instrs) != 1 {
+			return fmt.Errorf("element segment %d: unsupported offset expression", i)
+		}
+		is = append(is,
+			seg.Offset.Instrs[0], // destination
+			instruction.I32Const{Value: 0},
+			instruction.I32Const{Value: int32(len(seg.Indices))},
+			instruction.TableInit{Segment: uint32(i), Table: seg.Index},
+			instruction.ElemDrop{Segment: uint32(i)},
+		)
+		c.module.Element.Segments[i] = module.ElementSegment{Indices: seg.Indices, Passive: true}
+	}
+	if len(is) == 0 {
+		return nil
+	}
+	if start := c.module.Start.FuncIndex; start != nil {
+		is = append(is, instruction.Call{Index: *start})
+	}
+
+	var buf bytes.Buffer
+	entry := &module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: is}}}
+	if err := encoding.WriteCodeEntry(&buf, entry); err != nil {
+		return fmt.Errorf("encode %s: %w", tableInitFunc, err)
+	}
+	c.module.Function.TypeIndices = append(c.module.Function.TypeIndices, c.emptyFunctionType())
+	c.module.Code.Segments = append(c.module.Code.Segments, module.RawCodeSegment{Code: buf.Bytes()})
+	idx := uint32(c.functionImportCount() + len(c.module.Function.TypeIndices) - 1)
+	c.module.Names.Functions = append(c.module.Names.Functions, module.NameMap{Index: idx, Name: tableInitFunc})
+	c.funcs[tableInitFunc] = idx
+	c.module.Start.FuncIndex = &idx
+	return nil
+}
+
+// emptyFunctionType returns the index of the type `() -> ()`, which is
+// added if the module has no such type yet.
+func (c *Compiler) emptyFunctionType() uint32 {
+	for i, tpe := range c.module.Type.Functions {
+		if len(tpe.Params) == 0 && len(tpe.Results) == 0 {
+			return uint32(i)
+		}
+	}
+	c.module.Type.Functions = append(c.module.Type.Functions, module.FunctionType{})
+	return uint32(len(c.module.Type.Functions) - 1)
+}
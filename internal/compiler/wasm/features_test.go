@@ -0,0 +1,129 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+)
+
+func TestPassiveElements(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	active, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New().WithPolicy(policy).WithFeatures(BulkMemory).WithPassiveElements(true)
+	passive, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// roundtrip to check the encoding
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, passive); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := encoding.ReadModule(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, act := len(active.Element.Segments), len(mod.Element.Segments); exp != act {
+		t.Fatalf("expected %d element segments, got %d", exp, act)
+	}
+	var exp []instruction.Instruction
+	for i, seg := range mod.Element.Segments {
+		if !seg.Passive {
+			t.Errorf("expected element segment %d to be passive", i)
+		}
+		orig := active.Element.Segments[i]
+		if !reflect.DeepEqual(orig.Indices, seg.Indices) {
+			t.Errorf("element segment %d: expected indices %v, got %v", i, orig.Indices, seg.Indices)
+		}
+		exp = append(exp,
+			orig.Offset.Instrs[0],
+			instruction.I32Const{Value: 0},
+			instruction.I32Const{Value: int32(len(orig.Indices))},
+			instruction.TableInit{Segment: uint32(i)},
+			instruction.ElemDrop{Segment: uint32(i)},
+		)
+	}
+	if active.Start.FuncIndex != nil {
+		exp = append(exp, instruction.Call{Index: *active.Start.FuncIndex})
+	}
+
+	start := mod.Start.FuncIndex
+	if start == nil || *start != c.function(tableInitFunc) {
+		t.Fatalf("expected start function %d, got %v", c.function(tableInitFunc), start)
+	}
+	entry, err := encoding.ReadCodeEntry(bytes.NewReader(mod.Code.Segments[int(*start)-c.functionImportCount()].Code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exp, entry.Func.Expr.Instrs) {
+		t.Errorf("expected start function %v, got %v", exp, entry.Func.Expr.Instrs)
+	}
+	if tpe, ok := c.functionType(*start); !ok || len(tpe.Params) != 0 || len(tpe.Results) != 0 {
+		t.Errorf("expected start function of type () -> (), got %v", tpe)
+	}
+}
+
+func TestPassiveElementsRequireBulkMemory(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	_, err := New().WithPolicy(policy).WithPassiveElements(true).Compile()
+	if err == nil || err.Error() != "passive element segments require the bulk-memory feature" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = New().WithPolicy(policy).WithTargetProfile("wazero").WithPassiveElements(true).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFeatureWasmOptFlags(t *testing.T) {
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "")
+	for _, tc := range []struct {
+		note     string
+		features []Feature
+		args     []string
+		exp      []string
+	}{
+		{note: "no features", exp: []string{"-O2", "--debuginfo"}},
+		{note: "defaults", features: []Feature{TailCall, BulkMemory}, exp: []string{"-O2", "--debuginfo", "--enable-bulk-memory", "--enable-tail-call"}},
+		{note: "already enabled", features: []Feature{BulkMemory}, args: []string{"-Oz", "--enable-bulk-memory"}, exp: []string{"-Oz", "--enable-bulk-memory"}},
+		{note: "disabled", features: []Feature{BulkMemory}, args: []string{"-Oz", "--disable-bulk-memory"}, exp: []string{"-Oz", "--disable-bulk-memory"}},
+		{note: "all features", features: []Feature{TailCall}, args: []string{"--all-features"}, exp: []string{"--all-features"}},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			c := New().WithFeatures(tc.features...)
+			if tc.args != nil {
+				c.WithWasmOptArgs(tc.args...)
+			}
+			opts, err := c.optimizeOptions(OptimizeOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exp := [][]string{tc.exp}; !reflect.DeepEqual(exp, opts.WasmOptPasses) {
+				t.Errorf("expected passes %q, got %q", exp, opts.WasmOptPasses)
+			}
+			if tc.args != nil && !reflect.DeepEqual(tc.args, c.woptArgs) {
+				t.Errorf("expected arguments set unchanged, got %q", c.woptArgs)
+			}
+		})
+	}
+}
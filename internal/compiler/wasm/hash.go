@@ -0,0 +1,25 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+)
+
+// ModuleHash returns the hex-encoded SHA-256 of the encoded module. Compiling
+// the same policy with the same options yields the same hash, so builds can
+// use it to assert they're reproducible. It returns "" if the module can't
+// be encoded.
+func (c *Compiler) ModuleHash() string {
+	h := sha256.New()
+	if err := encoding.WriteModule(h, c.module); err != nil {
+		c.debug.Printf("hash module: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
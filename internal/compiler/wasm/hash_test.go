@@ -0,0 +1,45 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+)
+
+func TestModuleHash(t *testing.T) {
+	hash := func(module string) string {
+		t.Helper()
+		policy := planModules(t, module, planner.QuerySet{
+			Name:    "test",
+			Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+		})
+		c := New().WithPolicy(policy).WithCompactUnusedCode(true).WithPruneImports(true)
+		if _, err := c.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		h := c.ModuleHash()
+		if len(h) != 64 {
+			t.Fatalf("expected hex-encoded SHA-256, got %q", h)
+		}
+		return h
+	}
+
+	const module = `package test
+p { input.x == 1 }
+q[x] { x := input.y[_] }
+r := re_match("^a", input.z)`
+	first := hash(module)
+	for i := 0; i < 5; i++ {
+		if h := hash(module); h != first {
+			t.Fatalf("expected hash %s, got %s", first, h)
+		}
+	}
+	if h := hash(module + "\ns := 1"); h == first {
+		t.Errorf("expected different hash for different policy, got %s", h)
+	}
+}
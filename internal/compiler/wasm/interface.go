@@ -0,0 +1,173 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// Interface is the public interface of a module: its function exports, and
+// all of its imports.
+type Interface struct {
+	Exports []Signature `json:"exports"`
+	Imports []Import    `json:"imports"`
+}
+
+// Import is an import of a module. Params and Results are only set for
+// function imports.
+type Import struct {
+	Module  string   `json:"module"`
+	Name    string   `json:"name"`
+	Kind    string   `json:"kind"` // "func", "table", "memory" or "global"
+	Params  []string `json:"params,omitempty"`
+	Results []string `json:"results,omitempty"`
+}
+
+func (i Import) String() string {
+	if i.Kind != module.FunctionImportType.String() {
+		return fmt.Sprintf("import %s.%s: %s", i.Module, i.Name, i.Kind)
+	}
+	return fmt.Sprintf("import %s.%s: func (%s) -> (%s)", i.Module, i.Name, strings.Join(i.Params, ", "), strings.Join(i.Results, ", "))
+}
+
+// WithExpectedInterface sets the interface the compiled module must have.
+// If the module's interface differs, compilation fails with an error listing
+// the expected items that are missing ("-") and the unexpected ones ("+").
+// The order of exports and imports does not matter.
+func (c *Compiler) WithExpectedInterface(iface *Interface) *Compiler {
+	c.iface = iface
+	return c
+}
+
+// ModuleInterface returns the interface of the module: its function exports
+// as returned by ExportSignatures, and its imports, sorted by module and name.
+func (c *Compiler) ModuleInterface() (*Interface, error) {
+	exps, err := c.ExportSignatures()
+	if err != nil {
+		return nil, err
+	}
+	var imps []Import
+	for _, imp := range c.module.Import.Imports {
+		i := Import{
+			Module: imp.Module,
+			Name:   imp.Name,
+			Kind:   imp.Descriptor.Kind().String(),
+		}
+		if fi, ok := imp.Descriptor.(module.FunctionImport); ok {
+			if int(fi.Func) >= len(c.module.Type.Functions) {
+				return nil, fmt.Errorf("import %s.%s: type %d not found", imp.Module, imp.Name, fi.Func)
+			}
+			i.Params, i.Results = typeStrings(c.module.Type.Functions[fi.Func])
+		}
+		imps = append(imps, i)
+	}
+	sort.Slice(imps, func(i, j int) bool {
+		if imps[i].Module != imps[j].Module {
+			return imps[i].Module < imps[j].Module
+		}
+		return imps[i].Name < imps[j].Name
+	})
+	return &Interface{Exports: exps, Imports: imps}, nil
+}
+
+// ImportInfo is a function import the host must provide.
+type ImportInfo struct {
+	Module  string   `json:"module"`
+	Name    string   `json:"name"`
+	Params  []string `json:"params"`
+	Results []string `json:"results"`
+}
+
+// RequiredImports returns the function imports of the module, in the order
+// of its import section. Called after Compile, they reflect all pruning of
+// unused imports, so they are exactly what the host has to provide.
+func (c *Compiler) RequiredImports() []ImportInfo {
+	var ret []ImportInfo
+	for _, imp := range c.module.Import.Imports {
+		fi, ok := imp.Descriptor.(module.FunctionImport)
+		if !ok {
+			continue
+		}
+		info := ImportInfo{Module: imp.Module, Name: imp.Name}
+		if int(fi.Func) < len(c.module.Type.Functions) {
+			info.Params, info.Results = typeStrings(c.module.Type.Functions[fi.Func])
+		}
+		ret = append(ret, info)
+	}
+	return ret
+}
+
+// typeStrings returns the names of the parameter and result types of tpe.
+func typeStrings(tpe module.FunctionType) ([]string, []string) {
+	params := make([]string, len(tpe.Params))
+	results := make([]string, len(tpe.Results))
+	for i, p := range tpe.Params {
+		params[i] = p.String()
+	}
+	for i, r := range tpe.Results {
+		results[i] = r.String()
+	}
+	return params, results
+}
+
+// checkInterface compares the module's interface against the expected one,
+// if any.
+func (c *Compiler) checkInterface() error {
+	if c.iface == nil {
+		return nil
+	}
+	actual, err := c.ModuleInterface()
+	if err != nil {
+		return err
+	}
+	if diff := interfaceDiff(c.iface, actual); len(diff) > 0 {
+		return fmt.Errorf("module interface mismatch:\n%s", strings.Join(diff, "\n"))
+	}
+	return nil
+}
+
+// interfaceDiff returns the sorted lines describing the differences between
+// the expected and actual interface, or nil if there are none.
+func interfaceDiff(expected, actual *Interface) []string {
+	items := func(iface *Interface) map[string]struct{} {
+		ret := make(map[string]struct{}, len(iface.Exports)+len(iface.Imports))
+		for _, e := range iface.Exports {
+			ret[e.String()] = struct{}{}
+		}
+		for _, i := range iface.Imports {
+			ret[i.String()] = struct{}{}
+		}
+		return ret
+	}
+	exp, act := items(expected), items(actual)
+
+	var diff []string
+	for item := range exp {
+		if _, ok := act[item]; !ok {
+			diff = append(diff, "- "+item)
+		}
+	}
+	for item := range act {
+		if _, ok := exp[item]; !ok {
+			diff = append(diff, "+ "+item)
+		}
+	}
+	// Sort by export or import name, with expected items first, so that a
+	// changed signature shows up as a pair of adjacent lines.
+	name := func(line string) string {
+		return strings.SplitN(line[2:], ":", 2)[0]
+	}
+	sort.Slice(diff, func(i, j int) bool {
+		if ni, nj := name(diff[i]), name(diff[j]); ni != nj {
+			return ni < nj
+		}
+		return diff[i][0] == '-' && diff[j][0] == '+'
+	})
+	return diff
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+func TestExpectedInterface(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	iface, err := c.ModuleInterface()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("match", func(t *testing.T) {
+		if _, err := New().WithPolicy(policy).WithExpectedInterface(iface).Compile(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		exp := &Interface{}
+		for _, sig := range iface.Exports {
+			switch sig.Name {
+			case "eval":
+				exp.Exports = append(exp.Exports, Signature{Name: "eval", Params: []string{"i32", "i32"}, Results: []string{"i32"}})
+			case "opa_malloc":
+			default:
+				exp.Exports = append(exp.Exports, sig)
+			}
+		}
+		for _, imp := range iface.Imports {
+			if imp.Name != "opa_abort" {
+				exp.Imports = append(exp.Imports, imp)
+			}
+		}
+		exp.Imports = append(exp.Imports, Import{Module: "env", Name: "opa_foo", Kind: "global"})
+
+		_, err := New().WithPolicy(policy).WithExpectedInterface(exp).Compile()
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		expMsg := `module interface mismatch:
+- export eval: (i32, i32) -> (i32)
++ export eval: (i32) -> (i32)
++ export opa_malloc: (i32) -> (i32)
++ import env.opa_abort: func (i32) -> ()
+- import env.opa_foo: global`
+		if err.Error() != expMsg {
+			t.Errorf("expected error:\n%s\ngot:\n%s", expMsg, err)
+		}
+	})
+}
+
+func TestRequiredImports(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+
+	required := func(c *Compiler) []ImportInfo {
+		t.Helper()
+		mod, err := c.WithPolicy(policy).Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exp []ImportInfo
+		for _, imp := range mod.Import.Imports {
+			fi, ok := imp.Descriptor.(module.FunctionImport)
+			if !ok {
+				continue
+			}
+			params, results := typeStrings(mod.Type.Functions[fi.Func])
+			exp = append(exp, ImportInfo{Module: imp.Module, Name: imp.Name, Params: params, Results: results})
+		}
+		if act := c.RequiredImports(); !reflect.DeepEqual(exp, act) {
+			t.Fatalf("expected %v, got %v", exp, act)
+		}
+		return exp
+	}
+
+	all := required(New())
+	pruned := required(New().WithCompactUnusedCode(true).WithPruneImports(true))
+	if len(pruned) >= len(all) {
+		t.Errorf("expected fewer imports after pruning, got %d (before: %d)", len(pruned), len(all))
+	}
+	exp := ImportInfo{Module: "env", Name: "opa_abort", Params: []string{"i32"}, Results: []string{}}
+	for _, imp := range pruned {
+		if imp.Name == exp.Name && !reflect.DeepEqual(imp, exp) {
+			t.Errorf("expected %v, got %v", exp, imp)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+)
+
+// WithRemoveUnusedLocals toggles the removal of locals that are declared,
+// but never read or written, from the compiled functions. The remaining
+// locals are renumbered.
+func (c *Compiler) WithRemoveUnusedLocals(enabled bool) *Compiler {
+	c.removeLocals = enabled
+	return c
+}
+
+// UnusedLocals returns, keyed by function name, the indices of declared
+// locals that are never referenced. It's populated by Compile, and reflects
+// the functions before any locals have been removed.
+func (c *Compiler) UnusedLocals() map[string][]uint32 {
+	return c.unusedLocals
+}
+
+// findUnusedLocals records the unused locals of each compiled function, and
+// removes them if requested.
+func (c *Compiler) findUnusedLocals() error {
+	c.unusedLocals = map[string][]uint32{}
+	for _, f := range c.funcsCode {
+		tpe, ok := c.functionType(c.function(f.name))
+		if !ok {
+			return fmt.Errorf("func %s: type not found", f.name)
+		}
+		params := uint32(len(tpe.Params))
+		used := map[uint32]struct{}{}
+		usedLocals(f.code.Func.Expr.Instrs, used)
+
+		var unused []uint32
+		var n uint32
+		for _, decl := range f.code.Func.Locals {
+			n += decl.Count
+		}
+		for i := params; i < params+n; i++ {
+			if _, ok := used[i]; !ok {
+				unused = append(unused, i)
+			}
+		}
+		if len(unused) == 0 {
+			continue
+		}
+		c.unusedLocals[f.name] = unused
+		c.debug.Printf("func %s: unused locals %v", f.name, unused)
+
+		if c.removeLocals || c.minimal {
+			removeLocals(f.code, params, unused)
+		}
+	}
+	return nil
+}
+
+func usedLocals(is []instruction.Instruction, used map[uint32]struct{}) {
+	for _, i := range is {
+		switch i := i.(type) {
+		case instruction.GetLocal:
+			used[i.Index] = struct{}{}
+		case instruction.SetLocal:
+			used[i.Index] = struct{}{}
+		case instruction.TeeLocal:
+			used[i.Index] = struct{}{}
+		case instruction.StructuredInstruction:
+			usedLocals(i.Instructions(), used)
+		}
+	}
+}
+
+// removeLocals drops the (sorted) unused locals from the entry's declarations,
+// and renumbers all references to the locals following them.
+func removeLocals(entry *module.CodeEntry, params uint32, unused []uint32) {
+	var tpes []types.ValueType
+	for _, decl := range entry.Func.Locals {
+		for j := uint32(0); j < decl.Count; j++ {
+			tpes = append(tpes, decl.Type)
+		}
+	}
+
+	remap := make(map[uint32]uint32, len(tpes))
+	var decls []module.LocalDeclaration
+	next := params
+	for i, tpe := range tpes {
+		idx := params + uint32(i)
+		if j := sort.Search(len(unused), func(j int) bool { return unused[j] >= idx }); j < len(unused) && unused[j] == idx {
+			continue
+		}
+		remap[idx] = next
+		next++
+		if l := len(decls); l > 0 && decls[l-1].Type == tpe {
+			decls[l-1].Count++
+		} else {
+			decls = append(decls, module.LocalDeclaration{Count: 1, Type: tpe})
+		}
+	}
+
+	renumber := Nested(func(is []instruction.Instruction) []instruction.Instruction {
+		for j, i := range is {
+			switch i := i.(type) {
+			case instruction.GetLocal:
+				if n, ok := remap[i.Index]; ok {
+					is[j] = instruction.GetLocal{Index: n}
+				}
+			case instruction.SetLocal:
+				if n, ok := remap[i.Index]; ok {
+					is[j] = instruction.SetLocal{Index: n}
+				}
+			case instruction.TeeLocal:
+				if n, ok := remap[i.Index]; ok {
+					is[j] = instruction.TeeLocal{Index: n}
+				}
+			}
+		}
+		return is
+	})
+	entry.Func.Expr.Instrs = renumber(entry.Func.Expr.Instrs)
+	entry.Func.Locals = decls
+}
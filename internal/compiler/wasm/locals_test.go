@@ -0,0 +1,107 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+)
+
+func localsTestCompiler() *Compiler {
+	c := New()
+	c.module = &module.Module{
+		Type: module.TypeSection{Functions: []module.FunctionType{
+			{Params: []types.ValueType{types.I32}, Results: []types.ValueType{types.I32}},
+		}},
+		Function: module.FunctionSection{TypeIndices: []uint32{0}},
+	}
+	c.funcs = map[string]uint32{"f": 0}
+	c.funcsCode = []funcCode{{name: "f", code: &module.CodeEntry{Func: module.Function{
+		Locals: []module.LocalDeclaration{
+			{Count: 2, Type: types.I32},
+			{Count: 2, Type: types.I64},
+		},
+		Expr: module.Expr{Instrs: []instruction.Instruction{
+			instruction.I64Const{Value: 1},
+			instruction.SetLocal{Index: 4},
+			instruction.Block{Instrs: []instruction.Instruction{
+				instruction.GetLocal{Index: 0},
+				instruction.TeeLocal{Index: 2},
+				instruction.Drop{},
+			}},
+			instruction.GetLocal{Index: 2},
+		}},
+	}}}}
+	return c
+}
+
+func TestUnusedLocals(t *testing.T) {
+	c := localsTestCompiler()
+	if err := c.findUnusedLocals(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := map[string][]uint32{"f": {1, 3}}, c.UnusedLocals(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+	// nothing removed
+	if exp, act := 2, len(c.funcsCode[0].code.Func.Locals); exp != act {
+		t.Errorf("expected %d local declarations, got %d", exp, act)
+	}
+}
+
+func TestRemoveUnusedLocals(t *testing.T) {
+	c := localsTestCompiler().WithRemoveUnusedLocals(true)
+	if err := c.findUnusedLocals(); err != nil {
+		t.Fatal(err)
+	}
+	f := c.funcsCode[0].code.Func
+	expLocals := []module.LocalDeclaration{
+		{Count: 1, Type: types.I32},
+		{Count: 1, Type: types.I64},
+	}
+	if !reflect.DeepEqual(expLocals, f.Locals) {
+		t.Errorf("expected locals %v, got %v", expLocals, f.Locals)
+	}
+	expInstrs := []instruction.Instruction{
+		instruction.I64Const{Value: 1},
+		instruction.SetLocal{Index: 2},
+		instruction.Block{Instrs: []instruction.Instruction{
+			instruction.GetLocal{Index: 0},
+			instruction.TeeLocal{Index: 1},
+			instruction.Drop{},
+		}},
+		instruction.GetLocal{Index: 1},
+	}
+	if !reflect.DeepEqual(expInstrs, f.Expr.Instrs) {
+		t.Errorf("expected instructions %v, got %v", expInstrs, f.Expr.Instrs)
+	}
+}
+
+func TestRemoveUnusedLocalsCompile(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1; x = input.bar; x = 2`)},
+	})
+	c := New().WithPolicy(policy).WithRemoveUnusedLocals(true)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.UnusedLocals()) == 0 {
+		t.Fatal("expected unused locals")
+	}
+	// a second run finds nothing left to remove
+	if err := c.findUnusedLocals(); err != nil {
+		t.Fatal(err)
+	}
+	if act := c.UnusedLocals(); len(act) != 0 {
+		t.Errorf("expected no unused locals, got %v", act)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"time"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+)
+
+// PassMetrics describes a single run of an optimization pass: removing
+// unused code, or running wasm-opt.
+type PassMetrics struct {
+	Name       string        `json:"name"`        // "remove-unused-code", "wasm-opt", or "wasm-opt-N" for several passes
+	Duration   time.Duration `json:"duration_ns"` // wall-clock time taken
+	SizeBefore int           `json:"size_before"` // encoded module size (in bytes) before the pass
+	SizeAfter  int           `json:"size_after"`  // encoded module size (in bytes) after the pass
+}
+
+// Saved returns the number of bytes the pass removed from the module.
+func (m PassMetrics) Saved() int {
+	return m.SizeBefore - m.SizeAfter
+}
+
+// PassMetrics returns the metrics of the optimization passes run so far, in
+// order. wasm-opt is only included if it was run. Note that the sizes
+// measured before the compiled functions are emitted don't include them.
+func (c *Compiler) PassMetrics() []PassMetrics {
+	return c.passMetrics
+}
+
+// measure returns a stage running pass, and recording its metrics.
+func (c *Compiler) measure(name string, pass func() error) func() error {
+	return func() error {
+		before, err := encoding.EncodedSize(c.module)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		if err := pass(); err != nil {
+			return err
+		}
+		d := time.Since(start)
+		after, err := encoding.EncodedSize(c.module)
+		if err != nil {
+			return err
+		}
+		c.recordPass(PassMetrics{Name: name, Duration: d, SizeBefore: before, SizeAfter: after})
+		return nil
+	}
+}
+
+func (c *Compiler) recordPass(m PassMetrics) {
+	c.debug.Printf("pass %s took %v: %d -> %d bytes", m.Name, m.Duration, m.SizeBefore, m.SizeAfter)
+	c.passMetrics = append(c.passMetrics, m)
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+)
+
+func TestPassMetrics(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	ms := c.PassMetrics()
+	if len(ms) != 1 || ms[0].Name != "remove-unused-code" {
+		t.Fatalf("expected metrics of removing unused code only, got %v", ms)
+	}
+	if ms[0].Saved() <= 0 {
+		t.Errorf("expected removing unused code to save bytes, got %v", ms[0])
+	}
+
+	fakeWasmOpt(t, "exec cat")
+	c = New().WithPolicy(policy)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms = c.PassMetrics()
+	if len(ms) != 2 || ms[1].Name != "wasm-opt" {
+		t.Fatalf("expected metrics of wasm-opt, got %v", ms)
+	}
+	size, err := encoding.EncodedSize(mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := ms[1]; m.SizeBefore != m.SizeAfter || m.SizeAfter < size || m.Duration <= 0 {
+		t.Errorf("expected size of module passed through, got %v (final module: %d bytes)", m, size)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+// abiExports are the exported functions hosts use to interact with the
+// module, as documented for the Wasm ABI.
+var abiExports = map[string]struct{}{
+	"eval":                        {},
+	"builtins":                    {},
+	"entrypoints":                 {},
+	"opa_eval":                    {},
+	"opa_eval_ctx_new":            {},
+	"opa_eval_ctx_set_input":      {},
+	"opa_eval_ctx_set_data":       {},
+	"opa_eval_ctx_set_entrypoint": {},
+	"opa_eval_ctx_get_result":     {},
+	"opa_malloc":                  {},
+	"opa_free":                    {},
+	"opa_heap_ptr_get":            {},
+	"opa_heap_ptr_set":            {},
+	"opa_json_parse":              {},
+	"opa_value_parse":             {},
+	"opa_json_dump":               {},
+	"opa_value_dump":              {},
+	"opa_value_add_path":          {},
+	"opa_value_remove_path":       {},
+}
+
+// WithMinimal toggles producing the smallest module that is still usable
+// via the Wasm ABI. It implies
+//
+//   - stripping the name section, and the start section if it has no effect,
+//   - removing all custom sections, except for those explicitly requested,
+//   - removing function exports that aren't part of the ABI,
+//   - removing unused locals, and simplifying local accesses,
+//   - merging duplicate functions, see WithDedupFunctions,
+//   - removing unused globals and table entries, see WithRemoveUnusedData,
+//   - shrinking the table, and setting its maximum size to its initial size,
+//     see WithShrinkTable,
+//   - removing unused functions altogether, see WithCompactUnusedCode,
+//   - running wasm-opt with -Oz (if opted into, and no other arguments are set).
+//
+// Function types are always deduplicated, and the planner interns the
+// policy's strings, so there's nothing to deduplicate in the data segments;
+// wasm-opt's memory packing shrinks them further. The memory is imported:
+// its limits are the host's, and the heap needs to grow at runtime. The
+// imports are kept as they are, see WithPruneImports, as hosts provide the
+// ABI's functions regardless.
+func (c *Compiler) WithMinimal(enabled bool) *Compiler {
+	c.minimal = enabled
+	return c
+}
+
+// dedupEnabled returns true if duplicate functions are merged.
+func (c *Compiler) dedupEnabled() bool {
+	return c.dedupFuncs || c.minimal
+}
+
+// dataRemoved returns true if unused globals and table entries are removed.
+func (c *Compiler) dataRemoved() bool {
+	return c.removeData || c.minimal
+}
+
+// tableShrunk returns true if the table only keeps the entries reachable via
+// call_indirect.
+func (c *Compiler) tableShrunk() bool {
+	return c.shrinkTable || c.minimal
+}
+
+// compacting returns true if unused functions are removed altogether.
+func (c *Compiler) compacting() bool {
+	return c.compact || c.minimal
+}
+
+// stripCustomSections removes all custom sections but those requested.
+func (c *Compiler) stripCustomSections() error {
+	if !c.minimal {
+		return nil
+	}
+	keep := map[string]bool{
+		EntrypointTableSection: c.entrypointTable,
+		BuildInfoSection:       c.buildInfo,
+		AnnotationsSection:     len(c.annotations) > 0,
+		ProducersSection:       c.producers,
+	}
+	customs := c.module.Customs[:0]
+	for _, s := range c.module.Customs {
+		if keep[s.Name] {
+			customs = append(customs, s)
+		} else {
+			c.debug.Printf("removing custom section %s", s.Name)
+		}
+	}
+	c.module.Customs = customs
+	return nil
+}
+
+// tightenTable sets the maximum size of the tables to their initial size:
+// the compiled code never grows them.
+func (c *Compiler) tightenTable() error {
+	if !c.minimal {
+		return nil
+	}
+	for i := range c.module.Table.Tables {
+		min := c.module.Table.Tables[i].Lim.Min
+		c.module.Table.Tables[i].Lim.Max = &min
+	}
+	return nil
+}
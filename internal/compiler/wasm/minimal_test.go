@@ -0,0 +1,83 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+func TestMinimal(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defSize, err := encoding.EncodedSize(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New().WithPolicy(policy).WithMinimal(true).WithEntrypointTable(true)
+	min, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	minSize, err := encoding.EncodedSize(min)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: Without wasm-opt, the savings come from the removal of names and
+	// custom sections only.
+	if saved := defSize - minSize; saved < 2000 {
+		t.Errorf("expected minimal module (%d bytes) to be smaller than default (%d bytes)", minSize, defSize)
+	}
+
+	if len(min.Names.Functions) != 0 {
+		t.Error("expected names to be removed")
+	}
+	if len(min.Customs) != 1 || min.Customs[0].Name != EntrypointTableSection {
+		t.Errorf("expected only the requested custom section, got %v", min.Customs)
+	}
+	for _, exp := range min.Export.Exports {
+		if _, ok := abiExports[exp.Name]; !ok && exp.Descriptor.Type == module.FunctionExportType {
+			t.Errorf("unexpected export %s", exp.Name)
+		}
+	}
+	for name := range abiExports {
+		var found bool
+		for _, exp := range min.Export.Exports {
+			found = found || exp.Name == name
+		}
+		if !found {
+			t.Errorf("expected ABI export %s", name)
+		}
+	}
+	for _, tbl := range min.Table.Tables {
+		if tbl.Lim.Max == nil || *tbl.Lim.Max != tbl.Lim.Min {
+			t.Errorf("expected table limits to be tightened, got %v", tbl.Lim)
+		}
+	}
+
+	// unused functions and table entries are removed
+	if exp, act := len(def.Code.Segments), len(min.Code.Segments); act >= exp {
+		t.Errorf("expected fewer than %d functions, got %d", exp, act)
+	}
+	elems := func(m *module.Module) (n int) {
+		for _, seg := range m.Element.Segments {
+			n += len(seg.Indices)
+		}
+		return n
+	}
+	if exp, act := elems(def), elems(min); act >= exp {
+		t.Errorf("expected fewer than %d table entries, got %d", exp, act)
+	}
+}
@@ -1,15 +1,22 @@
 package wasm
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/open-policy-agent/opa/internal/compiler/wasm/opa"
 	"github.com/open-policy-agent/opa/internal/wasm/encoding"
@@ -22,80 +29,612 @@ WARNING: Using EXPERIMENTAL, unsupported wasm-opt optimization.
          It is not supported, and may go away in the future.
 ---------------------------------------------------------------`
 
-// optimizeBinaryen passes the encoded module into wasm-opt, and replaces
-// the compiler's module with the decoding of the process' output.
+// optimizeBinaryen runs wasm-opt as configured via the compiler's options
+// and the environment, see Optimize.
 func (c *Compiler) optimizeBinaryen() error {
-	if os.Getenv("EXPERIMENTAL_WASM_OPT") == "" && os.Getenv("EXPERIMENTAL_WASM_OPT_ARGS") == "" {
-		c.debug.Printf("not opted in, skipping wasm-opt optimization")
-		return nil
+	var opts OptimizeOptions
+	if c.optimizeOpts != nil {
+		opts = *c.optimizeOpts
+	}
+	return c.optimize(c.context(), opts)
+}
+
+// runBinaryen passes the encoded module into wasm-opt, and replaces the
+// compiler's module with the decoding of the process' output. With several
+// passes configured, each one is run on the output of the previous one.
+func (c *Compiler) runBinaryen(ctx context.Context, opts OptimizeOptions, required bool) error {
+	bin, ok := woptFound(opts.WasmOptPath)
+	runner := c.woptRunner
+	if runner != nil {
+		bin, ok = "in-process wasm-opt", true
 	}
-	if !woptFound() {
-		c.debug.Printf("wasm-opt binary not found, skipping optimization")
+	if !ok {
+		if required {
+			return fmt.Errorf("wasm-opt binary %s not found, but optimization is required", bin)
+		}
+		c.debug.Printf("wasm-opt binary %s not found, skipping optimization", bin)
 		return nil
 	}
-	if os.Getenv("EXPERIMENTAL_WASM_OPT") != "silent" { // for benchmarks
-		fmt.Fprintln(os.Stderr, warning)
+	if os.Getenv("EXPERIMENTAL_WASM_OPT") != "silent" && !c.woptWarned { // for benchmarks
+		c.debug.Printf("%s", warning)
+		c.woptWarned = true
 	}
-	args := []string{ // WARNING: flags with typos are ignored!
-		"-O2",
-		"--debuginfo", // don't strip name section
+	passes := opts.WasmOptPasses
+	for _, args := range passes {
+		if err := checkWasmOptArgs(args); err != nil {
+			return err
+		}
 	}
-	// allow overriding the options
-	if env := os.Getenv("EXPERIMENTAL_WASM_OPT_ARGS"); env != "" {
-		args = strings.Split(env, " ")
+
+	parent, timeout := ctx, opts.WasmOptTimeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if runner == nil {
+		if err := c.checkWasmOptVersion(ctx, bin); err != nil {
+			return err
+		}
 	}
 
-	args = append(args, "-o", "-") // always output to stdout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	orig, metrics := c.module, len(c.passMetrics)
+	for i, args := range passes {
+		name := "wasm-opt"
+		if len(passes) > 1 {
+			name = fmt.Sprintf("wasm-opt-%d", i+1)
+		}
+		err := c.runWasmOpt(ctx, bin, runner, args, name)
+		aborted := parent.Err() != nil
+		switch {
+		case err == nil:
+			continue
+		case aborted:
+			err = fmt.Errorf("wasm-opt optimization aborted: %w", parent.Err())
+		case ctx.Err() == context.DeadlineExceeded:
+			err = woptTimeoutError(timeout, opts.timeoutSource)
+		}
+		if len(passes) > 1 {
+			err = fmt.Errorf("%s: %w", name, err)
+		}
+		if c.woptFallback && !aborted {
+			c.debug.Printf("wasm-opt failed, keeping the unoptimized module: %v", err)
+			c.module, c.passMetrics = orig, c.passMetrics[:metrics]
+			return nil
+		}
+		return err
+	}
+	return nil
+}
 
-	wopt := exec.CommandContext(ctx, "wasm-opt", args...)
-	stdin, err := wopt.StdinPipe()
+// WithWasmOptFallback toggles keeping the unoptimized module if wasm-opt
+// fails, e.g. because it's killed for running out of memory, instead of
+// failing the compilation. The failure is logged as debug output. Canceling
+// the compilation still fails it.
+func (c *Compiler) WithWasmOptFallback(enabled bool) *Compiler {
+	c.woptFallback = enabled
+	return c
+}
+
+// runWasmOpt runs a single wasm-opt pass with args, recording its metrics
+// under name. If runner is set, it's used instead of the binary bin.
+func (c *Compiler) runWasmOpt(ctx context.Context, bin string, runner WasmOptRunner, args []string, name string) error {
+	// The module is encoded as it's passed to wasm-opt, so that it's never
+	// held in memory as a whole.
+	size, err := encoding.EncodedSize(c.module)
+	if err != nil {
+		return fmt.Errorf("encode module: %w", err)
+	}
+	write := func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		if err := encoding.WriteModule(bw, c.module); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	var out, stderr []byte
+	start := time.Now()
+	if runner != nil {
+		out, stderr, err = runWasmOptWith(ctx, runner, args, write)
+	} else if est := estimatedSize(c.module); est > woptFileThreshold {
+		c.debug.Printf("estimated module size %d exceeds %d, passing it to wasm-opt via temporary files", est, woptFileThreshold)
+		out, stderr, err = runWasmOptFiles(ctx, bin, args, write)
+	} else {
+		out, stderr, err = runWasmOptPipes(ctx, bin, args, write)
+	}
+	d := time.Since(start)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return woptRunError(err, stderr)
+	}
+	if len(out) == 0 {
+		return woptNoOutputError(args, stderr)
+	}
+
+	if err := c.checkWasmOptOutput(string(stderr)); err != nil {
+		return err
+	}
+	mod, err := encoding.ReadModule(bytes.NewReader(out))
+	if err != nil {
+		return fmt.Errorf("decode module: %w", err)
+	}
+	if n := restoreCustomSections(c.module, mod); n > 0 {
+		c.debug.Printf("restored %d custom sections dropped by wasm-opt", n)
+	}
+	c.module = mod
+	c.recordPass(PassMetrics{Name: name, Duration: d, SizeBefore: size, SizeAfter: len(out)})
+	return c.writeSnapshot(name)
+}
+
+// restoreCustomSections re-attaches the custom sections of orig that are
+// missing in mod, the module returned by wasm-opt, and returns how many.
+// Sections kept by wasm-opt are left as they are.
+func restoreCustomSections(orig, mod *module.Module) int {
+	kept := make(map[string]struct{}, len(mod.Customs))
+	for _, s := range mod.Customs {
+		kept[s.Name] = struct{}{}
+	}
+	var n int
+	for _, s := range orig.Customs {
+		if _, ok := kept[s.Name]; !ok {
+			mod.Customs = append(mod.Customs, s)
+			n++
+		}
+	}
+	return n
+}
+
+// woptRunError describes wasm-opt failing to run, or exiting with a non-zero
+// status: whatever it wrote to stdout is not used.
+func woptRunError(err error, stderr []byte) error {
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		if msg := woptStderr(stderr, ""); msg != "" {
+			return fmt.Errorf("run wasm-opt: %w: %s", err, msg)
+		}
+		return fmt.Errorf("run wasm-opt: %w", err)
+	}
+	return fmt.Errorf("wasm-opt exited with code %d: %s", exit.ExitCode(), woptStderr(stderr, "no output"))
+}
+
+// maxStderrLen is how much of wasm-opt's stderr output is included in
+// errors.
+const maxStderrLen = 2048
+
+// woptStderr returns wasm-opt's stderr output for an error message, or none
+// if there's none. Long output is truncated to its end, where wasm-opt
+// reports why it's failing, following any dumped code.
+func woptStderr(stderr []byte, none string) string {
+	msg := strings.TrimSpace(string(stderr))
+	if msg == "" {
+		return none
+	}
+	if len(msg) > maxStderrLen {
+		msg = fmt.Sprintf("[%d bytes truncated]...%s", len(msg)-maxStderrLen, msg[len(msg)-maxStderrLen:])
+	}
+	return msg
+}
+
+// defaultWasmOptMinVersion is the oldest Binaryen release that is expected
+// to work with the default wasm-opt arguments, unless set otherwise, see
+// WithWasmOptMinVersion.
+const defaultWasmOptMinVersion = 101
+
+// WithWasmOptMinVersion sets the oldest wasm-opt version that is accepted
+// without a warning, zero meaning any version. In strict mode, an older
+// version causes an error.
+func (c *Compiler) WithWasmOptMinVersion(v int) *Compiler {
+	c.woptMinVersion = &v
+	return c
+}
+
+// checkWasmOptVersion logs the version of the wasm-opt binary, and warns if
+// it's older than the minimum version. If the version can't be determined,
+// that is logged, but not treated as an error.
+func (c *Compiler) checkWasmOptVersion(ctx context.Context, bin string) error {
+	v, err := woptVersion(ctx, bin)
+	if err != nil {
+		c.debug.Printf("could not determine wasm-opt version: %v", err)
+		return nil
+	}
+	c.debug.Printf("using wasm-opt %s, version %s", bin, v)
+	min := defaultWasmOptMinVersion
+	if c.woptMinVersion != nil {
+		min = *c.woptMinVersion
+	}
+	n, err := strconv.Atoi(strings.SplitN(v, "-", 2)[0])
 	if err != nil {
-		return fmt.Errorf("get stdin: %w", err)
+		c.debug.Printf("could not parse wasm-opt version %q: %v", v, err)
+		return nil
 	}
-	defer stdin.Close()
+	if n < min {
+		return c.warn("wasm-opt version %d is older than the minimum version %d", n, min)
+	}
+	return nil
+}
+
+// woptVersion returns the version reported by `wasm-opt --version`, e.g.
+// "116" for "wasm-opt version 116 (version_116)".
+func woptVersion(ctx context.Context, bin string) (string, error) {
+	out, err := exec.CommandContext(ctx, bin, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	return parseWasmOptVersion(string(out))
+}
+
+// WasmOptVersion returns the version of the wasm-opt binary the compiler
+// would run, see WithWasmOptPath, e.g. for keying caches of optimized
+// modules.
+func (c *Compiler) WasmOptVersion(ctx context.Context) (string, error) {
+	bin, _ := woptFound(c.wasmOptPath())
+	return woptVersion(ctx, bin)
+}
+
+func parseWasmOptVersion(out string) (string, error) {
+	fields := strings.Fields(out)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "version" {
+			return fields[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("unexpected version output %q", strings.TrimSpace(out))
+}
+
+// woptFileThreshold is the estimated module size (see estimatedSize) above
+// which the module is passed to wasm-opt via temporary files instead of
+// stdin and stdout, so that neither the input nor the output has to be
+// buffered in a pipe.
+var woptFileThreshold = 16 << 20
+
+// estimatedSize returns a lower bound of the encoded size of m, for choosing
+// how to pass it to wasm-opt without encoding it: code, data and custom
+// sections make up almost all of it.
+func estimatedSize(m *module.Module) int {
+	var n int
+	for _, seg := range m.Code.Segments {
+		n += len(seg.Code)
+	}
+	for _, seg := range m.Data.Segments {
+		n += len(seg.Init)
+	}
+	for _, s := range m.Customs {
+		n += len(s.Data)
+	}
+	return n
+}
 
+// runWasmOptPipes runs wasm-opt, feeding the module written by write in via
+// stdin, and returning the optimized module read from stdout, along with
+// stderr. If write fails, wasm-opt is killed; it's always waited for.
+func runWasmOptPipes(ctx context.Context, bin string, args []string, write func(io.Writer) error) ([]byte, []byte, error) {
+	args = append(args, "-o", "-") // output to stdout
 	var stdout, stderr bytes.Buffer
+	wopt := exec.CommandContext(ctx, bin, args...)
 	wopt.Stdout = &stdout
-
+	wopt.Stderr = &stderr
+	stdin, err := wopt.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
 	if err := wopt.Start(); err != nil {
-		return fmt.Errorf("start wasm-opt: %w", err)
+		return nil, nil, err
 	}
-	if err := encoding.WriteModule(stdin, c.module); err != nil {
-		return fmt.Errorf("encode module: %w", err)
+	werr := write(stdin)
+	if werr != nil {
+		// wasm-opt won't get the complete module: don't wait for it to finish,
+		// but still reap it below
+		_ = wopt.Process.Kill()
+	}
+	if err := stdin.Close(); werr == nil && !errors.Is(err, os.ErrClosed) {
+		werr = err
 	}
-	if err := stdin.Close(); err != nil {
-		return fmt.Errorf("write to wasm-opt: %w", err)
+	err = wopt.Wait()
+	switch {
+	case werr != nil && wopt.ProcessState.ExitCode() == -1: // killed above
+		return nil, stderr.Bytes(), fmt.Errorf("write module: %w", werr)
+	case err != nil:
+		return nil, stderr.Bytes(), err // takes precedence: wasm-opt might have stopped reading
+	case werr != nil:
+		return nil, stderr.Bytes(), fmt.Errorf("write module: %w", werr)
 	}
-	if err := wopt.Wait(); err != nil {
-		return fmt.Errorf("wait for wasm-opt: %w", err)
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// runWasmOptFiles runs wasm-opt on a temporary file holding the module
+// written by write, and returns the contents of the output file, along with
+// stderr. Both files are removed before returning.
+func runWasmOptFiles(ctx context.Context, bin string, args []string, write func(io.Writer) error) ([]byte, []byte, error) {
+	dir, err := os.MkdirTemp("", "opa-wasm-opt-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create temporary directory: %w", err)
 	}
+	defer os.RemoveAll(dir)
 
-	if d := stderr.String(); d != "" {
-		c.debug.Printf("wasm-opt debug output: %s", d)
+	infile, outfile := filepath.Join(dir, "in.wasm"), filepath.Join(dir, "out.wasm")
+	if err := writeFile(infile, write); err != nil {
+		return nil, nil, fmt.Errorf("write module: %w", err)
 	}
-	mod, err := encoding.ReadModule(&stdout)
+	args = append(args, infile, "-o", outfile)
+	var stderr bytes.Buffer
+	wopt := exec.CommandContext(ctx, bin, args...)
+	wopt.Stderr = &stderr
+	if err := wopt.Run(); err != nil {
+		return nil, stderr.Bytes(), err
+	}
+	out, err := os.ReadFile(outfile)
 	if err != nil {
-		return fmt.Errorf("decode module: %w", err)
+		return nil, nil, fmt.Errorf("read wasm-opt output: %w", err)
+	}
+	return out, stderr.Bytes(), nil
+}
+
+// WasmOptRunner runs wasm-opt in-process, e.g. a build of it compiled to
+// WebAssembly, executed by an embedded runtime. It's passed the arguments,
+// without any input and output files, and the encoded module, and returns
+// the optimized module and what wasm-opt wrote to stderr.
+type WasmOptRunner func(ctx context.Context, args []string, module []byte) (out, stderr []byte, err error)
+
+// WithWasmOptRunner sets a runner used instead of executing the wasm-opt
+// binary: no binary is looked up, and its version isn't checked. All other
+// wasm-opt options still apply. See WazeroWasmOpt for running a build of
+// wasm-opt targeting WASI.
+func (c *Compiler) WithWasmOptRunner(r WasmOptRunner) *Compiler {
+	c.woptRunner = r
+	return c
+}
+
+// runWasmOptWith passes the module to wasm-opt run in-process by r.
+func runWasmOptWith(ctx context.Context, r WasmOptRunner, args []string, write func(io.Writer) error) ([]byte, []byte, error) {
+	var in bytes.Buffer
+	if err := write(&in); err != nil {
+		return nil, nil, fmt.Errorf("write module: %w", err)
+	}
+	return r(ctx, append([]string(nil), args...), in.Bytes())
+}
+
+// woptNoOutputError describes wasm-opt exiting successfully without writing
+// a module, which happens with some combinations of arguments.
+func woptNoOutputError(args []string, stderr []byte) error {
+	return fmt.Errorf("wasm-opt produced no output (arguments %q): %s", args, woptStderr(stderr, "nothing on stderr"))
+}
+
+func writeFile(name string, write func(io.Writer) error) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// defaultWasmOptTimeout is the time wasm-opt is given to finish, unless
+// set otherwise, see WithWasmOptTimeout.
+const defaultWasmOptTimeout = 10 * time.Second
+
+// WithWasmOptTimeout sets the time wasm-opt is given to optimize the module,
+// zero meaning no timeout. It takes precedence over the
+// EXPERIMENTAL_WASM_OPT_TIMEOUT environment variable, a duration like "1m"
+// or a number of seconds.
+func (c *Compiler) WithWasmOptTimeout(d time.Duration) *Compiler {
+	c.woptTimeout = &d
+	return c
+}
+
+// wasmOptTimeout returns the effective wasm-opt timeout, and the setting it
+// was taken from.
+func (c *Compiler) wasmOptTimeout() (time.Duration, string, error) {
+	if c.woptTimeout != nil {
+		return *c.woptTimeout, "WithWasmOptTimeout", nil
+	}
+	const name = "EXPERIMENTAL_WASM_OPT_TIMEOUT"
+	if env := os.Getenv(name); env != "" {
+		if secs, err := strconv.Atoi(env); err == nil {
+			return time.Duration(secs) * time.Second, name, nil
+		}
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return 0, name, fmt.Errorf("%s: %w", name, err)
+		}
+		return d, name, nil
+	}
+	return defaultWasmOptTimeout, "WithWasmOptTimeout or " + name, nil
+}
+
+func woptTimeoutError(timeout time.Duration, source string) error {
+	return fmt.Errorf("wasm-opt optimization timed out after %v: consider raising the timeout via %s", timeout, source)
+}
+
+// WithWasmOptWarningsAsErrors toggles failing the compilation if wasm-opt
+// reports any warnings or errors on stderr, e.g. about ignored options.
+func (c *Compiler) WithWasmOptWarningsAsErrors(enabled bool) *Compiler {
+	c.woptStrict = enabled
+	return c
+}
+
+// WithRequireWasmOpt toggles requiring the wasm-opt optimization: it's run
+// without having to opt in via EXPERIMENTAL_WASM_OPT, and compilation fails
+// if the wasm-opt binary isn't found, instead of skipping the optimization.
+// Setting EXPERIMENTAL_WASM_OPT=require has the same effect.
+func (c *Compiler) WithRequireWasmOpt(enabled bool) *Compiler {
+	c.woptRequired = enabled
+	return c
+}
+
+// WithWasmOptArgs sets the arguments passed to wasm-opt, replacing the
+// defaults ("-O2 --debuginfo", or "-O2" with WithStripNames). They take
+// precedence over the EXPERIMENTAL_WASM_OPT_ARGS environment variable, and
+// the optimization level, see WithOptLevel.
+func (c *Compiler) WithWasmOptArgs(args ...string) *Compiler {
+	c.woptArgs = append([]string{}, args...)
+	return c
+}
+
+// WithWasmOptPasses sets several wasm-opt invocations, each with its own
+// arguments, run in order on the output of the previous one. It takes
+// precedence over WithWasmOptArgs, and the EXPERIMENTAL_WASM_OPT_ARGS
+// environment variable.
+func (c *Compiler) WithWasmOptPasses(passes ...[]string) *Compiler {
+	c.woptPasses = make([][]string, len(passes))
+	for i, args := range passes {
+		c.woptPasses[i] = append([]string{}, args...)
+	}
+	return c
+}
+
+// splitArgs splits s into arguments like a shell would: arguments are
+// separated by runs of whitespace, single and double quotes group characters
+// including whitespace, and a backslash escapes the next character (other
+// than in single quotes). Empty arguments are dropped.
+func splitArgs(s string) ([]string, error) {
+	var ret []string
+	var arg strings.Builder
+	var escaped bool
+	var quote rune
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case unicode.IsSpace(r):
+			if arg.Len() > 0 {
+				ret = append(ret, arg.String())
+				arg.Reset()
+			}
+		default:
+			arg.WriteRune(r)
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if arg.Len() > 0 {
+		ret = append(ret, arg.String())
+	}
+	return ret, nil
+}
+
+// checkWasmOptArgs rejects output options: the output is always read from
+// wasm-opt's stdout.
+func checkWasmOptArgs(args []string) error {
+	for _, arg := range args {
+		if arg == "-o" || arg == "--output" || strings.HasPrefix(arg, "--output=") {
+			return fmt.Errorf("wasm-opt arguments must not contain %s: output is written to stdout", arg)
+		}
 	}
-	c.module = mod
 	return nil
 }
 
-func woptFound() bool {
-	_, err := exec.LookPath("wasm-opt")
-	return err == nil
+// checkWasmOptOutput logs wasm-opt's stderr output, and turns complaints
+// about unknown options into an error: the module would otherwise silently
+// be optimized differently than requested. If requested, all diagnostics
+// found in the output become errors.
+func (c *Compiler) checkWasmOptOutput(out string) error {
+	if out == "" {
+		return nil
+	}
+	c.debug.Printf("wasm-opt debug output: %s", out)
+	if ds := woptUnknownOptions(out); len(ds) > 0 {
+		return fmt.Errorf("wasm-opt: invalid arguments: %s", strings.Join(ds, "; "))
+	}
+	if !c.woptStrict {
+		return nil
+	}
+	if ds := woptDiagnostics(out); len(ds) > 0 {
+		return fmt.Errorf("wasm-opt: %s", strings.Join(ds, "; "))
+	}
+	return nil
+}
+
+// woptDiagnostics returns the lines of wasm-opt's stderr output that are
+// warnings or errors.
+func woptDiagnostics(out string) []string {
+	var ret []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		l := strings.ToLower(line)
+		switch {
+		case strings.HasPrefix(l, "warning"),
+			strings.HasPrefix(l, "error"),
+			strings.HasPrefix(l, "fatal"),
+			strings.HasPrefix(l, "[wasm-validator error"),
+			unknownOption(l):
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
+
+// woptUnknownOptions returns the lines of wasm-opt's stderr output that
+// complain about options it doesn't know.
+func woptUnknownOptions(out string) []string {
+	var ret []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if unknownOption(strings.ToLower(line)) {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
+
+func unknownOption(l string) bool {
+	return strings.Contains(l, "unknown option") || strings.Contains(l, "unrecognized")
+}
+
+// WithWasmOptPath sets the wasm-opt binary to use. If not set, the
+// EXPERIMENTAL_WASM_OPT_BIN environment variable is consulted, and if that
+// isn't set either, "wasm-opt" is looked up in PATH.
+func (c *Compiler) WithWasmOptPath(path string) *Compiler {
+	c.woptPath = path
+	return c
 }
 
-// NOTE(sr): Yes, there are more control instructions than these two,
-// but we haven't made use of them yet. So this function only checks
-// for the control instructions we're possibly emitting, and which are
-// relevant for block nesting.
+func (c *Compiler) wasmOptPath() string {
+	if c.woptPath != "" {
+		return c.woptPath
+	}
+	if env := os.Getenv("EXPERIMENTAL_WASM_OPT_BIN"); env != "" {
+		return env
+	}
+	return "wasm-opt"
+}
+
+// woptFound resolves the wasm-opt binary: paths containing a separator are
+// used as-is, names are looked up in PATH. If it's not found, the unresolved
+// path is returned.
+func woptFound(path string) (string, bool) {
+	bin, err := exec.LookPath(path)
+	if err != nil {
+		return path, false
+	}
+	return bin, true
+}
+
+// withControlInstr returns true if the instructions contain a branch, or a
+// return (including tail calls), at any level of nesting: these are the
+// control instructions that are relevant for block nesting, as they refer
+// to block labels, or leave the function.
 func withControlInstr(is []instruction.Instruction) bool {
 	for _, i := range is {
 		switch i := i.(type) {
-		case instruction.Br, instruction.BrIf:
+		case instruction.Br, instruction.BrIf, instruction.BrTable, instruction.Return,
+			instruction.ReturnCall, instruction.ReturnCallIndirect:
 			return true
 		case instruction.StructuredInstruction:
 			// NOTE(sr): We could attempt to further flatten the nested blocks
@@ -108,132 +647,602 @@ func withControlInstr(is []instruction.Instruction) bool {
 	return false
 }
 
-func unquote(s string) (string, error) {
-	return strconv.Unquote("\"" + strings.ReplaceAll(s, `\`, `\x`) + "\"")
+// removeTrivialStart drops the start section if it refers to a function
+// that has no effect: running it at instantiation time would be a waste.
+func (c *Compiler) removeTrivialStart() error {
+	if !c.stripStart && !c.minimal {
+		return nil
+	}
+	return c.stripTrivialStart()
 }
 
-func (c *Compiler) removeUnusedCode() error {
-	cgCSV := opa.CallGraphCSV()
-	r := csv.NewReader(bytes.NewReader(cgCSV))
-	r.LazyQuotes = true
-	cg, err := r.ReadAll()
-	if err != nil {
-		return fmt.Errorf("csv read: %w", err)
+func (c *Compiler) stripTrivialStart() error {
+	if c.module.Start.FuncIndex == nil {
+		return nil
+	}
+	idx := *c.module.Start.FuncIndex
+	seg := int(idx) - c.functionImportCount()
+	if seg < 0 || seg >= len(c.module.Code.Segments) {
+		c.debug.Printf("start function %d is imported, keeping start section", idx)
+		return nil
 	}
+	entry, err := encoding.ReadCodeEntry(bytes.NewReader(c.module.Code.Segments[seg].Code))
+	if err != nil { // uses instructions we don't know, so it's not trivial
+		c.debug.Printf("start function %d not decodable, keeping start section: %v", idx, err)
+		return nil
+	}
+	if !withoutSideEffects(entry.Func.Expr.Instrs) {
+		return nil
+	}
+	c.debug.Printf("start function %d has no side effects, removing start section", idx)
+	c.module.Start.FuncIndex = nil
+	return nil
+}
 
-	cgIdx := map[uint32][]uint32{}
-	for i := range cg {
-		callerName, err := unquote(cg[i][0])
-		if err != nil {
-			return fmt.Errorf("unquote caller name %s: %w", cg[i][0], err)
+// withoutSideEffects returns true if the instructions can neither trap nor
+// change any state outside of the function's own locals. It's conservative:
+// calls, memory accesses and loops are all considered effectful.
+func withoutSideEffects(is []instruction.Instruction) bool {
+	for _, i := range is {
+		switch i := i.(type) {
+		case instruction.Nop, instruction.Drop, instruction.Select,
+			instruction.I32Const, instruction.I64Const, instruction.F32Const, instruction.F64Const,
+			instruction.GetLocal, instruction.SetLocal, instruction.TeeLocal,
+			instruction.I32Eqz, instruction.I32Eq, instruction.I32Ne, instruction.I32GtS,
+			instruction.I32GeS, instruction.I32LtS, instruction.I32LeS, instruction.I32Add,
+			instruction.I64Add, instruction.F32Add, instruction.F64Add, instruction.I32Mul,
+			instruction.I32Sub, instruction.Br, instruction.BrIf, instruction.Return:
+		case instruction.Block:
+			if !withoutSideEffects(i.Instrs) {
+				return false
+			}
+		case instruction.If:
+			if !withoutSideEffects(i.Instrs) {
+				return false
+			}
+		default:
+			return false
 		}
-		calleeName, err := unquote(cg[i][1])
-		if err != nil {
-			return fmt.Errorf("unquote callee name %s: %w", cg[i][1], err)
+	}
+	return true
+}
+
+// unescapeName decodes a function name of the call graph CSV, as printed by
+// wasm-opt: bytes outside the identifier characters are escaped as `\XX`,
+// using two hex digits, and a few as `\t`, `\n`, `\r`, `\"`, `\'` or `\\`.
+// Backslashes that don't start a valid escape sequence are kept as they are,
+// so that any name can be decoded.
+func unescapeName(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
 		}
-		caller, ok := c.funcs[callerName]
-		if !ok {
-			return fmt.Errorf("caller not found: %s (%s)", cg[i][0], callerName)
+		if i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			continue
 		}
-		callee, ok := c.funcs[calleeName]
-		if !ok {
-			return fmt.Errorf("callee not found: %s (%s)", cg[i][1], calleeName)
+		switch s[i+1] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case '"', '\'', '\\':
+			b.WriteByte(s[i+1])
+		default:
+			b.WriteByte('\\')
+			continue
 		}
-		cgIdx[caller] = append(cgIdx[caller], callee)
+		i++
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// WithKeepFunctions retains the named functions when removing unused code,
+// along with everything they call, just like exported functions are.
+// Naming a function the module doesn't have is an error.
+func (c *Compiler) WithKeepFunctions(names ...string) *Compiler {
+	c.keepFunctions = append(c.keepFunctions, names...)
+	return c
+}
+
+func (c *Compiler) removeUnusedCode() error {
+	lib, err := c.libraryCallGraph()
+	if err != nil {
+		return err
+	}
+	cgIdx := make(map[uint32][]uint32, len(lib)+len(c.funcsCode))
+	for caller, callees := range lib {
+		cgIdx[caller] = callees
 	}
 
-	// add the calls from planned functions
+	// add the calls from planned functions, keeping the library's calls of
+	// functions compiled in their place
+	indirect := c.indirectCallees()
+	total := uint32(c.functionImportCount() + len(c.module.Function.TypeIndices))
 	for _, f := range c.funcsCode {
 		fidx := c.funcs[f.name]
-		cgIdx[fidx] = findCallees(f.code.Func.Expr.Instrs)
+		callees := findCallees(f.code.Func.Expr.Instrs, indirect)
+		for _, callee := range callees {
+			if callee >= total {
+				return fmt.Errorf("function %s calls function %d, but there are only %d functions", f.name, callee, total)
+			}
+		}
+		cgIdx[fidx] = append(cgIdx[fidx], callees...)
+	}
+	if c.tableShrunk() {
+		if err := c.addIndirectCalls(cgIdx, indirect); err != nil {
+			return err
+		}
 	}
 
 	keepFuncs := map[uint32]struct{}{}
+	keptBy := map[uint32]uint32{} // kept function -> root it was first reached from
+	roots := map[uint32]string{}  // root -> why it's kept
+	keep := func(root uint32, why string) {
+		for _, idx := range reach(cgIdx, keepFuncs, root) {
+			keptBy[idx] = root
+		}
+		if _, ok := roots[root]; !ok {
+			roots[root] = why
+		}
+	}
 
 	// we'll keep
-	// - what's referenced in a table (these could be called indirectly)
-	// - what's exported or imported
+	// - what's referenced in a table (these could be called indirectly),
+	//   unless shrinking the table
+	// - what's exported or imported (unless pruning imports)
 	// - what's been compiled by us
+	// - what's been requested to be kept
 	// - anything transitively called from those
 
-	for _, imp := range c.module.Import.Imports {
-		if _, ok := imp.Descriptor.(module.FunctionImport); ok {
-			reach(cgIdx, keepFuncs, c.funcs[imp.Name])
+	if !c.pruneImports {
+		for _, imp := range c.module.Import.Imports {
+			if _, ok := imp.Descriptor.(module.FunctionImport); ok {
+				keep(c.funcs[imp.Name], "import")
+			}
 		}
 	}
 
+	exports := make(map[string]struct{}, len(c.module.Export.Exports))
 	for _, exp := range c.module.Export.Exports {
-		if exp.Descriptor.Type == module.FunctionExportType {
-			reach(cgIdx, keepFuncs, c.funcs[exp.Name])
+		if _, ok := exports[exp.Name]; ok {
+			return fmt.Errorf("duplicate export %q", exp.Name)
+		}
+		exports[exp.Name] = struct{}{}
+		if exp.Descriptor.Type != module.FunctionExportType {
+			continue
 		}
+		idx, ok := c.funcs[exp.Name]
+		if !ok {
+			return fmt.Errorf("export %q (%d): unknown function", exp.Name, exp.Descriptor.Index)
+		}
+		keep(idx, "export")
 	}
 
 	for _, f := range c.funcsCode {
-		reach(cgIdx, keepFuncs, c.funcs[f.name])
+		keep(c.funcs[f.name], "compiled")
+	}
+
+	for _, name := range c.keepFunctions {
+		idx, ok := c.funcs[name]
+		if !ok {
+			return fmt.Errorf("keep function: unknown function %q", name)
+		}
+		keep(idx, "keep")
 	}
 
 	// anything referenced in a table
 	for _, seg := range c.module.Element.Segments {
 		for _, idx := range seg.Indices {
-			if c.skipElemRE2(keepFuncs, idx) {
+			switch {
+			case c.skipElemRE2(keepFuncs, idx):
 				c.debug.Printf("dropping element %d because policy does not depend on re2", idx)
-			} else {
-				reach(cgIdx, keepFuncs, idx)
+			case c.tableShrunk() && !c.re2Internal(idx):
+				// kept if reached via call_indirect, see addIndirectCalls
+			default:
+				keep(idx, "table")
 			}
 		}
 	}
+	c.reportDeadCode(keptBy, roots)
+	if total := c.functionImportCount() + len(c.module.Code.Segments); len(keepFuncs) == total {
+		var exported int
+		for _, why := range roots {
+			if why == "export" {
+				exported++
+			}
+		}
+		c.debug.Printf("warning: removing unused code kept all %d functions (%d exports as roots), consider dropping exports", total, exported)
+	}
+	c.callGraph = cgIdx
+	c.roots = roots
+	c.keepFuncs = keepFuncs
+
+	// remove all that's not needed, update index for remaining ones; names
+	// that are stripped anyway are dropped now, they're no longer needed
+	c.pruneFunctionNames(keepFuncs)
+
+	// For anything that we don't want, replace the function code entries'
+	// expressions with `unreachable`, or with `nop` for functions without
+	// results, so that calling them doesn't trap.
+	// We do this because it lets the resulting wasm module pass `wasm-validate`,
+	// empty bodies of functions with results would not.
+	// Each function gets its own copy of its stub, so that modifying one of
+	// them in place can't affect the others; they share one allocation.
+	var stubbed []int
+	var stubs [][]byte
+	var size int
+	c.stubbedCode = nil
+	for i := range c.module.Code.Segments {
+		idx := i + c.functionImportCount()
+		if _, ok := keepFuncs[uint32(idx)]; ok {
+			continue
+		}
+		stub, err := c.stubCode(uint32(idx))
+		if err != nil {
+			return err
+		}
+		stubbed = append(stubbed, i)
+		stubs = append(stubs, stub)
+		size += len(stub)
+		if c.verifyInputs != nil {
+			if c.stubbedCode == nil {
+				c.stubbedCode = map[int][]byte{}
+			}
+			c.stubbedCode[i] = c.module.Code.Segments[i].Code
+		}
+	}
+	buf := make([]byte, 0, size)
+	for k, i := range stubbed {
+		start := len(buf)
+		buf = append(buf, stubs[k]...)
+		c.module.Code.Segments[i].Code = buf[start:len(buf):len(buf)]
+	}
+	return nil
+}
 
-	// remove all that's not needed, update index for remaining ones
-	funcNames := []module.NameMap{}
+// pruneFunctionNames drops the names of the functions not in keepFuncs from
+// the name section, or the whole section if it's stripped anyway. Without
+// function names, e.g. when compiled without debug info, there's nothing to
+// do. Names of functions the module doesn't have are warned about.
+func (c *Compiler) pruneFunctionNames(keepFuncs map[uint32]struct{}) {
+	if c.namesStripped() {
+		c.module.Names = module.NameSection{}
+		return
+	}
+	if len(c.module.Names.Functions) == 0 {
+		return
+	}
+	n := len(keepFuncs) // at most one name per function
+	if n > len(c.module.Names.Functions) {
+		n = len(c.module.Names.Functions)
+	}
+	funcNames := make([]module.NameMap, 0, n)
+	total := uint32(c.functionImportCount() + len(c.module.Code.Segments))
+	var unknown []string
 	for _, nm := range c.module.Names.Functions {
 		if _, ok := keepFuncs[nm.Index]; ok {
 			funcNames = append(funcNames, nm)
+		} else if nm.Index >= total {
+			unknown = append(unknown, fmt.Sprintf("%s (%d)", nm.Name, nm.Index))
 		}
 	}
+	if len(unknown) > 0 {
+		c.debug.Printf("warning: name section refers to %d functions the module doesn't have: %s", len(unknown), strings.Join(unknown, ", "))
+	}
+	// the name section must be ordered by index, independently of how
+	// the names were recorded
+	sort.SliceStable(funcNames, func(i, j int) bool { return funcNames[i].Index < funcNames[j].Index })
 	c.module.Names.Functions = funcNames
+}
 
-	// For anything that we don't want, replace the function code entries'
-	// expressions with `unreachable`.
-	// We do this because it lets the resulting wasm module pass `wasm-validate`,
-	// empty bodies would not.
-	nopEntry := module.Function{
-		Expr: module.Expr{
-			Instrs: []instruction.Instruction{instruction.Unreachable{}},
-		},
+// libCallGraph caches the call graph of the library functions, see
+// libraryCallGraph.
+var libCallGraph struct {
+	sync.Mutex
+	lib []byte // the embedded library it was derived from
+	cg  map[uint32][]uint32
+}
+
+// WithCallGraphCSV sets the source of the library's call graph used for
+// removing unused code, instead of deriving it from the library's code. fn
+// returns the graph in the format of opa.CallGraphCSV, one "caller,callee"
+// row per call.
+func (c *Compiler) WithCallGraphCSV(fn func() []byte) *Compiler {
+	c.callGraphCSV = fn
+	return c
+}
+
+// libraryCallGraph returns the call graph of the library functions, derived
+// from the code of the library module, opa.Bytes. Its indices are those of
+// the compiler's module, too: compiled functions are only appended to the
+// library's. So the result is the same for all compiles: it's built once,
+// and reused for as long as the library doesn't change. Its callee slices
+// are full, so appending to them doesn't modify it. A graph set via
+// WithCallGraphCSV is read for every compile.
+func (c *Compiler) libraryCallGraph() (map[uint32][]uint32, error) {
+	if c.callGraphCSV != nil {
+		return c.parseCallGraph(c.callGraphCSV())
 	}
-	var buf bytes.Buffer
-	if err := encoding.WriteCodeEntry(&buf, &module.CodeEntry{Func: nopEntry}); err != nil {
-		return fmt.Errorf("write code entry: %w", err)
+	lib := opa.Bytes()
+	libCallGraph.Lock()
+	defer libCallGraph.Unlock()
+	if libCallGraph.cg != nil && sameBytes(libCallGraph.lib, lib) {
+		return libCallGraph.cg, nil
 	}
-	for i := range c.module.Code.Segments {
-		idx := i + c.functionImportCount()
-		if _, ok := keepFuncs[uint32(idx)]; !ok {
-			c.module.Code.Segments[i].Code = buf.Bytes()
+
+	cg, err := codeCallGraph(lib)
+	if err != nil {
+		return nil, fmt.Errorf("library call graph: %w", err)
+	}
+	for caller, callees := range cg {
+		cg[caller] = callees[:len(callees):len(callees)]
+	}
+	libCallGraph.lib, libCallGraph.cg = lib, cg
+	return cg, nil
+}
+
+// codeCallGraph returns the functions called directly by each function of
+// the encoded module bs, including tail calls, and the functions they
+// reference via ref.func. Calls via call_indirect aren't included.
+func codeCallGraph(bs []byte) (map[uint32][]uint32, error) {
+	m, err := encoding.ReadModule(bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	var imports uint32
+	for _, imp := range m.Import.Imports {
+		if imp.Descriptor.Kind() == module.FunctionImportType {
+			imports++
 		}
 	}
-	return nil
+	cg := map[uint32][]uint32{}
+	for i, seg := range m.Code.Segments {
+		caller := imports + uint32(i)
+		seen := map[uint32]struct{}{}
+		call := func(callee uint32) (uint32, error) {
+			if _, ok := seen[callee]; !ok {
+				seen[callee] = struct{}{}
+				cg[caller] = append(cg[caller], callee)
+			}
+			return callee, nil
+		}
+		if _, err := encoding.RemapCodeIndices(seg.Code, call, nil); err != nil {
+			return nil, fmt.Errorf("code segment %d: %w", i, err)
+		}
+	}
+	return cg, nil
+}
+
+// The columns of the call graph CSV holding the caller and the callee of
+// each call. Further columns, like edge weights, are ignored.
+const (
+	callerColumn = 0
+	calleeColumn = 1
+)
+
+// parseCallGraph parses the call graph CSV, with one call per row, and
+// resolves the names of caller and callee to function indices.
+func (c *Compiler) parseCallGraph(csvBytes []byte) (map[uint32][]uint32, error) {
+	r := csv.NewReader(bytes.NewReader(csvBytes))
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1 // checked below, for a better error
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("csv read: %w", err)
+	}
+	fields := callerColumn + 1
+	if calleeColumn >= fields {
+		fields = calleeColumn + 1
+	}
+	cg := map[uint32][]uint32{}
+	for i, row := range rows {
+		if len(row) < fields {
+			return nil, fmt.Errorf("csv read: row %d has %d fields, expected at least %d", i+1, len(row), fields)
+		}
+		callerName, calleeName := unescapeName(row[callerColumn]), unescapeName(row[calleeColumn])
+		caller, ok := c.funcs[callerName]
+		if !ok {
+			return nil, fmt.Errorf("caller not found: %s (%s)", row[callerColumn], callerName)
+		}
+		callee, ok := c.funcs[calleeName]
+		if !ok {
+			return nil, fmt.Errorf("callee not found: %s (%s)", row[calleeColumn], calleeName)
+		}
+		cg[caller] = append(cg[caller], callee)
+	}
+	return cg, nil
+}
+
+// sameBytes returns true if a and b are the same slice, not just equal ones:
+// the embedded inputs of the cache are compared by identity.
+func sameBytes(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
 }
 
-func findCallees(instrs []instruction.Instruction) []uint32 {
+// stubBodies are the encodings of the stub bodies, see unreachableCode and
+// nopCode.
+var stubBodies struct {
+	once        sync.Once
+	unreachable []byte
+	nop         []byte
+	err         error
+}
+
+func encodeStubs() error {
+	stubBodies.once.Do(func() {
+		encode := func(instr instruction.Instruction) []byte {
+			var buf bytes.Buffer
+			entry := module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: []instruction.Instruction{instr}}}}
+			if err := encoding.WriteCodeEntry(&buf, &entry); err != nil {
+				stubBodies.err = fmt.Errorf("write code entry: %w", err)
+			}
+			return buf.Bytes()
+		}
+		stubBodies.unreachable = encode(instruction.Unreachable{})
+		stubBodies.nop = encode(instruction.Nop{})
+	})
+	return stubBodies.err
+}
+
+// unreachableCode returns the encoding of a function body consisting of
+// `unreachable` only. It's encoded once, and shared by all callers: the
+// slice must not be modified, and it can't be appended to in place. It's
+// meant for comparisons; functions replaced by it get copies.
+func unreachableCode() ([]byte, error) {
+	err := encodeStubs()
+	code := stubBodies.unreachable
+	return code[:len(code):len(code)], err
+}
+
+// nopCode returns the encoding of a function body consisting of `nop` only,
+// the stub of functions without results. Like unreachableCode, it's shared.
+func nopCode() ([]byte, error) {
+	err := encodeStubs()
+	code := stubBodies.nop
+	return code[:len(code):len(code)], err
+}
+
+// stubCode returns the stub body for the function at index idx: nopCode if
+// it has no results, and unreachableCode otherwise.
+func (c *Compiler) stubCode(idx uint32) ([]byte, error) {
+	if tpe, ok := c.functionType(idx); ok && len(tpe.Results) == 0 {
+		return nopCode()
+	}
+	return unreachableCode()
+}
+
+// isStub returns true if code is one of the stub bodies put in place when
+// removing unused code.
+func isStub(code []byte) bool {
+	if err := encodeStubs(); err != nil {
+		return false
+	}
+	return bytes.Equal(code, stubBodies.unreachable) || bytes.Equal(code, stubBodies.nop)
+}
+
+// findCallees returns the functions called by instrs. Calls via call_indirect
+// are resolved using indirect, which maps type indices to the functions that
+// could be called using them.
+func findCallees(instrs []instruction.Instruction, indirect map[uint32][]uint32) []uint32 {
 	var ret []uint32
 	for _, expr := range instrs {
 		switch expr := expr.(type) {
 		case instruction.Call:
 			ret = append(ret, expr.Index)
+		case instruction.ReturnCall:
+			ret = append(ret, expr.Index)
+		case instruction.CallIndirect:
+			ret = append(ret, indirect[expr.Index]...)
+		case instruction.ReturnCallIndirect:
+			ret = append(ret, indirect[expr.Index]...)
 		case instruction.StructuredInstruction:
-			ret = append(ret, findCallees(expr.Instructions())...)
+			ret = append(ret, findCallees(expr.Instructions(), indirect)...)
+		}
+	}
+	return ret
+}
+
+// addIndirectCalls adds the possible targets of the library functions'
+// call_indirect instructions to cg: the call graph of the library only
+// contains direct calls.
+func (c *Compiler) addIndirectCalls(cg map[uint32][]uint32, indirect map[uint32][]uint32) error {
+	imports := uint32(c.functionImportCount())
+	for i, seg := range c.module.Code.Segments {
+		if len(seg.Code) == 0 { // compiled function, see findCallees
+			continue
+		}
+		fidx := imports + uint32(i)
+		seen := map[uint32]struct{}{}
+		call := func(tidx uint32) (uint32, error) {
+			if _, ok := seen[tidx]; !ok {
+				seen[tidx] = struct{}{}
+				cg[fidx] = append(cg[fidx], indirect[tidx]...)
+			}
+			return tidx, nil
+		}
+		if _, err := encoding.RemapCallIndirectTypes(seg.Code, call); err != nil {
+			return fmt.Errorf("code segment %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// indirectCallees maps type indices to the functions referenced in the
+// element segments having a type of the same signature: these are the
+// possible targets of a call_indirect using that type, which only checks the
+// signature, not the index. Functions of the re2 library are left out: the
+// compiled code never calls them indirectly, and they're kept via the table
+// if the policy depends on re2, see skipElemRE2.
+func (c *Compiler) indirectCallees() map[uint32][]uint32 {
+	bySig := map[string][]uint32{}
+	seen := map[uint32]struct{}{}
+	imports := uint32(c.functionImportCount())
+	for _, seg := range c.module.Element.Segments {
+		for _, idx := range seg.Indices {
+			if _, ok := seen[idx]; ok || idx < imports || int(idx-imports) >= len(c.module.Function.TypeIndices) {
+				continue
+			}
+			seen[idx] = struct{}{}
+			if c.re2Internal(idx) {
+				continue
+			}
+			tidx := c.module.Function.TypeIndices[idx-imports]
+			if int(tidx) < len(c.module.Type.Functions) {
+				sig := c.module.Type.Functions[tidx].String()
+				bySig[sig] = append(bySig[sig], idx)
+			}
+		}
+	}
+	ret := map[uint32][]uint32{}
+	for tidx, tpe := range c.module.Type.Functions {
+		if fs, ok := bySig[tpe.String()]; ok {
+			ret[uint32(tidx)] = fs
 		}
 	}
 	return ret
 }
 
-func reach(cg map[uint32][]uint32, keep map[uint32]struct{}, node uint32) {
-	if _, ok := keep[node]; !ok {
-		keep[node] = struct{}{}
-		for _, v := range cg[node] {
-			reach(cg, keep, v)
+// reach marks node, and everything transitively called from it, as kept,
+// and returns the nodes that weren't kept before. It uses an explicit stack,
+// since the call graph can be arbitrarily deep.
+func reach(cg map[uint32][]uint32, keep map[uint32]struct{}, node uint32) []uint32 {
+	var added []uint32
+	stack := []uint32{node}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := keep[n]; ok {
+			continue
 		}
+		keep[n] = struct{}{}
+		added = append(added, n)
+		stack = append(stack, cg[n]...)
 	}
+	return added
 }
 
 // skipElemRE2 determines if a function in the table is really required:
@@ -243,6 +1252,12 @@ func (c *Compiler) skipElemRE2(keep map[uint32]struct{}, idx uint32) bool {
 	if c.usesRE2(keep) {
 		return false
 	}
+	return c.re2Internal(idx)
+}
+
+// re2Internal returns true if the function at idx is part of the re2
+// library, or its C++ runtime.
+func (c *Compiler) re2Internal(idx uint32) bool {
 	return c.nameContains(idx, "re2::", "lexer::", "std::", "__cxa_pure_virtual", "operator", "parser_")
 }
 
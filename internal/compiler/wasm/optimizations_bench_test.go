@@ -0,0 +1,129 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// BenchmarkWasmOptRoundTrip measures the allocations of passing increasingly
+// large modules through wasm-opt, faked by cat, via pipes and temporary
+// files.
+func BenchmarkWasmOptRoundTrip(b *testing.B) {
+	path := writeWasmOpt(b, `[ "$1" = "--version" ] && exit 0
+[ "$1" = "-o" ] && exec cat
+exec cp "$1" "$3"`) // no arguments but input and output
+	for _, n := range []int{10, 1000} {
+		var mod strings.Builder
+		mod.WriteString("package test\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&mod, "p%d { input.x == %d; input.y[_] == \"%d\" }\n", i, i, i)
+		}
+		policy := planModules(b, mod.String(), planner.QuerySet{
+			Name:    "test",
+			Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+		})
+
+		for _, files := range []bool{false, true} {
+			name := fmt.Sprintf("%d/pipes", n)
+			if files {
+				name = fmt.Sprintf("%d/files", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				defer func(n int) { woptFileThreshold = n }(woptFileThreshold)
+				if files {
+					woptFileThreshold = 0
+				}
+				c := New().WithPolicy(policy).WithWasmOptPath(path).WithWasmOptArgs()
+				if _, err := c.Compile(); err != nil {
+					b.Fatal(err)
+				}
+				ctx, opts := c.context(), OptimizeOptions{WasmOpt: true}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := c.optimize(ctx, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkRemoveUnusedCode measures building the call graph, the library's
+// and the compiled functions', and pruning it, for policies of increasing
+// size.
+func BenchmarkRemoveUnusedCode(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		var mod strings.Builder
+		mod.WriteString("package test\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&mod, "p%d { input.x == %d; input.y[_] == \"%d\" }\n", i, i, i)
+		}
+		policy := planModules(b, mod.String(), planner.QuerySet{
+			Name:    "test",
+			Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+		})
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			c := New().WithPolicy(policy)
+			if err := c.Prepare(); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.removeUnusedCode(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPruneFunctionNames measures dropping the names of unused functions
+// from a large name section, and from an empty one.
+func BenchmarkPruneFunctionNames(b *testing.B) {
+	var mod strings.Builder
+	mod.WriteString("package test\n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&mod, "p%d { input.x == %d }\n", i, i)
+	}
+	policy := planModules(b, mod.String(), planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		b.Fatal(err)
+	}
+	names := append([]module.NameMap(nil), c.module.Names.Functions...)
+	if err := c.removeUnusedCode(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		note  string
+		names []module.NameMap
+	}{
+		{note: fmt.Sprintf("%d names", len(names)), names: names},
+		{note: "no names"},
+	} {
+		b.Run(tc.note, func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.module.Names.Functions = tc.names
+				c.pruneFunctionNames(c.keepFuncs)
+			}
+		})
+	}
+}
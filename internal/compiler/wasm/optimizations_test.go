@@ -1,11 +1,28 @@
 package wasm
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/opcode"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
 )
 
 func TestRemoveUnusedCode(t *testing.T) {
@@ -54,3 +71,1387 @@ func TestRemoveUnusedCode(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoveUnusedCodeAllKept(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	const msg = "warning: removing unused code kept all"
+
+	var buf bytes.Buffer
+	if _, err := New().WithPolicy(policy).WithDebug(&buf).Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), msg) {
+		t.Errorf("expected no warning, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	c := New().WithPolicy(policy).WithDebug(&buf)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	for name := range c.funcs {
+		c.keepFunctions = append(c.keepFunctions, name)
+	}
+	before := len(c.module.Code.Segments)
+	if err := c.removeUnusedCode(); err != nil {
+		t.Fatal(err)
+	}
+	var exports int
+	for _, exp := range c.module.Export.Exports {
+		if exp.Descriptor.Type == module.FunctionExportType {
+			exports++
+		}
+	}
+	exp := fmt.Sprintf("%s %d functions (%d exports as roots)", msg, c.functionImportCount()+before, exports)
+	if !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", exp, buf.String())
+	}
+}
+
+func TestRemoveUnusedCodeVoidStub(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy).WithValidateStructure(true)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	// add two unused functions, one without results, and one with
+	var buf bytes.Buffer
+	body := []instruction.Instruction{instruction.I32Const{Value: 1}, instruction.Drop{}}
+	if err := encoding.WriteCodeEntry(&buf, &module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: body}}}); err != nil {
+		t.Fatal(err)
+	}
+	void := uint32(c.functionImportCount() + len(c.module.Code.Segments))
+	for _, tpe := range []module.FunctionType{
+		{Params: []types.ValueType{types.I32}},
+		{Params: []types.ValueType{types.I32}, Results: []types.ValueType{types.I32}},
+	} {
+		c.module.Type.Functions = append(c.module.Type.Functions, tpe)
+		c.module.Function.TypeIndices = append(c.module.Function.TypeIndices, uint32(len(c.module.Type.Functions)-1))
+		c.module.Code.Segments = append(c.module.Code.Segments, module.RawCodeSegment{Code: append([]byte(nil), buf.Bytes()...)})
+	}
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, exp := range map[uint32]instruction.Instruction{
+		void:     instruction.Nop{},
+		void + 1: instruction.Unreachable{},
+	} {
+		code := mod.Code.Segments[int(idx)-c.functionImportCount()].Code
+		entry, err := encoding.ReadCodeEntry(bytes.NewReader(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act := entry.Func.Expr.Instrs; !reflect.DeepEqual(act, []instruction.Instruction{exp}) {
+			t.Errorf("func %d: expected stub %v, got %v", idx, exp, act)
+		}
+		if !isStub(code) {
+			t.Errorf("func %d: expected stub to be recognized", idx)
+		}
+	}
+	nop := []instruction.Instruction{instruction.Nop{}}
+	if callees := findCallees(nop, nil); len(callees) != 0 {
+		t.Errorf("expected no callees of nop, got %v", callees)
+	}
+	if withControlInstr(nop) {
+		t.Error("expected nop not to be a control instruction")
+	}
+}
+
+func TestRemoveUnusedCodeStubsNotShared(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.removeUnusedCode(); err != nil {
+		t.Fatal(err)
+	}
+	stub, err := unreachableCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stubbed []int
+	for i, seg := range c.module.Code.Segments {
+		if bytes.Equal(seg.Code, stub) {
+			stubbed = append(stubbed, i)
+		}
+	}
+	if len(stubbed) < 2 {
+		t.Fatalf("expected several stubbed functions, got %d", len(stubbed))
+	}
+
+	orig := append([]byte(nil), stub...)
+	first := c.module.Code.Segments[stubbed[0]].Code
+	first[len(first)-2] = 0x01 // nop instead of unreachable
+	for _, i := range stubbed[1:] {
+		if !bytes.Equal(c.module.Code.Segments[i].Code, stub) {
+			t.Fatalf("expected segment %d to be unaffected, got %v", i, c.module.Code.Segments[i].Code)
+		}
+	}
+	if !bytes.Equal(stub, orig) {
+		t.Errorf("expected shared stub %v to be unaffected, got %v", orig, stub)
+	}
+}
+
+func TestRemoveUnusedCodeAccountsForImports(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imports := c.functionImportCount()
+	if imports == 0 {
+		t.Fatal("expected function imports")
+	}
+
+	// Exported functions are kept: their bodies, found at their function
+	// index minus the number of imported functions, must not be stubbed.
+	var n int
+	for _, exp := range mod.Export.Exports {
+		if exp.Descriptor.Type != module.FunctionExportType {
+			continue
+		}
+		seg := int(exp.Descriptor.Index) - imports
+		if seg < 0 {
+			continue
+		}
+		n++
+		if len(mod.Code.Segments[seg].Code) == 3 {
+			t.Errorf("exported func %s (%d): body was removed", exp.Name, exp.Descriptor.Index)
+		}
+	}
+	if n == 0 {
+		t.Fatal("expected exported functions")
+	}
+}
+
+func TestRemoveTrivialStart(t *testing.T) {
+	noop := module.CodeEntry{Func: module.Function{Expr: module.Expr{
+		Instrs: []instruction.Instruction{instruction.Nop{}},
+	}}}
+	effectful := module.CodeEntry{Func: module.Function{Expr: module.Expr{
+		Instrs: []instruction.Instruction{instruction.Call{Index: 0}},
+	}}}
+
+	for _, tc := range []struct {
+		note   string
+		entry  module.CodeEntry
+		strip  bool
+		remove bool
+	}{
+		{note: "no-op start, option set", entry: noop, strip: true, remove: true},
+		{note: "no-op start, option unset", entry: noop},
+		{note: "effectful start, option set", entry: effectful, strip: true},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := encoding.WriteCodeEntry(&buf, &tc.entry); err != nil {
+				t.Fatal(err)
+			}
+			start := uint32(0)
+			c := New().WithStripTrivialStart(tc.strip)
+			c.module = &module.Module{
+				Type:     module.TypeSection{Functions: []module.FunctionType{{}}},
+				Function: module.FunctionSection{TypeIndices: []uint32{0}},
+				Code:     module.RawCodeSection{Segments: []module.RawCodeSegment{{Code: buf.Bytes()}}},
+				Start:    module.StartSection{FuncIndex: &start},
+			}
+			if err := c.removeTrivialStart(); err != nil {
+				t.Fatal(err)
+			}
+			if removed := c.module.Start.FuncIndex == nil; removed != tc.remove {
+				t.Errorf("expected start section removed: %v, got %v", tc.remove, removed)
+			}
+		})
+	}
+}
+
+func TestRemoveTrivialStartKeepsInitialize(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	mod, err := New().WithPolicy(policy).WithStripTrivialStart(true).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod.Start.FuncIndex == nil {
+		t.Fatal("expected start section to be kept")
+	}
+}
+
+func TestWasmOptWarningsAsErrors(t *testing.T) {
+	stderr := `[wasm-validator error in function 3] unexpected false: call target must exist
+warning: no passes specified, not doing any work
+Some unrelated information
+`
+	if err := New().checkWasmOptOutput(stderr); err != nil {
+		t.Fatalf("expected no error by default, got %v", err)
+	}
+
+	err := New().WithWasmOptWarningsAsErrors(true).checkWasmOptOutput(stderr)
+	exp := "wasm-opt: [wasm-validator error in function 3] unexpected false: call target must exist; warning: no passes specified, not doing any work"
+	if err == nil || err.Error() != exp {
+		t.Fatalf("expected error %q, got %v", exp, err)
+	}
+
+	if err := New().WithWasmOptWarningsAsErrors(true).checkWasmOptOutput("[PassRunner] running passes\n"); err != nil {
+		t.Fatalf("expected no error for non-diagnostic output, got %v", err)
+	}
+}
+
+// writeWasmOpt writes an executable named wasm-opt running script into a
+// temporary directory, returns its path, and opts into using wasm-opt.
+func writeWasmOpt(t testing.TB, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "wasm-opt")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "silent")
+	return path
+}
+
+// fakeWasmOpt puts the executable written by writeWasmOpt in front of the
+// PATH.
+func fakeWasmOpt(t *testing.T, script string) {
+	t.Helper()
+	path := writeWasmOpt(t, script)
+	t.Setenv("PATH", filepath.Dir(path)+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestWasmOptTimeout(t *testing.T) {
+	fakeWasmOpt(t, "exec sleep 10")
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+
+	_, err := New().WithPolicy(policy).WithWasmOptTimeout(100 * time.Millisecond).Compile()
+	if err == nil || !strings.Contains(err.Error(), "wasm-opt optimization timed out after 100ms: consider raising the timeout via WithWasmOptTimeout") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+
+	t.Setenv("EXPERIMENTAL_WASM_OPT_TIMEOUT", "1h")
+	_, err = New().WithPolicy(policy).WithWasmOptTimeout(200 * time.Millisecond).Compile()
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Fatalf("expected timeout to override environment, got %v", err)
+	}
+
+	t.Setenv("EXPERIMENTAL_WASM_OPT_TIMEOUT", "200ms")
+	_, err = New().WithPolicy(policy).Compile()
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms: consider raising the timeout via EXPERIMENTAL_WASM_OPT_TIMEOUT") {
+		t.Fatalf("expected timeout from environment, got %v", err)
+	}
+
+	_, err = New().WithPolicy(policy).CompileOptimized(context.Background(), OptimizeOptions{WasmOptTimeout: 100 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms: consider raising the timeout via OptimizeOptions.WasmOptTimeout") {
+		t.Fatalf("expected timeout from options, got %v", err)
+	}
+}
+
+func TestWasmOptCanceled(t *testing.T) {
+	fakeWasmOpt(t, "exec sleep 10")
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := New().WithPolicy(policy).WithWasmOptTimeout(time.Hour).CompileContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected wasm-opt to be terminated promptly, took %v", d)
+	}
+
+	// A canceled context stops the compilation before any stage is run.
+	c := New().WithPolicy(policy)
+	if _, err := c.CompileContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+	if c.stagesRun != 0 {
+		t.Errorf("expected no stages to be run, got %d", c.stagesRun)
+	}
+}
+
+func TestWasmOptWriteErrorKills(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "pid")
+	bin := writeWasmOpt(t, `echo $$ > `+pidfile+`
+exec sleep 30`)
+
+	// fail writing once wasm-opt is running, which doesn't read its input
+	write := func(w io.Writer) error {
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(pidfile); err == nil {
+				return errors.New("oops")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return errors.New("wasm-opt not started")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, _, err := runWasmOptPipes(ctx, bin, nil, write)
+	if exp := "write module: oops"; err == nil || err.Error() != exp {
+		t.Fatalf("expected error %q, got %v", exp, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected wasm-opt to be killed right away, took %v", d)
+	}
+
+	bs, err := os.ReadFile(pidfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// signal 0 only checks for existence: the reaped process is gone
+	if p, err := os.FindProcess(pid); err == nil {
+		if err := p.Signal(syscall.Signal(0)); err == nil {
+			t.Errorf("expected process %d to be reaped", pid)
+		}
+	}
+}
+
+func TestWasmOptTimeoutFromEnv(t *testing.T) {
+	for env, exp := range map[string]time.Duration{
+		"":    defaultWasmOptTimeout,
+		"0":   0,
+		"30":  30 * time.Second,
+		"90s": 90 * time.Second,
+		"2m":  2 * time.Minute,
+	} {
+		t.Setenv("EXPERIMENTAL_WASM_OPT_TIMEOUT", env)
+		act, _, err := New().wasmOptTimeout()
+		if err != nil {
+			t.Fatalf("%q: %v", env, err)
+		}
+		if act != exp {
+			t.Errorf("%q: expected %v, got %v", env, exp, act)
+		}
+	}
+	t.Setenv("EXPERIMENTAL_WASM_OPT_TIMEOUT", "soon")
+	if _, _, err := New().wasmOptTimeout(); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestWasmOptPath(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// The fake wasm-opt records that it ran, and passes the module through.
+	marker := filepath.Join(t.TempDir(), "ran")
+	path := writeWasmOpt(t, "touch "+marker+"\nexec cat")
+
+	ran := func() bool {
+		_, err := os.Stat(marker)
+		os.Remove(marker)
+		return err == nil
+	}
+
+	if _, err := New().WithPolicy(policy).WithWasmOptPath(path).Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !ran() {
+		t.Error("expected configured wasm-opt to be run")
+	}
+
+	t.Setenv("EXPERIMENTAL_WASM_OPT_BIN", path)
+	if _, err := New().WithPolicy(policy).Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !ran() {
+		t.Error("expected wasm-opt from EXPERIMENTAL_WASM_OPT_BIN to be run")
+	}
+
+	var debug bytes.Buffer
+	missing := filepath.Join(t.TempDir(), "wasm-opt")
+	if _, err := New().WithPolicy(policy).WithWasmOptPath(missing).WithDebug(&debug).Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if ran() {
+		t.Error("expected configured path to take precedence")
+	}
+	if exp := "wasm-opt binary " + missing + " not found"; !strings.Contains(debug.String(), exp) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", exp, debug.String())
+	}
+}
+
+func TestWasmOptFiles(t *testing.T) {
+	defer func(n int) { woptFileThreshold = n }(woptFileThreshold)
+	woptFileThreshold = 0
+
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// The fake wasm-opt records its input file, and copies it to the output
+	// file, never touching stdin or stdout.
+	rec := filepath.Join(t.TempDir(), "infile")
+	const files = `eval in=\${$(($# - 2))}
+eval out=\${$#}
+echo "$in" > `
+
+	readRec := func() string {
+		t.Helper()
+		bs, err := os.ReadFile(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(bs))
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		fakeWasmOpt(t, files+rec+"\nexec cp \"$in\" \"$out\" </dev/null >/dev/null")
+		if _, err := New().WithPolicy(policy).Compile(); err != nil {
+			t.Fatal(err)
+		}
+		in := readRec()
+		if _, err := os.Stat(filepath.Dir(in)); !os.IsNotExist(err) {
+			t.Errorf("expected temporary files to be removed, got %v", err)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		fakeWasmOpt(t, files+rec+"\nexit 1")
+		if _, err := New().WithPolicy(policy).Compile(); err == nil {
+			t.Fatal("expected error")
+		}
+		in := readRec()
+		if _, err := os.Stat(filepath.Dir(in)); !os.IsNotExist(err) {
+			t.Errorf("expected temporary files to be removed, got %v", err)
+		}
+	})
+}
+
+func TestWasmOptExitCode(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// The fake wasm-opt writes a partial module, and fails.
+	fakeWasmOpt(t, `printf '\000asm'
+echo "Fatal: something went wrong" >&2
+exit 3`)
+
+	for _, threshold := range []int{woptFileThreshold, 0} {
+		func() {
+			defer func(n int) { woptFileThreshold = n }(woptFileThreshold)
+			woptFileThreshold = threshold
+
+			_, err := New().WithPolicy(policy).Compile()
+			if exp := "wasm-opt exited with code 3: Fatal: something went wrong"; err == nil || err.Error() != exp {
+				t.Errorf("threshold %d: expected error %q, got %v", threshold, exp, err)
+			}
+		}()
+	}
+}
+
+func TestWasmOptStderrTruncated(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// The fake wasm-opt dumps lots of code before failing.
+	fakeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+cat > /dev/null
+i=0; while [ $i -lt 200 ]; do echo "(func $f$i (unreachable))" >&2; i=$((i+1)); done
+echo "Fatal: error validating input" >&2
+exit 1`)
+
+	_, err := New().WithPolicy(policy).Compile()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "wasm-opt exited with code 1: [") || !strings.Contains(msg, "bytes truncated]...") {
+		t.Errorf("expected truncated stderr, got %q", msg)
+	}
+	if !strings.HasSuffix(msg, "Fatal: error validating input") {
+		t.Errorf("expected end of stderr to be kept, got %q", msg)
+	}
+	if len(msg) > maxStderrLen+100 {
+		t.Errorf("expected error of at most %d bytes, got %d", maxStderrLen+100, len(msg))
+	}
+}
+
+func TestWasmOptNoOutput(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// The fake wasm-opt reads the module, and succeeds without writing one.
+	fakeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+for a; do out=$a; done
+if [ "$out" = - ]; then cat > /dev/null; else : > "$out"; fi
+echo "warning: no passes specified" >&2`)
+
+	for _, threshold := range []int{woptFileThreshold, 0} {
+		func() {
+			defer func(n int) { woptFileThreshold = n }(woptFileThreshold)
+			woptFileThreshold = threshold
+
+			_, err := New().WithPolicy(policy).WithWasmOptArgs("--foo").Compile()
+			if exp := `wasm-opt produced no output (arguments ["--foo"]): warning: no passes specified`; err == nil || err.Error() != exp {
+				t.Errorf("threshold %d: expected error %q, got %v", threshold, exp, err)
+			}
+		}()
+	}
+}
+
+func TestParseWasmOptVersion(t *testing.T) {
+	tests := []struct {
+		out, exp string
+	}{
+		{out: "wasm-opt version 116 (version_116)\n", exp: "116"},
+		{out: "wasm-opt version 116-12-gdeadbeef (version_116-12-gdeadbeef)", exp: "116-12-gdeadbeef"},
+		{out: "wasm-opt version", exp: ""},
+		{out: "", exp: ""},
+	}
+	for _, tc := range tests {
+		act, err := parseWasmOptVersion(tc.out)
+		if tc.exp == "" {
+			if err == nil {
+				t.Errorf("%q: expected error, got %q", tc.out, act)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.out, err)
+		} else if act != tc.exp {
+			t.Errorf("%q: expected %q, got %q", tc.out, tc.exp, act)
+		}
+	}
+}
+
+func TestWasmOptVersion(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	version := func(out string) string {
+		return `if [ "$1" = "--version" ]; then echo "` + out + `"; exit 0; fi
+exec cat`
+	}
+
+	t.Run("old", func(t *testing.T) {
+		fakeWasmOpt(t, version("wasm-opt version 90 (version_90)"))
+		var debug bytes.Buffer
+		if _, err := New().WithPolicy(policy).WithDebug(&debug).Compile(); err != nil {
+			t.Fatal(err)
+		}
+		for _, exp := range []string{"version 90", "wasm-opt version 90 is older than the minimum version 101"} {
+			if !strings.Contains(debug.String(), exp) {
+				t.Errorf("expected debug output to contain %q, got:\n%s", exp, debug.String())
+			}
+		}
+
+		_, err := New().WithPolicy(policy).WithStrict(true).Compile()
+		if err == nil || !strings.Contains(err.Error(), "older than the minimum version") {
+			t.Errorf("expected version error in strict mode, got %v", err)
+		}
+		if _, err := New().WithPolicy(policy).WithStrict(true).WithWasmOptMinVersion(90).Compile(); err != nil {
+			t.Errorf("expected version 90 to be accepted: %v", err)
+		}
+	})
+
+	t.Run("unexpected output", func(t *testing.T) {
+		fakeWasmOpt(t, version("something else"))
+		var debug bytes.Buffer
+		if _, err := New().WithPolicy(policy).WithStrict(true).WithDebug(&debug).Compile(); err != nil {
+			t.Fatal(err)
+		}
+		if exp := "could not determine wasm-opt version"; !strings.Contains(debug.String(), exp) {
+			t.Errorf("expected debug output to contain %q, got:\n%s", exp, debug.String())
+		}
+	})
+
+	t.Run("reported", func(t *testing.T) {
+		fakeWasmOpt(t, version("wasm-opt version 116 (version_116)"))
+		v, err := New().WasmOptVersion(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != "116" {
+			t.Errorf("expected version 116, got %q", v)
+		}
+	})
+}
+
+func TestUnescapeName(t *testing.T) {
+	tests := []struct {
+		in, exp string
+	}{
+		{in: "", exp: ""},
+		{in: "opa_value_type", exp: "opa_value_type"},
+		{in: `re2::RE2::RE2\28char\20const*\29`, exp: "re2::RE2::RE2(char const*)"},
+		{in: `a\2cb\2C`, exp: "a,b,"},
+		{in: `say\22hi\22`, exp: `say"hi"`},
+		{in: `say\"hi\"`, exp: `say"hi"`},
+		{in: `say"hi"`, exp: `say"hi"`},
+		{in: `back\5cslash`, exp: `back\slash`},
+		{in: `back\\slash`, exp: `back\slash`},
+		{in: `tab\tnl\nquote\'`, exp: "tab\tnl\nquote'"},
+		{in: `\e2\82\ac`, exp: "€"},
+		{in: "€uro", exp: "€uro"},
+		{in: `trailing\`, exp: `trailing\`},
+		{in: `bad\x`, exp: `bad\x`},
+		{in: `bad\2`, exp: `bad\2`},
+		{in: `bad\zz\`, exp: `bad\zz\`},
+	}
+	for _, tc := range tests {
+		if act := unescapeName(tc.in); act != tc.exp {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.exp, act)
+		}
+	}
+}
+
+func TestFindCalleesIndirect(t *testing.T) {
+	is := []instruction.Instruction{
+		instruction.Call{Index: 1},
+		instruction.Block{Instrs: []instruction.Instruction{
+			instruction.I32Const{Value: 0},
+			instruction.CallIndirect{Index: 7},
+		}},
+		instruction.I32Const{Value: 0},
+		instruction.CallIndirect{Index: 8},
+	}
+	indirect := map[uint32][]uint32{7: {10, 11}, 9: {12}}
+	if exp, act := []uint32{1, 10, 11}, findCallees(is, indirect); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
+
+func TestFindCalleesTailCalls(t *testing.T) {
+	is := []instruction.Instruction{
+		instruction.Block{Instrs: []instruction.Instruction{
+			instruction.ReturnCall{Index: 1},
+		}},
+		instruction.I32Const{Value: 0},
+		instruction.ReturnCallIndirect{Index: 7},
+	}
+	indirect := map[uint32][]uint32{7: {10, 11}}
+	if exp, act := []uint32{1, 10, 11}, findCallees(is, indirect); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
+
+func TestRemoveUnusedCodeTailCall(t *testing.T) {
+	policy := planModules(t, "package test\np { input.x = 1 }", planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test.p = x`)},
+	})
+	def := New().WithPolicy(policy)
+	if _, err := def.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	// Find a function removed by default that has the same type as the
+	// compiled one, and make it the target of a tail call only.
+	caller := c.funcs["g0.data.test.p"]
+	tpe, _ := c.functionType(caller)
+	var target string
+	for _, name := range def.DeadCodeReport().RemovedFuncs {
+		if t, ok := c.functionType(c.funcs[name]); ok && reflect.DeepEqual(t, tpe) {
+			target = name
+			break
+		}
+	}
+	if target == "" {
+		t.Fatal("no removed function of the right type found")
+	}
+	for _, f := range c.funcsCode {
+		if f.name == "g0.data.test.p" {
+			f.code.Func.Expr.Instrs = append(f.code.Func.Expr.Instrs,
+				instruction.GetLocal{Index: 0},
+				instruction.GetLocal{Index: 1},
+				instruction.ReturnCall{Index: c.funcs[target]},
+			)
+		}
+	}
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.keepFuncs[c.funcs[target]]; !ok {
+		t.Errorf("expected %s, reached via return_call, to be kept", target)
+	}
+}
+
+func TestRemoveUnusedCodeInvalidCallee(t *testing.T) {
+	policy := planModules(t, "package test\np { input.x = 1 }", planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test.p = x`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	total := c.functionImportCount() + len(c.module.Function.TypeIndices)
+	for _, f := range c.funcsCode {
+		if f.name == "g0.data.test.p" {
+			f.code.Func.Expr.Instrs = append([]instruction.Instruction{
+				instruction.Block{Instrs: []instruction.Instruction{
+					instruction.Call{Index: uint32(total)},
+					instruction.Drop{},
+				}},
+			}, f.code.Func.Expr.Instrs...)
+		}
+	}
+	_, err := c.Compile()
+	if exp := fmt.Sprintf("function g0.data.test.p calls function %d, but there are only %d functions", total, total); err == nil || !strings.Contains(err.Error(), exp) {
+		t.Fatalf("expected error %q, got %v", exp, err)
+	}
+}
+
+func TestRemoveUnusedCodeBogusExports(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	for _, tc := range []struct {
+		note   string
+		export func(c *Compiler) module.Export
+		exp    string
+	}{
+		{
+			note: "unknown function",
+			export: func(c *Compiler) module.Export {
+				return module.Export{Name: "bogus", Descriptor: module.ExportDescriptor{Type: module.FunctionExportType, Index: 3}}
+			},
+			exp: `export "bogus" (3): unknown function`,
+		},
+		{
+			note: "duplicate",
+			export: func(c *Compiler) module.Export {
+				return module.Export{Name: "eval", Descriptor: module.ExportDescriptor{Type: module.FunctionExportType, Index: c.funcs["eval"]}}
+			},
+			exp: `duplicate export "eval"`,
+		},
+		{
+			note: "duplicate of another kind",
+			export: func(*Compiler) module.Export {
+				return module.Export{Name: "memory", Descriptor: module.ExportDescriptor{Type: module.GlobalExportType}}
+			},
+			exp: `duplicate export "memory"`,
+		},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			c := New().WithPolicy(policy)
+			if err := c.Prepare(); err != nil {
+				t.Fatal(err)
+			}
+			c.module.Export.Exports = append(c.module.Export.Exports, tc.export(c))
+			if err := c.removeUnusedCode(); err == nil || err.Error() != tc.exp {
+				t.Errorf("expected error %q, got %v", tc.exp, err)
+			}
+		})
+	}
+}
+
+func TestRemoveUnusedCodeIndirectCalls(t *testing.T) {
+	policy := planModules(t, `package test
+a = {"b": b, "c": c}
+b = input.b
+c = input.c
+`, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`x = input.x; data.test[x] = y`)},
+	})
+	c := New().WithPolicy(policy)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	callers := c.FunctionsUsing(opcode.CallIndirect)
+	if len(callers) == 0 {
+		t.Fatal("expected call_indirect")
+	}
+
+	// The functions called via the table are recorded as callees of those
+	// using call_indirect, so anything only they call is retained.
+	for _, target := range []string{"g0.data.test.b", "g0.data.test.c"} {
+		idx, ok := c.funcs[target]
+		if !ok {
+			t.Fatalf("func %s not found", target)
+		}
+		var found bool
+		for _, caller := range callers {
+			for _, callee := range c.callGraph[c.funcs[caller]] {
+				found = found || callee == idx
+			}
+		}
+		if !found {
+			t.Errorf("expected %s to be a callee of %v", target, callers)
+		}
+		if _, ok := c.keepFuncs[idx]; !ok {
+			t.Errorf("expected %s to be kept", target)
+		}
+	}
+}
+
+func TestReachDeepCallGraph(t *testing.T) {
+	const n = 200000
+	cg := make(map[uint32][]uint32, n)
+	for i := uint32(0); i < n-1; i++ {
+		cg[i] = []uint32{i + 1}
+	}
+	cg[n-1] = []uint32{0} // cycle back to the start
+	cg[n] = []uint32{n + 1}
+
+	keep := map[uint32]struct{}{}
+	reach(cg, keep, 0)
+	if len(keep) != n {
+		t.Fatalf("expected %d reachable nodes, got %d", n, len(keep))
+	}
+	if _, ok := keep[n]; ok {
+		t.Error("expected unreachable node not to be kept")
+	}
+}
+
+func TestWasmOptUnknownOptions(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	fakeWasmOpt(t, `echo "Unknown option '--strip-debgu'" >&2
+exec cat`)
+
+	_, err := New().WithPolicy(policy).Compile()
+	exp := "wasm-opt: invalid arguments: Unknown option '--strip-debgu'"
+	if err == nil || err.Error() != exp {
+		t.Fatalf("expected error %q, got %v", exp, err)
+	}
+}
+
+func TestWasmOptOutputArgs(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	fakeWasmOpt(t, "exec cat")
+
+	for _, args := range []string{"-O2 -o out.wasm", "--output out.wasm", "--output=out.wasm"} {
+		t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", args)
+		_, err := New().WithPolicy(policy).Compile()
+		if err == nil || !strings.Contains(err.Error(), "wasm-opt arguments must not contain") {
+			t.Errorf("%s: expected error, got %v", args, err)
+		}
+	}
+
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "-O2 --debuginfo")
+	if _, err := New().WithPolicy(policy).Compile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		exp []string
+	}{
+		{in: "-O2 --debuginfo", exp: []string{"-O2", "--debuginfo"}},
+		{in: "  -O2 \t  --debuginfo  ", exp: []string{"-O2", "--debuginfo"}},
+		{in: `--pass-arg="a b" -O2`, exp: []string{"--pass-arg=a b", "-O2"}},
+		{in: `'--pass-arg=x "y"' a\ b`, exp: []string{`--pass-arg=x "y"`, "a b"}},
+		{in: `"" -O2 ''`, exp: []string{"-O2"}},
+		{in: "", exp: nil},
+	} {
+		act, err := splitArgs(tc.in)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.exp, act) {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.exp, act)
+		}
+	}
+	for _, in := range []string{`"-O2`, `-O2\`} {
+		if _, err := splitArgs(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestWithWasmOptArgs(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	out := filepath.Join(t.TempDir(), "args")
+	fakeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+for a in "$@"; do echo "$a" >> `+out+`; done
+exec cat`)
+
+	if _, err := New().WithPolicy(policy).WithWasmOptArgs("-O1", "--pass-arg=a b").Compile(); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := "-O1\n--pass-arg=a b\n-o\n-\n", string(bs); exp != act {
+		t.Errorf("expected arguments %q, got %q", exp, act)
+	}
+}
+
+func TestRequireWasmOpt(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	missing := filepath.Join(t.TempDir(), "wasm-opt")
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "silent")
+
+	if _, err := New().WithPolicy(policy).WithWasmOptPath(missing).Compile(); err != nil {
+		t.Fatalf("expected missing wasm-opt to be skipped by default, got %v", err)
+	}
+
+	exp := "wasm-opt binary " + missing + " not found, but optimization is required"
+	_, err := New().WithPolicy(policy).WithWasmOptPath(missing).WithRequireWasmOpt(true).Compile()
+	if err == nil || err.Error() != exp {
+		t.Fatalf("expected error %q, got %v", exp, err)
+	}
+
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "require")
+	_, err = New().WithPolicy(policy).WithWasmOptPath(missing).Compile()
+	if err == nil || err.Error() != exp {
+		t.Fatalf("expected error %q, got %v", exp, err)
+	}
+}
+
+func TestWithControlInstr(t *testing.T) {
+	for _, tc := range []struct {
+		note string
+		is   []instruction.Instruction
+		exp  bool
+	}{
+		{
+			note: "no control instructions",
+			is:   []instruction.Instruction{instruction.I32Const{Value: 1}, instruction.Drop{}},
+		},
+		{
+			note: "br",
+			is:   []instruction.Instruction{instruction.Br{Index: 0}},
+			exp:  true,
+		},
+		{
+			note: "br_if",
+			is:   []instruction.Instruction{instruction.I32Const{Value: 1}, instruction.BrIf{Index: 0}},
+			exp:  true,
+		},
+		{
+			note: "br_table in block",
+			is: []instruction.Instruction{instruction.Block{Instrs: []instruction.Instruction{
+				instruction.I32Const{Value: 1},
+				instruction.BrTable{Targets: []uint32{0, 1}, Default: 0},
+			}}},
+			exp: true,
+		},
+		{
+			note: "return in loop",
+			is: []instruction.Instruction{instruction.Loop{Instrs: []instruction.Instruction{
+				instruction.Return{},
+			}}},
+			exp: true,
+		},
+		{
+			note: "nested block without control instructions",
+			is: []instruction.Instruction{instruction.Block{Instrs: []instruction.Instruction{
+				instruction.If{Instrs: []instruction.Instruction{instruction.Nop{}}},
+			}}},
+		},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			if act := withControlInstr(tc.is); act != tc.exp {
+				t.Errorf("expected %v, got %v", tc.exp, act)
+			}
+		})
+	}
+}
+
+func TestWasmOptWarningOnce(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	fakeWasmOpt(t, "exec cat")
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "on")
+
+	var debug bytes.Buffer
+	c := New().WithPolicy(policy).WithDebug(&debug)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.optimizeBinaryen(); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(debug.String(), "WARNING: Using EXPERIMENTAL"); n != 1 {
+		t.Errorf("expected warning to be logged once, got %d times:\n%s", n, debug.String())
+	}
+}
+
+func TestWasmOptKeepsCustomSections(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// The fake wasm-opt drops all custom sections but one.
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def.Customs = []module.CustomSection{{Name: "kept", Data: []byte("by wasm-opt")}}
+	out := filepath.Join(t.TempDir(), "out.wasm")
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, def); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(out, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fakeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+cat >/dev/null
+exec cat `+out)
+
+	var debug bytes.Buffer
+	c := New().WithPolicy(policy).WithDebug(&debug)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	meta := module.CustomSection{Name: "metadata", Data: []byte{0, 1, 2, 0xff}}
+	c.module.Customs = append(c.module.Customs, meta, module.CustomSection{Name: "kept", Data: []byte("by opa")})
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string][][]byte{}
+	for _, s := range mod.Customs {
+		found[s.Name] = append(found[s.Name], s.Data)
+	}
+	if act := found[meta.Name]; len(act) != 1 || !bytes.Equal(act[0], meta.Data) {
+		t.Errorf("expected custom section %s to be restored, got %q", meta.Name, act)
+	}
+	if act := found["kept"]; len(act) != 1 || string(act[0]) != "by wasm-opt" {
+		t.Errorf("expected custom section kept by wasm-opt to be left as it is, got %q", act)
+	}
+	if exp := "custom sections dropped by wasm-opt"; !strings.Contains(debug.String(), exp) {
+		t.Errorf("expected debug output to contain %q", exp)
+	}
+}
+
+func TestWasmOptFallback(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exp bytes.Buffer
+	if err := encoding.WriteModule(&exp, def); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake wasm-opt passes the module through in the first pass, and
+	// gets killed in the second one.
+	fakeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+if [ "$1" = "-O3" ]; then cat > /dev/null; echo "Killed" >&2; exit 137; fi
+exec cat`)
+	c := New().WithPolicy(policy).WithWasmOptPasses([]string{"-Oz"}, []string{"-O3"})
+	if _, err := c.Compile(); err == nil {
+		t.Fatal("expected error without fallback")
+	}
+
+	var buf bytes.Buffer
+	c = New().WithPolicy(policy).WithWasmOptPasses([]string{"-Oz"}, []string{"-O3"}).WithWasmOptFallback(true).WithDebug(&buf)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := "wasm-opt failed, keeping the unoptimized module: wasm-opt-2: wasm-opt exited with code 137: Killed"; !strings.Contains(buf.String(), msg) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", msg, buf.String())
+	}
+	var act bytes.Buffer
+	if err := encoding.WriteModule(&act, mod); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exp.Bytes(), act.Bytes()) {
+		t.Error("expected unoptimized module")
+	}
+	for _, m := range c.PassMetrics() {
+		if strings.HasPrefix(m.Name, "wasm-opt") {
+			t.Errorf("expected no metrics of the failed optimization, got %v", m)
+		}
+	}
+
+	// canceling is still an error
+	fakeWasmOpt(t, "exec sleep 10")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := New().WithPolicy(policy).WithWasmOptFallback(true).CompileContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation error, got %v", err)
+	}
+}
+
+func TestWasmOptPasses(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// The fake wasm-opt records the arguments of each invocation on a line,
+	// and passes the module through, failing for -O3 if requested.
+	rec := filepath.Join(t.TempDir(), "args")
+	fakeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+echo "$@" >> `+rec+`
+[ -n "$FAIL" ] && [ "$1" = "-O3" ] && exit 1
+exec cat`)
+	runs := func() []string {
+		t.Helper()
+		bs, err := os.ReadFile(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(rec)
+		return strings.Split(strings.TrimSpace(string(bs)), "\n")
+	}
+	names := func(c *Compiler) []string {
+		var ret []string
+		for _, m := range c.PassMetrics() {
+			if strings.HasPrefix(m.Name, "wasm-opt") {
+				ret = append(ret, m.Name)
+			}
+		}
+		return ret
+	}
+
+	c := New().WithPolicy(policy).WithWasmOptPasses([]string{"-Oz"}, []string{"--flatten", "--rereloop"}, []string{"-O3"})
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := []string{"-Oz -o -", "--flatten --rereloop -o -", "-O3 -o -"}, runs(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected invocations %q, got %q", exp, act)
+	}
+	if exp, act := []string{"wasm-opt-1", "wasm-opt-2", "wasm-opt-3"}, names(c); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected passes %v, got %v", exp, act)
+	}
+	ms := c.PassMetrics()
+	for i := 1; i < len(ms); i++ {
+		if strings.HasPrefix(ms[i-1].Name, "wasm-opt") && ms[i].SizeBefore != ms[i-1].SizeAfter {
+			t.Errorf("pass %s: expected input of %d bytes, got %d", ms[i].Name, ms[i-1].SizeAfter, ms[i].SizeBefore)
+		}
+	}
+
+	// A single pass is run as before.
+	c = New().WithPolicy(policy).WithWasmOptPasses([]string{"-O1"})
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := []string{"-O1 -o -"}, runs(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected invocations %q, got %q", exp, act)
+	}
+	if exp, act := []string{"wasm-opt"}, names(c); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected passes %v, got %v", exp, act)
+	}
+
+	// Optimize options take precedence, and failing passes are reported.
+	t.Setenv("FAIL", "1")
+	_, err := c.Optimize(context.Background(), OptimizeOptions{WasmOpt: true, WasmOptPasses: [][]string{{"-Os"}, {"-O3"}, {"-O4"}}})
+	if exp := "wasm-opt-2: wasm-opt exited with code 1: no output"; err == nil || err.Error() != exp {
+		t.Errorf("expected error %q, got %v", exp, err)
+	}
+	if exp, act := []string{"-Os -o -", "-O3 -o -"}, runs(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected invocations %q, got %q", exp, act)
+	}
+}
+
+func TestParseCallGraph(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	eval, malloc, free := c.funcs["opa_eval"], c.funcs["opa_malloc"], c.funcs["opa_free"]
+
+	for _, tc := range []struct {
+		note string
+		csv  string
+		exp  map[uint32][]uint32
+		err  string
+	}{
+		{
+			note: "two fields",
+			csv:  "opa_eval,opa_malloc\nopa_eval,opa_free\n",
+			exp:  map[uint32][]uint32{eval: {malloc, free}},
+		},
+		{
+			note: "extra fields",
+			csv:  "opa_eval,opa_malloc,3\nopa_eval,opa_free,1,x\n",
+			exp:  map[uint32][]uint32{eval: {malloc, free}},
+		},
+		{
+			note: "too few fields",
+			csv:  "opa_eval,opa_malloc\nopa_eval\n",
+			err:  "csv read: row 2 has 1 fields, expected at least 2",
+		},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			cg, err := c.parseCallGraph([]byte(tc.csv))
+			switch {
+			case tc.err != "":
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case !reflect.DeepEqual(tc.exp, cg):
+				t.Errorf("expected call graph %v, got %v", tc.exp, cg)
+			}
+		})
+	}
+}
+
+func TestWithCallGraphCSV(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// opa_value_add_path is unused once it's no longer exported, unless the
+	// call graph says otherwise
+	for _, tc := range []struct {
+		note string
+		csv  func() []byte
+		kept bool
+	}{
+		{note: "embedded"},
+		{note: "custom", csv: func() []byte { return []byte("opa_eval,opa_value_add_path\n") }, kept: true},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			c := New().WithPolicy(policy).WithKeptExports("opa_eval").WithCallGraphCSV(tc.csv)
+			mod, err := c.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stubbed := isStub(mod.Code.Segments[int(c.function("opa_value_add_path"))-c.functionImportCount()].Code); stubbed == tc.kept {
+				t.Errorf("expected opa_value_add_path kept: %v", tc.kept)
+			}
+		})
+	}
+
+	_, err := New().WithPolicy(policy).WithCallGraphCSV(func() []byte { return []byte("opa_eval,opa_nope\n") }).Compile()
+	if exp := "callee not found: opa_nope (opa_nope)"; err == nil || err.Error() != exp {
+		t.Errorf("expected error %q, got %v", exp, err)
+	}
+}
+
+func TestLibraryCallGraphCached(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`re_match("^a", input.foo)`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	cg, err := c.libraryCallGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := make(map[uint32][]uint32, len(cg))
+	for caller, callees := range cg {
+		exp[caller] = append([]uint32(nil), callees...)
+	}
+
+	// adds the library's indirect calls to the call graph
+	if _, err := New().WithPolicy(policy).WithShrinkTable(true).Compile(); err != nil {
+		t.Fatal(err)
+	}
+	act, err := c.libraryCallGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.ValueOf(act).Pointer() != reflect.ValueOf(cg).Pointer() {
+		t.Error("expected cached call graph to be reused")
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Error("expected cached call graph to be unchanged")
+	}
+}
+
+func TestWasmOptRunner(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// no wasm-opt binary is needed
+	missing := filepath.Join(t.TempDir(), "wasm-opt")
+	var args []string
+	var in []byte
+	runner := func(_ context.Context, a []string, mod []byte) ([]byte, []byte, error) {
+		args, in = a, mod
+		return mod, nil, nil
+	}
+	c := New().WithPolicy(policy).WithWasmOptPath(missing).WithRequireWasmOpt(true).WithWasmOptRunner(runner)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"-O2", "--debuginfo"}; !reflect.DeepEqual(exp, args) {
+		t.Errorf("expected arguments %v, got %v", exp, args)
+	}
+	var act bytes.Buffer
+	if err := encoding.WriteModule(&act, mod); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in, act.Bytes()) {
+		t.Error("expected the runner's output to replace the module")
+	}
+	if n := len(c.PassMetrics()); n == 0 || c.PassMetrics()[n-1].Name != "wasm-opt" {
+		t.Errorf("expected wasm-opt metrics, got %v", c.PassMetrics())
+	}
+
+	failing := func(context.Context, []string, []byte) ([]byte, []byte, error) {
+		return nil, []byte("out of memory"), errors.New("trap")
+	}
+	_, err = New().WithPolicy(policy).WithRequireWasmOpt(true).WithWasmOptRunner(failing).Compile()
+	if exp := "run wasm-opt: trap: out of memory"; err == nil || err.Error() != exp {
+		t.Fatalf("expected error %q, got %v", exp, err)
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/internal/debug"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// OptimizeOptions controls Optimize. Fields left at their zero value fall
+// back to the compiler's options, and the EXPERIMENTAL_WASM_OPT* environment
+// variables, so that the zero value behaves like the optimization run as
+// part of Compile.
+type OptimizeOptions struct {
+	WasmOpt          bool          // run wasm-opt, even if not opted into via EXPERIMENTAL_WASM_OPT
+	WasmOptPath      string        // wasm-opt binary, see WithWasmOptPath
+	WasmOptArgs      []string      // wasm-opt arguments, see WithWasmOptArgs
+	OptLevel         OptLevel      // wasm-opt optimization level, instead of the default -O2; ignored if arguments are set
+	WasmOptPasses    [][]string    // several wasm-opt invocations, see WithWasmOptPasses; overrides WasmOptArgs
+	WasmOptTimeout   time.Duration // wasm-opt timeout, see WithWasmOptTimeout; negative for none
+	Strict           bool          // fail on wasm-opt warnings, see WithWasmOptWarningsAsErrors
+	RemoveUnusedCode bool          // remove unused functions first, see WithCompactUnusedCode
+	DryRun           bool          // only report the effect, keeping the module as it is
+
+	timeoutSource string // the setting WasmOptTimeout was taken from
+}
+
+// OptLevel is a wasm-opt optimization level, see OptimizeOptions.
+type OptLevel int
+
+// The optimization levels, OptLevelDefault keeps the default arguments.
+const (
+	OptLevelDefault        OptLevel = iota
+	OptLevelNone                    // -O0
+	OptLevelSize                    // -Oz
+	OptLevelSizeAggressive          // -Os
+	OptLevelSpeed2                  // -O2
+	OptLevelSpeed3                  // -O3
+)
+
+var optLevelFlags = map[OptLevel]string{
+	OptLevelNone:           "-O0",
+	OptLevelSize:           "-Oz",
+	OptLevelSizeAggressive: "-Os",
+	OptLevelSpeed2:         "-O2",
+	OptLevelSpeed3:         "-O3",
+}
+
+// Flag returns the wasm-opt flag selecting the level, or "" for
+// OptLevelDefault and unknown levels.
+func (l OptLevel) Flag() string {
+	return optLevelFlags[l]
+}
+
+// ParseOptLevel returns the level selected by a wasm-opt flag, like "-Oz",
+// with or without the leading dash.
+func ParseOptLevel(s string) (OptLevel, error) {
+	flag := "-" + strings.TrimPrefix(s, "-")
+	for l, f := range optLevelFlags {
+		if f == flag {
+			return l, nil
+		}
+	}
+	return OptLevelDefault, fmt.Errorf("unknown optimization level %q", s)
+}
+
+// WithOptLevel sets the wasm-opt optimization level, instead of the default
+// -O2. Like OptimizeOptions.OptLevel, it's ignored if wasm-opt arguments are
+// set, and takes precedence over the EXPERIMENTAL_WASM_OPT_ARGS environment
+// variable. It doesn't opt into running wasm-opt, see WithRequireWasmOpt.
+func (c *Compiler) WithOptLevel(l OptLevel) *Compiler {
+	c.woptLevel = l
+	return c
+}
+
+// Optimize optimizes the compiled module, replacing it: see Module. It must
+// be called after Compile. If ctx is canceled, a running wasm-opt process is
+// killed. The result compares the encoded module before and after; for a
+// dry run, the module is left unchanged, but any errors are still returned.
+func (c *Compiler) Optimize(ctx context.Context, opts OptimizeOptions) (PassResult, error) {
+	if c.stagesRun < len(c.stages) {
+		return PassResult{}, errors.New("optimize: module not compiled yet")
+	}
+	var before bytes.Buffer
+	if err := encoding.WriteModule(&before, c.module); err != nil {
+		return PassResult{}, fmt.Errorf("encode module: %w", err)
+	}
+	if opts.DryRun { // optimize a copy
+		mod, err := encoding.ReadModule(bytes.NewReader(before.Bytes()))
+		if err != nil {
+			return PassResult{}, fmt.Errorf("decode module: %w", err)
+		}
+		orig, compacted, metrics := c.module, c.compacted, len(c.passMetrics)
+		c.module = mod
+		defer func() {
+			c.module, c.compacted, c.passMetrics = orig, compacted, c.passMetrics[:metrics]
+		}()
+	}
+	if err := c.optimize(ctx, opts); err != nil {
+		return PassResult{}, err
+	}
+	if err := c.emitMemoryChecksum(); err != nil {
+		return PassResult{}, err
+	}
+	var after bytes.Buffer
+	if err := encoding.WriteModule(&after, c.module); err != nil {
+		return PassResult{}, fmt.Errorf("encode module: %w", err)
+	}
+	return PassResult{
+		Changed:    !bytes.Equal(before.Bytes(), after.Bytes()),
+		SizeBefore: before.Len(),
+		SizeAfter:  after.Len(),
+	}, nil
+}
+
+// Module returns the compiled module, as optimized by Optimize.
+func (c *Compiler) Module() *module.Module {
+	return c.module
+}
+
+func (c *Compiler) optimize(ctx context.Context, opts OptimizeOptions) error {
+	if opts.RemoveUnusedCode && !c.compacted {
+		prev := c.compact
+		c.compact = true
+		err := c.compactUnusedCode()
+		c.compact = prev
+		if err != nil {
+			return err
+		}
+		if err := c.emitSourceMap(); err != nil {
+			return err
+		}
+	}
+
+	run, required := c.woptEnabled(opts)
+	if !run {
+		c.debug.Printf("not opted in, skipping wasm-opt optimization")
+		return nil
+	}
+	opts, err := c.optimizeOptions(opts)
+	if err != nil {
+		return err
+	}
+	if opts.Strict {
+		prev := c.woptStrict
+		c.woptStrict = true
+		defer func() { c.woptStrict = prev }()
+	}
+	return c.runBinaryen(ctx, opts, required)
+}
+
+// CompileOptimized compiles the module, like CompileContext, with the
+// optimization stage run using opts instead of the defaults, and returns the
+// encoded module. The final module's structure is always validated, see
+// WithValidateStructure. It must be called before Compile; dry runs aren't
+// supported.
+func (c *Compiler) CompileOptimized(ctx context.Context, opts OptimizeOptions) ([]byte, error) {
+	if c.stagesRun == len(c.stages) {
+		return nil, errors.New("compile optimized: module already compiled")
+	}
+	if opts.DryRun {
+		return nil, errors.New("compile optimized: dry run not supported")
+	}
+	prevOpts, prevValidate := c.optimizeOpts, c.validate
+	c.optimizeOpts, c.validate = &opts, true
+	defer func() { c.optimizeOpts, c.validate = prevOpts, prevValidate }()
+
+	mod, err := c.CompileContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("compile optimized: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, mod); err != nil {
+		return nil, fmt.Errorf("encode module: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// woptEnabled returns whether wasm-opt is run with opts, and whether it's
+// required to be.
+func (c *Compiler) woptEnabled(opts OptimizeOptions) (run, required bool) {
+	required = c.woptRequired || os.Getenv("EXPERIMENTAL_WASM_OPT") == "require"
+	run = opts.WasmOpt || required || os.Getenv("EXPERIMENTAL_WASM_OPT") != "" || os.Getenv("EXPERIMENTAL_WASM_OPT_ARGS") != ""
+	return run, required
+}
+
+// WasmOptSettings describes how Compile runs wasm-opt, see
+// Compiler.WasmOptSettings.
+type WasmOptSettings struct {
+	Enabled bool       `json:"enabled"`
+	Path    string     `json:"path,omitempty"`    // resolved binary, empty if run in-process
+	Version string     `json:"version,omitempty"` // of the binary, or "runner"
+	Passes  [][]string `json:"passes,omitempty"`  // arguments of each invocation
+}
+
+// WasmOptSettings resolves how Compile runs wasm-opt, from the compiler's
+// options and the environment, e.g. for keying caches of compiled modules.
+// The version of a runner set by WithWasmOptRunner isn't known: it's up to
+// the caller to account for it.
+func (c *Compiler) WasmOptSettings(ctx context.Context) (WasmOptSettings, error) {
+	var opts OptimizeOptions
+	if c.optimizeOpts != nil {
+		opts = *c.optimizeOpts
+	}
+	if run, _ := c.woptEnabled(opts); !run {
+		return WasmOptSettings{}, nil
+	}
+	prev := c.debug // resolving again doesn't warrant logging
+	c.debug = debug.Discard()
+	opts, err := c.optimizeOptions(opts)
+	c.debug = prev
+	if err != nil {
+		return WasmOptSettings{}, err
+	}
+	s := WasmOptSettings{Enabled: true, Passes: opts.WasmOptPasses}
+	bin, ok := woptFound(opts.WasmOptPath)
+	switch {
+	case c.woptRunner != nil:
+		s.Version = "runner"
+	case ok:
+		s.Path = bin
+		if s.Version, err = woptVersion(ctx, bin); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// optimizeOptions fills in the wasm-opt settings not set in opts. The
+// arguments are taken from the first of these that is set:
+//
+//  1. opts' WasmOptPasses or WasmOptArgs
+//  2. WithWasmOptPasses or WithWasmOptArgs
+//  3. the EXPERIMENTAL_WASM_OPT_ARGS environment variable, unless opts'
+//     OptLevel or WithOptLevel is set
+//  4. the defaults, with the optimization level applied, if set
+//
+// Options set explicitly hence take precedence over the environment.
+func (c *Compiler) optimizeOptions(opts OptimizeOptions) (OptimizeOptions, error) {
+	if opts.WasmOptPath == "" {
+		opts.WasmOptPath = c.wasmOptPath()
+	}
+	if opts.OptLevel == OptLevelDefault {
+		opts.OptLevel = c.woptLevel
+	}
+	if opts.OptLevel != OptLevelDefault && opts.OptLevel.Flag() == "" {
+		return opts, fmt.Errorf("unknown optimization level %d", opts.OptLevel)
+	}
+	env := os.Getenv("EXPERIMENTAL_WASM_OPT_ARGS")
+	switch {
+	case opts.WasmOptPasses != nil:
+		c.ignoreOptLevel(opts.OptLevel)
+	case opts.WasmOptArgs != nil:
+		c.ignoreOptLevel(opts.OptLevel)
+		opts.WasmOptPasses = [][]string{opts.WasmOptArgs}
+	case c.woptPasses != nil:
+		c.ignoreOptLevel(opts.OptLevel)
+		opts.WasmOptPasses = c.woptPasses
+	case c.woptArgs != nil:
+		c.ignoreOptLevel(opts.OptLevel)
+		opts.WasmOptPasses = [][]string{append([]string(nil), c.woptArgs...)}
+	case env != "" && opts.OptLevel == OptLevelDefault:
+		args, err := splitArgs(env)
+		if err != nil {
+			return opts, fmt.Errorf("EXPERIMENTAL_WASM_OPT_ARGS: %w", err)
+		}
+		opts.WasmOptPasses = [][]string{args}
+	default:
+		if env != "" {
+			c.debug.Printf("optimization level %s set, ignoring EXPERIMENTAL_WASM_OPT_ARGS", opts.OptLevel.Flag())
+		}
+		args := []string{
+			"-O2",
+			"--debuginfo", // don't strip name section
+		}
+		if c.minimal {
+			args = []string{"-Oz"}
+		} else if c.stripNames {
+			args = []string{"-O2"}
+		}
+		if flag := opts.OptLevel.Flag(); flag != "" {
+			args[0] = flag
+		}
+		opts.WasmOptPasses = [][]string{args}
+	}
+	opts.WasmOptPasses = c.withFeatureFlags(opts.WasmOptPasses)
+	switch {
+	case opts.WasmOptTimeout < 0:
+		opts.WasmOptTimeout = 0
+	case opts.WasmOptTimeout == 0:
+		timeout, source, err := c.wasmOptTimeout()
+		if err != nil {
+			return opts, err
+		}
+		opts.WasmOptTimeout, opts.timeoutSource = timeout, source
+	default:
+		opts.timeoutSource = "OptimizeOptions.WasmOptTimeout"
+	}
+	opts.Strict = opts.Strict || c.woptStrict
+	return opts, nil
+}
+
+// withFeatureFlags returns passes with the wasm-opt flags enabling the
+// features declared via WithFeatures appended to each pass, so that the code
+// making use of them is accepted. Flags already passed, or disabling the
+// feature, are left as they are.
+func (c *Compiler) withFeatureFlags(passes [][]string) [][]string {
+	if len(c.features) == 0 {
+		return passes
+	}
+	fs := make([]string, 0, len(c.features))
+	for f := range c.features {
+		fs = append(fs, string(f))
+	}
+	sort.Strings(fs)
+	ret := make([][]string, len(passes))
+	for i, args := range passes {
+		ret[i] = append([]string(nil), args...)
+		for _, f := range fs {
+			enable, disable := "--enable-"+f, "--disable-"+f
+			if !containsArg(args, enable) && !containsArg(args, disable) && !containsArg(args, "--all-features") {
+				ret[i] = append(ret[i], enable)
+			}
+		}
+	}
+	return ret
+}
+
+func containsArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Compiler) ignoreOptLevel(l OptLevel) {
+	if l != OptLevelDefault {
+		c.debug.Printf("wasm-opt arguments set, ignoring optimization level %s", l.Flag())
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+)
+
+func TestOptimize(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// The fake wasm-opt records its arguments, and passes the module through.
+	out := filepath.Join(t.TempDir(), "args")
+	path := writeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+for a in "$@"; do echo "$a" >> `+out+`; done
+exec cat`)
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "")
+	args := func() string {
+		bs, err := os.ReadFile(out)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		os.Remove(out)
+		return string(bs)
+	}
+	ctx := context.Background()
+
+	if _, err := New().WithPolicy(policy).Optimize(ctx, OptimizeOptions{}); err == nil {
+		t.Fatal("expected error for module not compiled yet")
+	}
+
+	c := New().WithPolicy(policy).WithWasmOptPath(path)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if act := args(); act != "" {
+		t.Fatalf("expected wasm-opt not to run when not opted in, got arguments %q", act)
+	}
+
+	// The zero value behaves like Compile.
+	if _, err := c.Optimize(ctx, OptimizeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if act := args(); act != "" {
+		t.Fatalf("expected wasm-opt not to run when not opted in, got arguments %q", act)
+	}
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "-O3")
+	if _, err := c.Optimize(ctx, OptimizeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := "-O3\n-o\n-\n", args(); exp != act {
+		t.Fatalf("expected arguments %q, got %q", exp, act)
+	}
+
+	// Options set take precedence over the environment.
+	if _, err := c.Optimize(ctx, OptimizeOptions{WasmOpt: true, WasmOptArgs: []string{"-O1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := "-O1\n-o\n-\n", args(); exp != act {
+		t.Fatalf("expected arguments %q, got %q", exp, act)
+	}
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "")
+
+	before := len(c.Module().Code.Segments)
+	if _, err := c.Optimize(ctx, OptimizeOptions{RemoveUnusedCode: true}); err != nil {
+		t.Fatal(err)
+	}
+	if after := len(c.Module().Code.Segments); after >= before {
+		t.Errorf("expected unused functions to be removed, got %d (before: %d)", after, before)
+	}
+}
+
+func TestOptimizeOptLevel(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	out := filepath.Join(t.TempDir(), "args")
+	path := writeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+echo "$@" > `+out+`
+exec cat`)
+	var buf bytes.Buffer
+	c := New().WithPolicy(policy).WithWasmOptPath(path).WithDebug(&buf)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	optimize := func(opts OptimizeOptions) string {
+		t.Helper()
+		opts.WasmOpt = true
+		if _, err := c.Optimize(context.Background(), opts); err != nil {
+			t.Fatal(err)
+		}
+		bs, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(bs))
+	}
+
+	for level, exp := range map[OptLevel]string{
+		OptLevelDefault:        "-O2 --debuginfo -o -",
+		OptLevelNone:           "-O0 --debuginfo -o -",
+		OptLevelSize:           "-Oz --debuginfo -o -",
+		OptLevelSizeAggressive: "-Os --debuginfo -o -",
+		OptLevelSpeed2:         "-O2 --debuginfo -o -",
+		OptLevelSpeed3:         "-O3 --debuginfo -o -",
+	} {
+		if act := optimize(OptimizeOptions{OptLevel: level}); exp != act {
+			t.Errorf("level %d: expected arguments %q, got %q", level, exp, act)
+		}
+	}
+
+	// explicit arguments win
+	if exp, act := "-O1 -o -", optimize(OptimizeOptions{OptLevel: OptLevelSpeed3, WasmOptArgs: []string{"-O1"}}); exp != act {
+		t.Errorf("expected arguments %q, got %q", exp, act)
+	}
+	if exp := "ignoring optimization level -O3"; !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", exp, buf.String())
+	}
+
+	// an explicit level wins over the environment, which replaces the
+	// defaults otherwise
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "-O1")
+	if exp, act := "-O3 --debuginfo -o -", optimize(OptimizeOptions{OptLevel: OptLevelSpeed3}); exp != act {
+		t.Errorf("expected arguments %q, got %q", exp, act)
+	}
+	if exp := "ignoring EXPERIMENTAL_WASM_OPT_ARGS"; !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", exp, buf.String())
+	}
+	if exp, act := "-O1 -o -", optimize(OptimizeOptions{}); exp != act {
+		t.Errorf("expected arguments %q, got %q", exp, act)
+	}
+
+	if _, err := c.Optimize(context.Background(), OptimizeOptions{WasmOpt: true, OptLevel: 42}); err == nil {
+		t.Error("expected error for unknown optimization level")
+	}
+}
+
+func TestWithOptLevel(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	out := filepath.Join(t.TempDir(), "args")
+	path := writeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+echo "$@" > `+out+`
+exec cat`)
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "")
+	l, err := ParseOptLevel("Oz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New().WithPolicy(policy).WithWasmOptPath(path).WithRequireWasmOpt(true).WithOptLevel(l)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := "-Oz --debuginfo -o -", strings.TrimSpace(string(bs)); exp != act {
+		t.Errorf("expected arguments %q, got %q", exp, act)
+	}
+
+	// the options passed to Optimize win
+	if _, err := c.Optimize(context.Background(), OptimizeOptions{OptLevel: OptLevelSpeed3}); err != nil {
+		t.Fatal(err)
+	}
+	bs, err = os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := "-O3 --debuginfo -o -", strings.TrimSpace(string(bs)); exp != act {
+		t.Errorf("expected arguments %q, got %q", exp, act)
+	}
+
+	// the compiler's options win over the environment
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "-O1")
+	for _, tc := range []struct {
+		c   *Compiler
+		exp string
+	}{
+		{New().WithOptLevel(l), "-Oz --debuginfo -o -"},
+		{New().WithWasmOptArgs("-O0"), "-O0 -o -"},
+		{New(), "-O1 -o -"},
+	} {
+		if _, err := tc.c.WithPolicy(policy).WithWasmOptPath(path).Compile(); err != nil {
+			t.Fatal(err)
+		}
+		bs, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act := strings.TrimSpace(string(bs)); tc.exp != act {
+			t.Errorf("expected arguments %q, got %q", tc.exp, act)
+		}
+	}
+}
+
+func TestWasmOptSettings(t *testing.T) {
+	ctx := context.Background()
+	path := writeWasmOpt(t, `echo "wasm-opt version 116 (version_116)"`)
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "")
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "")
+
+	s, err := New().WithWasmOptPath(path).WasmOptSettings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Enabled {
+		t.Errorf("expected wasm-opt not to be enabled, got %+v", s)
+	}
+
+	s, err = New().WithWasmOptPath(path).WithRequireWasmOpt(true).WithOptLevel(OptLevelSize).WasmOptSettings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := WasmOptSettings{Enabled: true, Path: path, Version: "116", Passes: [][]string{{"-Oz", "--debuginfo"}}}
+	if !reflect.DeepEqual(exp, s) {
+		t.Errorf("expected %+v, got %+v", exp, s)
+	}
+
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "-O1")
+	s, err = New().WithWasmOptPath(path).WasmOptSettings(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := [][]string{{"-O1"}}; !s.Enabled || !reflect.DeepEqual(exp, s.Passes) {
+		t.Errorf("expected passes %v from the environment, got %+v", exp, s)
+	}
+}
+
+func TestParseOptLevel(t *testing.T) {
+	for s, exp := range map[string]OptLevel{
+		"O0":  OptLevelNone,
+		"-Oz": OptLevelSize,
+		"Os":  OptLevelSizeAggressive,
+		"-O2": OptLevelSpeed2,
+		"O3":  OptLevelSpeed3,
+	} {
+		act, err := ParseOptLevel(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if act != exp {
+			t.Errorf("%s: expected level %d, got %d", s, exp, act)
+		}
+	}
+	for _, s := range []string{"", "O1", "Ox", "--O2"} {
+		if _, err := ParseOptLevel(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestOptimizeTimeout(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	path := writeWasmOpt(t, "exec sleep 10")
+	c := New().WithPolicy(policy).WithWasmOptPath(path).WithWasmOptTimeout(time.Hour)
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "")
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := c.Optimize(context.Background(), OptimizeOptions{WasmOpt: true, WasmOptTimeout: 100 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+func TestOptimizeDryRun(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	path := writeWasmOpt(t, "exec cat")
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "")
+	c := New().WithPolicy(policy).WithWasmOptPath(path)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before bytes.Buffer
+	if err := encoding.WriteModule(&before, mod); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := func() {
+		t.Helper()
+		if c.Module() != mod {
+			t.Fatal("expected module to be kept")
+		}
+		var after bytes.Buffer
+		if err := encoding.WriteModule(&after, mod); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before.Bytes(), after.Bytes()) {
+			t.Fatal("expected module to be unchanged")
+		}
+	}
+
+	res, err := c.Optimize(context.Background(), OptimizeOptions{WasmOpt: true, RemoveUnusedCode: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchanged()
+	if !res.Changed || res.SizeBefore != before.Len() || res.Saved() <= 0 || res.Reduction() <= 0 {
+		t.Errorf("expected size reduction, got %+v (%.1f%%)", res, res.Reduction())
+	}
+	if n := len(c.PassMetrics()); n != 1 {
+		t.Errorf("expected metrics of the dry run to be dropped, got %d passes", n)
+	}
+
+	// The real run has the same effect.
+	act, err := c.Optimize(context.Background(), OptimizeOptions{WasmOpt: true, RemoveUnusedCode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act != res {
+		t.Errorf("expected %+v, got %+v", res, act)
+	}
+
+	// Errors are reported, and the module is kept.
+	c = New().WithPolicy(policy).WithWasmOptPath(writeWasmOpt(t, "exit 1"))
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "")
+	if mod, err = c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	before.Reset()
+	if err := encoding.WriteModule(&before, mod); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Optimize(context.Background(), OptimizeOptions{WasmOpt: true, RemoveUnusedCode: true, DryRun: true}); err == nil {
+		t.Fatal("expected error")
+	}
+	unchanged()
+}
+
+func TestCompileOptimized(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	out := filepath.Join(t.TempDir(), "args")
+	path := writeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+echo "$@" >> `+out+`
+exec cat`)
+	t.Setenv("EXPERIMENTAL_WASM_OPT", "")
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New().WithPolicy(policy).WithWasmOptPath(path)
+	bs, err := c.CompileOptimized(context.Background(), OptimizeOptions{WasmOpt: true, OptLevel: OptLevelSize, RemoveUnusedCode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, err := encoding.ReadModule(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mod.Code.Segments) >= len(def.Code.Segments) {
+		t.Errorf("expected unused functions to be removed, got %d (default: %d)", len(mod.Code.Segments), len(def.Code.Segments))
+	}
+	args, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wasm-opt runs once, with the options passed
+	if exp, act := "-Oz --debuginfo -o -", strings.TrimSpace(string(args)); exp != act {
+		t.Errorf("expected arguments %q, got %q", exp, act)
+	}
+	if c.validate || c.optimizeOpts != nil {
+		t.Error("expected compiler options to be restored")
+	}
+
+	if _, err := c.CompileOptimized(context.Background(), OptimizeOptions{}); err == nil {
+		t.Error("expected error for module already compiled")
+	}
+	if _, err := New().WithPolicy(policy).CompileOptimized(context.Background(), OptimizeOptions{DryRun: true}); err == nil {
+		t.Error("expected error for dry run")
+	}
+
+	failing := writeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+cat > /dev/null
+echo "boom" >&2
+exit 3`)
+	_, err = New().WithPolicy(policy).WithWasmOptPath(failing).CompileOptimized(context.Background(), OptimizeOptions{WasmOpt: true})
+	if exp := "compile optimized: wasm-opt exited with code 3: boom"; err == nil || err.Error() != exp {
+		t.Fatalf("expected error %q, got %v", exp, err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/open-policy-agent/opa/ir"
+)
+
+// WithParallelism sets the number of policy functions compiled concurrently.
+// It defaults to GOMAXPROCS; 1 compiles them one after the other. The module
+// doesn't depend on it: the functions are emitted in the policy's order.
+func (c *Compiler) WithParallelism(n int) *Compiler {
+	c.parallelism = n
+	return c
+}
+
+// compiledFunc is the outcome of compiling a policy function on a copy of
+// the compiler, see compileFuncsCode.
+type compiledFunc struct {
+	code     []funcCode
+	errors   []error
+	err      error
+	panicked interface{}
+}
+
+// compileFuncsCode compiles the policy functions. With more than one worker,
+// each function is compiled by a shallow copy of the compiler, which holds
+// the per-function state: the code and locals. Everything else it uses is
+// only read while compiling, including the type section, as the type that
+// dynamic calls refer to is that of the functions in the table, which are
+// declared already. The outcomes are collected in the policy's order, so
+// that the module and the errors don't depend on scheduling.
+func (c *Compiler) compileFuncsCode() error {
+	fns := c.policy.Funcs.Funcs
+	workers := c.parallelism
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(fns) {
+		workers = len(fns)
+	}
+	if workers <= 1 {
+		for _, fn := range fns {
+			if err := c.compileFunc(fn); err != nil {
+				return fmt.Errorf("func %v: %w", fn.Name, err)
+			}
+		}
+		return nil
+	}
+
+	results := make([]compiledFunc, len(fns))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = c.compileFuncCopy(fns[i])
+			}
+		}()
+	}
+	for i := range fns {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	c.debug.Printf("compiled %d functions using %d workers", len(fns), workers)
+
+	for i, fn := range fns {
+		res := results[i]
+		if res.panicked != nil {
+			panic(res.panicked)
+		}
+		c.errors = append(c.errors, res.errors...)
+		if res.err != nil {
+			return fmt.Errorf("func %v: %w", fn.Name, res.err)
+		}
+		for _, f := range res.code {
+			if err := c.storeFunc(f.name, f.code); err != nil {
+				return fmt.Errorf("func %v: %w", fn.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// compileFuncCopy compiles fn on a copy of the compiler. Panics are passed
+// on, to be re-thrown by the caller's goroutine.
+func (c *Compiler) compileFuncCopy(fn *ir.Func) (res compiledFunc) {
+	fc := *c
+	fc.errors, fc.funcsCode = nil, nil
+	defer func() {
+		if e := recover(); e != nil {
+			res = compiledFunc{panicked: e}
+		}
+	}()
+	err := fc.compileFunc(fn)
+	return compiledFunc{code: fc.funcsCode, errors: fc.errors, err: err}
+}
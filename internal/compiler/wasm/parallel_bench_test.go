@@ -0,0 +1,37 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+)
+
+// BenchmarkParallelism measures compiling a thousand rules one after the
+// other, and concurrently.
+func BenchmarkParallelism(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString("package test\n\n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&sb, "r%d { input.x[_] > %d; startswith(input.s, \"%d\"); count(input.y) < %d }\n", i, i, i, i)
+	}
+	policy := planModules(b, sb.String(), planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+	})
+	for _, n := range []int{1, 0} {
+		b.Run(fmt.Sprintf("parallelism=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := New().WithPolicy(policy).WithParallelism(n).Compile(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+)
+
+func TestParallelism(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("package test\n\nf(x) = y { y := x * 2 }\n")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&b, "r%d { f(input.x) > %d; startswith(input.s, \"%d\") }\n", i, i, i)
+	}
+	policy := planModules(t, b.String(), planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+	})
+
+	encode := func(parallelism int) []byte {
+		t.Helper()
+		mod, err := New().WithPolicy(policy).WithParallelism(parallelism).Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := encoding.WriteModule(&buf, mod); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	exp := encode(1)
+	for _, n := range []int{0, 2, 8} {
+		if !bytes.Equal(exp, encode(n)) {
+			t.Errorf("parallelism %d: expected the same module as without", n)
+		}
+	}
+}
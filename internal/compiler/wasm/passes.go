@@ -0,0 +1,358 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// InstructionPass rewrites the instructions of a function body. It is
+// handed the top-level instructions of each retained function; passes
+// that want to rewrite nested blocks can be wrapped using Nested.
+type InstructionPass func([]instruction.Instruction) []instruction.Instruction
+
+// Nested returns a pass that applies p to the instruction sequence given,
+// and to the instructions of every (transitively) nested block, loop and if.
+// Inner sequences are rewritten before the outer ones.
+func Nested(p InstructionPass) InstructionPass {
+	var rec InstructionPass
+	rec = func(is []instruction.Instruction) []instruction.Instruction {
+		ret := make([]instruction.Instruction, len(is))
+		for i, instr := range is {
+			switch instr := instr.(type) {
+			case instruction.Block:
+				instr.Instrs = rec(instr.Instrs)
+				ret[i] = instr
+			case instruction.Loop:
+				instr.Instrs = rec(instr.Instrs)
+				ret[i] = instr
+			case instruction.If:
+				instr.Instrs = rec(instr.Instrs)
+				ret[i] = instr
+			default:
+				ret[i] = instr
+			}
+		}
+		return p(ret)
+	}
+	return rec
+}
+
+// WithPeephole toggles removing obvious waste from each function body
+// compiled from the policy, after the registered instruction passes, see
+// peepholePass. Unlike wasm-opt, it requires no external tool.
+func (c *Compiler) WithPeephole(enabled bool) *Compiler {
+	c.peephole = enabled
+	return c
+}
+
+// WithInstructionPasses registers passes to be applied, in order, to each
+// function body compiled from the policy, after unused code has been removed.
+func (c *Compiler) WithInstructionPasses(ps ...InstructionPass) *Compiler {
+	c.passes = append(c.passes, ps...)
+	return c
+}
+
+// applyInstructionPasses runs the registered instruction passes on each
+// compiled function. When debug output is requested, the stack effect of
+// every rewritten body is checked against its state before the pass ran.
+func (c *Compiler) applyInstructionPasses() error {
+	check := c.debug.Writer() != io.Discard
+	passes := c.passes
+	if c.peephole {
+		passes = append(passes[:len(passes):len(passes)], Nested(c.peepholePass))
+	}
+	if c.minimal {
+		passes = append(passes[:len(passes):len(passes)], Nested(SimplifyLocals))
+	}
+	for i, p := range passes {
+		for _, f := range c.funcsCode {
+			before := f.code.Func.Expr.Instrs
+			after := p(before)
+			if check {
+				if err := c.checkStackBalance(f.name, before, after); err != nil {
+					return fmt.Errorf("instruction pass %d: %w", i, err)
+				}
+			}
+			f.code.Func.Expr.Instrs = after
+		}
+		if err := c.writeSnapshot(fmt.Sprintf("pass-%d", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Compiler) checkStackBalance(name string, before, after []instruction.Instruction) error {
+	b, ok := c.stackDelta(before)
+	if !ok {
+		return nil
+	}
+	a, ok := c.stackDelta(after)
+	if !ok {
+		return nil
+	}
+	if a != b {
+		return fmt.Errorf("func %s: stack effect changed from %d to %d", name, b, a)
+	}
+	return nil
+}
+
+// stackDelta returns the net number of values the given instruction sequence
+// leaves on the stack. If that can't be determined -- because an instruction
+// is unknown, or control flow makes the stack polymorphic -- false is
+// returned.
+func (c *Compiler) stackDelta(is []instruction.Instruction) (int, bool) {
+	var n int
+	for _, instr := range is {
+		switch instr := instr.(type) {
+		case instruction.Unreachable, instruction.Br, instruction.BrTable, instruction.Return,
+			instruction.ReturnCall, instruction.ReturnCallIndirect:
+			return 0, false
+		case instruction.Nop:
+		case instruction.I32Const, instruction.I64Const, instruction.F32Const, instruction.F64Const,
+			instruction.GetLocal:
+			n++
+		case instruction.I32Eqz, instruction.TeeLocal, instruction.I32Load:
+		case instruction.I32Eq, instruction.I32Ne, instruction.I32GtS, instruction.I32GeS,
+			instruction.I32LtS, instruction.I32LeS, instruction.I32Add, instruction.I64Add,
+			instruction.F32Add, instruction.F64Add, instruction.I32Mul, instruction.I32Sub,
+			instruction.SetLocal, instruction.Drop, instruction.BrIf:
+			n--
+		case instruction.Select, instruction.I32Store:
+			n -= 2
+		case instruction.Call:
+			tpe, ok := c.functionType(instr.Index)
+			if !ok {
+				return 0, false
+			}
+			n += len(tpe.Results) - len(tpe.Params)
+		case instruction.CallIndirect:
+			if int(instr.Index) >= len(c.module.Type.Functions) {
+				return 0, false
+			}
+			tpe := c.module.Type.Functions[instr.Index]
+			n += len(tpe.Results) - len(tpe.Params) - 1
+		case instruction.Block, instruction.Loop:
+			if instr.(instruction.StructuredInstruction).BlockType() != nil {
+				n++
+			}
+		case instruction.If:
+			n--
+			if instr.Type != nil {
+				n++
+			}
+		default:
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// functionType returns the type of the function at index idx, which can
+// refer to an imported function, or a function of the module.
+func (c *Compiler) functionType(idx uint32) (module.FunctionType, bool) {
+	var tidx uint32
+	imports := uint32(c.functionImportCount())
+	if idx < imports {
+		var n uint32
+		for _, imp := range c.module.Import.Imports {
+			if fi, ok := imp.Descriptor.(module.FunctionImport); ok {
+				if n == idx {
+					tidx = fi.Func
+					break
+				}
+				n++
+			}
+		}
+	} else {
+		i := idx - imports
+		if int(i) >= len(c.module.Function.TypeIndices) {
+			return module.FunctionType{}, false
+		}
+		tidx = c.module.Function.TypeIndices[i]
+	}
+	if int(tidx) >= len(c.module.Type.Functions) {
+		return module.FunctionType{}, false
+	}
+	return c.module.Type.Functions[tidx], true
+}
+
+// SimplifyLocals is an instruction pass that rewrites redundant accesses of
+// the same local, where each rewrite preserves the stack effect:
+//
+//	local.set $x, local.get $x  =>  local.tee $x
+//	local.tee $x, drop          =>  local.set $x
+//	local.tee $x, local.set $x  =>  local.set $x
+//	local.get $x, local.set $x  =>  (nothing)
+//	local.get $x, drop          =>  (nothing)
+//
+// So a redundant copy such as "local.tee $x, local.get $x, drop" becomes
+// "local.tee $x", while "local.tee $x, local.get $x" is kept where both
+// values are consumed.
+// It only considers adjacent instructions of one sequence; use Nested to
+// apply it to nested blocks, too.
+func SimplifyLocals(is []instruction.Instruction) []instruction.Instruction {
+	ret := make([]instruction.Instruction, 0, len(is))
+	for _, instr := range is {
+		ret = append(ret, instr)
+		for len(ret) >= 2 {
+			n := len(ret)
+			repl, ok := simplifyLocalPair(ret[n-2], ret[n-1])
+			if !ok {
+				break
+			}
+			ret = append(ret[:n-2], repl...)
+		}
+	}
+	return ret
+}
+
+func simplifyLocalPair(a, b instruction.Instruction) ([]instruction.Instruction, bool) {
+	switch a := a.(type) {
+	case instruction.SetLocal:
+		if b, ok := b.(instruction.GetLocal); ok && a.Index == b.Index {
+			return []instruction.Instruction{instruction.TeeLocal{Index: a.Index}}, true
+		}
+	case instruction.TeeLocal:
+		switch b := b.(type) {
+		case instruction.Drop:
+			return []instruction.Instruction{instruction.SetLocal{Index: a.Index}}, true
+		case instruction.SetLocal:
+			if a.Index == b.Index {
+				return []instruction.Instruction{b}, true
+			}
+		}
+	case instruction.GetLocal:
+		switch b := b.(type) {
+		case instruction.Drop:
+			return nil, true
+		case instruction.SetLocal:
+			if a.Index == b.Index {
+				return nil, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// peepholePass removes waste from a sequence of instructions, preserving
+// its stack effect:
+//
+//	unreachable, ...        =>  unreachable (same for br, br_table, return)
+//	nop                     =>  (nothing)
+//	block ... end           =>  ...  (same for loop)
+//	block ... br 0 end      =>  block ... end  (same for if)
+//	block ... br_if 0 end   =>  block ... drop end  (same for if)
+//	if end                  =>  drop
+//	i32.const, drop         =>  (nothing)  (same for the other constants, local.get)
+//	i32.const 0, i32.add    =>  (nothing)  (same for i32.sub)
+//	i32.const 0, br_if      =>  (nothing)
+//
+// Blocks and loops are only unwrapped if they have no result type, and
+// contain no branches or returns (see withControlInstr): these refer to
+// block labels, which would shift. A branch ending a block is only removed
+// if the block's instructions before it leave the stack as the block's end
+// expects it, see stackDelta. Calls followed by drop are kept, even if the
+// function returns nothing: the drop then consumes an earlier value.
+// It only considers one sequence; use Nested to apply it to nested blocks,
+// too.
+func (c *Compiler) peepholePass(is []instruction.Instruction) []instruction.Instruction {
+	ret := make([]instruction.Instruction, 0, len(is))
+	var dead bool
+	var push func(instruction.Instruction)
+	push = func(instr instruction.Instruction) {
+		if dead {
+			return
+		}
+		switch i := instr.(type) {
+		case instruction.Nop:
+			return
+		case instruction.Unreachable, instruction.Br, instruction.BrTable, instruction.Return,
+			instruction.ReturnCall, instruction.ReturnCallIndirect:
+			dead = true
+		case instruction.Block:
+			if i.Type != nil {
+				break
+			}
+			i.Instrs = c.trimFinalBranch(i.Instrs)
+			if !withControlInstr(i.Instrs) {
+				for _, instr := range i.Instrs {
+					push(instr)
+				}
+				return
+			}
+			instr = i
+		case instruction.Loop:
+			if i.Type == nil && !withControlInstr(i.Instrs) {
+				for _, instr := range i.Instrs {
+					push(instr)
+				}
+				return
+			}
+		case instruction.If:
+			if i.Type != nil {
+				break
+			}
+			i.Instrs = c.trimFinalBranch(i.Instrs)
+			if len(i.Instrs) == 0 {
+				instr = instruction.Drop{}
+			} else {
+				instr = i
+			}
+		}
+		ret = append(ret, instr)
+		if n := len(ret); n >= 2 && peepholePair(ret[n-2], ret[n-1]) {
+			ret = ret[:n-2]
+		}
+	}
+	for _, instr := range is {
+		push(instr)
+	}
+	return ret
+}
+
+// trimFinalBranch removes the branch to the end of the enclosing block, which
+// has no result type, that ends is: it's a no-op if the instructions before
+// it leave nothing on the stack. A br_if is replaced by dropping its
+// condition.
+func (c *Compiler) trimFinalBranch(is []instruction.Instruction) []instruction.Instruction {
+	n := len(is)
+	if n == 0 {
+		return is
+	}
+	switch br := is[n-1].(type) {
+	case instruction.Br:
+		if d, ok := c.stackDelta(is[:n-1]); ok && d == 0 && br.Index == 0 {
+			return c.peepholePass(is[:n-1])
+		}
+	case instruction.BrIf:
+		if d, ok := c.stackDelta(is[:n-1]); ok && d == 1 && br.Index == 0 {
+			return c.peepholePass(append(is[:n-1:n-1], instruction.Drop{}))
+		}
+	}
+	return is
+}
+
+// peepholePair returns true if the pair of instructions can be removed.
+func peepholePair(a, b instruction.Instruction) bool {
+	switch b.(type) {
+	case instruction.Drop:
+		switch a.(type) {
+		case instruction.I32Const, instruction.I64Const, instruction.F32Const, instruction.F64Const,
+			instruction.GetLocal:
+			return true
+		}
+	case instruction.I32Add, instruction.I32Sub, instruction.BrIf:
+		if a, ok := a.(instruction.I32Const); ok {
+			return a.Value == 0
+		}
+	}
+	return false
+}
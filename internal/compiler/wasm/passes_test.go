@@ -0,0 +1,251 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+)
+
+func TestInstructionPasses(t *testing.T) {
+	policy, err := planner.New().
+		WithQueries([]planner.QuerySet{
+			{
+				Name:    "test",
+				Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+			},
+		}).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first pass sprinkles Nops into every block, the second one
+	// removes them again.
+	addNops := Nested(func(is []instruction.Instruction) []instruction.Instruction {
+		return append([]instruction.Instruction{instruction.Nop{}}, is...)
+	})
+	var runs int
+	dropNops := Nested(func(is []instruction.Instruction) []instruction.Instruction {
+		runs++
+		ret := make([]instruction.Instruction, 0, len(is))
+		for _, i := range is {
+			if _, ok := i.(instruction.Nop); !ok {
+				ret = append(ret, i)
+			}
+		}
+		return ret
+	})
+
+	c := New().WithPolicy(policy).WithInstructionPasses(addNops, dropNops)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if runs < len(c.funcsCode) {
+		t.Errorf("expected pass to run at least %d times, ran %d times", len(c.funcsCode), runs)
+	}
+	for _, f := range c.funcsCode {
+		if hasNop(f.code.Func.Expr.Instrs) {
+			t.Errorf("func %s: expected no nops", f.name)
+		}
+	}
+}
+
+func TestInstructionPassesStackBalance(t *testing.T) {
+	policy, err := planner.New().
+		WithQueries([]planner.QuerySet{
+			{
+				Name:    "test",
+				Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+			},
+		}).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bogus: leaves an extra value on the stack
+	push := func(is []instruction.Instruction) []instruction.Instruction {
+		return append([]instruction.Instruction{instruction.I32Const{Value: 1}}, is...)
+	}
+
+	var buf bytes.Buffer
+	c := New().WithPolicy(policy).WithDebug(&buf).WithInstructionPasses(push)
+	_, err = c.Compile()
+	if err == nil || !strings.Contains(err.Error(), "stack effect changed") {
+		t.Fatalf("expected stack effect error, got %v", err)
+	}
+
+	// without debug output, no check happens
+	c = New().WithPolicy(policy).WithInstructionPasses(push)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hasNop(is []instruction.Instruction) bool {
+	for _, i := range is {
+		switch i := i.(type) {
+		case instruction.Nop:
+			return true
+		case instruction.StructuredInstruction:
+			if hasNop(i.Instructions()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestSimplifyLocals(t *testing.T) {
+	type is = []instruction.Instruction
+	get := func(i uint32) instruction.Instruction { return instruction.GetLocal{Index: i} }
+	set := func(i uint32) instruction.Instruction { return instruction.SetLocal{Index: i} }
+	tee := func(i uint32) instruction.Instruction { return instruction.TeeLocal{Index: i} }
+	drop := instruction.Drop{}
+	call := instruction.Call{Index: 1}
+
+	for _, tc := range []struct {
+		note       string
+		input, exp is
+	}{
+		{note: "set, get", input: is{set(1), get(1)}, exp: is{tee(1)}},
+		{note: "tee, drop", input: is{tee(1), drop}, exp: is{set(1)}},
+		{note: "tee, set", input: is{tee(1), set(1)}, exp: is{set(1)}},
+		{note: "get, set", input: is{call, get(1), set(1), call}, exp: is{call, call}},
+		{note: "tee, get, drop", input: is{tee(1), get(1), drop}, exp: is{tee(1)}},
+		{note: "set, get, drop", input: is{set(1), get(1), drop}, exp: is{set(1)}},
+		{note: "tee, get kept", input: is{tee(1), get(1), call}, exp: is{tee(1), get(1), call}},
+		{note: "other locals kept", input: is{set(1), get(2), tee(1), set(2)}, exp: is{set(1), get(2), tee(1), set(2)}},
+		{note: "call, drop kept", input: is{call, drop}, exp: is{call, drop}},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			act := SimplifyLocals(tc.input)
+			if !reflect.DeepEqual(tc.exp, act) {
+				t.Errorf("expected %v, got %v", tc.exp, act)
+			}
+		})
+	}
+}
+
+func TestSimplifyLocalsCompile(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// stack balance is checked in debug mode
+	var buf bytes.Buffer
+	c := New().WithPolicy(policy).
+		WithInstructionPasses(Nested(SimplifyLocals)).
+		WithDebug(&buf)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	type is = []instruction.Instruction
+	get := instruction.GetLocal{Index: 1}
+	set := instruction.SetLocal{Index: 1}
+	drop := instruction.Drop{}
+	call := instruction.Call{Index: 1}
+	i32 := func(v int32) instruction.Instruction { return instruction.I32Const{Value: v} }
+	i32Type := types.I32
+
+	for _, tc := range []struct {
+		note       string
+		input, exp is
+	}{
+		{note: "after unreachable", input: is{call, instruction.Unreachable{}, call, set}, exp: is{call, instruction.Unreachable{}}},
+		{note: "after br", input: is{call, instruction.Br{Index: 1}, call}, exp: is{call, instruction.Br{Index: 1}}},
+		{note: "after return", input: is{get, instruction.Return{}, drop}, exp: is{get, instruction.Return{}}},
+		{note: "nop", input: is{call, instruction.Nop{}, set}, exp: is{call, set}},
+		{note: "const, drop", input: is{call, i32(1), drop}, exp: is{call}},
+		{note: "get, drop", input: is{call, get, drop, set}, exp: is{call, set}},
+		{note: "call, drop kept", input: is{call, drop}, exp: is{call, drop}},
+		{note: "add 0", input: is{get, i32(0), instruction.I32Add{}, set}, exp: is{get, set}},
+		{note: "sub 0", input: is{get, i32(0), instruction.I32Sub{}, set}, exp: is{get, set}},
+		{note: "add 1 kept", input: is{get, i32(1), instruction.I32Add{}}, exp: is{get, i32(1), instruction.I32Add{}}},
+		{note: "br_if never taken", input: is{call, i32(0), instruction.BrIf{Index: 0}, call}, exp: is{call, call}},
+		{note: "block unwrapped", input: is{call, instruction.Block{Instrs: is{get, set}}, call}, exp: is{call, get, set, call}},
+		{note: "loop unwrapped", input: is{instruction.Loop{Instrs: is{call}}}, exp: is{call}},
+		{note: "empty block", input: is{call, instruction.Block{}, call}, exp: is{call, call}},
+		{
+			note:  "unwrapped block ending in unreachable",
+			input: is{instruction.Block{Instrs: is{call, instruction.Unreachable{}}}, call},
+			exp:   is{call, instruction.Unreachable{}},
+		},
+		{
+			note:  "block with branch kept",
+			input: is{instruction.Block{Instrs: is{get, instruction.BrIf{Index: 1}, call}}},
+			exp:   is{instruction.Block{Instrs: is{get, instruction.BrIf{Index: 1}, call}}},
+		},
+		{
+			note:  "block with nested branch kept",
+			input: is{instruction.Block{Instrs: is{get, instruction.If{Instrs: is{instruction.Br{Index: 1}}}}}},
+			exp:   is{instruction.Block{Instrs: is{get, instruction.If{Instrs: is{instruction.Br{Index: 1}}}}}},
+		},
+		{
+			note:  "typed block kept",
+			input: is{instruction.Block{Type: &i32Type, Instrs: is{get}}},
+			exp:   is{instruction.Block{Type: &i32Type, Instrs: is{get}}},
+		},
+		{note: "empty if", input: is{call, get, instruction.If{}}, exp: is{call}},
+		{note: "if kept", input: is{get, instruction.If{Instrs: is{call}}}, exp: is{get, instruction.If{Instrs: is{call}}}},
+	} {
+		t.Run(tc.note, func(t *testing.T) {
+			act := New().peepholePass(tc.input)
+			if !reflect.DeepEqual(tc.exp, act) {
+				t.Errorf("expected %v, got %v", tc.exp, act)
+			}
+		})
+	}
+}
+
+func TestPeepholeCompile(t *testing.T) {
+	policy := planModules(t, `package test
+p { input.x == 1; not q }
+q { input.y[_] == 3 }
+r { p with input as {"x": 1} }`, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+	})
+	count := func(c *Compiler) int {
+		var n int
+		for _, f := range c.funcsCode {
+			n += countInstrs(f.code.Func.Expr.Instrs)
+		}
+		return n
+	}
+	def := New().WithPolicy(policy)
+	if _, err := def.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	// stack balance is checked in debug mode
+	var buf bytes.Buffer
+	c := New().WithPolicy(policy).WithPeephole(true).WithDebug(&buf)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if before, after := count(def), count(c); after >= before {
+		t.Errorf("expected fewer instructions, got %d (before: %d)", after, before)
+	}
+}
+
+func countInstrs(is []instruction.Instruction) int {
+	n := len(is)
+	for _, instr := range is {
+		if s, ok := instr.(instruction.StructuredInstruction); ok {
+			n += countInstrs(s.Instructions())
+		}
+	}
+	return n
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import "bytes"
+
+// PassResult describes the effect of running a single optimization pass.
+type PassResult struct {
+	Changed    bool // true if the encoded module differs
+	SizeBefore int  // encoded module size (in bytes) before the pass
+	SizeAfter  int  // encoded module size (in bytes) after the pass
+}
+
+// Saved returns the number of bytes the pass removed from the module.
+func (r PassResult) Saved() int {
+	return r.SizeBefore - r.SizeAfter
+}
+
+// Reduction returns the share of the module the pass removed, in percent.
+func (r PassResult) Reduction() float64 {
+	if r.SizeBefore == 0 {
+		return 0
+	}
+	return 100 * float64(r.Saved()) / float64(r.SizeBefore)
+}
+
+// Prepare runs the compilation stages that plan the policy and compile its
+// functions, without any of the optimizations. Afterwards, the passes below
+// can be applied one-by-one; a subsequent call to Compile runs the rest of
+// the pipeline.
+func (c *Compiler) Prepare() error {
+	return c.runStages(c.prepareStages)
+}
+
+// RemoveUnusedCode applies the dead code elimination pass, replacing all
+// functions not reachable from exports, imports, the table or compiled
+// functions with stubs.
+func (c *Compiler) RemoveUnusedCode() (PassResult, error) {
+	return c.runPass(c.measure("remove-unused-code", c.removeUnusedCode))
+}
+
+// RemoveUnusedLocals removes all unused locals from the compiled functions,
+// regardless of WithRemoveUnusedLocals.
+func (c *Compiler) RemoveUnusedLocals() (PassResult, error) {
+	return c.runPass(func() error {
+		prev := c.removeLocals
+		c.removeLocals = true
+		defer func() { c.removeLocals = prev }()
+		return c.findUnusedLocals()
+	})
+}
+
+// DedupFunctions merges the identical functions planned from the policy,
+// regardless of WithDedupFunctions. The duplicates are removed by a
+// subsequent RemoveUnusedCode.
+func (c *Compiler) DedupFunctions() (PassResult, error) {
+	return c.runPass(func() error {
+		prev := c.dedupFuncs
+		c.dedupFuncs = true
+		defer func() { c.dedupFuncs = prev }()
+		return c.dedupFunctions()
+	})
+}
+
+// ApplyInstructionPass rewrites all compiled functions using p.
+func (c *Compiler) ApplyInstructionPass(p InstructionPass) (PassResult, error) {
+	return c.runPass(func() error {
+		for _, f := range c.funcsCode {
+			f.code.Func.Expr.Instrs = p(f.code.Func.Expr.Instrs)
+		}
+		return nil
+	})
+}
+
+// RemoveTrivialStart removes the start section if its function has no
+// effect, regardless of WithStripTrivialStart.
+func (c *Compiler) RemoveTrivialStart() (PassResult, error) {
+	return c.runPass(c.stripTrivialStart)
+}
+
+// StripNames removes the name section, regardless of WithTargetProfile.
+func (c *Compiler) StripNames() (PassResult, error) {
+	return c.runPass(func() error {
+		prev := c.stripNames
+		c.stripNames = true
+		defer func() { c.stripNames = prev }()
+		return c.stripNameSection()
+	})
+}
+
+// runPass applies pass to the current module, and compares its encoding
+// before and after.
+func (c *Compiler) runPass(pass func() error) (PassResult, error) {
+	before, err := c.encodePending()
+	if err != nil {
+		return PassResult{}, err
+	}
+	if err := pass(); err != nil {
+		return PassResult{}, err
+	}
+	after, err := c.encodePending()
+	if err != nil {
+		return PassResult{}, err
+	}
+	return PassResult{
+		Changed:    !bytes.Equal(before, after),
+		SizeBefore: len(before),
+		SizeAfter:  len(after),
+	}, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+)
+
+func prepared(t *testing.T) *Compiler {
+	t.Helper()
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPassRemoveUnusedCode(t *testing.T) {
+	c := prepared(t)
+	res, err := c.RemoveUnusedCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Changed || res.Saved() <= 0 {
+		t.Errorf("expected module to shrink, got %+v", res)
+	}
+	if _, ok := c.keepFuncs[c.function("opa_malloc")]; !ok {
+		t.Error("expected opa_malloc to be kept")
+	}
+
+	// idempotent
+	res, err = c.RemoveUnusedCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Changed {
+		t.Errorf("expected no change, got %+v", res)
+	}
+}
+
+func TestPassRemoveUnusedLocals(t *testing.T) {
+	c := prepared(t)
+	fn := c.funcsCode[0]
+	fn.code.Func.Locals = append(fn.code.Func.Locals, module.LocalDeclaration{Count: 3, Type: types.I32})
+
+	res, err := c.RemoveUnusedLocals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Changed || res.Saved() <= 0 {
+		t.Errorf("expected module to shrink, got %+v", res)
+	}
+	if len(c.UnusedLocals()[fn.name]) < 3 {
+		t.Errorf("expected unused locals of %s recorded, got %v", fn.name, c.UnusedLocals())
+	}
+	if c.removeLocals {
+		t.Error("expected option to be unchanged")
+	}
+}
+
+func TestPassDedupFunctions(t *testing.T) {
+	policy := planModules(t, dedupModule, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.DedupFunctions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Changed {
+		t.Errorf("expected calls redirected, got %+v", res)
+	}
+	for _, f := range c.funcsCode {
+		if f.name == "g0.data.test.u" || f.name == "g0.data.test.w" {
+			t.Errorf("expected %s merged", f.name)
+		}
+	}
+	if c.dedupFuncs {
+		t.Error("expected option to be unchanged")
+	}
+}
+
+func TestPassApplyInstructionPass(t *testing.T) {
+	c := prepared(t)
+	nop := func(is []instruction.Instruction) []instruction.Instruction {
+		return append(is, instruction.Nop{})
+	}
+	res, err := c.ApplyInstructionPass(nop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := len(c.funcsCode); !res.Changed || res.Saved() != -exp {
+		t.Errorf("expected module to grow by %d bytes, got %+v", exp, res)
+	}
+}
+
+func TestPassStripNames(t *testing.T) {
+	c := prepared(t)
+	res, err := c.StripNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Changed || res.Saved() <= 0 || len(c.module.Names.Functions) != 0 {
+		t.Errorf("expected names removed, got %+v", res)
+	}
+}
+
+func TestPassRemoveTrivialStart(t *testing.T) {
+	var buf bytes.Buffer
+	entry := module.CodeEntry{Func: module.Function{Expr: module.Expr{
+		Instrs: []instruction.Instruction{instruction.Nop{}},
+	}}}
+	if err := encoding.WriteCodeEntry(&buf, &entry); err != nil {
+		t.Fatal(err)
+	}
+	start := uint32(0)
+	c := New()
+	c.module = &module.Module{
+		Type:     module.TypeSection{Functions: []module.FunctionType{{}}},
+		Function: module.FunctionSection{TypeIndices: []uint32{0}},
+		Code:     module.RawCodeSection{Segments: []module.RawCodeSegment{{Code: buf.Bytes()}}},
+		Start:    module.StartSection{FuncIndex: &start},
+	}
+	res, err := c.RemoveTrivialStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Changed || c.module.Start.FuncIndex != nil {
+		t.Errorf("expected start section removed, got %+v", res)
+	}
+}
+
+func TestPassesThenCompile(t *testing.T) {
+	c := prepared(t)
+	if _, err := c.StripNames(); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mod.Names.Functions) != 0 {
+		t.Error("expected names to stay removed")
+	}
+	if seg := mod.Code.Segments[int(c.function("eval"))-c.functionImportCount()]; len(seg.Code) <= 3 {
+		t.Errorf("expected eval to be emitted, got %v", seg.Code)
+	}
+}
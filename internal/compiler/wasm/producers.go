@@ -0,0 +1,163 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/open-policy-agent/opa/internal/leb128"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/version"
+)
+
+// ProducersSection is the name of the custom section recording the tools
+// that produced the module, see
+// https://github.com/WebAssembly/tool-conventions/blob/main/ProducersSection.md
+const ProducersSection = "producers"
+
+// ProducersField is a field of the producers section, e.g. "processed-by".
+type ProducersField struct {
+	Name   string
+	Values []ProducersValue
+}
+
+// ProducersValue is an entry of a producers field.
+type ProducersValue struct {
+	Name    string
+	Version string
+}
+
+// WithProducers toggles replacing the producers section of the module with
+// one naming OPA and its version, and the bundle set via WithBundle, if any.
+// The section is emitted after wasm-opt has run, so it doesn't list the tools
+// used to build OPA's runtime or to optimize the module.
+func (c *Compiler) WithProducers(enabled bool) *Compiler {
+	c.producers = enabled
+	return c
+}
+
+// WithBundle records the name and revision of the bundle the policy was
+// built from.
+func (c *Compiler) WithBundle(name, revision string) *Compiler {
+	c.bundleName = name
+	c.bundleRevision = revision
+	return c
+}
+
+func (c *Compiler) emitProducers() error {
+	if !c.producers {
+		return nil
+	}
+	fields := []ProducersField{
+		{Name: "language", Values: []ProducersValue{{Name: "Rego"}}},
+		{Name: "processed-by", Values: []ProducersValue{{Name: "opa", Version: version.Version}}},
+	}
+	if c.bundleName != "" {
+		fields = append(fields, ProducersField{
+			Name:   "opa-bundle",
+			Values: []ProducersValue{{Name: c.bundleName, Version: c.bundleRevision}},
+		})
+	}
+	bs, err := encodeProducers(fields)
+	if err != nil {
+		return fmt.Errorf("encode producers: %w", err)
+	}
+
+	customs := c.module.Customs[:0]
+	for _, s := range c.module.Customs {
+		if s.Name != ProducersSection {
+			customs = append(customs, s)
+		}
+	}
+	c.module.Customs = append(customs, module.CustomSection{Name: ProducersSection, Data: bs})
+	return nil
+}
+
+func encodeProducers(fields []ProducersField) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := leb128.WriteVarUint32(&buf, uint32(len(fields))); err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		if err := writeString(&buf, f.Name); err != nil {
+			return nil, err
+		}
+		if err := leb128.WriteVarUint32(&buf, uint32(len(f.Values))); err != nil {
+			return nil, err
+		}
+		for _, v := range f.Values {
+			if err := writeString(&buf, v.Name); err != nil {
+				return nil, err
+			}
+			if err := writeString(&buf, v.Version); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func writeString(w io.Writer, s string) error {
+	if err := leb128.WriteVarUint32(w, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// ReadProducers returns the fields of the producers section of m, if any.
+func ReadProducers(m *module.Module) ([]ProducersField, error) {
+	for _, s := range m.Customs {
+		if s.Name == ProducersSection {
+			fields, err := decodeProducers(bytes.NewReader(s.Data))
+			if err != nil {
+				return nil, fmt.Errorf("decode producers: %w", err)
+			}
+			return fields, nil
+		}
+	}
+	return nil, nil
+}
+
+func decodeProducers(r io.Reader) ([]ProducersField, error) {
+	n, err := leb128.ReadVarUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]ProducersField, n)
+	for i := range fields {
+		if fields[i].Name, err = readString(r); err != nil {
+			return nil, err
+		}
+		m, err := leb128.ReadVarUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		fields[i].Values = make([]ProducersValue, m)
+		for j := range fields[i].Values {
+			if fields[i].Values[j].Name, err = readString(r); err != nil {
+				return nil, err
+			}
+			if fields[i].Values[j].Version, err = readString(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fields, nil
+}
+
+func readString(r io.Reader) (string, error) {
+	n, err := leb128.ReadVarUint32(r)
+	if err != nil {
+		return "", err
+	}
+	bs := make([]byte, n)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
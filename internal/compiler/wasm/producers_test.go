@@ -0,0 +1,85 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/version"
+)
+
+func TestProducers(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	m, err := New().WithPolicy(policy).WithProducers(true).WithBundle("example", "abc123").Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// roundtrip, like a consumer of the module would see it
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	m, err = encoding.ReadModule(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	for _, s := range m.Customs {
+		if s.Name == ProducersSection {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expected one producers section, got %d", n)
+	}
+	act, err := ReadProducers(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []ProducersField{
+		{Name: "language", Values: []ProducersValue{{Name: "Rego"}}},
+		{Name: "processed-by", Values: []ProducersValue{{Name: "opa", Version: version.Version}}},
+		{Name: "opa-bundle", Values: []ProducersValue{{Name: "example", Version: "abc123"}}},
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("expected %v, got %v", exp, act)
+	}
+}
+
+func TestProducersDefault(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	m, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := ReadProducers(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the section of the OPA runtime module is kept as-is
+	for _, f := range fields {
+		for _, v := range f.Values {
+			if v.Name == "opa" {
+				t.Errorf("unexpected producers value %v", v)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		t.Error("expected producers section")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// Profile is a named combination of compiler settings known to work well
+// with a specific Wasm runtime.
+type Profile struct {
+	// EntrypointTable toggles the emission of the entrypoint table custom
+	// section, see WithEntrypointTable.
+	EntrypointTable bool
+
+	// StripTrivialStart toggles the removal of a start section without
+	// effects, see WithStripTrivialStart.
+	StripTrivialStart bool
+
+	// StripNames removes the "name" custom section from the output.
+	StripNames bool
+
+	// WasmOptArgs are the arguments passed to wasm-opt, if its use has been
+	// opted into. They include the feature flags describing what the
+	// runtime supports.
+	WasmOptArgs []string
+
+	// Features are the WebAssembly features the runtime supports, see
+	// WithFeatures.
+	Features []Feature
+}
+
+// Profiles are the known target runtime profiles, selectable via
+// WithTargetProfile.
+var Profiles = map[string]Profile{
+	// wasmtime supports all the features wasm-opt enables by default; names
+	// are kept for proper stack traces.
+	"wasmtime": {
+		EntrypointTable: true,
+		WasmOptArgs:     []string{"-O2", "--debuginfo"},
+	},
+	// browser produces small modules for network delivery.
+	"browser": {
+		StripTrivialStart: true,
+		StripNames:        true,
+		WasmOptArgs:       []string{"-Oz"},
+	},
+	// wazero implements the 2.0 core spec, names are kept for its stack traces.
+	"wazero": {
+		EntrypointTable: true,
+		WasmOptArgs:     []string{"-O2", "--debuginfo", "--enable-bulk-memory", "--enable-sign-ext"},
+		Features:        []Feature{BulkMemory},
+	},
+	// wasm-mvp targets runtimes only supporting the 1.0 (MVP) spec.
+	"wasm-mvp": {
+		StripNames:  true,
+		WasmOptArgs: []string{"-O2", "--mvp-features"},
+	},
+}
+
+// ProfileNames returns the sorted names of all known profiles.
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for n := range Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithTargetProfile sets all the options of the named profile. Unknown
+// profile names cause compilation to fail.
+func (c *Compiler) WithTargetProfile(name string) *Compiler {
+	p, ok := Profiles[name]
+	if !ok {
+		c.errors = append(c.errors, fmt.Errorf("unknown target profile %q (known: %v)", name, ProfileNames()))
+		return c
+	}
+	c.entrypointTable = p.EntrypointTable
+	c.stripStart = p.StripTrivialStart
+	c.stripNames = p.StripNames
+	c.woptArgs = append([]string(nil), p.WasmOptArgs...)
+	c.woptPasses = nil
+	c.WithFeatures(p.Features...)
+	return c
+}
+
+// WithStripNames toggles removing the name section from the output. It's
+// dropped right away when removing unused code, and wasm-opt is no longer
+// told to keep it: the default arguments become "-O2".
+func (c *Compiler) WithStripNames(enabled bool) *Compiler {
+	c.stripNames = enabled
+	return c
+}
+
+// namesStripped returns true if the name section won't be part of the output.
+func (c *Compiler) namesStripped() bool {
+	return c.stripNames || c.minimal
+}
+
+// stripNameSection removes the name section, if requested.
+func (c *Compiler) stripNameSection() error {
+	if c.namesStripped() {
+		c.module.Names = module.NameSection{}
+	}
+	return nil
+}
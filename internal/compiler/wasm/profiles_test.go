@@ -0,0 +1,152 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+func TestTargetProfiles(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+
+	exp := map[string]Profile{
+		"wasmtime": {EntrypointTable: true, WasmOptArgs: []string{"-O2", "--debuginfo"}},
+		"browser":  {StripTrivialStart: true, StripNames: true, WasmOptArgs: []string{"-Oz"}},
+		"wazero":   {EntrypointTable: true, WasmOptArgs: []string{"-O2", "--debuginfo", "--enable-bulk-memory", "--enable-sign-ext"}},
+		"wasm-mvp": {StripNames: true, WasmOptArgs: []string{"-O2", "--mvp-features"}},
+	}
+	if len(exp) != len(Profiles) {
+		t.Fatalf("expected %d profiles, got %v", len(exp), ProfileNames())
+	}
+
+	for name, p := range exp {
+		t.Run(name, func(t *testing.T) {
+			c := New().WithPolicy(policy).WithTargetProfile(name)
+			act := Profile{
+				EntrypointTable:   c.entrypointTable,
+				StripTrivialStart: c.stripStart,
+				StripNames:        c.stripNames,
+				WasmOptArgs:       c.woptArgs,
+			}
+			if !reflect.DeepEqual(p, act) {
+				t.Fatalf("expected settings %v, got %v", p, act)
+			}
+
+			mod, err := c.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := encoding.WriteModule(&buf, mod); err != nil {
+				t.Fatal(err)
+			}
+			mod, err = encoding.ReadModule(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stripped := len(mod.Names.Functions) == 0; stripped != p.StripNames {
+				t.Errorf("expected names stripped: %v, got %v", p.StripNames, stripped)
+			}
+			table, err := ReadEntrypointTable(mod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := table != nil; found != p.EntrypointTable {
+				t.Errorf("expected entrypoint table: %v, got %v", p.EntrypointTable, found)
+			}
+		})
+	}
+}
+
+func TestTargetProfileUnknown(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	_, err := New().WithPolicy(policy).WithTargetProfile("nope").Compile()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if exp, act := `unknown target profile "nope" (known: [browser wasm-mvp wasmtime wazero])`, err.Error(); exp != act {
+		t.Errorf("expected error %q, got %q", exp, act)
+	}
+}
+
+func TestStripNames(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`re_match("^a", input.foo)`)},
+	})
+	rec := filepath.Join(t.TempDir(), "args")
+	fakeWasmOpt(t, `[ "$1" = "--version" ] && exit 0
+echo "$@" >> `+rec+`
+exec cat`)
+	compile := func(strip bool) (*module.Module, string) {
+		t.Helper()
+		mod, err := New().WithPolicy(policy).WithStripNames(strip).Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := encoding.WriteModule(&buf, mod); err != nil {
+			t.Fatal(err)
+		}
+		mod, err = encoding.ReadModule(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := os.ReadFile(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(rec)
+		return mod, strings.TrimSpace(string(bs))
+	}
+	elems := func(mod *module.Module) int {
+		var n int
+		for _, seg := range mod.Element.Segments {
+			n += len(seg.Indices)
+		}
+		return n
+	}
+
+	kept, args := compile(false)
+	if len(kept.Names.Functions) == 0 {
+		t.Error("expected names to be kept")
+	}
+	if exp := "-O2 --debuginfo -o -"; args != exp {
+		t.Errorf("expected wasm-opt arguments %q, got %q", exp, args)
+	}
+
+	stripped, args := compile(true)
+	if len(stripped.Names.Functions) != 0 {
+		t.Errorf("expected names to be stripped, got %d", len(stripped.Names.Functions))
+	}
+	if exp := "-O2 -o -"; args != exp {
+		t.Errorf("expected wasm-opt arguments %q, got %q", exp, args)
+	}
+	// the names are still used for deciding which table entries to keep
+	if exp, act := elems(kept), elems(stripped); exp != act {
+		t.Errorf("expected %d table entries, got %d", exp, act)
+	}
+
+	t.Setenv("EXPERIMENTAL_WASM_OPT_ARGS", "-O1 --debuginfo")
+	if _, args := compile(true); args != "-O1 --debuginfo -o -" {
+		t.Errorf("expected environment to override wasm-opt arguments, got %q", args)
+	}
+}
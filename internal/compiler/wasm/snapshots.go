@@ -0,0 +1,73 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// WithSnapshotDir sets a directory that the encoded module is written to
+// after each major compilation stage, for debugging purposes. The files are
+// named by the sequence number and the stage, e.g. `01-dead-code.wasm`.
+func (c *Compiler) WithSnapshotDir(dir string) *Compiler {
+	c.snapshotDir = dir
+	return c
+}
+
+// snapshotStage returns a compiler stage writing a snapshot.
+func (c *Compiler) snapshotStage(name string) func() error {
+	return func() error {
+		return c.writeSnapshot(name)
+	}
+}
+
+// writeSnapshot writes the current state of the module, including all
+// compiled functions not yet emitted, to the snapshot directory.
+func (c *Compiler) writeSnapshot(name string) error {
+	if c.snapshotDir == "" {
+		return nil
+	}
+
+	bs, err := c.encodePending()
+	if err != nil {
+		return fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	if err := os.MkdirAll(c.snapshotDir, 0755); err != nil {
+		return fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	file := filepath.Join(c.snapshotDir, fmt.Sprintf("%02d-%s.wasm", c.snapshots, name))
+	c.snapshots++
+	if err := os.WriteFile(file, bs, 0644); err != nil {
+		return fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	c.debug.Printf("wrote snapshot %s", file)
+	return nil
+}
+
+// encodePending returns the encoding of the current state of the module,
+// with all compiled functions not yet emitted put in place.
+func (c *Compiler) encodePending() ([]byte, error) {
+	m := *c.module
+	m.Code.Segments = append([]module.RawCodeSegment(nil), c.module.Code.Segments...)
+	for _, fn := range c.funcsCode {
+		var buf bytes.Buffer
+		if err := encoding.WriteCodeEntry(&buf, fn.code); err != nil {
+			return nil, fmt.Errorf("write function %s: %w", fn.name, err)
+		}
+		m.Code.Segments[c.function(fn.name)-uint32(c.functionImportCount())].Code = buf.Bytes()
+	}
+
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, &m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+)
+
+func TestSnapshots(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	noop := func(is []instruction.Instruction) []instruction.Instruction { return is }
+
+	dir := t.TempDir()
+	c := New().WithPolicy(policy).WithSnapshotDir(dir).WithInstructionPasses(noop, noop)
+	if _, err := c.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+		bs, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := encoding.ReadModule(bytes.NewReader(bs)); err != nil {
+			t.Errorf("snapshot %s: %v", f.Name(), err)
+		}
+	}
+	exp := []string{"00-plan.wasm", "01-dead-code.wasm", "02-pass-0.wasm", "03-pass-1.wasm"}
+	if !reflect.DeepEqual(exp, names) {
+		t.Errorf("expected snapshots %v, got %v", exp, names)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/ir"
+)
+
+// SourceMapSection is the name of the custom section mapping the functions
+// compiled from the policy to their Rego source, see WithSourceMap.
+const SourceMapSection = "opa_source_map"
+
+// SourceLocation is the position in the Rego source that a function of the
+// module has been compiled from: that of its first statement.
+type SourceLocation struct {
+	Func uint32 `json:"func"` // function index
+	Name string `json:"name"` // function name, as in the name section
+	File string `json:"file"`
+	Row  int    `json:"row"`
+	Col  int    `json:"col"`
+}
+
+// WithSourceMap toggles the emission of a custom section mapping the
+// functions compiled from the policy to the Rego source they're compiled
+// from, so that a trap's stack trace can be traced back to the policy. The
+// section's contents are a JSON array of SourceLocation, sorted by function
+// index. The indices are those of the compiled module, after removing
+// unused code, but before any wasm-opt optimization: wasm-opt can renumber
+// functions, but keeps their names when passed --debuginfo.
+func (c *Compiler) WithSourceMap(enabled bool) *Compiler {
+	c.sourceMap = enabled
+	return c
+}
+
+// emitSourceMap adds the source map section, see WithSourceMap, replacing
+// an existing one. It's run after unused code has been compacted, to refer
+// to the final indices.
+func (c *Compiler) emitSourceMap() error {
+	if !c.sourceMap {
+		return nil
+	}
+	locs := []SourceLocation{}
+	for _, fn := range c.policy.Funcs.Funcs {
+		loc := firstLocation(fn)
+		if loc == nil || loc.File >= len(c.policy.Static.Files) {
+			continue
+		}
+		idx, ok := c.funcs[fn.Name]
+		if !ok {
+			continue
+		}
+		if c.compactedFuncs != nil {
+			if idx, ok = c.compactedFuncs[idx]; !ok {
+				continue
+			}
+		}
+		locs = append(locs, SourceLocation{
+			Func: idx,
+			Name: fn.Name,
+			File: c.policy.Static.Files[loc.File].Value,
+			Row:  loc.Row,
+			Col:  loc.Col,
+		})
+	}
+	sort.Slice(locs, func(i, j int) bool { return locs[i].Func < locs[j].Func })
+	bs, err := json.Marshal(locs)
+	if err != nil {
+		return fmt.Errorf("encode source map: %w", err)
+	}
+	customs := c.module.Customs[:0]
+	for _, s := range c.module.Customs {
+		if s.Name != SourceMapSection {
+			customs = append(customs, s)
+		}
+	}
+	c.module.Customs = append(customs, module.CustomSection{
+		Name: SourceMapSection,
+		Data: bs,
+	})
+	return nil
+}
+
+// firstLocation returns the location of the first statement of fn that has
+// one, or nil.
+func firstLocation(fn *ir.Func) *ir.Location {
+	v := &locationVisitor{}
+	for _, b := range fn.Blocks {
+		if err := ir.Walk(v, b); err != nil || v.loc != nil {
+			break
+		}
+	}
+	return v.loc
+}
+
+type locationVisitor struct {
+	loc *ir.Location
+}
+
+func (*locationVisitor) Before(interface{}) {}
+
+func (*locationVisitor) After(interface{}) {}
+
+func (v *locationVisitor) Visit(x interface{}) (ir.Visitor, error) {
+	if v.loc != nil {
+		return nil, nil
+	}
+	if stmt, ok := x.(ir.Stmt); ok {
+		if loc := stmt.GetLocation(); loc.Row > 0 {
+			v.loc = loc
+			return nil, nil
+		}
+	}
+	return v, nil
+}
+
+// ReadSourceMap returns the source map embedded into m, if any.
+func ReadSourceMap(m *module.Module) ([]SourceLocation, error) {
+	for _, s := range m.Customs {
+		if s.Name == SourceMapSection {
+			var ret []SourceLocation
+			if err := json.Unmarshal(s.Data, &ret); err != nil {
+				return nil, fmt.Errorf("decode source map: %w", err)
+			}
+			return ret, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+)
+
+func TestSourceMap(t *testing.T) {
+	policy := planModules(t, "package test\n\np { input.x = 1 }", planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`data.test.p = x`)},
+	})
+
+	mod, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locs, err := ReadSourceMap(mod); err != nil || locs != nil {
+		t.Fatalf("expected no source map, got %v (err: %v)", locs, err)
+	}
+
+	for _, compact := range []bool{false, true} {
+		mod, err := New().WithPolicy(policy).WithSourceMap(true).WithCompactUnusedCode(compact).Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs, err := ReadSourceMap(mod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := map[uint32]string{}
+		for _, nm := range mod.Names.Functions {
+			names[nm.Index] = nm.Name
+		}
+		var found bool
+		for _, loc := range locs {
+			if names[loc.Func] != loc.Name {
+				t.Errorf("compact=%v: expected func %d to be %s, got %q", compact, loc.Func, loc.Name, names[loc.Func])
+			}
+			if loc.Name == "g0.data.test.p" {
+				found = true
+				if loc.Row != 3 {
+					t.Errorf("compact=%v: expected %s at row 3, got %d", compact, loc.Name, loc.Row)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("compact=%v: expected g0.data.test.p in source map, got %v", compact, locs)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// WithValidateStructure toggles checking the final module's structure, as
+// far as the compiler's own passes depend on it: all references to types,
+// functions, globals, tables and memories must be in range, imports and
+// exports must be named uniquely, and no retained function may call one
+// replaced by a stub when removing unused code. This is no replacement for
+// a validator, but it catches corruption, e.g. by wasm-opt, before the
+// module is used.
+//
+// Calls into stubs are reported as warnings; they only become errors in
+// strict mode.
+func (c *Compiler) WithValidateStructure(enabled bool) *Compiler {
+	c.validate = enabled
+	return c
+}
+
+func (c *Compiler) validateStructure() error {
+	if !c.validate {
+		return nil
+	}
+	if errs := structuralErrors(c.module); len(errs) > 0 {
+		return fmt.Errorf("invalid module structure:\n%s", strings.Join(errs, "\n"))
+	}
+	for _, call := range stubCalls(c.module) {
+		if err := c.warn("%s", call); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// structuralErrors returns the problems found in m's structure, see
+// WithValidateStructure.
+func structuralErrors(m *module.Module) []string {
+	var errs []string
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	// the number of entities of each kind, indexed by ImportDescriptorType,
+	// which matches ExportDescriptorType
+	var counts [4]uint32
+	types := uint32(len(m.Type.Functions))
+	imports := map[string]struct{}{}
+	for i, imp := range m.Import.Imports {
+		name := imp.Module + "." + imp.Name
+		if imp.Module == "" || imp.Name == "" {
+			errorf("import %d: empty name %q", i, name)
+		}
+		if _, ok := imports[name]; ok {
+			errorf("import %d: duplicate import %s", i, name)
+		}
+		imports[name] = struct{}{}
+		if fi, ok := imp.Descriptor.(module.FunctionImport); ok && fi.Func >= types {
+			errorf("import %s: type %d out of range", name, fi.Func)
+		}
+		counts[imp.Descriptor.Kind()]++
+	}
+	counts[module.FunctionImportType] += uint32(len(m.Function.TypeIndices))
+	counts[module.TableImportType] += uint32(len(m.Table.Tables))
+	counts[module.MemoryImportType] += uint32(len(m.Memory.Memories))
+	counts[module.GlobalImportType] += uint32(len(m.Global.Globals))
+	funcs := counts[module.FunctionImportType]
+
+	if len(m.Function.TypeIndices) != len(m.Code.Segments) {
+		errorf("%d functions declared, but %d code segments", len(m.Function.TypeIndices), len(m.Code.Segments))
+	}
+	for i, tidx := range m.Function.TypeIndices {
+		if tidx >= types {
+			errorf("func %d: type %d out of range", i, tidx)
+		}
+	}
+
+	exports := map[string]struct{}{}
+	for _, exp := range m.Export.Exports {
+		if _, ok := exports[exp.Name]; ok {
+			errorf("duplicate export %q", exp.Name)
+		}
+		exports[exp.Name] = struct{}{}
+		kind := int(exp.Descriptor.Type)
+		if kind < 0 || kind >= len(counts) {
+			errorf("export %q: unknown kind %d", exp.Name, kind)
+		} else if exp.Descriptor.Index >= counts[kind] {
+			errorf("export %q: %s %d out of range", exp.Name, exp.Descriptor.Type, exp.Descriptor.Index)
+		}
+	}
+
+	for i, seg := range m.Element.Segments {
+		if !seg.Passive && seg.Index >= counts[module.TableImportType] {
+			errorf("element segment %d: table %d out of range", i, seg.Index)
+		}
+		for _, idx := range seg.Indices {
+			if idx >= funcs {
+				errorf("element segment %d: func %d out of range", i, idx)
+			}
+		}
+	}
+	for i, seg := range m.Data.Segments {
+		if seg.Index >= counts[module.MemoryImportType] {
+			errorf("data segment %d: memory %d out of range", i, seg.Index)
+		}
+	}
+	if start := m.Start.FuncIndex; start != nil && *start >= funcs {
+		errorf("start func %d out of range", *start)
+	}
+	for _, nm := range m.Names.Functions {
+		if nm.Index >= funcs {
+			errorf("name %q: func %d out of range", nm.Name, nm.Index)
+		}
+	}
+
+	inRange := func(what string, n uint32) encoding.IndexMap {
+		return func(idx uint32) (uint32, error) {
+			if idx >= n {
+				return 0, fmt.Errorf("%s %d out of range", what, idx)
+			}
+			return idx, nil
+		}
+	}
+	imported := funcs - uint32(len(m.Function.TypeIndices))
+	for i, seg := range m.Code.Segments {
+		idx := imported + uint32(i)
+		if _, err := encoding.RemapCodeIndices(seg.Code, inRange("func", funcs), inRange("type", types)); err != nil {
+			errorf("func %d: %v", idx, err)
+		}
+		if _, err := encoding.RemapGlobalIndices(seg.Code, inRange("global", counts[module.GlobalImportType])); err != nil {
+			errorf("func %d: %v", idx, err)
+		}
+	}
+	return errs
+}
+
+// stubCalls describes the calls of functions into functions whose body is
+// one of the stubs put in place when removing unused code.
+func stubCalls(m *module.Module) []string {
+	var imported uint32
+	for _, imp := range m.Import.Imports {
+		if _, ok := imp.Descriptor.(module.FunctionImport); ok {
+			imported++
+		}
+	}
+	stubbed := func(idx uint32) bool {
+		return idx >= imported && int(idx-imported) < len(m.Code.Segments) &&
+			isStub(m.Code.Segments[idx-imported].Code)
+	}
+	names := make(map[uint32]string, len(m.Names.Functions))
+	for _, nm := range m.Names.Functions {
+		names[nm.Index] = nm.Name
+	}
+	name := func(idx uint32) string {
+		if n, ok := names[idx]; ok {
+			return n
+		}
+		return fmt.Sprint(idx)
+	}
+
+	var ret []string
+	identity := func(idx uint32) (uint32, error) { return idx, nil }
+	for i, seg := range m.Code.Segments {
+		caller := imported + uint32(i)
+		if stubbed(caller) {
+			continue
+		}
+		call := func(idx uint32) (uint32, error) {
+			if stubbed(idx) {
+				ret = append(ret, fmt.Sprintf("func %s calls removed func %s", name(caller), name(idx)))
+			}
+			return idx, nil
+		}
+		_, _ = encoding.RemapCodeIndices(seg.Code, call, identity) // errors are reported by structuralErrors
+	}
+	return ret
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+func TestValidateStructure(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	for name, c := range map[string]*Compiler{
+		"default":     New(),
+		"compacted":   New().WithCompactUnusedCode(true).WithPruneImports(true).WithRemoveUnusedData(true),
+		"minimal":     New().WithMinimal(true),
+		"passive":     New().WithFeatures(BulkMemory).WithPassiveElements(true),
+		"entrypoints": New().WithEntrypointTable(true),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := c.WithPolicy(policy).WithValidateStructure(true).WithStrict(true).Compile(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStructuralErrors(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// decode returns a fresh copy of the compiled module.
+	var buf bytes.Buffer
+	mod, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := encoding.WriteModule(&buf, mod); err != nil {
+		t.Fatal(err)
+	}
+	decode := func() *module.Module {
+		m, err := encoding.ReadModule(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	if errs := structuralErrors(decode()); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	funcs := uint32(len(mod.Function.TypeIndices))
+	for _, imp := range mod.Import.Imports {
+		if imp.Descriptor.Kind() == module.FunctionImportType {
+			funcs++
+		}
+	}
+
+	tests := []struct {
+		note    string
+		corrupt func(*module.Module)
+		exp     string
+	}{
+		{
+			note: "call out of range",
+			corrupt: func(m *module.Module) {
+				m.Code.Segments[0].Code = []byte{0x00, 0x10, 0xff, 0x7f, 0x0b} // call 16383, end
+			},
+			exp: "func 16383 out of range",
+		},
+		{
+			note: "global out of range",
+			corrupt: func(m *module.Module) {
+				m.Code.Segments[0].Code = []byte{0x00, 0x23, 0x7f, 0x1a, 0x0b} // global.get 127, drop, end
+			},
+			exp: "global 127 out of range",
+		},
+		{
+			note: "export out of range",
+			corrupt: func(m *module.Module) {
+				m.Export.Exports[0].Descriptor.Index = funcs
+			},
+			exp: "out of range",
+		},
+		{
+			note: "duplicate export",
+			corrupt: func(m *module.Module) {
+				m.Export.Exports = append(m.Export.Exports, m.Export.Exports[0])
+			},
+			exp: "duplicate export",
+		},
+		{
+			note: "duplicate import",
+			corrupt: func(m *module.Module) {
+				m.Import.Imports = append(m.Import.Imports, m.Import.Imports[0])
+			},
+			exp: "duplicate import",
+		},
+		{
+			note: "element out of range",
+			corrupt: func(m *module.Module) {
+				m.Element.Segments[0].Indices[0] = funcs
+			},
+			exp: "element segment 0: func",
+		},
+		{
+			note: "missing code",
+			corrupt: func(m *module.Module) {
+				m.Code.Segments = m.Code.Segments[1:]
+			},
+			exp: "code segments",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			m := decode()
+			tc.corrupt(m)
+			errs := structuralErrors(m)
+			if !strings.Contains(strings.Join(errs, "\n"), tc.exp) {
+				t.Errorf("expected error containing %q, got %v", tc.exp, errs)
+			}
+		})
+	}
+}
+
+func TestStubCalls(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := stubCalls(mod); len(calls) > 0 {
+		t.Fatalf("unexpected calls into stubs: %v", calls)
+	}
+
+	// Replace a retained function called by eval with a stub.
+	imports := uint32(c.functionImportCount())
+	names, byName := funcNames(mod), map[string]uint32{}
+	for idx, n := range names {
+		byName[n] = idx
+	}
+	var callee string
+	for _, n := range calledNames(t, mod, names, c.function("eval")) {
+		if byName[n] >= imports {
+			callee = n
+			break
+		}
+	}
+	if callee == "" {
+		t.Fatal("expected eval to call a function")
+	}
+	stub, err := unreachableCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod.Code.Segments[byName[callee]-imports].Code = stub
+	calls := strings.Join(stubCalls(mod), "\n")
+	if exp := "func eval calls removed func " + callee; !strings.Contains(calls, exp) {
+		t.Errorf("expected %q, got %v", exp, calls)
+	}
+}
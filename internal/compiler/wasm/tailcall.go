@@ -0,0 +1,102 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+)
+
+// WithTailCalls toggles turning the calls in tail position of the functions
+// compiled from the policy into tail calls, return_call and
+// return_call_indirect, so that long chains of calls don't grow the call
+// stack. It requires the TailCall feature: if the target runtime doesn't
+// support it, the calls are kept as they are, which is logged. wasm-opt is
+// passed --enable-tail-call for the declared feature.
+func (c *Compiler) WithTailCalls(enabled bool) *Compiler {
+	c.tailCalls = enabled
+	return c
+}
+
+// emitTailCalls rewrites calls followed by a return, and calls ending a
+// function body, into tail calls, where the callee's results are those of
+// the compiled function.
+func (c *Compiler) emitTailCalls() error {
+	if !c.tailCalls {
+		return nil
+	}
+	if !c.hasFeature(TailCall) {
+		c.debug.Printf("tail calls require the %s feature, keeping calls", TailCall)
+		return nil
+	}
+	var n int
+	for _, f := range c.funcsCode {
+		tpe, ok := c.functionType(c.function(f.name))
+		if !ok {
+			continue
+		}
+		pass := Nested(func(is []instruction.Instruction) []instruction.Instruction {
+			return c.tailCallPass(tpe.Results, is, &n)
+		})
+		is := pass(f.code.Func.Expr.Instrs)
+		if last := len(is) - 1; last >= 0 {
+			if tc, ok := c.tailCall(tpe.Results, is[last]); ok {
+				is[last] = tc
+				n++
+			}
+		}
+		f.code.Func.Expr.Instrs = is
+	}
+	c.debug.Printf("emitted %d tail calls", n)
+	return nil
+}
+
+// tailCallPass replaces each call followed by a return in is by a tail
+// call, counting them in n.
+func (c *Compiler) tailCallPass(results []types.ValueType, is []instruction.Instruction, n *int) []instruction.Instruction {
+	ret := is[:0:0]
+	for i := 0; i < len(is); i++ {
+		if i+1 < len(is) {
+			if _, ok := is[i+1].(instruction.Return); ok {
+				if tc, ok := c.tailCall(results, is[i]); ok {
+					ret = append(ret, tc)
+					i++
+					*n++
+					continue
+				}
+			}
+		}
+		ret = append(ret, is[i])
+	}
+	return ret
+}
+
+// tailCall returns the tail call replacing instr, if it's a call of a
+// function with the given results.
+func (c *Compiler) tailCall(results []types.ValueType, instr instruction.Instruction) (instruction.Instruction, bool) {
+	switch instr := instr.(type) {
+	case instruction.Call:
+		if tpe, ok := c.functionType(instr.Index); ok && sameTypes(tpe.Results, results) {
+			return instruction.ReturnCall{Index: instr.Index}, true
+		}
+	case instruction.CallIndirect:
+		if int(instr.Index) < len(c.module.Type.Functions) && sameTypes(c.module.Type.Functions[instr.Index].Results, results) {
+			return instruction.ReturnCallIndirect{Index: instr.Index, Reserved: instr.Reserved}, true
+		}
+	}
+	return nil, false
+}
+
+func sameTypes(a, b []types.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+)
+
+func TestTailCalls(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	// counts the tail calls in the body of the named compiled function
+	tailCalls := func(t *testing.T, c *Compiler, name string) int {
+		t.Helper()
+		var instrs []instruction.Instruction
+		for _, f := range c.funcsCode {
+			if f.name == name {
+				instrs = f.code.Func.Expr.Instrs
+			}
+		}
+		var n int
+		var count func([]instruction.Instruction)
+		count = func(is []instruction.Instruction) {
+			for _, instr := range is {
+				switch instr := instr.(type) {
+				case instruction.ReturnCall, instruction.ReturnCallIndirect:
+					n++
+				case instruction.StructuredInstruction:
+					count(instr.Instructions())
+				}
+			}
+		}
+		count(instrs)
+		return n
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		var buf bytes.Buffer
+		c := New().WithPolicy(policy).WithFeatures(TailCall).WithTailCalls(true).WithValidateStructure(true).WithDebug(&buf)
+		if _, err := c.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		// _initialize ends calling a function without results
+		if n := tailCalls(t, c, "_initialize"); n != 1 {
+			t.Errorf("expected 1 tail call, got %d", n)
+		}
+		if exp := "emitted 1 tail calls"; !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected debug output to contain %q, got:\n%s", exp, buf.String())
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		var buf bytes.Buffer
+		c := New().WithPolicy(policy).WithTailCalls(true).WithDebug(&buf)
+		if _, err := c.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		if n := tailCalls(t, c, "_initialize"); n != 0 {
+			t.Errorf("expected no tail calls, got %d", n)
+		}
+		if exp := "tail calls require the tail-call feature, keeping calls"; !strings.Contains(buf.String(), exp) {
+			t.Errorf("expected debug output to contain %q, got:\n%s", exp, buf.String())
+		}
+	})
+}
+
+func TestTailCallPass(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	value := c.function("opa_value_get") // (i32, i32) -> i32
+	tpe, ok := c.functionType(value)
+	if !ok {
+		t.Fatal("expected type of opa_value_get")
+	}
+
+	var n int
+	is := c.tailCallPass(tpe.Results, []instruction.Instruction{
+		instruction.Call{Index: value},
+		instruction.Return{},
+		instruction.Call{Index: value},
+		instruction.Drop{},
+	}, &n)
+	exp := []instruction.Instruction{
+		instruction.ReturnCall{Index: value},
+		instruction.Call{Index: value},
+		instruction.Drop{},
+	}
+	if n != 1 || len(is) != len(exp) {
+		t.Fatalf("expected %v, got %v", exp, is)
+	}
+	for i := range exp {
+		if is[i] != exp[i] {
+			t.Errorf("instruction %d: expected %v, got %v", i, exp[i], is[i])
+		}
+	}
+
+	// results differing from the caller's are kept
+	n = 0
+	is = c.tailCallPass(nil, []instruction.Instruction{instruction.Call{Index: value}, instruction.Return{}}, &n)
+	if n != 0 || len(is) != 2 {
+		t.Errorf("expected call to be kept, got %v", is)
+	}
+}
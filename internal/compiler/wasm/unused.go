@@ -0,0 +1,231 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// WithRemoveUnusedData toggles removing the globals no function accesses,
+// and the table entries referring to functions found to be unused. Imported
+// and exported globals are kept, and so are all data segments: accesses to
+// linear memory can't be attributed to them.
+//
+// The table's layout doesn't change: an element segment is split around the
+// entries removed, which are left uninitialized. Calling them traps, just
+// like calling the stubs that replaced the unused functions. Combined with
+// WithCompactUnusedCode, these functions are then removed altogether.
+func (c *Compiler) WithRemoveUnusedData(enabled bool) *Compiler {
+	c.removeData = enabled
+	return c
+}
+
+// WithShrinkTable toggles removing the functions that are only kept because
+// they're referenced in the table: when removing unused code, table entries
+// are no longer kept unconditionally, but only if they could be the target
+// of a call_indirect of a retained function, judging by its type. The table
+// entries of the functions removed are dropped, as with
+// WithRemoveUnusedData, and the table is shrunk to end at its last retained
+// entry.
+//
+// The remaining entries aren't renumbered: the library refers to them by
+// function pointers, which are plain integers in its code and data that
+// can't be told apart from other constants.
+func (c *Compiler) WithShrinkTable(enabled bool) *Compiler {
+	c.shrinkTable = enabled
+	return c
+}
+
+// removeUnusedData removes unused globals, and the table entries of
+// functions removed as unused.
+func (c *Compiler) removeUnusedData() error {
+	if !c.dataRemoved() {
+		return nil
+	}
+	if err := c.removeUnusedGlobals(); err != nil {
+		return err
+	}
+	return c.removeUnusedElements()
+}
+
+// removeUnusedGlobals removes the globals that are neither imported, nor
+// exported, nor accessed by any function, and renumbers the remaining ones.
+func (c *Compiler) removeUnusedGlobals() error {
+	var imports uint32
+	for _, imp := range c.module.Import.Imports {
+		if _, ok := imp.Descriptor.(module.GlobalImport); ok {
+			imports++
+		}
+	}
+	used := map[uint32]struct{}{}
+	for i := uint32(0); i < imports; i++ {
+		used[i] = struct{}{}
+	}
+	for _, exp := range c.module.Export.Exports {
+		if exp.Descriptor.Type == module.GlobalExportType {
+			used[exp.Descriptor.Index] = struct{}{}
+		}
+	}
+	use := func(idx uint32) (uint32, error) {
+		used[idx] = struct{}{}
+		return idx, nil
+	}
+	for i, seg := range c.module.Code.Segments {
+		if _, err := encoding.RemapGlobalIndices(seg.Code, use); err != nil {
+			return fmt.Errorf("code segment %d: %w", i, err)
+		}
+	}
+
+	globals := map[uint32]uint32{}
+	var kept []module.Global
+	for i := uint32(0); i < imports+uint32(len(c.module.Global.Globals)); i++ {
+		if _, ok := used[i]; !ok {
+			continue
+		}
+		globals[i] = imports + uint32(len(kept))
+		if i >= imports {
+			kept = append(kept, c.module.Global.Globals[i-imports])
+		}
+	}
+	removed := len(c.module.Global.Globals) - len(kept)
+	if removed == 0 {
+		return nil
+	}
+
+	mapGlobal := func(idx uint32) (uint32, error) {
+		return globals[idx], nil
+	}
+	for i, seg := range c.module.Code.Segments {
+		code, err := encoding.RemapGlobalIndices(seg.Code, mapGlobal)
+		if err != nil {
+			return fmt.Errorf("code segment %d: %w", i, err)
+		}
+		c.module.Code.Segments[i].Code = code
+	}
+	for i, exp := range c.module.Export.Exports {
+		if exp.Descriptor.Type == module.GlobalExportType {
+			c.module.Export.Exports[i].Descriptor.Index = globals[exp.Descriptor.Index]
+		}
+	}
+	c.module.Global.Globals = kept
+	c.debug.Printf("removed %d unused globals", removed)
+	return nil
+}
+
+// removeUnusedElements drops the entries of active element segments that
+// refer to functions removed as unused, splitting the segments so that the
+// remaining entries keep their table index. Segments with an offset other
+// than a constant are kept as they are.
+func (c *Compiler) removeUnusedElements() error {
+	if c.keepFuncs == nil {
+		return nil
+	}
+	imports := uint32(c.functionImportCount())
+	unused := func(idx uint32) bool {
+		if _, ok := c.keepFuncs[idx]; ok || idx < imports {
+			return false
+		}
+		i := idx - imports
+		return int(i) < len(c.module.Code.Segments) && isStub(c.module.Code.Segments[i].Code)
+	}
+
+	var segs []module.ElementSegment
+	var removed int
+	for _, seg := range c.module.Element.Segments {
+		offset, ok := constOffset(seg)
+		if !ok {
+			segs = append(segs, seg)
+			continue
+		}
+		var n int
+		for _, idx := range seg.Indices {
+			if unused(idx) {
+				n++
+			}
+		}
+		if n == 0 {
+			segs = append(segs, seg)
+			continue
+		}
+		removed += n
+
+		// emit each run of used entries as a segment of its own
+		start := -1
+		for j := 0; j <= len(seg.Indices); j++ {
+			if j < len(seg.Indices) && !unused(seg.Indices[j]) {
+				if start < 0 {
+					start = j
+				}
+				continue
+			}
+			if start >= 0 {
+				segs = append(segs, module.ElementSegment{
+					Index:   seg.Index,
+					Offset:  module.Expr{Instrs: []instruction.Instruction{instruction.I32Const{Value: offset + int32(start)}}},
+					Indices: seg.Indices[start:j],
+				})
+				start = -1
+			}
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	c.module.Element.Segments = segs
+	c.debug.Printf("removed %d table entries of unused functions", removed)
+	return nil
+}
+
+// trimTable drops the table entries of removed functions, unless done by
+// removeUnusedData already, and shrinks the tables to end at their last
+// entry. Tables initialized by segments without a constant offset are kept
+// as they are.
+func (c *Compiler) trimTable() error {
+	if !c.tableShrunk() {
+		return nil
+	}
+	if !c.dataRemoved() {
+		if err := c.removeUnusedElements(); err != nil {
+			return err
+		}
+	}
+	ends := map[uint32]int32{}
+	for _, seg := range c.module.Element.Segments {
+		offset, ok := constOffset(seg)
+		if !ok {
+			return nil
+		}
+		if end := offset + int32(len(seg.Indices)); end > ends[seg.Index] {
+			ends[seg.Index] = end
+		}
+	}
+	for i := range c.module.Table.Tables {
+		lim := &c.module.Table.Tables[i].Lim
+		end := uint32(ends[uint32(i)])
+		if end >= lim.Min {
+			continue
+		}
+		c.debug.Printf("shrank table %d from %d to %d entries", i, lim.Min, end)
+		if lim.Max != nil && *lim.Max == lim.Min {
+			lim.Max = &end
+		}
+		lim.Min = end
+	}
+	return nil
+}
+
+// constOffset returns the offset of an active element segment, if it's a
+// constant.
+func constOffset(seg module.ElementSegment) (int32, bool) {
+	if seg.Passive || len(seg.Offset.Instrs) != 1 {
+		return 0, false
+	}
+	o, ok := seg.Offset.Instrs[0].(instruction.I32Const)
+	return o.Value, ok
+}
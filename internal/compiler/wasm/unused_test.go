@@ -0,0 +1,326 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+)
+
+func TestRemoveUnusedGlobals(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add an unreferenced global in front of all others.
+	var debug bytes.Buffer
+	c := New().WithPolicy(policy).WithRemoveUnusedData(true).WithDebug(&debug)
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	unused := module.Global{Type: types.I32, Init: module.Expr{Instrs: []instruction.Instruction{instruction.I32Const{Value: 42}}}}
+	c.module.Global.Globals = append([]module.Global{unused}, c.module.Global.Globals...)
+	shift := func(idx uint32) (uint32, error) { return idx + 1, nil }
+	for i, seg := range c.module.Code.Segments {
+		if len(seg.Code) == 0 { // compiled function, not emitted yet
+			continue
+		}
+		code, err := encoding.RemapGlobalIndices(seg.Code, shift)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.module.Code.Segments[i].Code = code
+	}
+	for i, exp := range c.module.Export.Exports {
+		if exp.Descriptor.Type == module.GlobalExportType {
+			c.module.Export.Exports[i].Descriptor.Index++
+		}
+	}
+
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, mod); err != nil {
+		t.Fatal(err)
+	}
+	mod, err = encoding.ReadModule(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(def.Global.Globals, mod.Global.Globals) {
+		t.Fatalf("expected globals %v, got %v", def.Global.Globals, mod.Global.Globals)
+	}
+	if exp := "removed 1 unused globals"; !strings.Contains(debug.String(), exp) {
+		t.Errorf("expected debug output to contain %q", exp)
+	}
+	for _, exp := range mod.Export.Exports {
+		if exp.Descriptor.Type == module.GlobalExportType {
+			if want := exportIndex(def, exp.Name); want != exp.Descriptor.Index {
+				t.Errorf("export %s: expected global %d, got %d", exp.Name, want, exp.Descriptor.Index)
+			}
+		}
+	}
+	// All functions access the same globals as before.
+	for i := range def.Code.Segments {
+		if exp, act := accessedGlobals(t, def.Code.Segments[i].Code), accessedGlobals(t, mod.Code.Segments[i].Code); !reflect.DeepEqual(exp, act) {
+			t.Errorf("code segment %d: expected globals %v, got %v", i, exp, act)
+		}
+	}
+}
+
+func accessedGlobals(t *testing.T, code []byte) []uint32 {
+	t.Helper()
+	var ret []uint32
+	record := func(idx uint32) (uint32, error) {
+		ret = append(ret, idx)
+		return idx, nil
+	}
+	if _, err := encoding.RemapGlobalIndices(code, record); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestRemoveUnusedElements(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New().WithPolicy(policy).WithRemoveUnusedData(true)
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imports := uint32(c.functionImportCount())
+	stubbed := func(m *module.Module, idx uint32) bool {
+		return idx >= imports && isStub(m.Code.Segments[idx-imports].Code)
+	}
+	table := func(m *module.Module) map[int32]uint32 {
+		ret := map[int32]uint32{}
+		for _, seg := range m.Element.Segments {
+			offset, ok := constOffset(seg)
+			if !ok {
+				t.Fatalf("unexpected element segment %v", seg)
+			}
+			for j, idx := range seg.Indices {
+				ret[offset+int32(j)] = idx
+			}
+		}
+		return ret
+	}
+
+	// The remaining entries are those of the retained functions, at the
+	// same table index.
+	defTable, tbl := table(def), table(mod)
+	var removed int
+	for i, idx := range defTable {
+		if stubbed(def, idx) {
+			removed++
+			if act, ok := tbl[i]; ok {
+				t.Errorf("table index %d: expected entry of unused func %d to be removed, got %d", i, idx, act)
+			}
+		} else if act := tbl[i]; act != idx {
+			t.Errorf("table index %d: expected func %d, got %d", i, idx, act)
+		}
+	}
+	if removed == 0 {
+		t.Fatal("expected table entries of unused functions")
+	}
+	if len(tbl) != len(defTable)-removed {
+		t.Errorf("expected %d table entries, got %d", len(defTable)-removed, len(tbl))
+	}
+	if !reflect.DeepEqual(def.Table, mod.Table) {
+		t.Errorf("expected table %v, got %v", def.Table, mod.Table)
+	}
+
+	// Compacting the code removes these functions, too.
+	compact, err := New().WithPolicy(policy).WithCompactUnusedCode(true).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	both, err := New().WithPolicy(policy).WithCompactUnusedCode(true).WithRemoveUnusedData(true).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(both.Code.Segments) >= len(compact.Code.Segments) {
+		t.Errorf("expected fewer functions, got %d (compacted only: %d)", len(both.Code.Segments), len(compact.Code.Segments))
+	}
+}
+
+func TestShrinkTable(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	def, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a function of a type no call_indirect uses, and a table entry at
+	// the end referring to it: it's only kept because of that entry.
+	var unused uint32
+	var offset int32
+	build := func(c *Compiler) (*Compiler, *module.Module) {
+		t.Helper()
+		if err := c.WithPolicy(policy).Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		offset, err = getLowestFreeElementSegmentOffset(c.module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := encoding.WriteCodeEntry(&buf, &module.CodeEntry{}); err != nil {
+			t.Fatal(err)
+		}
+		unused = uint32(c.functionImportCount() + len(c.module.Code.Segments))
+		c.module.Type.Functions = append(c.module.Type.Functions, module.FunctionType{Params: []types.ValueType{types.F64}})
+		c.module.Function.TypeIndices = append(c.module.Function.TypeIndices, uint32(len(c.module.Type.Functions)-1))
+		c.module.Code.Segments = append(c.module.Code.Segments, module.RawCodeSegment{Code: buf.Bytes()})
+		c.module.Element.Segments = append(c.module.Element.Segments, module.ElementSegment{
+			Offset:  module.Expr{Instrs: []instruction.Instruction{instruction.I32Const{Value: offset}}},
+			Indices: []uint32{unused},
+		})
+		c.module.Table.Tables[0].Lim.Min++
+		mod, err := c.Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, mod
+	}
+	c, mod := build(New())
+	imports := uint32(c.functionImportCount())
+	stubbed := func(m *module.Module, idx uint32) bool {
+		return idx >= imports && isStub(m.Code.Segments[idx-imports].Code)
+	}
+	if stubbed(mod, unused) {
+		t.Fatal("expected func to be kept by default")
+	}
+
+	var debug bytes.Buffer
+	c, mod = build(New().WithShrinkTable(true).WithDebug(&debug))
+	if !stubbed(mod, unused) {
+		t.Error("expected func to be removed")
+	}
+	tbl := map[int32]uint32{}
+	for _, seg := range mod.Element.Segments {
+		offset, ok := constOffset(seg)
+		if !ok {
+			t.Fatalf("unexpected element segment %v", seg)
+		}
+		for j, idx := range seg.Indices {
+			tbl[offset+int32(j)] = idx
+		}
+	}
+	if act, ok := tbl[offset]; ok {
+		t.Errorf("expected table entry %d to be removed, got func %d", offset, act)
+	}
+	if exp, act := def.Table.Tables[0].Lim.Min, mod.Table.Tables[0].Lim.Min; exp != act {
+		t.Errorf("expected table size %d, got %d", exp, act)
+	}
+	if exp := "shrank table 0"; !strings.Contains(debug.String(), exp) {
+		t.Errorf("expected debug output to contain %q", exp)
+	}
+
+	// The remaining entries are at the same table index as before, and refer
+	// to retained functions: call_indirect still resolves them.
+	var removed int
+	for _, seg := range def.Element.Segments {
+		offset, _ := constOffset(seg)
+		for j, idx := range seg.Indices {
+			act, ok := tbl[offset+int32(j)]
+			switch {
+			case !ok:
+				removed++
+			case act != idx:
+				t.Errorf("table index %d: expected func %d, got %d", offset+int32(j), idx, act)
+			case stubbed(mod, act):
+				t.Errorf("table index %d: expected func %d to be retained", offset+int32(j), act)
+			}
+		}
+	}
+	if removed == 0 {
+		t.Error("expected table entries of unused functions to be removed")
+	}
+	for _, fn := range policy.Funcs.Funcs {
+		if stubbed(mod, c.funcs[fn.Name]) {
+			t.Errorf("expected compiled func %s to be retained", fn.Name)
+		}
+	}
+}
+
+func TestShrinkTableSignatures(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	c := New().WithPolicy(policy).WithShrinkTable(true).WithKeepFunctions("caller")
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	offset, err := getLowestFreeElementSegmentOffset(c.module)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two types of the same signature, and one of another: the caller's
+	// call_indirect uses the first, the table entries f and g the others.
+	i32 := module.FunctionType{Params: []types.ValueType{types.I32}, Results: []types.ValueType{types.I32}}
+	f64 := module.FunctionType{Params: []types.ValueType{types.F64}}
+	base := uint32(len(c.module.Type.Functions))
+	c.module.Type.Functions = append(c.module.Type.Functions, i32, i32, f64)
+	add := func(tidx uint32, instrs ...instruction.Instruction) uint32 {
+		var buf bytes.Buffer
+		if err := encoding.WriteCodeEntry(&buf, &module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: instrs}}}); err != nil {
+			t.Fatal(err)
+		}
+		c.module.Function.TypeIndices = append(c.module.Function.TypeIndices, tidx)
+		c.module.Code.Segments = append(c.module.Code.Segments, module.RawCodeSegment{Code: buf.Bytes()})
+		return uint32(c.functionImportCount() + len(c.module.Code.Segments) - 1)
+	}
+	f := add(base+1, instruction.GetLocal{Index: 0})
+	g := add(base + 2)
+	c.funcs["caller"] = add(base, instruction.GetLocal{Index: 0}, instruction.I32Const{Value: offset}, instruction.CallIndirect{Index: base})
+	c.module.Element.Segments = append(c.module.Element.Segments, module.ElementSegment{
+		Offset:  module.Expr{Instrs: []instruction.Instruction{instruction.I32Const{Value: offset}}},
+		Indices: []uint32{f, g},
+	})
+	c.module.Table.Tables[0].Lim.Min += 2
+
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imports := uint32(c.functionImportCount())
+	for idx, exp := range map[uint32]bool{f: false, g: true} {
+		if stubbed := isStub(mod.Code.Segments[idx-imports].Code); stubbed != exp {
+			t.Errorf("func %d: expected removed %v, got %v", idx, exp, stubbed)
+		}
+	}
+}
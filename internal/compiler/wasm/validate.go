@@ -0,0 +1,162 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/util"
+)
+
+// WithStrict toggles strict mode: problems found when validating the
+// compiled module, which are otherwise only logged, become errors.
+func (c *Compiler) WithStrict(enabled bool) *Compiler {
+	c.strict = enabled
+	return c
+}
+
+// warn logs the problem, and returns it as error in strict mode.
+func (c *Compiler) warn(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if c.strict {
+		return err
+	}
+	c.debug.Printf("warning: %v", err)
+	return nil
+}
+
+// checkDataSegments reports data segments initializing overlapping memory
+// ranges: the later segment would silently overwrite the earlier one.
+func (c *Compiler) checkDataSegments() error {
+	type span struct {
+		idx        int
+		start, end int32
+	}
+	spans := make([]span, 0, len(c.module.Data.Segments))
+	for i, seg := range c.module.Data.Segments {
+		start, end, err := dataSegmentRange(seg)
+		if err != nil {
+			return fmt.Errorf("data segment %d: %w", i, err)
+		}
+		if start == end {
+			continue
+		}
+		spans = append(spans, span{idx: i, start: start, end: end})
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	for i := 1; i < len(spans); i++ {
+		prev, curr := spans[i-1], spans[i]
+		if curr.start < prev.end {
+			if err := c.warn("data segment %d [%d, %d) overlaps data segment %d [%d, %d)",
+				curr.idx, curr.start, curr.end, prev.idx, prev.start, prev.end); err != nil {
+				return err
+			}
+		}
+		if prev.end > curr.end { // keep the widest range for the next comparison
+			spans[i] = span{idx: prev.idx, start: prev.start, end: prev.end}
+		}
+	}
+	return nil
+}
+
+// checkExportNames cross-checks the function exports with the name section:
+// every exported function should have a name, and no name should refer to a
+// function that has been removed. It is run when debug output is requested,
+// or in strict mode.
+func (c *Compiler) checkExportNames() error {
+	if !c.strict && c.debug.Writer() == io.Discard {
+		return nil
+	}
+	if len(c.module.Names.Functions) == 0 { // names stripped, nothing to check
+		return nil
+	}
+	names := make(map[uint32]string, len(c.module.Names.Functions))
+	total := uint32(c.functionImportCount() + len(c.module.Function.TypeIndices))
+	for _, nm := range c.module.Names.Functions {
+		names[nm.Index] = nm.Name
+		_, kept := c.keepFuncs[nm.Index]
+		if nm.Index >= total || (c.keepFuncs != nil && !kept) {
+			if err := c.warn("name %q refers to removed function %d", nm.Name, nm.Index); err != nil {
+				return err
+			}
+		}
+	}
+	for _, exp := range c.module.Export.Exports {
+		if exp.Descriptor.Type != module.FunctionExportType {
+			continue
+		}
+		if _, ok := names[exp.Descriptor.Index]; !ok {
+			if err := c.warn("exported function %q (%d) has no name", exp.Name, exp.Descriptor.Index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WithMaxModuleSize sets an upper bound on the size of the encoded module
+// (in bytes). Compilation fails if the final module exceeds it. Zero, the
+// default, means no limit.
+func (c *Compiler) WithMaxModuleSize(n int) *Compiler {
+	c.maxSize = n
+	return c
+}
+
+func (c *Compiler) checkModuleSize() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	n, err := encoding.EncodedSize(c.module)
+	if err != nil {
+		return fmt.Errorf("encode module: %w", err)
+	}
+	if n > c.maxSize {
+		return fmt.Errorf("encoded module size %d bytes exceeds limit of %d bytes", n, c.maxSize)
+	}
+	return nil
+}
+
+// inputMemoryFactor approximates how many bytes of memory evaluation takes
+// per byte of JSON input: the input is copied into memory, and parsed into
+// values of at least the same size.
+const inputMemoryFactor = 2
+
+// WithExpectedInputSize sets the size (in bytes) of a typical JSON input
+// document. If the module's initial memory is too small to hold its static
+// data plus the estimated memory needed for such an input, a warning is
+// issued: evaluation would need to grow the memory first. With WithStrict,
+// the compilation fails instead. The estimate is a heuristic, see
+// inputMemoryFactor; the initial memory isn't raised to match it.
+func (c *Compiler) WithExpectedInputSize(n int) *Compiler {
+	c.inputSize = n
+	return c
+}
+
+func (c *Compiler) checkInitialMemory() error {
+	if c.inputSize <= 0 {
+		return nil
+	}
+	var initial int64
+	for _, imp := range c.module.Import.Imports {
+		if mem, ok := imp.Descriptor.(module.MemoryImport); ok {
+			initial = int64(mem.Mem.Lim.Min) * util.PageSize
+		}
+	}
+	static, err := getLowestFreeDataSegmentOffset(c.module)
+	if err != nil {
+		return err
+	}
+	estimate := int64(static) + int64(inputMemoryFactor)*int64(c.inputSize)
+	if estimate > initial {
+		return c.warn("initial memory of %d bytes is below the estimated %d bytes needed for inputs of %d bytes",
+			initial, estimate, c.inputSize)
+	}
+	return nil
+}
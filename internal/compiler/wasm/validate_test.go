@@ -0,0 +1,160 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+func dataSegment(offset int32, init string) module.DataSegment {
+	return module.DataSegment{
+		Offset: module.Expr{Instrs: []instruction.Instruction{instruction.I32Const{Value: offset}}},
+		Init:   []byte(init),
+	}
+}
+
+func TestCheckDataSegments(t *testing.T) {
+	overlapping := []module.DataSegment{
+		dataSegment(106, "foo"),
+		dataSegment(100, "barbarbar"),
+	}
+	exp := "data segment 0 [106, 109) overlaps data segment 1 [100, 109)"
+
+	var buf bytes.Buffer
+	c := New().WithDebug(&buf)
+	c.module = &module.Module{Data: module.DataSection{Segments: overlapping}}
+	if err := c.checkDataSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected warning %q, got %q", exp, buf.String())
+	}
+
+	c = New().WithStrict(true)
+	c.module = &module.Module{Data: module.DataSection{Segments: overlapping}}
+	if err := c.checkDataSegments(); err == nil || err.Error() != exp {
+		t.Errorf("expected error %q, got %v", exp, err)
+	}
+
+	c = New().WithStrict(true)
+	c.module = &module.Module{Data: module.DataSection{Segments: []module.DataSegment{
+		dataSegment(103, "foo"),
+		dataSegment(100, "bar"),
+		dataSegment(106, ""),
+	}}}
+	if err := c.checkDataSegments(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestCheckExportNames(t *testing.T) {
+	mod := func() *module.Module {
+		return &module.Module{
+			Function: module.FunctionSection{TypeIndices: []uint32{0, 0}},
+			Export: module.ExportSection{Exports: []module.Export{
+				{Name: "eval", Descriptor: module.ExportDescriptor{Type: module.FunctionExportType, Index: 0}},
+				{Name: "builtins", Descriptor: module.ExportDescriptor{Type: module.FunctionExportType, Index: 1}},
+				{Name: "memory", Descriptor: module.ExportDescriptor{Type: module.MemoryExportType, Index: 0}},
+			}},
+			Names: module.NameSection{Functions: []module.NameMap{
+				{Index: 0, Name: "eval"},
+				{Index: 1, Name: "builtins"},
+			}},
+		}
+	}
+
+	c := New().WithStrict(true)
+	c.module = mod()
+	if err := c.checkExportNames(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.module = mod()
+	c.module.Names.Functions = c.module.Names.Functions[:1]
+	if err := c.checkExportNames(); err == nil || err.Error() != `exported function "builtins" (1) has no name` {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	c.module = mod()
+	c.module.Names.Functions = append(c.module.Names.Functions, module.NameMap{Index: 2, Name: "gone"})
+	if err := c.checkExportNames(); err == nil || err.Error() != `name "gone" refers to removed function 2` {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	c.module = mod()
+	c.keepFuncs = map[uint32]struct{}{0: {}}
+	if err := c.checkExportNames(); err == nil || err.Error() != `name "builtins" refers to removed function 1` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckExportNamesCompile(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	if _, err := New().WithPolicy(policy).WithStrict(true).Compile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxModuleSize(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	mod, err := New().WithPolicy(policy).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, mod); err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+
+	if _, err := New().WithPolicy(policy).WithMaxModuleSize(size).Compile(); err != nil {
+		t.Errorf("expected no error for limit %d, got %v", size, err)
+	}
+
+	_, err = New().WithPolicy(policy).WithMaxModuleSize(1024).Compile()
+	exp := fmt.Sprintf("encoded module size %d bytes exceeds limit of 1024 bytes", size)
+	if err == nil || err.Error() != exp {
+		t.Errorf("expected error %q, got %v", exp, err)
+	}
+}
+
+func TestExpectedInputSize(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+
+	if _, err := New().WithPolicy(policy).WithStrict(true).WithExpectedInputSize(1024).Compile(); err != nil {
+		t.Errorf("expected no error for small input, got %v", err)
+	}
+
+	_, err := New().WithPolicy(policy).WithStrict(true).WithExpectedInputSize(1 << 20).Compile()
+	if err == nil || !strings.HasPrefix(err.Error(), "initial memory of 131070 bytes is below the estimated") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := New().WithPolicy(policy).WithDebug(&buf).WithExpectedInputSize(1 << 20).Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "warning: initial memory of 131070 bytes") {
+		t.Errorf("expected warning, got debug output %s", buf.String())
+	}
+}
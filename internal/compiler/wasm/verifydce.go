@@ -0,0 +1,123 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/open-policy-agent/opa/internal/rego/opa"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+)
+
+// WithVerifyDCE enables checking the removal of unused code: every
+// entrypoint is evaluated with each of inputs, arbitrary JSON documents, in
+// the module as it would be without the removal, and as it is, and the
+// compilation fails if any result differs. This is a debugging aid for
+// finding functions that were stubbed although they're used, and expensive:
+// it requires the wasm engine to be registered, by importing
+// github.com/open-policy-agent/opa/features/wasm, and shouldn't be used in
+// production.
+func (c *Compiler) WithVerifyDCE(inputs []interface{}) *Compiler {
+	c.verifyInputs = append([]interface{}{}, inputs...)
+	return c
+}
+
+// verifyDCE compares the evaluation of the module with the code removed by
+// removeUnusedCode restored to its evaluation as it is, if requested.
+func (c *Compiler) verifyDCE() error {
+	if c.verifyInputs == nil {
+		return nil
+	}
+	if len(c.stubbedCode) == 0 {
+		c.debug.Printf("verify DCE: no code removed")
+		return nil
+	}
+	e, err := opa.LookupEngine("wasm")
+	if err != nil {
+		return fmt.Errorf("verify DCE: %w", err)
+	}
+
+	var after bytes.Buffer
+	if err := encoding.WriteModule(&after, c.module); err != nil {
+		return fmt.Errorf("verify DCE: encode module: %w", err)
+	}
+	orig := c.module.Code.Segments
+	restored := append([]module.RawCodeSegment{}, orig...)
+	for i, code := range c.stubbedCode {
+		restored[i].Code = code
+	}
+	var before bytes.Buffer
+	c.module.Code.Segments = restored
+	err = encoding.WriteModule(&before, c.module)
+	c.module.Code.Segments = orig
+	if err != nil {
+		return fmt.Errorf("verify DCE: encode module: %w", err)
+	}
+
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	pre, err := e.New().WithPolicyBytes(before.Bytes()).Init()
+	if err != nil {
+		return fmt.Errorf("verify DCE: load module without removal: %w", err)
+	}
+	defer pre.Close()
+	post, err := e.New().WithPolicyBytes(after.Bytes()).Init()
+	if err != nil {
+		return fmt.Errorf("verify DCE: load module: %w", err)
+	}
+	defer post.Close()
+
+	eps, err := pre.Entrypoints(ctx)
+	if err != nil {
+		return fmt.Errorf("verify DCE: %w", err)
+	}
+	names := make([]string, 0, len(eps))
+	for name := range eps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// a fixed time, for policies depending on it
+	now := time.Unix(0, 0)
+	for i := range c.verifyInputs {
+		input := c.verifyInputs[i]
+		for _, name := range names {
+			opts := opa.EvalOpts{Input: &input, Entrypoint: eps[name], Time: now}
+			exp, err := evalResult(ctx, pre, opts)
+			if err != nil {
+				return fmt.Errorf("verify DCE: input %d, entrypoint %s: %w", i, name, err)
+			}
+			act, err := evalResult(ctx, post, opts)
+			if err != nil {
+				return fmt.Errorf("verify DCE: input %d, entrypoint %s: %w", i, name, err)
+			}
+			if exp != act {
+				return fmt.Errorf("verify DCE: input %d, entrypoint %s: got %s, without removing unused code %s", i, name, act, exp)
+			}
+		}
+		c.debug.Printf("verify DCE: input %d: same results for %d entrypoints", i, len(names))
+	}
+	return nil
+}
+
+// evalResult returns the result of evaluating e, or the error as a result if
+// the evaluation fails: a policy failing the same way either way is fine.
+func evalResult(ctx context.Context, e opa.EvalEngine, opts opa.EvalOpts) (string, error) {
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	res, err := e.Eval(ctx, opts)
+	if err != nil {
+		return "error: " + err.Error(), nil
+	}
+	return string(res.Result), nil
+}
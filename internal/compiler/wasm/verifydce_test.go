@@ -0,0 +1,87 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/rego/opa"
+)
+
+// fakeEngine evaluates every entrypoint to the size of the policy, or to
+// "true" if sizeless, so that stubbed functions make a difference.
+type fakeEngine struct {
+	sizeless bool
+	policy   []byte
+}
+
+func (f *fakeEngine) New() opa.EvalEngine                      { return &fakeEngine{sizeless: f.sizeless} }
+func (f *fakeEngine) Init() (opa.EvalEngine, error)            { return f, nil }
+func (f *fakeEngine) WithPolicyBytes(bs []byte) opa.EvalEngine { f.policy = bs; return f }
+func (f *fakeEngine) WithDataJSON(interface{}) opa.EvalEngine  { return f }
+func (f *fakeEngine) Entrypoints(context.Context) (map[string]int32, error) {
+	return map[string]int32{"test": 0}, nil
+}
+func (f *fakeEngine) Eval(_ context.Context, opts opa.EvalOpts) (*opa.Result, error) {
+	if (*opts.Input).(string) == "fail" {
+		return nil, errors.New("oops")
+	}
+	if f.sizeless {
+		return &opa.Result{Result: []byte("true")}, nil
+	}
+	return &opa.Result{Result: []byte(strconv.Itoa(len(f.policy)))}, nil
+}
+func (*fakeEngine) SetData(context.Context, interface{}) error               { return nil }
+func (*fakeEngine) SetDataPath(context.Context, []string, interface{}) error { return nil }
+func (*fakeEngine) RemoveDataPath(context.Context, []string) error           { return nil }
+func (*fakeEngine) Close()                                                   {}
+
+var (
+	fakeWasmEngine   = &fakeEngine{}
+	registerFakeOnce sync.Once
+)
+
+func TestVerifyDCE(t *testing.T) {
+	policy := planQueries(t, planner.QuerySet{
+		Name:    "test",
+		Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+	})
+	registerFakeOnce.Do(func() {
+		if _, err := New().WithPolicy(policy).WithVerifyDCE([]interface{}{"x"}).Compile(); !errors.Is(err, opa.ErrEngineNotFound) {
+			t.Errorf("expected engine not found, got %v", err)
+		}
+		opa.RegisterEngine("wasm", fakeWasmEngine)
+	})
+	engine := fakeWasmEngine
+	engine.sizeless = true
+
+	var buf bytes.Buffer
+	_, err := New().WithPolicy(policy).WithVerifyDCE([]interface{}{"x", "fail"}).WithDebug(&buf).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "verify DCE: input 1: same results for 1 entrypoints"; !strings.Contains(buf.String(), exp) {
+		t.Errorf("expected debug output to contain %q, got:\n%s", exp, buf.String())
+	}
+
+	engine.sizeless = false
+	_, err = New().WithPolicy(policy).WithVerifyDCE([]interface{}{"x"}).Compile()
+	if exp := "verify DCE: input 0, entrypoint test: got "; err == nil || !strings.Contains(err.Error(), exp) {
+		t.Fatalf("expected error containing %q, got %v", exp, err)
+	}
+
+	// not verified unless requested
+	if _, err := New().WithPolicy(policy).Compile(); err != nil {
+		t.Fatal(err)
+	}
+}
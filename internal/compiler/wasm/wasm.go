@@ -7,10 +7,12 @@ package wasm
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/internal/compiler/wasm/opa"
@@ -225,6 +227,33 @@ type Compiler struct {
 	opaBoolAddrs          map[ir.Bool]uint32      // addresses of interned opa_boolean_t
 	fileAddrs             []uint32                // null-terminated string constant addresses, used for file names
 	funcs                 map[string]uint32       // maps imported and exported function names to function indices
+	funcNames             map[uint32]string       // reverse of funcs, see funcName
+
+	wasmOptOptions
+	emitOptions
+	shrinkOptions
+	checkOptions
+
+	woptWarned     bool              // experimental wasm-opt warning has been logged
+	snapshots      int               // number of snapshots written
+	prepareStages  int               // number of stages run by Prepare
+	stagesRun      int               // number of stages run so far
+	compacted      bool              // unused code has been compacted
+	compactedFuncs map[uint32]uint32 // function indices before compaction -> after, if compacted
+
+	annotations map[string][]*ast.Annotations // annotations of entrypoints, by path
+
+	entrypointCallees map[string][]uint32 // functions called directly from each entrypoint
+	exclusiveFuncs    map[string][]uint32 // functions reachable from only one entrypoint
+	unusedLocals      map[string][]uint32 // unused locals, by function name
+	callGraph         map[uint32][]uint32 // call graph used for removing unused code
+	roots             map[uint32]string   // roots of the call graph, and why they're kept
+	keepFuncs         map[uint32]struct{} // functions retained when removing unused code
+	deadCode          *DeadCodeReport     // outcome of removing unused code
+	stubbedCode       map[int][]byte      // code segment -> original body, if verifying the removal
+	ctx               context.Context     // context of the running compilation, if any
+	optimizeOpts      *OptimizeOptions    // options of the optimization stage, if not the defaults
+	passMetrics       []PassMetrics       // metrics of the optimization passes run
 
 	nextLocal uint32
 	locals    map[ir.Local]uint32
@@ -234,6 +263,76 @@ type Compiler struct {
 	debug debug.Debug
 }
 
+// wasmOptOptions are the settings of the wasm-opt optimization, see
+// WithWasmOptArgs and the related options.
+type wasmOptOptions struct {
+	woptArgs       []string       // wasm-opt arguments, if not default
+	woptPasses     [][]string     // wasm-opt invocations, if several
+	woptLevel      OptLevel       // wasm-opt optimization level, if not default
+	woptStrict     bool           // fail on wasm-opt warnings
+	woptFallback   bool           // keep the unoptimized module if wasm-opt fails
+	woptTimeout    *time.Duration // wasm-opt timeout, if not default
+	woptPath       string         // wasm-opt binary, if not looked up in PATH
+	woptRunner     WasmOptRunner  // runs wasm-opt in-process, instead of the binary
+	woptRequired   bool           // fail if wasm-opt is not found
+	woptMinVersion *int           // minimum wasm-opt version, if not default
+}
+
+// emitOptions control what the compiled module contains, and which
+// WebAssembly features it uses.
+type emitOptions struct {
+	passes           []InstructionPass            // caller-provided instruction rewrites
+	entrypointPasses map[string][]InstructionPass // instruction passes for exclusively reachable functions
+	entrypointTable  bool                         // emit entrypoint table custom section
+	memoryChecksum   bool                         // emit data segments checksum global
+	buildInfo        bool                         // emit build info custom section
+	buildRevision    string                       // revision recorded in build info
+	epoch            *int64                       // fixed timestamp for embedding, see now
+	features         map[Feature]struct{}         // features supported by the target runtime
+	passiveElements  bool                         // emit passive element segments
+	bulkMemory       bool                         // use memory.copy and memory.fill, see WithBulkMemory
+	producers        bool                         // replace producers section
+	bundleName       string                       // bundle the policy was built from
+	bundleRevision   string                       // revision of that bundle
+	sourceMap        bool                         // emit source map custom section
+	peephole         bool                         // remove obvious waste from compiled functions
+	tailCalls        bool                         // emit tail calls in compiled functions
+	parallelism      int                          // policy functions compiled concurrently, if positive
+}
+
+// shrinkOptions control what is removed from the compiled module.
+type shrinkOptions struct {
+	stripStart     bool          // remove start section if it has no effect
+	stripNames     bool          // remove name section
+	removeLocals   bool          // remove unused locals from compiled functions
+	removedExports []string      // function exports to drop before removing unused code
+	keptExports    []string      // function exports to keep, dropping all others, if set
+	minimal        bool          // produce the smallest usable module
+	compact        bool          // remove unused functions instead of stubbing them
+	pruneImports   bool          // remove unreachable function imports
+	removeData     bool          // remove unused globals and table entries
+	keepFunctions  []string      // functions to retain when removing unused code
+	callGraphCSV   func() []byte // source of the library call graph, if not derived from its code
+	shrinkTable    bool          // don't keep functions for being referenced in the table
+	dedupFuncs     bool          // merge identical policy functions
+}
+
+// checkOptions control the checks of the compiled module, and the debugging
+// output written along the way.
+type checkOptions struct {
+	strict          bool          // treat validation warnings as errors
+	deniedBuiltins  []string      // built-ins that must not be referenced
+	selfContained   bool          // fail if built-ins provided by the host are referenced
+	maxSize         int           // maximum encoded module size, if positive
+	inputSize       int           // expected input size, for estimating memory needs
+	snapshotDir     string        // directory for module snapshots
+	callGraphWriter io.Writer     // destination of the retained call graph, as JSON
+	maxCallDepth    int           // maximum call depth before warning, if positive
+	iface           *Interface    // expected module interface, if any
+	validate        bool          // check the final module's structure
+	verifyInputs    []interface{} // inputs for checking the unused code removal, if any
+}
+
 type funcCode struct {
 	name string
 	code *module.CodeEntry
@@ -268,16 +367,55 @@ func New() *Compiler {
 		c.compileFuncs,
 		c.compilePlans,
 		c.emitABIVersionGlobals,
+	}
+	c.prepareStages = len(c.stages)
+	c.stages = append(c.stages,
+		c.snapshotStage("plan"),
 
 		// "local" optimizations
-		c.removeUnusedCode,
+		c.removeExports,
+		c.dedupFunctions,
+		c.emitBulkMemory,
+		c.measure("remove-unused-code", c.removeUnusedCode),
+		c.snapshotStage("dead-code"),
+		c.checkCallDepth,
+		c.checkDeniedBuiltins,
+		c.checkSelfContained,
+		c.applyInstructionPasses,
+		c.applyEntrypointPasses,
+		c.findUnusedLocals,
+		c.emitTailCalls,
 
 		// final emissions
 		c.emitFuncs,
+		c.checkDataSegments,
+		c.checkExportNames,
+		c.emitPassiveElements,
+		c.emitEntrypointTable,
+		c.emitBuildInfo,
+		c.emitAnnotations,
+		c.verifyDCE,
+		c.removeTrivialStart,
+		c.stripNameSection,
+		c.tightenTable,
+		c.removeUnusedData,
+		c.trimTable,
+		c.compactUnusedCode,
+		c.writeCallGraph,
+		c.emitSourceMap,
 
 		// global optimizations
 		c.optimizeBinaryen,
-	}
+		c.emitMemoryChecksum, // of the data segments as repacked by wasm-opt
+		c.emitProducers,      // replaces the section wasm-opt has amended
+		c.stripCustomSections,
+
+		// final checks
+		c.checkModuleSize,
+		c.checkInitialMemory,
+		c.validateStructure,
+		c.checkInterface,
+	)
 	return c
 }
 
@@ -304,20 +442,55 @@ func (c *Compiler) WithDebug(sink io.Writer) *Compiler {
 	return c
 }
 
+// WithStripTrivialStart toggles the removal of the module's start section,
+// if the start function doesn't have any side effects.
+func (c *Compiler) WithStripTrivialStart(enabled bool) *Compiler {
+	c.stripStart = enabled
+	return c
+}
+
 // Compile returns a compiled WASM module.
 func (c *Compiler) Compile() (*module.Module, error) {
+	return c.CompileContext(context.Background())
+}
 
-	for _, stage := range c.stages {
-		if err := stage(); err != nil {
-			return nil, err
-		} else if len(c.errors) > 0 {
-			return nil, c.errors[0] // TODO(tsandall) return all errors.
-		}
+// CompileContext returns a compiled WASM module. If ctx is canceled, the
+// compilation stops before the next stage, and a running wasm-opt process
+// is killed.
+func (c *Compiler) CompileContext(ctx context.Context) (*module.Module, error) {
+	c.ctx = ctx
+	defer func() { c.ctx = nil }()
+
+	if err := c.runStages(len(c.stages)); err != nil {
+		return nil, err
 	}
 
 	return c.module, nil
 }
 
+// context returns the context of the running compilation.
+func (c *Compiler) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// runStages runs the stages up to (excluding) n that haven't been run yet.
+func (c *Compiler) runStages(n int) error {
+	for ; c.stagesRun < n; c.stagesRun++ {
+		if err := c.context().Err(); err != nil {
+			return fmt.Errorf("compilation aborted: %w", err)
+		}
+		if err := c.stages[c.stagesRun](); err != nil {
+			return err
+		} else if len(c.errors) > 0 {
+			return c.errors[0] // TODO(tsandall) return all errors.
+		}
+	}
+	return nil
+}
+
 // initModule instantiates the module from the pre-compiled OPA binary. The
 // module is then updated to include declarations for all of the functions that
 // are about to be compiled.
@@ -713,10 +886,8 @@ func (c *Compiler) compileEntrypointDecls() error {
 
 // compileFuncs compiles the policy functions and emits them into the module.
 func (c *Compiler) compileFuncs() error {
-	for _, fn := range c.policy.Funcs.Funcs {
-		if err := c.compileFunc(fn); err != nil {
-			return fmt.Errorf("func %v: %w", fn.Name, err)
-		}
+	if err := c.compileFuncsCode(); err != nil {
+		return err
 	}
 
 	if err := c.emitMappingAndStartFunc(); err != nil {
@@ -766,6 +937,7 @@ func (c *Compiler) compilePlans() error {
 
 	// Add each entrypoint to this block.
 	main := instruction.Block{}
+	c.entrypointCallees = make(map[string][]uint32, len(c.policy.Plans.Plans))
 
 	for i, plan := range c.policy.Plans.Plans {
 
@@ -792,6 +964,7 @@ func (c *Compiler) compilePlans() error {
 
 		entrypoint.Instrs = append(entrypoint.Instrs, instruction.Br{Index: 1})
 		main.Instrs = append(main.Instrs, entrypoint)
+		c.entrypointCallees[plan.Name] = findCallees(entrypoint.Instrs, nil)
 	}
 
 	// If none of the entrypoint blocks execute, call opa_abort() as this likely
@@ -1703,17 +1876,11 @@ func getLowestFreeDataSegmentOffset(m *module.Module) (int32, error) {
 
 	for i := range m.Data.Segments {
 
-		if len(m.Data.Segments[i].Offset.Instrs) != 1 {
-			return 0, errors.New("bad data segment offset instructions")
-		}
-
-		instr, ok := m.Data.Segments[i].Offset.Instrs[0].(instruction.I32Const)
-		if !ok {
-			return 0, errors.New("bad data segment offset expr")
+		_, addr, err := dataSegmentRange(m.Data.Segments[i])
+		if err != nil {
+			return 0, err
 		}
 
-		// NOTE(tsandall): assume memory up to but not including addr is taken.
-		addr := instr.Value + int32(len(m.Data.Segments[i].Init))
 		if addr > offset {
 			offset = addr
 		}
@@ -1722,6 +1889,21 @@ func getLowestFreeDataSegmentOffset(m *module.Module) (int32, error) {
 	return offset, nil
 }
 
+// dataSegmentRange returns the memory range [start, end) initialized by seg.
+func dataSegmentRange(seg module.DataSegment) (int32, int32, error) {
+	if len(seg.Offset.Instrs) != 1 {
+		return 0, 0, errors.New("bad data segment offset instructions")
+	}
+
+	instr, ok := seg.Offset.Instrs[0].(instruction.I32Const)
+	if !ok {
+		return 0, 0, errors.New("bad data segment offset expr")
+	}
+
+	// NOTE(tsandall): assume memory up to but not including addr is taken.
+	return instr.Value, instr.Value + int32(len(seg.Init)), nil
+}
+
 func getLowestFreeElementSegmentOffset(m *module.Module) (int32, error) {
 	var offset int32
 
@@ -11,6 +11,7 @@ import (
 	"github.com/open-policy-agent/opa/internal/planner"
 	"github.com/open-policy-agent/opa/internal/wasm/instruction"
 	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/ir"
 )
 
 func TestCompilerHelloWorld(t *testing.T) {
@@ -93,3 +94,12 @@ func TestCompilerBadDataSegment(t *testing.T) {
 		t.Fatal("expected 106 but got:", result, "err:", err)
 	}
 }
+
+func planQueries(t *testing.T, qs ...planner.QuerySet) *ir.Policy {
+	t.Helper()
+	policy, err := planner.New().WithQueries(qs).WithBuiltinDecls(ast.BuiltinMap).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// WazeroWasmOpt runs a build of wasm-opt targeting WASI with wazero, a pure
+// Go WebAssembly runtime, so that no wasm-opt binary needs to be installed.
+// Its Run method is a WasmOptRunner, see WithWasmOptRunner.
+type WazeroWasmOpt struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+// NewWazeroWasmOpt compiles wasmOpt, a build of wasm-opt targeting WASI.
+// The compiled module is reused by every Run, until Close is called.
+func NewWazeroWasmOpt(ctx context.Context, wasmOpt []byte) (*WazeroWasmOpt, error) {
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		_ = r.Close(ctx)
+		return nil, fmt.Errorf("instantiate WASI: %w", err)
+	}
+	compiled, err := r.CompileModule(ctx, wasmOpt)
+	if err != nil {
+		_ = r.Close(ctx)
+		return nil, fmt.Errorf("compile wasm-opt: %w", err)
+	}
+	return &WazeroWasmOpt{runtime: r, compiled: compiled}, nil
+}
+
+// Run runs wasm-opt with args, reading the module from stdin and writing the
+// optimized one to stdout. Each run gets its own instance, so that runs can
+// happen concurrently. A non-zero exit code is returned as an error.
+func (w *WazeroWasmOpt) Run(ctx context.Context, args []string, module []byte) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cfg := wazero.NewModuleConfig().
+		WithName(""). // allows several instances at once
+		WithArgs(append([]string{"wasm-opt"}, append(args, "-o", "-")...)...).
+		WithStdin(bytes.NewReader(module)).
+		WithStdout(&stdout).
+		WithStderr(&stderr)
+	mod, err := w.runtime.InstantiateModule(ctx, w.compiled, cfg)
+	if mod != nil {
+		_ = mod.Close(ctx)
+	}
+	var exit *sys.ExitError
+	switch {
+	case errors.As(err, &exit) && exit.ExitCode() == 0:
+	case errors.As(err, &exit) && ctx.Err() != nil:
+		return nil, stderr.Bytes(), ctx.Err()
+	case errors.As(err, &exit):
+		return nil, stderr.Bytes(), fmt.Errorf("exit status %d", exit.ExitCode())
+	case err != nil:
+		return nil, stderr.Bytes(), err
+	}
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// Close releases the compiled wasm-opt.
+func (w *WazeroWasmOpt) Close(ctx context.Context) error {
+	return w.runtime.Close(ctx)
+}
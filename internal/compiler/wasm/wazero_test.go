@@ -0,0 +1,119 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/internal/planner"
+)
+
+// fakeWasiWasmOpt passes the module read from stdin through to stdout,
+// echoing its arguments on stderr, or fails if passed --fail.
+const fakeWasiWasmOpt = `package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func main() {
+	fmt.Fprintln(os.Stderr, strings.Join(os.Args[1:], " "))
+	for _, a := range os.Args[1:] {
+		if a == "--fail" {
+			os.Exit(3)
+		}
+	}
+	if _, err := io.Copy(os.Stdout, os.Stdin); err != nil {
+		os.Exit(1)
+	}
+}
+`
+
+// buildWasiWasmOpt compiles fakeWasiWasmOpt for WASI.
+func buildWasiWasmOpt(t *testing.T) []byte {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds a WASI module")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(fakeWasiWasmOpt), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "wasm-opt.wasm")
+	cmd := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "build", "-o", out, "main.go")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm", "GOFLAGS=", "GO111MODULE=off")
+	if bs, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("build WASI module: %v: %s", err, bs)
+	}
+	bs, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestWazeroWasmOpt(t *testing.T) {
+	ctx := context.Background()
+	w, err := NewWazeroWasmOpt(ctx, buildWasiWasmOpt(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close(ctx)
+
+	t.Run("compile", func(t *testing.T) {
+		policy := planQueries(t, planner.QuerySet{
+			Name:    "test",
+			Queries: []ast.Body{ast.MustParseBody(`input.foo = 1`)},
+		})
+		missing := filepath.Join(t.TempDir(), "wasm-opt")
+		c := New().WithPolicy(policy).WithWasmOptPath(missing).WithRequireWasmOpt(true).WithWasmOptRunner(w.Run)
+		if _, err := c.Compile(); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(c.PassMetrics()); n == 0 || c.PassMetrics()[n-1].Name != "wasm-opt" {
+			t.Errorf("expected wasm-opt metrics, got %v", c.PassMetrics())
+		}
+	})
+
+	t.Run("stderr", func(t *testing.T) {
+		out, stderr, err := w.Run(ctx, []string{"-O2"}, []byte("\x00asm"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, []byte("\x00asm")) {
+			t.Errorf("expected module passed through, got %q", out)
+		}
+		if exp := "-O2 -o -\n"; string(stderr) != exp {
+			t.Errorf("expected stderr %q, got %q", exp, stderr)
+		}
+	})
+
+	t.Run("exit code", func(t *testing.T) {
+		_, _, err := w.Run(ctx, []string{"--fail"}, nil)
+		if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+			t.Fatalf("expected exit status error, got %v", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, _, err := w.Run(ctx, nil, nil); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
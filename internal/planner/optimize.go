@@ -0,0 +1,694 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package planner
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/ir"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// maxOptimizePasses bounds the number of passes over a function, see
+// optimizeBlocks.
+const maxOptimizePasses = 16
+
+// pureBuiltins are the built-in functions that are evaluated when planning if
+// their arguments are constant: their results only depend on the arguments.
+var pureBuiltins = map[string]struct{}{
+	ast.Equal.Name:           {},
+	ast.NotEqual.Name:        {},
+	ast.GreaterThan.Name:     {},
+	ast.GreaterThanEq.Name:   {},
+	ast.LessThan.Name:        {},
+	ast.LessThanEq.Name:      {},
+	ast.Plus.Name:            {},
+	ast.Minus.Name:           {},
+	ast.Multiply.Name:        {},
+	ast.Divide.Name:          {},
+	ast.Rem.Name:             {},
+	ast.Abs.Name:             {},
+	ast.Round.Name:           {},
+	ast.Ceil.Name:            {},
+	ast.Floor.Name:           {},
+	ast.Upper.Name:           {},
+	ast.Lower.Name:           {},
+	ast.StartsWith.Name:      {},
+	ast.EndsWith.Name:        {},
+	ast.Contains.Name:        {},
+	ast.IndexOf.Name:         {},
+	ast.Substring.Name:       {},
+	ast.Replace.Name:         {},
+	ast.Trim.Name:            {},
+	ast.TrimLeft.Name:        {},
+	ast.TrimRight.Name:       {},
+	ast.TrimPrefix.Name:      {},
+	ast.TrimSuffix.Name:      {},
+	ast.TrimSpace.Name:       {},
+	ast.IsString.Name:        {},
+	ast.IsNumber.Name:        {},
+	ast.IsBoolean.Name:       {},
+	ast.IsNull.Name:          {},
+	ast.TypeNameBuiltin.Name: {},
+}
+
+// WithOptimizationLevel sets the optimization level. At level 1, calls and
+// comparisons of constants are evaluated, and the statements and blocks that
+// can't have an effect are removed, as are the built-in functions no longer
+// called. Level 2 also propagates the constant strings and booleans into the
+// statements using them. By default, the IR is not optimized.
+func (p *Planner) WithOptimizationLevel(n int) *Planner {
+	p.level = n
+	return p
+}
+
+// optimize optimizes the planned policy's plans and functions.
+func (p *Planner) optimize() {
+	for _, plan := range p.policy.Plans.Plans {
+		plan.Blocks = p.optimizeBlocks(plan.Blocks, nil, false)
+	}
+	for _, fn := range p.policy.Funcs.Funcs {
+		fn.Blocks = p.optimizeBlocks(fn.Blocks, append([]ir.Local{fn.Return}, fn.Params...), true)
+	}
+	p.pruneBuiltinFuncs()
+}
+
+// pruneBuiltinFuncs removes the built-in functions that are no longer called
+// once the calls with constant arguments have been evaluated.
+func (p *Planner) pruneBuiltinFuncs() {
+	called := map[string]struct{}{}
+	calls := func(blocks []*ir.Block) {
+		for _, b := range blocks {
+			walkStmts(b, func(stmt ir.Stmt) {
+				if s, ok := stmt.(*ir.CallStmt); ok {
+					called[s.Func] = struct{}{}
+				}
+			})
+		}
+	}
+	for _, plan := range p.policy.Plans.Plans {
+		calls(plan.Blocks)
+	}
+	for _, fn := range p.policy.Funcs.Funcs {
+		calls(fn.Blocks)
+	}
+	fs := p.policy.Static.BuiltinFuncs[:0]
+	for _, f := range p.policy.Static.BuiltinFuncs {
+		if _, ok := called[f.Name]; ok {
+			fs = append(fs, f)
+		}
+	}
+	p.policy.Static.BuiltinFuncs = fs
+}
+
+// optimizeBlocks optimizes the blocks of a plan or function until nothing
+// changes. The locals given are defined and read outside of the blocks. The
+// last block of a function is kept, as it returns its result. Blocks using
+// statements that aren't known are left unchanged.
+func (p *Planner) optimizeBlocks(blocks []*ir.Block, locals []ir.Local, keepLast bool) []*ir.Block {
+	for i := 0; i < maxOptimizePasses; i++ {
+		o := &optimizer{p: p}
+		if !o.count(blocks, locals) {
+			return blocks
+		}
+
+		out := blocks[:0]
+		for j, b := range blocks {
+			if o.block(b, map[ir.Local]ast.Value{}) && (!keepLast || j < len(blocks)-1) {
+				o.changed = true
+				continue
+			}
+			out = append(out, b)
+		}
+		blocks = out
+
+		o.count(blocks, locals)
+		for _, b := range blocks {
+			o.removeDeadDefs(b)
+		}
+		if !o.changed {
+			break
+		}
+	}
+	return blocks
+}
+
+// optimizer holds the state of a pass over the blocks of a plan or function.
+type optimizer struct {
+	p       *Planner
+	defs    map[ir.Local]int   // number of statements defining a local
+	reads   map[ir.Local][]use // statements reading a local
+	at      map[ir.Stmt]use    // where each statement is
+	mutated map[ir.Local]bool  // locals whose value may be changed in place
+	changed bool
+}
+
+// use is the position of a statement: its index in the order the statements
+// are run, and the innermost loop it's in.
+type use struct {
+	pos  int
+	loop *loop
+}
+
+// loop is a scan that statements are nested in.
+type loop struct {
+	scan   *ir.ScanStmt
+	parent *loop
+}
+
+// count records the locals each statement of blocks defines and reads. The
+// locals given are read after the blocks. It returns false if there are
+// statements it doesn't know.
+func (o *optimizer) count(blocks []*ir.Block, locals []ir.Local) bool {
+	o.defs = map[ir.Local]int{ir.Input: 1, ir.Data: 1}
+	o.reads = map[ir.Local][]use{}
+	o.at = map[ir.Stmt]use{}
+	o.mutated = map[ir.Local]bool{}
+
+	var aliases []*ir.AssignVarStmt
+	ok := true
+	var visit func(b *ir.Block, l *loop)
+	visit = func(b *ir.Block, l *loop) {
+		for _, stmt := range b.Stmts {
+			at := use{pos: len(o.at), loop: l}
+			o.at[stmt] = at
+			reads, writes, known := stmtLocals(stmt)
+			if !known {
+				ok = false
+			}
+			for _, r := range reads {
+				o.reads[r] = append(o.reads[r], at)
+			}
+			for _, w := range writes {
+				o.defs[w]++
+			}
+			switch s := stmt.(type) {
+			case *ir.AssignIntStmt:
+				o.mutated[s.Target] = true
+			case *ir.AssignVarStmt:
+				aliases = append(aliases, s)
+			case *ir.ScanStmt:
+				visit(s.Block, &loop{scan: s, parent: l})
+				continue
+			}
+			for _, nb := range nestedBlocks(stmt) {
+				visit(nb, l)
+			}
+		}
+	}
+	for _, b := range blocks {
+		visit(b, nil)
+	}
+	for _, l := range locals {
+		o.defs[l]++
+		o.reads[l] = append(o.reads[l], use{pos: len(o.at)})
+	}
+
+	// A local assigned to one that's mutated refers to the same value.
+	for changed := true; changed; {
+		changed = false
+		for _, s := range aliases {
+			if src, ok := s.Source.Value.(ir.Local); ok && o.mutated[s.Target] && !o.mutated[src] {
+				o.mutated[src] = true
+				changed = true
+			}
+		}
+	}
+	return ok
+}
+
+// live returns true if the value that stmt assigns to l may be read: by a
+// statement run after it, or by one run before it in the same loop.
+func (o *optimizer) live(stmt ir.Stmt, l ir.Local) bool {
+	at := o.at[stmt]
+	loops := map[*ir.ScanStmt]struct{}{}
+	for x := at.loop; x != nil; x = x.parent {
+		loops[x.scan] = struct{}{}
+	}
+	for _, r := range o.reads[l] {
+		if r.pos > at.pos {
+			return true
+		}
+		for x := r.loop; x != nil; x = x.parent {
+			if _, ok := loops[x.scan]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// block simplifies the statements of b, given the constants known when it's
+// entered, which it updates. It returns true if b fails at its first
+// statement, as it has no effect then.
+func (o *optimizer) block(b *ir.Block, env map[ir.Local]ast.Value) bool {
+	out := b.Stmts[:0]
+	for i, stmt := range b.Stmts {
+		s, fails := o.stmt(stmt, env)
+		if s != stmt {
+			o.changed = true
+		}
+		if s != nil {
+			out = append(out, s)
+		}
+		if fails {
+			if i < len(b.Stmts)-1 {
+				o.changed = true
+			}
+			b.Stmts = out
+			return len(out) == 1
+		}
+	}
+	b.Stmts = out
+	return false
+}
+
+// nested simplifies the blocks nested in stmt, which inherit the constants
+// known at stmt, except for the locals defined in any of them: these can be
+// run repeatedly, or one after the other. The constants known after stmt
+// don't include these locals either. It returns which blocks fail at their
+// first statement.
+func (o *optimizer) nested(stmt ir.Stmt, env map[ir.Local]ast.Value) []bool {
+	blocks := nestedBlocks(stmt)
+	defined := map[ir.Local]struct{}{}
+	for _, b := range blocks {
+		walkStmts(b, func(stmt ir.Stmt) {
+			_, writes, _ := stmtLocals(stmt)
+			for _, l := range writes {
+				defined[l] = struct{}{}
+			}
+		})
+	}
+	for l := range defined {
+		delete(env, l)
+	}
+
+	dead := make([]bool, len(blocks))
+	for i, b := range blocks {
+		inner := make(map[ir.Local]ast.Value, len(env))
+		for l, v := range env {
+			inner[l] = v
+		}
+		dead[i] = o.block(b, inner)
+	}
+	return dead
+}
+
+// stmt simplifies stmt, and records the constant it defines, if any. It
+// returns the statement to replace stmt with, nil to remove it, and whether
+// it's known to fail.
+func (o *optimizer) stmt(stmt ir.Stmt, env map[ir.Local]ast.Value) (ir.Stmt, bool) {
+	if o.p.level >= 2 {
+		o.propagate(stmt, env)
+	}
+	_, writes, _ := stmtLocals(stmt)
+	for _, l := range writes {
+		delete(env, l)
+	}
+
+	switch s := stmt.(type) {
+	case *ir.MakeNullStmt:
+		o.define(s.Target, ast.Null{}, env)
+	case *ir.MakeNumberIntStmt:
+		o.define(s.Target, ast.Number(strconv.FormatInt(s.Value, 10)), env)
+	case *ir.MakeNumberRefStmt:
+		o.define(s.Target, ast.Number(o.p.policy.Static.Strings[s.Index].Value), env)
+	case *ir.AssignVarStmt:
+		if v, ok := o.value(s.Source, env); ok {
+			o.define(s.Target, v, env)
+			if _, local := s.Source.Value.(ir.Local); local && o.p.level >= 2 {
+				return o.constant(s.Target, v, s.Location), false
+			}
+		}
+	case *ir.CallStmt:
+		if v, ok := o.call(s, env); ok {
+			o.define(s.Result, v, env)
+			return o.constant(s.Result, v, s.Location), false
+		}
+	case *ir.EqualStmt:
+		if a, b, ok := o.values(s.A, s.B, env); ok {
+			if ast.Compare(a, b) == 0 {
+				return nil, false
+			}
+			return o.fail(stmt), true
+		}
+	case *ir.NotEqualStmt:
+		if a, b, ok := o.values(s.A, s.B, env); ok {
+			if ast.Compare(a, b) != 0 {
+				return nil, false
+			}
+			return o.fail(stmt), true
+		}
+	case *ir.IsArrayStmt:
+		if _, ok := o.value(s.Source, env); ok {
+			return o.fail(stmt), true
+		}
+	case *ir.IsObjectStmt:
+		if _, ok := o.value(s.Source, env); ok {
+			return o.fail(stmt), true
+		}
+	case *ir.IsDefinedStmt:
+		if _, ok := env[s.Source]; ok {
+			return nil, false
+		} else if o.defs[s.Source] == 0 {
+			return o.fail(stmt), true
+		}
+	case *ir.IsUndefinedStmt:
+		if _, ok := env[s.Source]; ok {
+			return o.fail(stmt), true
+		} else if o.defs[s.Source] == 0 {
+			return nil, false
+		}
+	case *ir.BlockStmt:
+		dead := o.nested(s, env)
+		blocks := s.Blocks[:0]
+		for i, b := range s.Blocks {
+			if dead[i] || len(b.Stmts) == 0 {
+				o.changed = true
+				continue
+			}
+			blocks = append(blocks, b)
+		}
+		s.Blocks = blocks
+		if len(blocks) == 0 {
+			return nil, false
+		}
+	case *ir.NotStmt:
+		if o.nested(s, env)[0] {
+			return nil, false
+		}
+		if len(s.Block.Stmts) == 0 {
+			return o.fail(stmt), true
+		}
+	case *ir.ScanStmt:
+		if o.nested(s, env)[0] || len(s.Block.Stmts) == 0 {
+			return nil, false
+		}
+	case *ir.WithStmt:
+		o.nested(s, env)
+	}
+	return stmt, false
+}
+
+// define records v as the value of l for the statements following the
+// definition, until l is defined again, unless l's value may be changed in
+// place.
+func (o *optimizer) define(l ir.Local, v ast.Value, env map[ir.Local]ast.Value) {
+	if !o.mutated[l] {
+		env[l] = v
+	}
+}
+
+// value returns the constant value of op, if it's known.
+func (o *optimizer) value(op ir.Operand, env map[ir.Local]ast.Value) (ast.Value, bool) {
+	switch x := op.Value.(type) {
+	case ir.Bool:
+		return ast.Boolean(x), true
+	case ir.StringIndex:
+		return ast.String(o.p.policy.Static.Strings[x].Value), true
+	case ir.Local:
+		v, ok := env[x]
+		return v, ok
+	}
+	return nil, false
+}
+
+func (o *optimizer) values(a, b ir.Operand, env map[ir.Local]ast.Value) (ast.Value, ast.Value, bool) {
+	va, ok := o.value(a, env)
+	if !ok {
+		return nil, nil, false
+	}
+	vb, ok := o.value(b, env)
+	return va, vb, ok
+}
+
+// call evaluates a call of a pure built-in function with constant arguments.
+// Calls that fail or are undefined are left to the evaluation, as are those
+// whose results can't be represented exactly in the IR.
+func (o *optimizer) call(s *ir.CallStmt, env map[ir.Local]ast.Value) (ast.Value, bool) {
+	if _, ok := pureBuiltins[s.Func]; !ok {
+		return nil, false
+	}
+	args := make([]*ast.Term, len(s.Args))
+	for i := range s.Args {
+		v, ok := o.value(s.Args[i], env)
+		if !ok {
+			return nil, false
+		}
+		args[i] = ast.NewTerm(v)
+	}
+
+	var result ast.Value
+	bctx := topdown.BuiltinContext{Context: context.Background()}
+	err := topdown.GetBuiltin(s.Func)(bctx, args, func(t *ast.Term) error {
+		result = t.Value
+		return nil
+	})
+	if err != nil || result == nil {
+		return nil, false
+	}
+	switch v := result.(type) {
+	case ast.Null, ast.Boolean, ast.String:
+		return v, true
+	case ast.Number:
+		if _, ok := v.Int64(); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// constant returns the statement assigning v to l.
+func (o *optimizer) constant(l ir.Local, v ast.Value, loc ir.Location) ir.Stmt {
+	switch v := v.(type) {
+	case ast.Null:
+		return &ir.MakeNullStmt{Target: l, Location: loc}
+	case ast.Boolean:
+		return &ir.AssignVarStmt{Source: op(ir.Bool(v)), Target: l, Location: loc}
+	case ast.String:
+		return &ir.AssignVarStmt{Source: op(ir.StringIndex(o.p.getStringConst(string(v)))), Target: l, Location: loc}
+	case ast.Number:
+		if i, ok := v.Int64(); ok {
+			return &ir.MakeNumberIntStmt{Value: i, Target: l, Location: loc}
+		}
+		return &ir.MakeNumberRefStmt{Index: o.p.getStringConst(string(v)), Target: l, Location: loc}
+	}
+	panic("unreachable")
+}
+
+// fail returns a statement that fails like stmt: comparisons of constants
+// are kept, other statements are replaced, so that the statements defining
+// the locals they read can be removed.
+func (o *optimizer) fail(stmt ir.Stmt) ir.Stmt {
+	switch stmt.(type) {
+	case *ir.EqualStmt, *ir.NotEqualStmt:
+		if reads, _, _ := stmtLocals(stmt); len(reads) == 0 {
+			return stmt
+		}
+	}
+	return &ir.EqualStmt{A: op(ir.Bool(true)), B: op(ir.Bool(false)), Location: *stmt.GetLocation()}
+}
+
+// propagate replaces the operands of stmt referring to locals known to be
+// strings or booleans by the constants.
+func (o *optimizer) propagate(stmt ir.Stmt, env map[ir.Local]ast.Value) {
+	replace := func(ops ...*ir.Operand) {
+		for _, x := range ops {
+			l, ok := x.Value.(ir.Local)
+			if !ok {
+				continue
+			}
+			switch v := env[l].(type) {
+			case ast.Boolean:
+				x.Value = ir.Bool(v)
+			case ast.String:
+				x.Value = ir.StringIndex(o.p.getStringConst(string(v)))
+			default:
+				continue
+			}
+			o.changed = true
+		}
+	}
+
+	switch s := stmt.(type) {
+	case *ir.CallStmt:
+		for i := range s.Args {
+			replace(&s.Args[i])
+		}
+	case *ir.CallDynamicStmt:
+		for i := range s.Path {
+			replace(&s.Path[i])
+		}
+	case *ir.DotStmt:
+		replace(&s.Source, &s.Key)
+	case *ir.LenStmt:
+		replace(&s.Source)
+	case *ir.AssignVarStmt:
+		replace(&s.Source)
+	case *ir.AssignVarOnceStmt:
+		replace(&s.Source)
+	case *ir.EqualStmt:
+		replace(&s.A, &s.B)
+	case *ir.NotEqualStmt:
+		replace(&s.A, &s.B)
+	case *ir.IsArrayStmt:
+		replace(&s.Source)
+	case *ir.IsObjectStmt:
+		replace(&s.Source)
+	case *ir.ArrayAppendStmt:
+		replace(&s.Value)
+	case *ir.ObjectInsertStmt:
+		replace(&s.Key, &s.Value)
+	case *ir.ObjectInsertOnceStmt:
+		replace(&s.Key, &s.Value)
+	case *ir.SetAddStmt:
+		replace(&s.Value)
+	case *ir.WithStmt:
+		replace(&s.Value)
+	}
+}
+
+// removeDeadDefs removes the statements of b, and of the blocks nested in
+// it, that only define locals whose values aren't read.
+func (o *optimizer) removeDeadDefs(b *ir.Block) {
+	out := b.Stmts[:0]
+	for _, stmt := range b.Stmts {
+		var target ir.Local
+		switch s := stmt.(type) {
+		case *ir.MakeNullStmt:
+			target = s.Target
+		case *ir.MakeNumberIntStmt:
+			target = s.Target
+		case *ir.MakeNumberRefStmt:
+			target = s.Target
+		case *ir.MakeArrayStmt:
+			target = s.Target
+		case *ir.MakeObjectStmt:
+			target = s.Target
+		case *ir.MakeSetStmt:
+			target = s.Target
+		case *ir.AssignVarStmt:
+			target = s.Target
+		default:
+			for _, nb := range nestedBlocks(stmt) {
+				o.removeDeadDefs(nb)
+			}
+			out = append(out, stmt)
+			continue
+		}
+		if !o.live(stmt, target) {
+			o.changed = true
+			continue
+		}
+		out = append(out, stmt)
+	}
+	b.Stmts = out
+}
+
+// walkStmts calls f for the statements of b and those of the blocks nested
+// in them.
+func walkStmts(b *ir.Block, f func(ir.Stmt)) {
+	for _, stmt := range b.Stmts {
+		f(stmt)
+		for _, nb := range nestedBlocks(stmt) {
+			walkStmts(nb, f)
+		}
+	}
+}
+
+func nestedBlocks(stmt ir.Stmt) []*ir.Block {
+	switch s := stmt.(type) {
+	case *ir.BlockStmt:
+		return s.Blocks
+	case *ir.NotStmt:
+		return []*ir.Block{s.Block}
+	case *ir.ScanStmt:
+		return []*ir.Block{s.Block}
+	case *ir.WithStmt:
+		return []*ir.Block{s.Block}
+	}
+	return nil
+}
+
+// stmtLocals returns the locals stmt reads and those it defines or changes,
+// not including the statements of its nested blocks. It returns false for
+// statements it doesn't know.
+func stmtLocals(stmt ir.Stmt) ([]ir.Local, []ir.Local, bool) {
+	switch s := stmt.(type) {
+	case *ir.ReturnLocalStmt:
+		return []ir.Local{s.Source}, nil, true
+	case *ir.CallStmt:
+		return operandLocals(s.Args...), []ir.Local{s.Result}, true
+	case *ir.CallDynamicStmt:
+		return append(append([]ir.Local{}, s.Args...), operandLocals(s.Path...)...), []ir.Local{s.Result}, true
+	case *ir.BlockStmt, *ir.BreakStmt, *ir.NotStmt, *ir.NopStmt:
+		return nil, nil, true
+	case *ir.DotStmt:
+		return operandLocals(s.Source, s.Key), []ir.Local{s.Target}, true
+	case *ir.LenStmt:
+		return operandLocals(s.Source), []ir.Local{s.Target}, true
+	case *ir.ScanStmt:
+		return []ir.Local{s.Source}, []ir.Local{s.Key, s.Value}, true
+	case *ir.AssignIntStmt:
+		return []ir.Local{s.Target}, []ir.Local{s.Target}, true
+	case *ir.AssignVarStmt:
+		return operandLocals(s.Source), []ir.Local{s.Target}, true
+	case *ir.AssignVarOnceStmt:
+		return append(operandLocals(s.Source), s.Target), []ir.Local{s.Target}, true
+	case *ir.ResetLocalStmt:
+		return nil, []ir.Local{s.Target}, true
+	case *ir.MakeNullStmt:
+		return nil, []ir.Local{s.Target}, true
+	case *ir.MakeNumberIntStmt:
+		return nil, []ir.Local{s.Target}, true
+	case *ir.MakeNumberRefStmt:
+		return nil, []ir.Local{s.Target}, true
+	case *ir.MakeArrayStmt:
+		return nil, []ir.Local{s.Target}, true
+	case *ir.MakeObjectStmt:
+		return nil, []ir.Local{s.Target}, true
+	case *ir.MakeSetStmt:
+		return nil, []ir.Local{s.Target}, true
+	case *ir.EqualStmt:
+		return operandLocals(s.A, s.B), nil, true
+	case *ir.NotEqualStmt:
+		return operandLocals(s.A, s.B), nil, true
+	case *ir.IsArrayStmt:
+		return operandLocals(s.Source), nil, true
+	case *ir.IsObjectStmt:
+		return operandLocals(s.Source), nil, true
+	case *ir.IsDefinedStmt:
+		return []ir.Local{s.Source}, nil, true
+	case *ir.IsUndefinedStmt:
+		return []ir.Local{s.Source}, nil, true
+	case *ir.ArrayAppendStmt:
+		return append(operandLocals(s.Value), s.Array), []ir.Local{s.Array}, true
+	case *ir.ObjectInsertStmt:
+		return append(operandLocals(s.Key, s.Value), s.Object), []ir.Local{s.Object}, true
+	case *ir.ObjectInsertOnceStmt:
+		return append(operandLocals(s.Key, s.Value), s.Object), []ir.Local{s.Object}, true
+	case *ir.ObjectMergeStmt:
+		return []ir.Local{s.A, s.B}, []ir.Local{s.Target}, true
+	case *ir.SetAddStmt:
+		return append(operandLocals(s.Value), s.Set), []ir.Local{s.Set}, true
+	case *ir.WithStmt:
+		return append(operandLocals(s.Value), s.Local), []ir.Local{s.Local}, true
+	case *ir.ResultSetAddStmt:
+		return []ir.Local{s.Value}, nil, true
+	}
+	return nil, nil, false
+}
+
+func operandLocals(ops ...ir.Operand) []ir.Local {
+	var ls []ir.Local
+	for _, x := range ops {
+		if l, ok := x.Value.(ir.Local); ok {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
@@ -0,0 +1,265 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package planner
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/ir"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		note   string
+		level  int
+		rule   string
+		exp    []string // statements expected in data.test.p's function
+		unexp  []string // statements not expected in it
+		failed bool     // whether the rule's body is known to fail
+	}{
+		{
+			note:  "not optimized by default",
+			rule:  `p { 1 + 2 == 3 }`,
+			exp:   []string{"CallStmt plus", "EqualStmt"},
+			level: 0,
+		},
+		{
+			note:  "arithmetic and comparisons",
+			rule:  `p { 1 + 2 == 3; input.x == 1 }`,
+			level: 1,
+			exp:   []string{"DotStmt", "EqualStmt"},
+			unexp: []string{"CallStmt plus"},
+		},
+		{
+			note:   "false comparison",
+			rule:   `p { 1 > 2; input.x == 1 }`,
+			level:  1,
+			unexp:  []string{"CallStmt gt", "DotStmt", "MakeNumberRefStmt"},
+			failed: true,
+		},
+		{
+			note:   "different strings",
+			rule:   `p { "a" == "b" }`,
+			level:  1,
+			failed: true,
+		},
+		{
+			note:  "folded value",
+			rule:  `p = x { x := 3 * 4 }`,
+			level: 1,
+			exp:   []string{"MakeNumberIntStmt 12"},
+			unexp: []string{"CallStmt mul", "MakeNumberRefStmt"},
+		},
+		{
+			note:  "string built-ins",
+			rule:  `p = x { x := upper(trim_space(" a ")) }`,
+			level: 1,
+			unexp: []string{"CallStmt upper", "CallStmt trim_space"},
+		},
+		{
+			note:  "negated false comparison",
+			rule:  `p { not 1 > 2; input.x }`,
+			level: 1,
+			exp:   []string{"DotStmt"},
+			unexp: []string{"NotStmt"},
+		},
+		{
+			note:   "negated true comparison",
+			rule:   `p { not 1 < 2; input.x }`,
+			level:  1,
+			unexp:  []string{"NotStmt", "DotStmt"},
+			failed: true,
+		},
+		{
+			note:  "dead else branch",
+			rule:  `p = 1 { input.x } else = 2 { 1 > 2 } else = 3 { true }`,
+			level: 1,
+			exp:   []string{"MakeNumberRefStmt 1", "MakeNumberRefStmt 3"},
+			unexp: []string{"CallStmt gt", "MakeNumberRefStmt 2"},
+		},
+		{
+			note:  "errors are left to the evaluation",
+			rule:  `p = x { x := 1 / 0 }`,
+			level: 2,
+			exp:   []string{"CallStmt div"},
+		},
+		{
+			note:  "non-integer results are left to the evaluation",
+			rule:  `p = x { x := 1 / 3 }`,
+			level: 2,
+			exp:   []string{"CallStmt div"},
+		},
+		{
+			note:  "impure built-ins",
+			rule:  `p = x { x := time.now_ns() + 1 }`,
+			level: 2,
+			exp:   []string{"CallStmt time.now_ns", "CallStmt plus"},
+		},
+		{
+			note:  "unknown values",
+			rule:  `p { input.x + 1 == 3 }`,
+			level: 2,
+			exp:   []string{"CallStmt plus", "EqualStmt"},
+		},
+		{
+			note:  "redefined locals",
+			rule:  `p { x := 1; some y in input; x + y > 2 }`,
+			level: 2,
+			exp:   []string{"CallStmt plus", "CallStmt gt"},
+		},
+		{
+			note:  "strings and booleans propagated",
+			rule:  `p { y := "c"; z := true; input.b == y; input.c == z }`,
+			level: 2,
+			exp:   []string{"EqualStmt String", "EqualStmt Bool"},
+		},
+		{
+			note:  "strings and booleans not propagated at level 1",
+			rule:  `p { y := "c"; input.b == y }`,
+			level: 1,
+			unexp: []string{"EqualStmt String"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			policy := planOptimized(t, tc.level, "package test\n"+tc.rule)
+			fn := findFuncByName(t, policy, "g0.data.test.p")
+
+			stmts := map[string]bool{}
+			for _, b := range fn.Blocks {
+				walkStmts(b, func(stmt ir.Stmt) {
+					for _, d := range describeStmt(policy, stmt) {
+						stmts[d] = true
+					}
+				})
+			}
+			for _, e := range tc.exp {
+				if !stmts[e] {
+					t.Errorf("expected %q in %v", e, stmts)
+				}
+			}
+			for _, e := range tc.unexp {
+				if stmts[e] {
+					t.Errorf("unexpected %q in %v", e, stmts)
+				}
+			}
+
+			// The body is planned in the function's first block, after the
+			// reset of the rule's value.
+			body := fn.Blocks[0].Stmts
+			if failed := len(body) == 2 && isFalse(body[1]); failed != tc.failed {
+				t.Errorf("expected body failing %v, got %v", tc.failed, body)
+			}
+		})
+	}
+}
+
+func TestOptimizeKeepsReturn(t *testing.T) {
+	policy := planOptimized(t, 2, `package test
+p { false }`)
+	fn := findFuncByName(t, policy, "g0.data.test.p")
+	last := fn.Blocks[len(fn.Blocks)-1].Stmts
+	if len(last) != 1 {
+		t.Fatalf("expected return block, got %v", last)
+	}
+	if _, ok := last[0].(*ir.ReturnLocalStmt); !ok {
+		t.Fatalf("expected return, got %v", last[0])
+	}
+}
+
+func TestOptimizePrunesBuiltinFuncs(t *testing.T) {
+	builtins := func(level int) map[string]bool {
+		policy := planOptimized(t, level, `package test
+p = x { x := upper(trim_space(" a ")); startswith(input.x, "b") }`)
+		ret := map[string]bool{}
+		for _, f := range policy.Static.BuiltinFuncs {
+			ret[f.Name] = true
+		}
+		return ret
+	}
+	if act := builtins(0); !act["upper"] || !act["trim_space"] || !act["startswith"] {
+		t.Errorf("expected all built-in functions without optimization, got %v", act)
+	}
+	if act := builtins(1); act["upper"] || act["trim_space"] || !act["startswith"] {
+		t.Errorf("expected only the built-in functions still called, got %v", act)
+	}
+}
+
+func planOptimized(t *testing.T, level int, module string) *ir.Policy {
+	t.Helper()
+	c := ast.MustCompileModulesWithOpts(map[string]string{"test.rego": module}, ast.CompileOpts{
+		ParserOptions: ast.ParserOptions{AllFutureKeywords: true},
+	})
+	query, err := c.QueryCompiler().Compile(ast.MustParseBody(`x = data.test.p`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := make([]*ast.Module, 0, len(c.Modules))
+	for _, m := range c.Modules {
+		modules = append(modules, m)
+	}
+	policy, err := New().
+		WithQueries([]QuerySet{{Name: "test", Queries: []ast.Body{query}}}).
+		WithModules(modules).
+		WithBuiltinDecls(ast.BuiltinMap).
+		WithOptimizationLevel(level).
+		Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func findFuncByName(t *testing.T, policy *ir.Policy, name string) *ir.Func {
+	t.Helper()
+	for _, fn := range policy.Funcs.Funcs {
+		if fn.Name == name {
+			return fn
+		}
+	}
+	t.Fatalf("func %s not found", name)
+	return nil
+}
+
+// describeStmt returns the statement's type, followed by its function for
+// calls, its value for numbers, and the kinds of constants it compares.
+func describeStmt(policy *ir.Policy, stmt ir.Stmt) []string {
+	name := strings.TrimPrefix(fmt.Sprintf("%T", stmt), "*ir.")
+	ds := []string{name}
+	switch s := stmt.(type) {
+	case *ir.CallStmt:
+		ds = append(ds, name+" "+s.Func)
+	case *ir.MakeNumberIntStmt:
+		ds = append(ds, fmt.Sprintf("%s %d", name, s.Value))
+	case *ir.MakeNumberRefStmt:
+		ds = append(ds, name+" "+policy.Static.Strings[s.Index].Value)
+	case *ir.EqualStmt:
+		for _, x := range []ir.Operand{s.A, s.B} {
+			switch x.Value.(type) {
+			case ir.StringIndex:
+				ds = append(ds, name+" String")
+			case ir.Bool:
+				ds = append(ds, name+" Bool")
+			}
+		}
+	}
+	return ds
+}
+
+func isFalse(stmt ir.Stmt) bool {
+	switch s := stmt.(type) {
+	case *ir.EqualStmt:
+		_, a := s.A.Value.(ir.Local)
+		_, b := s.B.Value.(ir.Local)
+		return !a && !b && s.A != s.B
+	case *ir.NotEqualStmt:
+		return s.A == s.B
+	}
+	return false
+}
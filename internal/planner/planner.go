@@ -45,6 +45,7 @@ type Planner struct {
 	lnext   ir.Local                // next variable to use
 	loc     *location.Location      // location currently "being planned"
 	debug   debug.Debug             // debug information produced during planning
+	level   int                     // optimization level, see WithOptimizationLevel
 }
 
 // debugf prepends the planner location. We're passing callstack depth 2 because
@@ -126,6 +127,10 @@ func (p *Planner) Plan() (*ir.Policy, error) {
 		return nil, err
 	}
 
+	if p.level > 0 {
+		p.optimize()
+	}
+
 	return p.policy, nil
 }
 
@@ -57,6 +57,10 @@ const (
 // ElementTypeAnyFunc indicates the type of a table import.
 const ElementTypeAnyFunc byte = 0x70
 
+// ElementKindFunc indicates that a passive element segment holds function
+// indices.
+const ElementKindFunc byte = 0x00
+
 // BlockTypeEmpty represents a block type.
 const BlockTypeEmpty byte = 0x40
 
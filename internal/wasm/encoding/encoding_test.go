@@ -12,6 +12,7 @@ import (
 	"testing"
 
 	"github.com/open-policy-agent/opa/internal/compiler/wasm/opa"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
 	"github.com/open-policy-agent/opa/internal/wasm/module"
 )
 
@@ -111,3 +112,159 @@ func TestRoundtripOPA(t *testing.T) {
 		t.Fatal("modules are not equal")
 	}
 }
+
+func TestEncodedSize(t *testing.T) {
+	bs, err := os.ReadFile(filepath.Join("testdata", "test1.wasm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test1, err := ReadModule(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib, err := ReadModule(bytes.NewReader(opa.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var elems module.Module
+	elems.Element.Segments = []module.ElementSegment{
+		{Offset: module.Expr{Instrs: []instruction.Instruction{instruction.I32Const{Value: 1}}}, Indices: []uint32{0, 1}},
+		{Passive: true, Indices: []uint32{2, 3}},
+	}
+	elems.Customs = []module.CustomSection{{Name: "a", Data: []byte("data")}, {Name: "empty"}}
+
+	for note, m := range map[string]*module.Module{
+		"nil":      nil,
+		"empty":    {},
+		"test1":    test1,
+		"library":  lib,
+		"elements": &elems,
+	} {
+		var buf bytes.Buffer
+		if err := WriteModule(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		n, err := EncodedSize(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != buf.Len() {
+			t.Errorf("%s: expected size %d, got %d", note, buf.Len(), n)
+		}
+	}
+}
+
+func TestRoundtripPassiveElements(t *testing.T) {
+	var m module.Module
+	m.Element.Segments = []module.ElementSegment{
+		{Offset: module.Expr{Instrs: []instruction.Instruction{instruction.I32Const{Value: 1}}}, Indices: []uint32{0, 1}},
+		{Passive: true, Indices: []uint32{2, 3}},
+	}
+	entry := &module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: []instruction.Instruction{
+		instruction.I32Const{Value: 3},
+		instruction.I32Const{Value: 0},
+		instruction.I32Const{Value: 2},
+		instruction.TableInit{Segment: 1},
+		instruction.ElemDrop{Segment: 1},
+	}}}}
+
+	var buf bytes.Buffer
+	if err := WriteModule(&buf, &m); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := ReadModule(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Element, m2.Element) {
+		t.Errorf("expected %v, got %v", m.Element, m2.Element)
+	}
+
+	buf.Reset()
+	if err := WriteCodeEntry(&buf, entry); err != nil {
+		t.Fatal(err)
+	}
+	entry2, err := ReadCodeEntry(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entry.Func.Expr, entry2.Func.Expr) {
+		t.Errorf("expected %v, got %v", entry.Func.Expr, entry2.Func.Expr)
+	}
+}
+
+func TestRoundtripBulkMemory(t *testing.T) {
+	entry := &module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: []instruction.Instruction{
+		instruction.GetLocal{Index: 0},
+		instruction.GetLocal{Index: 1},
+		instruction.GetLocal{Index: 2},
+		instruction.MemoryCopy{},
+		instruction.GetLocal{Index: 0},
+		instruction.I32Const{Value: 0},
+		instruction.GetLocal{Index: 2},
+		instruction.MemoryFill{},
+	}}}}
+
+	var buf bytes.Buffer
+	if err := WriteCodeEntry(&buf, entry); err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range [][]byte{{0xfc, 0x0a, 0x00, 0x00}, {0xfc, 0x0b, 0x00}} {
+		if !bytes.Contains(buf.Bytes(), exp) {
+			t.Errorf("expected encoding %x to contain %x", buf.Bytes(), exp)
+		}
+	}
+	entry2, err := ReadCodeEntry(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entry.Func.Expr, entry2.Func.Expr) {
+		t.Errorf("expected %v, got %v", entry.Func.Expr, entry2.Func.Expr)
+	}
+}
+
+func TestRoundtripBrTable(t *testing.T) {
+	entry := &module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: []instruction.Instruction{
+		instruction.Block{Instrs: []instruction.Instruction{
+			instruction.Block{Instrs: []instruction.Instruction{
+				instruction.I32Const{Value: 1},
+				instruction.BrTable{Targets: []uint32{0, 1, 0}, Default: 1},
+			}},
+		}},
+	}}}}
+
+	var buf bytes.Buffer
+	if err := WriteCodeEntry(&buf, entry); err != nil {
+		t.Fatal(err)
+	}
+	entry2, err := ReadCodeEntry(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entry.Func.Expr, entry2.Func.Expr) {
+		t.Errorf("expected %v, got %v", entry.Func.Expr, entry2.Func.Expr)
+	}
+}
+
+func TestRoundtripTailCalls(t *testing.T) {
+	entry := &module.CodeEntry{Func: module.Function{Expr: module.Expr{Instrs: []instruction.Instruction{
+		instruction.Block{Instrs: []instruction.Instruction{
+			instruction.I32Const{Value: 1},
+			instruction.ReturnCall{Index: 300},
+		}},
+		instruction.I32Const{Value: 0},
+		instruction.ReturnCallIndirect{Index: 2},
+	}}}}
+
+	var buf bytes.Buffer
+	if err := WriteCodeEntry(&buf, entry); err != nil {
+		t.Fatal(err)
+	}
+	entry2, err := ReadCodeEntry(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entry.Func.Expr, entry2.Func.Expr) {
+		t.Errorf("expected %v, got %v", entry.Func.Expr, entry2.Func.Expr)
+	}
+}
@@ -659,10 +659,27 @@ func readExport(r io.Reader, exp *module.Export) error {
 
 func readElementSegment(r io.Reader, seg *module.ElementSegment) error {
 
-	if err := readVarUint32(r, &seg.Index); err != nil {
+	var flags uint32
+	if err := readVarUint32(r, &flags); err != nil {
 		return err
 	}
 
+	switch flags {
+	case 0: // active, table 0
+	case 1: // passive
+		kind, err := readByte(r)
+		if err != nil {
+			return err
+		}
+		if kind != constant.ElementKindFunc {
+			return fmt.Errorf("illegal element kind 0x%x", kind)
+		}
+		seg.Passive = true
+		return readVarUint32Vector(r, &seg.Indices)
+	default:
+		return fmt.Errorf("unsupported element segment flags 0x%x", flags)
+	}
+
 	if err := readConstantExpr(r, &seg.Offset); err != nil {
 		return err
 	}
@@ -746,6 +763,10 @@ func readInstructions(r io.Reader, instrs *[]instruction.Instruction) error {
 		}
 
 		switch opcode.Opcode(b) {
+		case opcode.Unreachable:
+			ret = append(ret, instruction.Unreachable{})
+		case opcode.Nop:
+			ret = append(ret, instruction.Nop{})
 		case opcode.I32Const:
 			ret = append(ret, instruction.I32Const{Value: leb128.MustReadVarInt32(r)})
 		case opcode.I64Const:
@@ -763,8 +784,23 @@ func readInstructions(r io.Reader, instrs *[]instruction.Instruction) error {
 				Index:    leb128.MustReadVarUint32(r),
 				Reserved: mustReadByte(r),
 			})
+		case opcode.ReturnCall:
+			ret = append(ret, instruction.ReturnCall{Index: leb128.MustReadVarUint32(r)})
+		case opcode.ReturnCallIndirect:
+			ret = append(ret, instruction.ReturnCallIndirect{
+				Index:    leb128.MustReadVarUint32(r),
+				Reserved: mustReadByte(r),
+			})
 		case opcode.BrIf:
 			ret = append(ret, instruction.BrIf{Index: leb128.MustReadVarUint32(r)})
+		case opcode.BrTable:
+			n := leb128.MustReadVarUint32(r)
+			brTable := instruction.BrTable{Targets: make([]uint32, n)}
+			for j := range brTable.Targets {
+				brTable.Targets[j] = leb128.MustReadVarUint32(r)
+			}
+			brTable.Default = leb128.MustReadVarUint32(r)
+			ret = append(ret, brTable)
 		case opcode.Return:
 			ret = append(ret, instruction.Return{})
 		case opcode.Block:
@@ -785,6 +821,25 @@ func readInstructions(r io.Reader, instrs *[]instruction.Instruction) error {
 				return err
 			}
 			ret = append(ret, loop)
+		case opcode.Misc:
+			switch sub := leb128.MustReadVarUint32(r); sub {
+			case opcode.MemoryCopy:
+				ret = append(ret, instruction.MemoryCopy{
+					Dst: leb128.MustReadVarUint32(r),
+					Src: leb128.MustReadVarUint32(r),
+				})
+			case opcode.MemoryFill:
+				ret = append(ret, instruction.MemoryFill{Memory: leb128.MustReadVarUint32(r)})
+			case opcode.TableInit:
+				ret = append(ret, instruction.TableInit{
+					Segment: leb128.MustReadVarUint32(r),
+					Table:   leb128.MustReadVarUint32(r),
+				})
+			case opcode.ElemDrop:
+				ret = append(ret, instruction.ElemDrop{Segment: leb128.MustReadVarUint32(r)})
+			default:
+				return fmt.Errorf("illegal opcode 0x%x 0x%x", b, sub)
+			}
 		case opcode.End:
 			*instrs = ret
 			return nil
@@ -0,0 +1,236 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/open-policy-agent/opa/internal/leb128"
+	"github.com/open-policy-agent/opa/internal/wasm/opcode"
+)
+
+// IndexMap maps an index of the module to its replacement.
+type IndexMap func(uint32) (uint32, error)
+
+// RemapCodeIndices returns the binary-encoded code entry (local declarations
+// and body, as found in a code segment) with all function indices replaced
+// using funcs, and all type indices (of call_indirect, and block types)
+// replaced using types. Unlike ReadCodeEntry, it supports all instructions
+// of the MVP, as well as the sign extension, non-trapping conversion,
+// bulk memory, reference types and tail call proposals' instructions: it
+// only needs to know the size of their immediates.
+func RemapCodeIndices(code []byte, funcs, types IndexMap) ([]byte, error) {
+	return remap(&remapper{r: bytes.NewReader(code), code: code, funcs: funcs, types: types, callTypes: types})
+}
+
+// RemapCallIndirectTypes returns the binary-encoded code entry with the type
+// indices of call_indirect (and return_call_indirect) replaced using types,
+// keeping block types. It supports the same instructions as
+// RemapCodeIndices.
+func RemapCallIndirectTypes(code []byte, types IndexMap) ([]byte, error) {
+	return remap(&remapper{r: bytes.NewReader(code), code: code, callTypes: types})
+}
+
+// RemapGlobalIndices returns the binary-encoded code entry with all global
+// indices (of global.get and global.set) replaced using globals. It supports
+// the same instructions as RemapCodeIndices.
+func RemapGlobalIndices(code []byte, globals IndexMap) ([]byte, error) {
+	return remap(&remapper{r: bytes.NewReader(code), code: code, globals: globals})
+}
+
+func remap(rw *remapper) ([]byte, error) {
+	if err := rw.remap(); err != nil {
+		return nil, fmt.Errorf("offset 0x%x: %w", rw.offset(), err)
+	}
+	return rw.out.Bytes(), nil
+}
+
+type remapper struct {
+	r         *bytes.Reader
+	code      []byte
+	out       bytes.Buffer
+	funcs     IndexMap // nil to keep function indices
+	types     IndexMap // nil to keep block type indices
+	callTypes IndexMap // nil to keep call_indirect type indices
+	globals   IndexMap // nil to keep global indices
+	start     int      // offset of the first input byte not yet written to out
+}
+
+func (rw *remapper) offset() int {
+	return len(rw.code) - rw.r.Len()
+}
+
+// flush copies the input consumed since the last flush to the output.
+func (rw *remapper) flush() {
+	rw.out.Write(rw.code[rw.start:rw.offset()])
+	rw.start = rw.offset()
+}
+
+// replace reads an unsigned index, and writes its replacement, if m is set.
+func (rw *remapper) replace(m IndexMap) error {
+	if m == nil {
+		return rw.skipUint32s(1)
+	}
+	rw.flush()
+	idx, err := leb128.ReadVarUint32(rw.r)
+	if err != nil {
+		return err
+	}
+	repl, err := m(idx)
+	if err != nil {
+		return err
+	}
+	rw.start = rw.offset()
+	return leb128.WriteVarUint32(&rw.out, repl)
+}
+
+func (rw *remapper) skipUint32s(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := leb128.ReadVarUint32(rw.r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rw *remapper) skipBytes(n int64) error {
+	if int64(rw.r.Len()) < n {
+		return io.ErrUnexpectedEOF
+	}
+	_, err := rw.r.Seek(n, io.SeekCurrent)
+	return err
+}
+
+func (rw *remapper) remap() error {
+	// local declarations: vec(count, valtype)
+	n, err := leb128.ReadVarUint32(rw.r)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < n; i++ {
+		if _, err := leb128.ReadVarUint32(rw.r); err != nil {
+			return err
+		}
+		if _, err := rw.r.ReadByte(); err != nil {
+			return err
+		}
+	}
+
+	for rw.r.Len() > 0 {
+		b, err := rw.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if err := rw.instr(b); err != nil {
+			return fmt.Errorf("opcode 0x%x: %w", b, err)
+		}
+	}
+	rw.flush()
+	return nil
+}
+
+func (rw *remapper) instr(b byte) error {
+	switch op := opcode.Opcode(b); {
+	case op == opcode.Block || op == opcode.Loop || op == opcode.If:
+		return rw.blockType()
+	case op == opcode.Br || op == opcode.BrIf,
+		b >= 0x20 && b <= 0x22, // local.get, local.set, local.tee
+		b == 0x25 || b == 0x26, // table.get, table.set
+		b == 0x3F || b == 0x40: // memory.size, memory.grow
+		return rw.skipUint32s(1)
+	case op == opcode.GetGlobal || op == opcode.SetGlobal:
+		return rw.replace(rw.globals)
+	case op == opcode.BrTable:
+		n, err := leb128.ReadVarUint32(rw.r)
+		if err != nil {
+			return err
+		}
+		return rw.skipUint32s(int(n) + 1)
+	case op == opcode.Call, b == 0x12, b == 0xD2: // call, return_call, ref.func
+		return rw.replace(rw.funcs)
+	case op == opcode.CallIndirect, b == 0x13: // call_indirect, return_call_indirect
+		if err := rw.replace(rw.callTypes); err != nil {
+			return err
+		}
+		return rw.skipUint32s(1)
+	case b == 0x1C: // select t*
+		n, err := leb128.ReadVarUint32(rw.r)
+		if err != nil {
+			return err
+		}
+		return rw.skipBytes(int64(n))
+	case b >= 0x28 && b <= 0x3E: // loads and stores: memarg
+		return rw.skipUint32s(2)
+	case op == opcode.I32Const:
+		_, err := leb128.ReadVarInt32(rw.r)
+		return err
+	case op == opcode.I64Const:
+		_, err := leb128.ReadVarInt64(rw.r)
+		return err
+	case op == opcode.F32Const:
+		return rw.skipBytes(4)
+	case op == opcode.F64Const:
+		return rw.skipBytes(8)
+	case b == 0xD0: // ref.null t
+		return rw.skipBytes(1)
+	case op == opcode.Misc:
+		return rw.misc()
+	case b <= 0x01, b == 0x05, b == 0x0B, b == 0x0F, b == 0x1A, b == 0x1B, b == 0xD1:
+		// unreachable, nop, else, end, return, drop, select, ref.is_null
+		return nil
+	case b >= 0x45 && b <= 0xC4: // numeric, including sign extension
+		return nil
+	}
+	return fmt.Errorf("unsupported instruction")
+}
+
+func (rw *remapper) blockType() error {
+	b, err := rw.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0x40 || b >= 0x6F && b <= 0x7F { // empty, or value type
+		return nil
+	}
+	if err := rw.r.UnreadByte(); err != nil {
+		return err
+	}
+	if rw.types == nil {
+		_, err := leb128.ReadVarInt64(rw.r)
+		return err
+	}
+	rw.flush()
+	idx, err := leb128.ReadVarInt64(rw.r) // s33
+	if err != nil {
+		return err
+	}
+	if idx < 0 {
+		return fmt.Errorf("illegal block type %d", idx)
+	}
+	repl, err := rw.types(uint32(idx))
+	if err != nil {
+		return err
+	}
+	rw.start = rw.offset()
+	return leb128.WriteVarInt64(&rw.out, int64(repl))
+}
+
+func (rw *remapper) misc() error {
+	sub, err := leb128.ReadVarUint32(rw.r)
+	if err != nil {
+		return err
+	}
+	switch {
+	case sub <= 7: // non-trapping float-to-int conversions
+		return nil
+	case sub == 9, sub == 11, sub == opcode.ElemDrop, sub >= 15 && sub <= 17: // data.drop, memory.fill, table.grow/size/fill
+		return rw.skipUint32s(1)
+	case sub == 8, sub == 10, sub == opcode.TableInit, sub == 14: // memory.init, memory.copy, table.copy
+		return rw.skipUint32s(2)
+	}
+	return fmt.Errorf("unsupported instruction 0x%x", sub)
+}
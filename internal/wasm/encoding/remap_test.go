@@ -0,0 +1,149 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package encoding
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/internal/compiler/wasm/opa"
+	"github.com/open-policy-agent/opa/internal/wasm/instruction"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	"github.com/open-policy-agent/opa/internal/wasm/types"
+)
+
+func identity(idx uint32) (uint32, error) { return idx, nil }
+
+func TestRemapCodeIndices(t *testing.T) {
+	entry := &module.CodeEntry{Func: module.Function{
+		Locals: []module.LocalDeclaration{{Count: 2, Type: types.I32}},
+		Expr: module.Expr{Instrs: []instruction.Instruction{
+			instruction.Block{Instrs: []instruction.Instruction{
+				instruction.I32Const{Value: 1},
+				instruction.Call{Index: 3},
+				instruction.I32Const{Value: 0},
+				instruction.CallIndirect{Index: 2},
+				instruction.BrIf{Index: 0},
+				instruction.Loop{Instrs: []instruction.Instruction{
+					instruction.Call{Index: 200},
+				}},
+			}},
+			instruction.I64Const{Value: -1},
+		}},
+	}}
+	var buf bytes.Buffer
+	if err := WriteCodeEntry(&buf, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	funcs := func(idx uint32) (uint32, error) { return idx + 100, nil }
+	types := func(idx uint32) (uint32, error) { return idx - 1, nil }
+	bs, err := RemapCodeIndices(buf.Bytes(), funcs, types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	act, err := ReadCodeEntry(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := entry
+	block := exp.Func.Expr.Instrs[0].(instruction.Block)
+	block.Instrs[1] = instruction.Call{Index: 103}
+	block.Instrs[3] = instruction.CallIndirect{Index: 1}
+	block.Instrs[5] = instruction.Loop{Instrs: []instruction.Instruction{instruction.Call{Index: 300}}}
+	if !reflect.DeepEqual(exp, act) {
+		t.Fatalf("expected %v, got %v", exp, act)
+	}
+
+	if _, err := RemapCodeIndices(buf.Bytes(), func(idx uint32) (uint32, error) {
+		return 0, fmt.Errorf("func %d removed", idx)
+	}, identity); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRemapGlobalIndices(t *testing.T) {
+	code := []byte{
+		0x00,       // no locals
+		0x23, 0x01, // global.get 1
+		0x10, 0x01, // call 1
+		0x24, 0x80, 0x01, // global.set 128
+		0x0B, // end
+	}
+	globals := func(idx uint32) (uint32, error) { return idx + 1, nil }
+	act, err := RemapGlobalIndices(code, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{0x00, 0x23, 0x02, 0x10, 0x01, 0x24, 0x81, 0x01, 0x0B}
+	if !bytes.Equal(exp, act) {
+		t.Fatalf("expected %x, got %x", exp, act)
+	}
+
+	// Global indices are kept when remapping functions and types.
+	act, err = RemapCodeIndices(code, identity, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(code, act) {
+		t.Fatalf("expected %x, got %x", code, act)
+	}
+}
+
+func TestRemapCallIndirectTypes(t *testing.T) {
+	code := []byte{
+		0x00,       // no locals
+		0x02, 0x01, // block (type 1)
+		0x41, 0x00, // i32.const 0
+		0x11, 0x01, 0x00, // call_indirect (type 1) table 0
+		0x0B, // end
+		0x0B, // end
+	}
+	types := func(idx uint32) (uint32, error) { return idx + 1, nil }
+	act, err := RemapCallIndirectTypes(code, types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{0x00, 0x02, 0x01, 0x41, 0x00, 0x11, 0x02, 0x00, 0x0B, 0x0B}
+	if !bytes.Equal(exp, act) {
+		t.Fatalf("expected %x, got %x", exp, act)
+	}
+}
+
+func TestRemapCodeIndicesOPA(t *testing.T) {
+	m, err := ReadModule(bytes.NewReader(opa.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	count := func(idx uint32) (uint32, error) {
+		calls++
+		return idx, nil
+	}
+	for i, seg := range m.Code.Segments {
+		bs, err := RemapCodeIndices(seg.Code, count, identity)
+		if err != nil {
+			t.Fatalf("code segment %d: %v", i, err)
+		}
+		// NOTE: The identity mapping can still shrink the code: indices are
+		// re-encoded without the padding the linker might have left.
+		if len(bs) > len(seg.Code) {
+			t.Fatalf("code segment %d: expected identity mapping not to grow the code", i)
+		}
+		again, err := RemapCodeIndices(bs, identity, identity)
+		if err != nil {
+			t.Fatalf("code segment %d: %v", i, err)
+		}
+		if !bytes.Equal(bs, again) {
+			t.Fatalf("code segment %d: expected identity mapping to preserve re-encoded code", i)
+		}
+	}
+	if calls == 0 {
+		t.Fatal("expected function indices to be mapped")
+	}
+}
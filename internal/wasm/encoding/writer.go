@@ -91,6 +91,22 @@ func WriteModule(w io.Writer, module *module.Module) error {
 	return nil
 }
 
+// EncodedSize returns the number of bytes WriteModule writes for module,
+// without keeping them.
+func EncodedSize(module *module.Module) (int, error) {
+	var w countingWriter
+	err := WriteModule(&w, module)
+	return int(w), err
+}
+
+// countingWriter discards everything written to it, but keeps count.
+type countingWriter int
+
+func (w *countingWriter) Write(bs []byte) (int, error) {
+	*w += countingWriter(len(bs))
+	return len(bs), nil
+}
+
 // WriteCodeEntry writes a binary encoded representation of entry to w.
 func WriteCodeEntry(w io.Writer, entry *module.CodeEntry) error {
 
@@ -356,6 +372,18 @@ func writeElementSection(w io.Writer, s module.ElementSection) error {
 	}
 
 	for _, seg := range s.Segments {
+		if seg.Passive {
+			if err := leb128.WriteVarUint32(&buf, 1); err != nil {
+				return err
+			}
+			if err := writeByte(&buf, constant.ElementKindFunc); err != nil {
+				return err
+			}
+			if err := writeVarUint32Vector(&buf, seg.Indices); err != nil {
+				return err
+			}
+			continue
+		}
 		if err := leb128.WriteVarUint32(&buf, seg.Index); err != nil {
 			return err
 		}
@@ -10,7 +10,7 @@ import (
 )
 
 // !!! If you find yourself adding support for more control
-//     instructions (br_table, if, ...), please adapt the
+//     instructions (else, ...), please adapt the
 //     `withControlInstr` functions of
 //     `compiler/wasm/optimizations.go`
 
@@ -131,6 +131,28 @@ func (i BrIf) ImmediateArgs() []interface{} {
 	return []interface{}{i.Index}
 }
 
+// BrTable represents a WASM br_table instruction.
+type BrTable struct {
+	Targets []uint32
+	Default uint32
+}
+
+// Op returns the opcode of the instruction.
+func (BrTable) Op() opcode.Opcode {
+	return opcode.BrTable
+}
+
+// ImmediateArgs returns the number of target block indices, the target
+// block indices, and the default block index to break to.
+func (i BrTable) ImmediateArgs() []interface{} {
+	ret := make([]interface{}, 0, len(i.Targets)+2)
+	ret = append(ret, uint32(len(i.Targets)))
+	for _, t := range i.Targets {
+		ret = append(ret, t)
+	}
+	return append(ret, i.Default)
+}
+
 // Call represents a WASM call instruction.
 type Call struct {
 	Index uint32
@@ -162,6 +184,38 @@ func (i CallIndirect) ImmediateArgs() []interface{} {
 	return []interface{}{i.Index, i.Reserved}
 }
 
+// ReturnCall represents a WASM return_call instruction: a call in tail
+// position, returning the result of the callee.
+type ReturnCall struct {
+	Index uint32
+}
+
+// Op returns the opcode of the instruction.
+func (ReturnCall) Op() opcode.Opcode {
+	return opcode.ReturnCall
+}
+
+// ImmediateArgs returns the function index.
+func (i ReturnCall) ImmediateArgs() []interface{} {
+	return []interface{}{i.Index}
+}
+
+// ReturnCallIndirect represents a WASM return_call_indirect instruction.
+type ReturnCallIndirect struct {
+	Index    uint32 // type index
+	Reserved byte   // zero for now
+}
+
+// Op returns the opcode of the instruction.
+func (ReturnCallIndirect) Op() opcode.Opcode {
+	return opcode.ReturnCallIndirect
+}
+
+// ImmediateArgs returns the type index and the reserved byte.
+func (i ReturnCallIndirect) ImmediateArgs() []interface{} {
+	return []interface{}{i.Index, i.Reserved}
+}
+
 // Return represents a WASM return instruction.
 type Return struct {
 	NoImmediateArgs
@@ -37,3 +37,36 @@ func (I32Store) Op() opcode.Opcode {
 func (i I32Store) ImmediateArgs() []interface{} {
 	return []interface{}{i.Align, i.Offset}
 }
+
+// MemoryCopy represents the WASM memory.copy instruction of the bulk memory
+// proposal.
+type MemoryCopy struct {
+	Dst uint32 // destination memory index, always 0
+	Src uint32 // source memory index, always 0
+}
+
+// Op returns the opcode of the instruction.
+func (MemoryCopy) Op() opcode.Opcode {
+	return opcode.Misc
+}
+
+// ImmediateArgs returns the sub-opcode and the memory indices.
+func (i MemoryCopy) ImmediateArgs() []interface{} {
+	return []interface{}{opcode.MemoryCopy, i.Dst, i.Src}
+}
+
+// MemoryFill represents the WASM memory.fill instruction of the bulk memory
+// proposal.
+type MemoryFill struct {
+	Memory uint32 // memory index, always 0
+}
+
+// Op returns the opcode of the instruction.
+func (MemoryFill) Op() opcode.Opcode {
+	return opcode.Misc
+}
+
+// ImmediateArgs returns the sub-opcode and the memory index.
+func (i MemoryFill) ImmediateArgs() []interface{} {
+	return []interface{}{opcode.MemoryFill, i.Memory}
+}
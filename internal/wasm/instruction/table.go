@@ -0,0 +1,38 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package instruction
+
+import "github.com/open-policy-agent/opa/internal/wasm/opcode"
+
+// TableInit represents the WASM table.init instruction.
+type TableInit struct {
+	Segment uint32
+	Table   uint32
+}
+
+// Op returns the opcode of the instruction.
+func (TableInit) Op() opcode.Opcode {
+	return opcode.Misc
+}
+
+// ImmediateArgs returns the sub-opcode, the element segment and table index.
+func (i TableInit) ImmediateArgs() []interface{} {
+	return []interface{}{opcode.TableInit, i.Segment, i.Table}
+}
+
+// ElemDrop represents the WASM elem.drop instruction.
+type ElemDrop struct {
+	Segment uint32
+}
+
+// Op returns the opcode of the instruction.
+func (ElemDrop) Op() opcode.Opcode {
+	return opcode.Misc
+}
+
+// ImmediateArgs returns the sub-opcode and the element segment index.
+func (i ElemDrop) ImmediateArgs() []interface{} {
+	return []interface{}{opcode.ElemDrop, i.Segment}
+}
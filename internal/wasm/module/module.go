@@ -161,6 +161,7 @@ type (
 		Index   uint32
 		Offset  Expr
 		Indices []uint32
+		Passive bool // no index and offset, initialized using table.init
 	}
 
 	// GlobalImport represents a WASM global variable import statement.
@@ -23,6 +23,18 @@ const (
 	End Opcode = 0x0B
 )
 
+// Misc is the prefix of instructions that are identified by a sub-opcode
+// following it, such as the bulk memory and table instructions.
+const Misc Opcode = 0xFC
+
+// Sub-opcodes of the instructions prefixed by Misc.
+const (
+	MemoryCopy uint32 = 0x0A
+	MemoryFill uint32 = 0x0B
+	TableInit  uint32 = 0x0C
+	ElemDrop   uint32 = 0x0D
+)
+
 // Extended control instructions.
 const (
 	Br Opcode = iota + 0x0C
@@ -33,6 +45,12 @@ const (
 	CallIndirect
 )
 
+// Tail call instructions.
+const (
+	ReturnCall Opcode = iota + 0x12
+	ReturnCallIndirect
+)
+
 // Parameter instructions.
 const (
 	Drop Opcode = iota + 0x1A
@@ -16,8 +16,6 @@ import (
 	"strconv"
 	"time"
 
-	wasmtime "github.com/bytecodealliance/wasmtime-go/v3"
-
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/topdown"
@@ -26,26 +24,16 @@ import (
 	"github.com/open-policy-agent/opa/topdown/print"
 )
 
-func opaFunctions(dispatcher *builtinDispatcher, store *wasmtime.Store) map[string]wasmtime.AsExtern {
-
-	i32 := wasmtime.NewValType(wasmtime.KindI32)
-
-	externs := map[string]wasmtime.AsExtern{
-		"opa_abort":    wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32}, nil), opaAbort),
-		"opa_builtin0": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
-		"opa_builtin1": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
-		"opa_builtin2": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
-		"opa_builtin3": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
-		"opa_builtin4": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32, i32, i32}, []*wasmtime.ValType{i32}), dispatcher.Call),
-		"opa_println":  wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32}, nil), opaPrintln),
-	}
-
-	return externs
+// caller gives host functions access to the instance calling them,
+// regardless of the runtime, see runtime_wasmtime.go and runtime_wazero.go.
+type caller interface {
+	memory() []byte
+	call(name string, args ...int32) (int32, error)
 }
 
-func opaAbort(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+func opaAbort(c caller, addr int32) {
 
-	data := caller.GetExport("memory").Memory().UnsafeData(caller)[args[0].I32():]
+	data := c.memory()[addr:]
 
 	n := bytes.IndexByte(data, 0)
 	if n == -1 {
@@ -55,8 +43,8 @@ func opaAbort(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wa
 	panic(abortError{message: string(data[:n])})
 }
 
-func opaPrintln(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
-	data := caller.GetExport("memory").Memory().UnsafeData(caller)[args[0].I32():]
+func opaPrintln(c caller, addr int32) {
+	data := c.memory()[addr:]
 
 	n := bytes.IndexByte(data, 0)
 	if n == -1 {
@@ -64,7 +52,6 @@ func opaPrintln(caller *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *
 	}
 
 	fmt.Fprintln(os.Stderr, string(data[:n]))
-	return nil, nil
 }
 
 type builtinDispatcher struct {
@@ -115,7 +102,9 @@ func (d *builtinDispatcher) Reset(ctx context.Context,
 
 }
 
-func (d *builtinDispatcher) Call(caller *wasmtime.Caller, args []wasmtime.Val) (result []wasmtime.Val, trap *wasmtime.Trap) {
+// Call is invoked if the policy calls one of opa_builtin0 to opa_builtin4,
+// with the built-in's identifier, the context structure, and the arguments.
+func (d *builtinDispatcher) Call(c caller, args []int32) int32 {
 
 	if d.ctx == nil {
 		panic("unreachable: uninitialized built-in dispatcher context")
@@ -153,21 +142,19 @@ func (d *builtinDispatcher) Call(caller *wasmtime.Caller, args []wasmtime.Val) (
 	//          \---> host func [(*builtinDispatcher).Call]
 	//                         \---> wasm func [exports]
 	//
-	// then the ctx <-> interrupt bridging done in internal/wasm/vm.g will
-	// already have taken care of signalling the interrupt to the wasm
-	// instance. The instances checks for interrupts that may have happened
+	// then the ctx <-> interrupt bridging done by the runtime will already
+	// have taken care of signalling the interrupt to the wasm instance. With
+	// wasmtime, the instances checks for interrupts that may have happened
 	// at the head of every loop, and in the prologue of every function.
 	//
 	// See https://docs.wasmtime.dev/api/wasmtime/struct.Store.html#when-are-interrupts-delivered
 
-	exports := getExports(caller)
-
 	var convertedArgs []*ast.Term
 
 	// first two args are the built-in identifier and context structure
 	for i := 2; i < len(args); i++ {
 
-		x, err := fromWasmValue(caller, exports, args[i].I32())
+		x, err := fromWasmValue(c, args[i])
 		if err != nil {
 			panic(builtinError{err: err})
 		}
@@ -177,7 +164,7 @@ func (d *builtinDispatcher) Call(caller *wasmtime.Caller, args []wasmtime.Val) (
 
 	var output *ast.Term
 
-	err := d.builtins[args[0].I32()](*d.ctx, convertedArgs, func(t *ast.Term) error {
+	err := d.builtins[args[0]](*d.ctx, convertedArgs, func(t *ast.Term) error {
 		output = t
 		return nil
 	})
@@ -195,65 +182,25 @@ func (d *builtinDispatcher) Call(caller *wasmtime.Caller, args []wasmtime.Val) (
 
 	// if output is undefined, return NULL
 	if output == nil {
-		return []wasmtime.Val{wasmtime.ValI32(0)}, nil
+		return 0
 	}
 
-	addr, err := toWasmValue(caller, exports, output)
+	addr, err := toWasmValue(c, output)
 	if err != nil {
 		panic(builtinError{err: err})
 	}
 
-	return []wasmtime.Val{wasmtime.ValI32(addr)}, nil
-}
-
-type exports struct {
-	Memory       *wasmtime.Memory
-	mallocFn     *wasmtime.Func
-	valueDumpFn  *wasmtime.Func
-	valueParseFn *wasmtime.Func
-}
-
-func getExports(c *wasmtime.Caller) exports {
-	var e exports
-	e.Memory = c.GetExport("memory").Memory()
-	e.mallocFn = c.GetExport("opa_malloc").Func()
-	e.valueDumpFn = c.GetExport("opa_value_dump").Func()
-	e.valueParseFn = c.GetExport("opa_value_parse").Func()
-	return e
-}
-
-func (e exports) Malloc(caller *wasmtime.Caller, len int32) (int32, error) {
-	ptr, err := e.mallocFn.Call(caller, len)
-	if err != nil {
-		return 0, err
-	}
-	return ptr.(int32), nil
-}
-
-func (e exports) ValueDump(caller *wasmtime.Caller, addr int32) (int32, error) {
-	result, err := e.valueDumpFn.Call(caller, addr)
-	if err != nil {
-		return 0, err
-	}
-	return result.(int32), nil
-}
-
-func (e exports) ValueParse(caller *wasmtime.Caller, addr int32, len int32) (int32, error) {
-	result, err := e.valueParseFn.Call(caller, addr, len)
-	if err != nil {
-		return 0, err
-	}
-	return result.(int32), nil
+	return addr
 }
 
-func fromWasmValue(caller *wasmtime.Caller, e exports, addr int32) (*ast.Term, error) {
+func fromWasmValue(c caller, addr int32) (*ast.Term, error) {
 
-	serialized, err := e.ValueDump(caller, addr)
+	serialized, err := c.call("opa_value_dump", addr)
 	if err != nil {
 		return nil, err
 	}
 
-	data := e.Memory.UnsafeData(caller)[serialized:]
+	data := c.memory()[serialized:]
 	n := bytes.IndexByte(data, 0)
 	if n < 0 {
 		return nil, errors.New("invalid serialized value address")
@@ -262,17 +209,17 @@ func fromWasmValue(caller *wasmtime.Caller, e exports, addr int32) (*ast.Term, e
 	return ast.ParseTerm(string(data[0:n]))
 }
 
-func toWasmValue(caller *wasmtime.Caller, e exports, term *ast.Term) (int32, error) {
+func toWasmValue(c caller, term *ast.Term) (int32, error) {
 
 	raw := []byte(term.String())
 	n := int32(len(raw))
-	p, err := e.Malloc(caller, n)
+	p, err := c.call("opa_malloc", n)
 	if err != nil {
 		return 0, err
 	}
 
-	copy(e.Memory.UnsafeData(caller)[p:p+n], raw)
-	addr, err := e.ValueParse(caller, p, n)
+	copy(c.memory()[p:p+n], raw)
+	addr, err := c.call("opa_value_parse", p, n)
 	if err != nil {
 		return 0, err
 	}
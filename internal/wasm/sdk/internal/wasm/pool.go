@@ -9,8 +9,6 @@ import (
 	"context"
 	"sync"
 
-	wasmtime "github.com/bytecodealliance/wasmtime-go/v3"
-
 	"github.com/open-policy-agent/opa/internal/wasm/sdk/opa/errors"
 	"github.com/open-policy-agent/opa/internal/wasm/util"
 	"github.com/open-policy-agent/opa/metrics"
@@ -20,7 +18,7 @@ var errNotReady = errors.New(errors.NotReadyErr, "")
 
 // Pool maintains a pool of WebAssemly VM instances.
 type Pool struct {
-	engine         *wasmtime.Engine
+	engine         *engine
 	available      chan struct{}
 	mutex          sync.Mutex
 	dataMtx        sync.Mutex
@@ -40,16 +38,13 @@ type Pool struct {
 // NewPool constructs a new pool with the pool and VM configuration provided.
 func NewPool(poolSize, memoryMinPages, memoryMaxPages uint32) *Pool {
 
-	cfg := wasmtime.NewConfig()
-	cfg.SetEpochInterruption(true)
-
 	available := make(chan struct{}, poolSize)
 	for i := uint32(0); i < poolSize; i++ {
 		available <- struct{}{}
 	}
 
 	return &Pool{
-		engine:         wasmtime.NewEngineWithConfig(cfg),
+		engine:         newEngine(),
 		memoryMinPages: memoryMinPages,
 		memoryMaxPages: memoryMaxPages,
 		available:      available,
@@ -181,7 +176,7 @@ func (p *Pool) SetPolicyData(ctx context.Context, policy []byte, data []byte) er
 
 		if err == nil {
 			parsedDataAddr, parsedData := vm.cloneDataSegment()
-			p.memoryMinPages = util.Pages(uint32(vm.memory.DataSize(vm.store)))
+			p.memoryMinPages = util.Pages(uint32(len(vm.instance.memory())))
 			p.vms = append(p.vms, vm)
 			p.acquired = append(p.acquired, false)
 			p.initialized = true
@@ -289,7 +284,7 @@ func (p *Pool) updateVMs(update func(vm *VM, opts vmOpts) error) error {
 				activated = true
 				policy = vm.policy
 				parsedDataAddr, parsedData = vm.cloneDataSegment()
-				seedMemorySize = util.Pages(uint32(vm.memory.DataSize(vm.store)))
+				seedMemorySize = util.Pages(uint32(len(vm.instance.memory())))
 				p.activate(policy, parsedData, parsedDataAddr, seedMemorySize)
 			}
 
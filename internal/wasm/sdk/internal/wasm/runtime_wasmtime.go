@@ -0,0 +1,220 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build !opa_wazero
+// +build !opa_wazero
+
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	wasmtime "github.com/bytecodealliance/wasmtime-go/v3"
+
+	sdk_errors "github.com/open-policy-agent/opa/internal/wasm/sdk/opa/errors"
+)
+
+// engine is the wasmtime engine shared by all VMs of a pool.
+type engine struct {
+	engine *wasmtime.Engine
+}
+
+func newEngine() *engine {
+	cfg := wasmtime.NewConfig()
+	cfg.SetEpochInterruption(true)
+	return &engine{engine: wasmtime.NewEngineWithConfig(cfg)}
+}
+
+type wasmtimeInstance struct {
+	engine   *wasmtime.Engine
+	store    *wasmtime.Store
+	instance *wasmtime.Instance // Pointer to avoid unintented destruction (triggering finalizers within).
+	mem      *wasmtime.Memory
+}
+
+func (e *engine) instantiate(policy []byte, memoryMin, memoryMax uint32, dispatcher *builtinDispatcher) (instance, error) {
+	store := wasmtime.NewStore(e.engine)
+	store.SetEpochDeadline(1)
+	memorytype := wasmtime.NewMemoryType(memoryMin, true, memoryMax)
+	memory, err := wasmtime.NewMemory(store, memorytype)
+	if err != nil {
+		return nil, err
+	}
+
+	module, err := wasmtime.NewModule(store.Engine, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	linker := wasmtime.NewLinker(store.Engine)
+	externs := opaFunctions(dispatcher, store)
+	for name, extern := range externs {
+		if err := linker.Define("env", name, extern); err != nil {
+			return nil, fmt.Errorf("linker: env.%s: %w", name, err)
+		}
+	}
+	if err := linker.Define("env", "memory", memory); err != nil {
+		return nil, fmt.Errorf("linker: env.memory: %w", err)
+	}
+
+	i, err := linker.Instantiate(store, module)
+	if err != nil {
+		return nil, err
+	}
+
+	// re-exported import, or just plain export if memory wasn't imported
+	memory = i.GetExport(store, "memory").Memory()
+
+	return &wasmtimeInstance{engine: e.engine, store: store, instance: i, mem: memory}, nil
+}
+
+func opaFunctions(dispatcher *builtinDispatcher, store *wasmtime.Store) map[string]wasmtime.AsExtern {
+
+	i32 := wasmtime.NewValType(wasmtime.KindI32)
+
+	externs := map[string]wasmtime.AsExtern{
+		"opa_abort":    wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32}, nil), wasmtimeAbort),
+		"opa_builtin0": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32}, []*wasmtime.ValType{i32}), wasmtimeBuiltin(dispatcher)),
+		"opa_builtin1": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32}, []*wasmtime.ValType{i32}), wasmtimeBuiltin(dispatcher)),
+		"opa_builtin2": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32}, []*wasmtime.ValType{i32}), wasmtimeBuiltin(dispatcher)),
+		"opa_builtin3": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32, i32}, []*wasmtime.ValType{i32}), wasmtimeBuiltin(dispatcher)),
+		"opa_builtin4": wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32, i32, i32, i32, i32, i32}, []*wasmtime.ValType{i32}), wasmtimeBuiltin(dispatcher)),
+		"opa_println":  wasmtime.NewFunc(store, wasmtime.NewFuncType([]*wasmtime.ValType{i32}, nil), wasmtimePrintln),
+	}
+
+	return externs
+}
+
+func wasmtimeAbort(c *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+	opaAbort(wasmtimeCaller{c}, args[0].I32())
+	return nil, nil
+}
+
+func wasmtimePrintln(c *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+	opaPrintln(wasmtimeCaller{c}, args[0].I32())
+	return nil, nil
+}
+
+func wasmtimeBuiltin(d *builtinDispatcher) func(*wasmtime.Caller, []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+	return func(c *wasmtime.Caller, args []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+		sl := make([]int32, len(args))
+		for i := range args {
+			sl[i] = args[i].I32()
+		}
+		return []wasmtime.Val{wasmtime.ValI32(d.Call(wasmtimeCaller{c}, sl))}, nil
+	}
+}
+
+// wasmtimeCaller gives host functions access to the calling instance.
+type wasmtimeCaller struct {
+	caller *wasmtime.Caller
+}
+
+func (c wasmtimeCaller) memory() []byte {
+	return c.caller.GetExport("memory").Memory().UnsafeData(c.caller)
+}
+
+func (c wasmtimeCaller) call(name string, args ...int32) (int32, error) {
+	res, err := c.caller.GetExport(name).Func().Call(c.caller, toVals(args)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.(int32), nil
+}
+
+func toVals(args []int32) []interface{} {
+	sl := make([]interface{}, len(args))
+	for i := range sl {
+		sl[i] = args[i]
+	}
+	return sl
+}
+
+func (i *wasmtimeInstance) memory() []byte {
+	return i.mem.UnsafeData(i.store)
+}
+
+func (i *wasmtimeInstance) grow(pages uint32) error {
+	_, err := i.mem.Grow(i.store, uint64(pages))
+	return err
+}
+
+func (i *wasmtimeInstance) global(name string) (int32, bool) {
+	exp := i.instance.GetExport(i.store, name)
+	if exp == nil || exp.Global() == nil {
+		return 0, false
+	}
+	val := exp.Global().Get(i.store)
+	if val.Kind() != wasmtime.KindI32 {
+		return 0, false
+	}
+	return val.I32(), true
+}
+
+// closed returns false: an interrupted store can be called again, see call.
+func (*wasmtimeInstance) closed() bool {
+	return false
+}
+
+func (i *wasmtimeInstance) call(ctx context.Context, name string, args ...int32) (int32, error) {
+	// `done` is closed when the eval is done;
+	// `ctxdone` is used to ensure that this goroutine is not running rogue;
+	// it may interact badly with other calls into this VM because of async
+	// execution. Concretely, there's no guarantee which branch of done or
+	// ctx.Done() is selected when they're both good to go. Hence, this may
+	// interrupt the VM long after _this_ functions is done. By tying them
+	// together (`<-ctxdone` at the end of call, `close(ctxdone)`
+	// here), we can avoid that.
+	done := make(chan struct{})
+	ctxdone := make(chan struct{})
+	// The deadline is relative to the current epoch, so that the store can
+	// be called again after an interrupt.
+	i.store.SetEpochDeadline(1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			i.engine.IncrementEpoch()
+		case <-done:
+		}
+		close(ctxdone)
+	}()
+
+	f := i.instance.GetFunc(i.store, name)
+	// If this call into the VM ends up calling host functions (builtins not
+	// implemented in Wasm), and those panic, wasmtime will re-throw them,
+	// to be dealt with in callOrCancel.
+	res, err := func() (interface{}, error) {
+		defer close(done)
+		return f.Call(i.store, toVals(args)...)
+	}()
+	if err != nil {
+		// if last err was trap, extract information
+		var t *wasmtime.Trap
+		if errors.As(err, &t) {
+			if strings.Contains(t.Message(), "wasm trap: interrupt") {
+				return 0, sdk_errors.New(sdk_errors.CancelledErr, "interrupted")
+			}
+			return 0, sdk_errors.New(sdk_errors.InternalErr, getStack(t.Frames(), "trapped"))
+		}
+		return 0, err
+	}
+	<-ctxdone // wait for the goroutine that's checking ctx
+	if res == nil {
+		return 0, nil
+	}
+	return res.(int32), nil
+}
+
+func getStack(fs []*wasmtime.Frame, desc string) string {
+	var funcs []string
+	for _, fr := range fs {
+		if fun := fr.FuncName(); fun != nil {
+			funcs = append(funcs, *fun)
+		}
+	}
+	return stackString(desc, len(fs), funcs)
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build opa_wazero
+// +build opa_wazero
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
+	"github.com/open-policy-agent/opa/internal/wasm/module"
+	sdk_errors "github.com/open-policy-agent/opa/internal/wasm/sdk/opa/errors"
+)
+
+// engine is the wazero runtime shared by all VMs of a pool. Unlike wasmtime,
+// it doesn't require cgo.
+type engine struct {
+	runtime wazero.Runtime
+	host    error // instantiating the host module
+
+	mtx      sync.Mutex
+	key      compiledKey
+	compiled wazero.CompiledModule
+}
+
+// compiledKey identifies the last module compiled: the memory limits are
+// part of it, see compile.
+type compiledKey struct {
+	policy               string
+	memoryMin, memoryMax uint32
+}
+
+// callState is passed to the host functions via the context of a call.
+type callState struct {
+	dispatcher *builtinDispatcher
+	panicked   interface{}
+}
+
+type callStateKey struct{}
+
+func newEngine() *engine {
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	e := &engine{runtime: r}
+
+	env := r.NewHostModuleBuilder("env").
+		NewFunctionBuilder().WithGoModuleFunction(hostFunc(func(c caller, _ *builtinDispatcher, stack []uint64) {
+		opaAbort(c, api.DecodeI32(stack[0]))
+	}), i32s(1), nil).Export("opa_abort").
+		NewFunctionBuilder().WithGoModuleFunction(hostFunc(func(c caller, _ *builtinDispatcher, stack []uint64) {
+		opaPrintln(c, api.DecodeI32(stack[0]))
+	}), i32s(1), nil).Export("opa_println")
+	for n := 0; n <= 4; n++ {
+		env = env.NewFunctionBuilder().WithGoModuleFunction(hostFunc(func(c caller, d *builtinDispatcher, stack []uint64) {
+			args := make([]int32, len(stack))
+			for i := range stack {
+				args[i] = api.DecodeI32(stack[i])
+			}
+			stack[0] = api.EncodeI32(d.Call(c, args))
+		}), i32s(n+2), i32s(1)).Export(fmt.Sprintf("opa_builtin%d", n))
+	}
+	_, e.host = env.Instantiate(ctx)
+	return e
+}
+
+func i32s(n int) []api.ValueType {
+	ts := make([]api.ValueType, n)
+	for i := range ts {
+		ts[i] = api.ValueTypeI32
+	}
+	return ts
+}
+
+// hostFunc adapts f to wazero. Panics are stashed in the call's state, and
+// re-thrown once the call has returned, since wazero turns them into errors,
+// see (*wazeroInstance).call.
+func hostFunc(f func(caller, *builtinDispatcher, []uint64)) api.GoModuleFunc {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		st := ctx.Value(callStateKey{}).(*callState)
+		defer func() {
+			if e := recover(); e != nil {
+				st.panicked = e
+				panic(e)
+			}
+		}()
+		f(wazeroCaller{ctx: ctx, mod: mod}, st.dispatcher, stack)
+	}
+}
+
+// compile compiles policy, turning its imported memory into a memory defined
+// by the module itself, with the limits given: wazero's host modules can't
+// provide memories. Only the last module compiled is kept, which is the one
+// all VMs of a pool are using.
+func (e *engine) compile(ctx context.Context, policy []byte, memoryMin, memoryMax uint32) (wazero.CompiledModule, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	key := compiledKey{policy: string(policy), memoryMin: memoryMin, memoryMax: memoryMax}
+	if e.compiled != nil && e.key == key {
+		return e.compiled, nil
+	}
+
+	m, err := encoding.ReadModule(bytes.NewReader(policy))
+	if err != nil {
+		return nil, err
+	}
+	imports := m.Import.Imports[:0]
+	for _, imp := range m.Import.Imports {
+		if _, ok := imp.Descriptor.(module.MemoryImport); ok && imp.Module == "env" && imp.Name == "memory" {
+			m.Memory.Memories = append([]module.Memory{{Lim: module.Limit{Min: memoryMin, Max: &memoryMax}}}, m.Memory.Memories...)
+			continue
+		}
+		imports = append(imports, imp)
+	}
+	m.Import.Imports = imports
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, m); err != nil {
+		return nil, err
+	}
+
+	compiled, err := e.runtime.CompileModule(ctx, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if e.compiled != nil {
+		_ = e.compiled.Close(ctx) // instances of it stay usable
+	}
+	e.key, e.compiled = key, compiled
+	return compiled, nil
+}
+
+type wazeroInstance struct {
+	mod   api.Module
+	mem   api.Memory
+	funcs map[string]api.Function
+	state *callState
+}
+
+func (e *engine) instantiate(policy []byte, memoryMin, memoryMax uint32, dispatcher *builtinDispatcher) (instance, error) {
+	if e.host != nil {
+		return nil, fmt.Errorf("host module: %w", e.host)
+	}
+	ctx := context.Background()
+	compiled, err := e.compile(ctx, policy, memoryMin, memoryMax)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &wazeroInstance{funcs: map[string]api.Function{}, state: &callState{dispatcher: dispatcher}}
+	// Policies are instantiated without a name, so that many of them can
+	// be instantiated in the same runtime.
+	ctx = context.WithValue(ctx, callStateKey{}, i.state)
+	i.mod, err = e.runtime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return nil, err
+	}
+	if i.mem = i.mod.ExportedMemory("memory"); i.mem == nil {
+		return nil, fmt.Errorf("invalid module: no memory export")
+	}
+	return i, nil
+}
+
+// wazeroCaller gives host functions access to the calling instance.
+type wazeroCaller struct {
+	ctx context.Context
+	mod api.Module
+}
+
+func (c wazeroCaller) memory() []byte {
+	return memoryData(c.mod.Memory())
+}
+
+func (c wazeroCaller) call(name string, args ...int32) (int32, error) {
+	f := c.mod.ExportedFunction(name)
+	if f == nil {
+		return 0, fmt.Errorf("no exported function %s", name)
+	}
+	res, err := f.Call(c.ctx, toParams(args)...)
+	if err != nil || len(res) == 0 {
+		return 0, err
+	}
+	return api.DecodeI32(res[0]), nil
+}
+
+func memoryData(mem api.Memory) []byte {
+	data, _ := mem.Read(0, mem.Size())
+	return data
+}
+
+func toParams(args []int32) []uint64 {
+	params := make([]uint64, len(args))
+	for i := range args {
+		params[i] = api.EncodeI32(args[i])
+	}
+	return params
+}
+
+func (i *wazeroInstance) memory() []byte {
+	return memoryData(i.mem)
+}
+
+func (i *wazeroInstance) grow(pages uint32) error {
+	if _, ok := i.mem.Grow(pages); !ok {
+		return fmt.Errorf("failed to grow memory by `%d`", pages)
+	}
+	return nil
+}
+
+func (i *wazeroInstance) global(name string) (int32, bool) {
+	g := i.mod.ExportedGlobal(name)
+	if g == nil || g.Type() != api.ValueTypeI32 {
+		return 0, false
+	}
+	return api.DecodeI32(g.Get()), true
+}
+
+// closed returns true once a call has been cancelled: wazero closes the
+// module then.
+func (i *wazeroInstance) closed() bool {
+	return i.mod.IsClosed()
+}
+
+func (i *wazeroInstance) call(ctx context.Context, name string, args ...int32) (int32, error) {
+	f, ok := i.funcs[name]
+	if !ok {
+		if f = i.mod.ExportedFunction(name); f == nil {
+			return 0, fmt.Errorf("no exported function %s", name)
+		}
+		i.funcs[name] = f
+	}
+
+	i.state.panicked = nil
+	res, err := f.Call(context.WithValue(ctx, callStateKey{}, i.state), toParams(args)...)
+	if err != nil {
+		// a host function panicked, re-throw it to be dealt with in callOrCancel
+		if e := i.state.panicked; e != nil {
+			i.state.panicked = nil
+			panic(e)
+		}
+		var exit *sys.ExitError
+		if errors.As(err, &exit) {
+			switch exit.ExitCode() {
+			case sys.ExitCodeContextCanceled, sys.ExitCodeDeadlineExceeded:
+				return 0, sdk_errors.New(sdk_errors.CancelledErr, "interrupted")
+			}
+			return 0, err
+		}
+		if frames, ok := parseTrap(err.Error()); ok {
+			return 0, sdk_errors.New(sdk_errors.InternalErr, stackString("trapped", len(frames), frames))
+		}
+		return 0, err
+	}
+	if len(res) == 0 {
+		return 0, nil
+	}
+	return api.DecodeI32(res[0]), nil
+}
+
+// parseTrap extracts the function names from a wazero trap's stack trace,
+// innermost first, like wasmtime's frames.
+func parseTrap(msg string) ([]string, bool) {
+	lines := strings.Split(msg, "\n")
+	if !strings.HasPrefix(lines[0], "wasm error: ") || len(lines) < 2 || lines[1] != "wasm stack trace:" {
+		return nil, false
+	}
+	var frames []string
+	for _, l := range lines[2:] {
+		if !strings.HasPrefix(l, "\t") || strings.HasPrefix(l, "\t\t") { // not a frame, or its source
+			continue
+		}
+		name := strings.TrimPrefix(l, "\t.") // the policy's module has no name
+		if n := strings.IndexByte(name, '('); n >= 0 {
+			name = name[:n]
+		}
+		frames = append(frames, name)
+	}
+	return frames, true
+}
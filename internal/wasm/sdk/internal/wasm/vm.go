@@ -8,14 +8,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"strings"
 	"time"
 
-	wasmtime "github.com/bytecodealliance/wasmtime-go/v3"
-
 	"github.com/open-policy-agent/opa/ast"
 	sdk_errors "github.com/open-policy-agent/opa/internal/wasm/sdk/opa/errors"
 	"github.com/open-policy-agent/opa/internal/wasm/util"
@@ -29,13 +26,11 @@ import (
 // VM is a wrapper around a Wasm VM instance
 type VM struct {
 	dispatcher           *builtinDispatcher
-	engine               *wasmtime.Engine
-	store                *wasmtime.Store
-	instance             *wasmtime.Instance // Pointer to avoid unintented destruction (triggering finalizers within).
+	engine               *engine
+	instance             instance
 	policy               []byte
 	abiMajorVersion      int32
 	abiMinorVersion      int32
-	memory               *wasmtime.Memory
 	memoryMin            uint32
 	memoryMax            uint32
 	entrypointIDs        map[string]int32
@@ -61,6 +56,20 @@ type VM struct {
 	valueRemovePath      func(context.Context, int32, int32) (int32, error)
 }
 
+// instance is a policy module instantiated by the engine: that's wasmtime's,
+// or, when built with the opa_wazero tag, wazero's, which doesn't need cgo.
+type instance interface {
+	// call calls the exported function name, returning its result, or 0 if
+	// it has none. Panics of host functions are re-thrown.
+	call(ctx context.Context, name string, args ...int32) (int32, error)
+	memory() []byte
+	grow(pages uint32) error
+	global(name string) (int32, bool)
+	// closed tells if the instance can no longer be called, which is the
+	// case for wazero's after a cancelled call.
+	closed() bool
+}
+
 type vmOpts struct {
 	policy         []byte
 	data           []byte
@@ -70,40 +79,16 @@ type vmOpts struct {
 	memoryMax      uint32
 }
 
-func newVM(opts vmOpts, engine *wasmtime.Engine) (*VM, error) {
+func newVM(opts vmOpts, engine *engine) (*VM, error) {
 	ctx := context.Background()
 	v := &VM{engine: engine}
-	store := wasmtime.NewStore(engine)
-	store.SetEpochDeadline(1)
-	memorytype := wasmtime.NewMemoryType(opts.memoryMin, true, opts.memoryMax)
-	memory, err := wasmtime.NewMemory(store, memorytype)
-	if err != nil {
-		return nil, err
-	}
-
-	module, err := wasmtime.NewModule(store.Engine, opts.policy)
-	if err != nil {
-		return nil, err
-	}
-
-	linker := wasmtime.NewLinker(store.Engine)
 	v.dispatcher = newBuiltinDispatcher()
-	externs := opaFunctions(v.dispatcher, store)
-	for name, extern := range externs {
-		if err := linker.Define("env", name, extern); err != nil {
-			return nil, fmt.Errorf("linker: env.%s: %w", name, err)
-		}
-	}
-	if err := linker.Define("env", "memory", memory); err != nil {
-		return nil, fmt.Errorf("linker: env.memory: %w", err)
-	}
-
-	i, err := linker.Instantiate(store, module)
+	i, err := engine.instantiate(opts.policy, opts.memoryMin, opts.memoryMax, v.dispatcher)
 	if err != nil {
 		return nil, err
 	}
 
-	v.abiMajorVersion, v.abiMinorVersion, err = getABIVersion(i, store)
+	v.abiMajorVersion, v.abiMinorVersion, err = getABIVersion(i)
 	if err != nil {
 		return nil, fmt.Errorf("invalid module: %w", err)
 	}
@@ -111,13 +96,8 @@ func newVM(opts vmOpts, engine *wasmtime.Engine) (*VM, error) {
 		return nil, fmt.Errorf("invalid module: unsupported ABI version: %d.%d", v.abiMajorVersion, v.abiMinorVersion)
 	}
 
-	// re-exported import, or just plain export if memory wasn't imported
-	memory = i.GetExport(store, "memory").Memory()
-
-	v.store = store
 	v.instance = i
 	v.policy = opts.policy
-	v.memory = memory
 	v.memoryMin = opts.memoryMin
 	v.memoryMax = opts.memoryMax
 	v.entrypointIDs = make(map[string]int32)
@@ -171,14 +151,14 @@ func newVM(opts vmOpts, engine *wasmtime.Engine) (*VM, error) {
 	// This only works because the placement is deterministic (eg, for a given policy
 	// the base heap pointer and parsed data layout will always be the same).
 	if opts.parsedData != nil {
-		if uint32(memory.DataSize(store))-uint32(v.baseHeapPtr) < uint32(len(opts.parsedData)) {
-			delta := uint32(len(opts.parsedData)) - (uint32(memory.DataSize(store)) - uint32(v.baseHeapPtr))
-			_, err = memory.Grow(store, uint64(util.Pages(delta)))
+		if uint32(len(i.memory()))-uint32(v.baseHeapPtr) < uint32(len(opts.parsedData)) {
+			delta := uint32(len(opts.parsedData)) - (uint32(len(i.memory())) - uint32(v.baseHeapPtr))
+			err = i.grow(util.Pages(delta))
 			if err != nil {
 				return nil, err
 			}
 		}
-		mem := memory.UnsafeData(store)
+		mem := i.memory()
 		for src, dest := 0, v.baseHeapPtr; src < len(opts.parsedData); src, dest = src+1, dest+1 {
 			mem[dest] = opts.parsedData[src]
 		}
@@ -200,12 +180,12 @@ func newVM(opts vmOpts, engine *wasmtime.Engine) (*VM, error) {
 
 	// Construct the builtin id to name mappings.
 
-	val, err := i.GetFunc(store, "builtins").Call(store)
+	val, err := call(ctx, v, "builtins")
 	if err != nil {
 		return nil, err
 	}
 
-	builtins, err := v.fromRegoJSON(ctx, val.(int32), true)
+	builtins, err := v.fromRegoJSON(ctx, val, true)
 	if err != nil {
 		return nil, err
 	}
@@ -229,12 +209,12 @@ func newVM(opts vmOpts, engine *wasmtime.Engine) (*VM, error) {
 	v.dispatcher.SetMap(builtinMap)
 
 	// Extract the entrypoint ID's
-	val, err = i.GetFunc(store, "entrypoints").Call(store)
+	val, err = call(ctx, v, "entrypoints")
 	if err != nil {
 		return nil, err
 	}
 
-	epMap, err := v.fromRegoJSON(ctx, val.(int32), true)
+	epMap, err := v.fromRegoJSON(ctx, val, true)
 	if err != nil {
 		return nil, err
 	}
@@ -250,15 +230,11 @@ func newVM(opts vmOpts, engine *wasmtime.Engine) (*VM, error) {
 	return v, nil
 }
 
-func getABIVersion(i *wasmtime.Instance, store wasmtime.Storelike) (int32, int32, error) {
-	major := i.GetExport(store, "opa_wasm_abi_version").Global()
-	minor := i.GetExport(store, "opa_wasm_abi_minor_version").Global()
-	if major != nil && minor != nil {
-		majorVal := major.Get(store)
-		minorVal := minor.Get(store)
-		if majorVal.Kind() == wasmtime.KindI32 && minorVal.Kind() == wasmtime.KindI32 {
-			return majorVal.I32(), minorVal.I32(), nil
-		}
+func getABIVersion(i instance) (int32, int32, error) {
+	major, ok := i.global("opa_wasm_abi_version")
+	minor, ok2 := i.global("opa_wasm_abi_minor_version")
+	if ok && ok2 {
+		return major, minor, nil
 	}
 	return 0, 0, fmt.Errorf("failed to read ABI version")
 }
@@ -308,14 +284,14 @@ func (i *VM) Eval(ctx context.Context,
 		inputLen = int32(len(raw))
 		inputAddr = i.evalHeapPtr
 
-		rest := inputAddr + inputLen - int32(i.memory.DataSize(i.store))
+		rest := inputAddr + inputLen - int32(len(i.instance.memory()))
 		if rest > 0 { // need to grow memory
-			_, err := i.memory.Grow(i.store, uint64(util.Pages(uint32(rest))))
+			err := i.instance.grow(util.Pages(uint32(rest)))
 			if err != nil {
 				return nil, fmt.Errorf("input: %w (max pages %d)", err, i.memoryMax)
 			}
 		}
-		mem := i.memory.UnsafeData(i.store)
+		mem := i.instance.memory()
 
 		heapPtr += inputLen
 		copy(mem[inputAddr:inputAddr+inputLen], raw)
@@ -332,11 +308,11 @@ func (i *VM) Eval(ctx context.Context,
 	metrics.Timer("wasm_vm_eval_call").Start()
 	resultAddr, err := i.evalOneOff(ctx, entrypoint, i.dataAddr, inputAddr, inputLen, heapPtr)
 	if err != nil {
-		return nil, err
+		return nil, i.renew(err)
 	}
 	metrics.Timer("wasm_vm_eval_call").Stop()
 
-	data := i.memory.UnsafeData(i.store)[resultAddr:]
+	data := i.instance.memory()[resultAddr:]
 	n := bytes.IndexByte(data, 0)
 	if n < 0 {
 		n = 0
@@ -408,7 +384,7 @@ func (i *VM) evalCompat(ctx context.Context,
 	err = i.eval(ctx, ctxAddr)
 	metrics.Timer("wasm_vm_eval_execute").Stop()
 	if err != nil {
-		return nil, err
+		return nil, i.renew(err)
 	}
 
 	metrics.Timer("wasm_vm_eval_prepare_result").Start()
@@ -422,7 +398,7 @@ func (i *VM) evalCompat(ctx context.Context,
 		return nil, err
 	}
 
-	data := i.memory.UnsafeData(i.store)[serialized:]
+	data := i.instance.memory()[serialized:]
 	n := bytes.IndexByte(data, 0)
 	if n < 0 {
 		n = 0
@@ -458,14 +434,14 @@ func (i *VM) SetPolicyData(ctx context.Context, opts vmOpts) error {
 	}
 
 	if opts.parsedData != nil {
-		if uint32(i.memory.DataSize(i.store))-uint32(i.baseHeapPtr) < uint32(len(opts.parsedData)) {
-			delta := uint32(len(opts.parsedData)) - (uint32(i.memory.DataSize(i.store)) - uint32(i.baseHeapPtr))
-			_, err := i.memory.Grow(i.store, uint64(util.Pages(delta)))
+		if uint32(len(i.instance.memory()))-uint32(i.baseHeapPtr) < uint32(len(opts.parsedData)) {
+			delta := uint32(len(opts.parsedData)) - (uint32(len(i.instance.memory())) - uint32(i.baseHeapPtr))
+			err := i.instance.grow(util.Pages(delta))
 			if err != nil {
 				return err
 			}
 		}
-		mem := i.memory.UnsafeData(i.store)
+		mem := i.instance.memory()
 		len := int32(len(opts.parsedData))
 		copy(mem[i.baseHeapPtr:i.baseHeapPtr+len], opts.parsedData)
 		i.dataAddr = opts.parsedDataAddr
@@ -498,7 +474,7 @@ type cancelledError struct {
 
 // Println is invoked if the policy WASM code calls opa_println().
 func (i *VM) Println(arg int32) {
-	data := i.memory.UnsafeData(i.store)[arg:]
+	data := i.instance.memory()[arg:]
 	n := bytes.IndexByte(data, 0)
 	if n == -1 {
 		panic("invalid opa_println argument")
@@ -598,7 +574,7 @@ func (i *VM) fromRegoJSON(ctx context.Context, addr int32, free bool) (interface
 		return nil, err
 	}
 
-	data := i.memory.UnsafeData(i.store)[serialized:]
+	data := i.instance.memory()[serialized:]
 	n := bytes.IndexByte(data, 0)
 	if n < 0 {
 		n = 0
@@ -648,7 +624,7 @@ func (i *VM) toRegoJSON(ctx context.Context, v interface{}, free bool) (int32, e
 		return 0, err
 	}
 
-	copy(i.memory.UnsafeData(i.store)[p:p+n], raw)
+	copy(i.instance.memory()[p:p+n], raw)
 
 	addr, err := i.valueParse(ctx, p, n)
 	if err != nil {
@@ -675,18 +651,35 @@ func (i *VM) setHeapState(ctx context.Context, ptr int32) error {
 func (i *VM) cloneDataSegment() (int32, []byte) {
 	// The parsed data values sit between the base heap address and end
 	// at the eval heap pointer address.
-	srcData := i.memory.UnsafeData(i.store)[i.baseHeapPtr:i.evalHeapPtr]
+	srcData := i.instance.memory()[i.baseHeapPtr:i.evalHeapPtr]
 	patchedData := make([]byte, len(srcData))
 	copy(patchedData, srcData)
 	return i.dataAddr, patchedData
 }
 
-func call(ctx context.Context, vm *VM, name string, args ...int32) (int32, error) {
-	res, err := callOrCancel(ctx, vm, name, args...)
-	if err != nil {
-		return 0, err
+// renew replaces the instance by a new one, with the same policy and data,
+// if it can no longer be called after err, see instance.closed.
+func (i *VM) renew(err error) error {
+	if !i.instance.closed() {
+		return err
 	}
-	return res.(int32), nil
+	parsedDataAddr, parsedData := i.cloneDataSegment()
+	n, nerr := newVM(vmOpts{
+		policy:         i.policy,
+		parsedData:     parsedData,
+		parsedDataAddr: parsedDataAddr,
+		memoryMin:      i.memoryMin,
+		memoryMax:      i.memoryMax,
+	}, i.engine)
+	if nerr != nil {
+		return fmt.Errorf("%v: renew instance: %w", err, nerr)
+	}
+	*i = *n
+	return err
+}
+
+func call(ctx context.Context, vm *VM, name string, args ...int32) (int32, error) {
+	return callOrCancel(ctx, vm, name, args...)
 }
 
 func callVoid(ctx context.Context, vm *VM, name string, args ...int32) error {
@@ -694,83 +687,40 @@ func callVoid(ctx context.Context, vm *VM, name string, args ...int32) error {
 	return err
 }
 
-func callOrCancel(ctx context.Context, vm *VM, name string, args ...int32) (interface{}, error) {
-	sl := make([]interface{}, len(args))
-	for i := range sl {
-		sl[i] = args[i]
-	}
-
-	// `done` is closed when the eval is done;
-	// `ctxdone` is used to ensure that this goroutine is not running rogue;
-	// it may interact badly with other calls into this VM because of async
-	// execution. Concretely, there's no guarantee which branch of done or
-	// ctx.Done() is selected when they're both good to go. Hence, this may
-	// interrupt the VM long after _this_ functions is done. By tying them
-	// together (`<-ctxdone` at the end of callOrCancel, `close(ctxdone)`
-	// here), we can avoid that.
-	done := make(chan struct{})
-	ctxdone := make(chan struct{})
-	go func() {
-		select {
-		case <-ctx.Done():
-			vm.store.Engine.IncrementEpoch()
-		case <-done:
-		}
-		close(ctxdone)
-	}()
-
-	f := vm.instance.GetFunc(vm.store, name)
+func callOrCancel(ctx context.Context, vm *VM, name string, args ...int32) (res int32, err error) {
 	// If this call into the VM ends up calling host functions (builtins not
-	// implemented in Wasm), and those panic, wasmtime will re-throw them,
+	// implemented in Wasm), and those panic, the runtime will re-throw them,
 	// and this is where we deal with that:
-	res, err := func() (res interface{}, err error) {
-		defer close(done)
-		defer func() {
-			if e := recover(); e != nil {
-				switch e := e.(type) {
-				case abortError:
-					err = sdk_errors.New(sdk_errors.InternalErr, e.message)
-				case cancelledError:
-					err = sdk_errors.New(sdk_errors.CancelledErr, e.message)
-				case builtinError:
-					err = sdk_errors.New(sdk_errors.InternalErr, e.err.Error())
-				default:
-					panic(e)
-				}
-			}
-		}()
-		res, err = f.Call(vm.store, sl...)
-		return
-	}()
-	if err != nil {
-		// if last err was trap, extract information
-		var t *wasmtime.Trap
-		if errors.As(err, &t) {
-			if strings.Contains(t.Message(), "wasm trap: interrupt") {
-				return 0, sdk_errors.New(sdk_errors.CancelledErr, "interrupted")
+	defer func() {
+		if e := recover(); e != nil {
+			switch e := e.(type) {
+			case abortError:
+				err = sdk_errors.New(sdk_errors.InternalErr, e.message)
+			case cancelledError:
+				err = sdk_errors.New(sdk_errors.CancelledErr, e.message)
+			case builtinError:
+				err = sdk_errors.New(sdk_errors.InternalErr, e.err.Error())
+			default:
+				panic(e)
 			}
-			return 0, sdk_errors.New(sdk_errors.InternalErr, getStack(t.Frames(), "trapped"))
 		}
-		return 0, err
-	}
-	<-ctxdone // wait for the goroutine that's checking ctx
-	return res, nil
+	}()
+	return vm.instance.call(ctx, name, args...)
 }
 
-func getStack(fs []*wasmtime.Frame, desc string) string {
+// stackString describes a trap: desc, followed by the names of the functions
+// on the stack of n frames, outermost first, if there's more than one frame.
+// The names are given innermost first.
+func stackString(desc string, n int, funcs []string) string {
 	var b strings.Builder
 	b.WriteString(desc)
-	if len(fs) > 1 {
+	if n > 1 {
 		b.WriteString(" at ")
-		for i := len(fs) - 1; i >= 0; i-- { // backwards
-			fr := fs[i]
-			if fun := fr.FuncName(); fun != nil {
-				if i != len(fs)-1 {
-					b.WriteRune('/')
-				}
-				b.WriteString(*fun)
-
+		for i := len(funcs) - 1; i >= 0; i-- { // backwards
+			if i != len(funcs)-1 {
+				b.WriteRune('/')
 			}
+			b.WriteString(funcs[i])
 		}
 	}
 	return b.String()
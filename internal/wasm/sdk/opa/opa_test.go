@@ -8,17 +8,25 @@
 package opa_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/compile"
+	_ "github.com/open-policy-agent/opa/features/wasm" // for WithVerifyDCE
+	"github.com/open-policy-agent/opa/internal/compiler/wasm"
+	"github.com/open-policy-agent/opa/internal/planner"
+	"github.com/open-policy-agent/opa/internal/wasm/encoding"
 	"github.com/open-policy-agent/opa/internal/wasm/sdk/opa"
+	sdk_errors "github.com/open-policy-agent/opa/internal/wasm/sdk/opa/errors"
 	wasm_util "github.com/open-policy-agent/opa/internal/wasm/util"
+	"github.com/open-policy-agent/opa/ir"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/util"
 )
@@ -402,6 +410,240 @@ func TestNamedEntrypoint(t *testing.T) {
 	}
 }
 
+func TestEvalAfterCancel(t *testing.T) {
+	policy := compileRegoToWasm(`package x
+	p = data.d { not loop }
+	loop { numbers.range(1, input.n)[_] = v; v < 0 }`, `data.x.p = x`, dump)
+
+	instance, err := opa.New().
+		WithPolicyBytes(policy).
+		WithDataBytes([]byte(`{"d": "data"}`)).
+		WithPoolSize(1).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = instance.Eval(ctx, opa.EvalOpts{Input: parseJSON(`{"n": 100000000}`)})
+	if !sdk_errors.IsCancel(err) {
+		t.Fatalf("Expected cancellation, got: %v", err)
+	}
+
+	// the VM can still be used, with the same data
+	r, err := instance.Eval(context.Background(), opa.EvalOpts{Input: parseJSON(`{"n": 1}`)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exp := ast.MustParseTerm(`{{"x": "data"}}`)
+	if actual := ast.MustParseTerm(string(r.Result)); !actual.Equal(exp) {
+		t.Fatalf("Expected result %s, got: %s", exp, actual)
+	}
+}
+
+func TestMinimalModule(t *testing.T) {
+	policy, err := planner.New().
+		WithQueries([]planner.QuerySet{{
+			Name:    "test",
+			Queries: []ast.Body{ast.MustParseBody(`x = input.foo`)},
+		}}).
+		WithBuiltinDecls(ast.BuiltinMap).
+		Plan()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	mod, err := wasm.New().WithPolicy(policy).WithMinimal(true).Compile()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, mod); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	instance, err := opa.New().
+		WithPolicyBytes(buf.Bytes()).
+		WithPoolSize(1).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	res, err := instance.Eval(ctx, opa.EvalOpts{Input: parseJSON(`{"foo": 7}`)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	exp := ast.MustParseTerm(`{{"x":7}}`)
+	actual := ast.MustParseTerm(string(res.Result))
+	if !actual.Equal(exp) {
+		t.Fatalf("Expected result to be %s, got: %s", exp, actual)
+	}
+}
+
+func TestCompactedModule(t *testing.T) {
+	policy, err := planner.New().
+		WithQueries([]planner.QuerySet{{
+			Name:    "test",
+			Queries: []ast.Body{ast.MustParseBody(`x = input.foo; startswith(input.bar, "a")`)},
+		}}).
+		WithBuiltinDecls(ast.BuiltinMap).
+		Plan()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	for name, c := range map[string]*wasm.Compiler{
+		"compact":       wasm.New().WithCompactUnusedCode(true),
+		"prune imports": wasm.New().WithPruneImports(true),
+		"both":          wasm.New().WithCompactUnusedCode(true).WithPruneImports(true),
+		"remove data":   wasm.New().WithCompactUnusedCode(true).WithRemoveUnusedData(true),
+		"shrink table":  wasm.New().WithCompactUnusedCode(true).WithShrinkTable(true),
+	} {
+		t.Run(name, func(t *testing.T) {
+			mod, err := c.WithPolicy(policy).Compile()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			var buf bytes.Buffer
+			if err := encoding.WriteModule(&buf, mod); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			instance, err := opa.New().
+				WithPolicyBytes(buf.Bytes()).
+				WithPoolSize(1).
+				Init()
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			defer instance.Close()
+
+			ctx := context.Background()
+			res, err := instance.Eval(ctx, opa.EvalOpts{Input: parseJSON(`{"foo": 7, "bar": "abc"}`)})
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			exp := ast.MustParseTerm(`{{"x":7}}`)
+			actual := ast.MustParseTerm(string(res.Result))
+			if !actual.Equal(exp) {
+				t.Fatalf("Expected result to be %s, got: %s", exp, actual)
+			}
+		})
+	}
+}
+
+func TestPeepholeModule(t *testing.T) {
+	policy := planModule(t, `package test
+p { input.x == 1; not q }
+q { input.y[_] == 3 }
+r { p with input as {"x": 1} }
+s := {x | x := input.y[_]; x != 1}
+f(x) := y { y := x + 1 } else := 0
+t := f(input.x)`)
+
+	for _, input := range []string{
+		`{}`,
+		`{"x": 1}`,
+		`{"x": 1, "y": [1, 2]}`,
+		`{"x": 2, "y": [3]}`,
+	} {
+		exp := ast.MustParseTerm(evalCompiled(t, wasm.New().WithPolicy(policy), input))
+		actual := ast.MustParseTerm(evalCompiled(t, wasm.New().WithPolicy(policy).WithPeephole(true), input))
+		if !actual.Equal(exp) {
+			t.Errorf("input %s: expected result to be %s, got: %s", input, exp, actual)
+		}
+	}
+}
+
+func TestDedupModule(t *testing.T) {
+	policy := planModule(t, `package test
+s[x] { x := input.a[_] }
+u[x] { x := input.a[_] }
+v[x] { s[x] }
+w[x] { u[x] }`)
+
+	for _, input := range []string{
+		`{}`,
+		`{"a": [1, 2]}`,
+	} {
+		exp := ast.MustParseTerm(evalCompiled(t, wasm.New().WithPolicy(policy), input))
+		actual := ast.MustParseTerm(evalCompiled(t, wasm.New().WithPolicy(policy).WithDedupFunctions(true), input))
+		if !actual.Equal(exp) {
+			t.Errorf("input %s: expected result to be %s, got: %s", input, exp, actual)
+		}
+	}
+}
+
+func TestVerifyDCE(t *testing.T) {
+	policy := planModule(t, `package test
+p := count(input.a)
+q := concat(",", input.b) { input.b }
+r := upper(input.s) { input.s }`)
+	var inputs []interface{}
+	for _, input := range []string{`{}`, `{"a": [1], "b": ["x", "y"], "s": "z"}`, `{"s": 1}`} {
+		inputs = append(inputs, *parseJSON(input))
+	}
+	if _, err := wasm.New().WithPolicy(policy).WithVerifyDCE(inputs).Compile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// planModule plans the query data.test against the module.
+func planModule(t *testing.T, module string) *ir.Policy {
+	t.Helper()
+	c := ast.NewCompiler()
+	c.Compile(map[string]*ast.Module{"test.rego": ast.MustParseModule(module)})
+	if c.Failed() {
+		t.Fatal(c.Errors)
+	}
+	policy, err := planner.New().
+		WithQueries([]planner.QuerySet{{
+			Name:    "test",
+			Queries: []ast.Body{ast.MustParseBody(`data.test = x`)},
+		}}).
+		WithModules([]*ast.Module{c.Modules["test.rego"]}).
+		WithBuiltinDecls(ast.BuiltinMap).
+		Plan()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return policy
+}
+
+// evalCompiled compiles the policy with c, and evaluates it for input.
+func evalCompiled(t *testing.T, c *wasm.Compiler, input string) string {
+	t.Helper()
+	mod, err := c.Compile()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := encoding.WriteModule(&buf, mod); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	instance, err := opa.New().
+		WithPolicyBytes(buf.Bytes()).
+		WithPoolSize(1).
+		Init()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer instance.Close()
+	res, err := instance.Eval(context.Background(), opa.EvalOpts{Input: parseJSON(input)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return string(res.Result)
+}
+
 // compileRegoToWasm is shared with the benchmarking functions in opa_bench_test.go;
 // those function use helpers shared with topdown_bench_test.go, and they all use
 // `package test` -- whereas the callers in this file don't provide the package at
@@ -31,6 +31,7 @@ const opaRootDir = "../../../../../"
 
 var caseDir = flag.String("case-dir", filepath.Join(opaRootDir, "test/cases/testdata"), "set directory to load test cases from")
 var exceptionsFile = flag.String("exceptions", "./exceptions.yaml", "set file to load a list of test names to exclude")
+var optimizationLevel = flag.Int("optimization-level", 0, "set the planner's optimization level to compile the test cases at")
 
 var exceptions map[string]string
 
@@ -74,7 +75,7 @@ func TestWasmE2E(t *testing.T) {
 			if testing.Verbose() {
 				opts = append(opts, rego.Dump(os.Stderr))
 			}
-			cr, err := rego.New(opts...).Compile(ctx)
+			cr, err := rego.New(opts...).Compile(ctx, rego.CompileOptimizationLevel(*optimizationLevel))
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -1316,7 +1316,8 @@ type CompileOption func(*CompileContext)
 
 // CompileContext contains options for Compile calls.
 type CompileContext struct {
-	partial bool
+	partial           bool
+	optimizationLevel int
 }
 
 // CompilePartial defines an option to control whether partial evaluation is run
@@ -1327,6 +1328,15 @@ func CompilePartial(yes bool) CompileOption {
 	}
 }
 
+// CompileOptimizationLevel defines an option to set the level the planned
+// query and policy are optimized at before they're compiled, see
+// planner.WithOptimizationLevel. By default, they're not optimized.
+func CompileOptimizationLevel(n int) CompileOption {
+	return func(cfg *CompileContext) {
+		cfg.optimizationLevel = n
+	}
+}
+
 // Compile returns a compiled policy query.
 func (r *Rego) Compile(ctx context.Context, opts ...CompileOption) (*CompileResult, error) {
 
@@ -1401,10 +1411,10 @@ func (r *Rego) Compile(ctx context.Context, opts ...CompileOption) (*CompileResu
 		queries = []ast.Body{r.compiledQueries[compileQueryType].query}
 	}
 
-	return r.compileWasm(modules, queries, compileQueryType)
+	return r.compileWasm(modules, queries, compileQueryType, cfg.optimizationLevel)
 }
 
-func (r *Rego) compileWasm(modules []*ast.Module, queries []ast.Body, qType queryType) (*CompileResult, error) {
+func (r *Rego) compileWasm(modules []*ast.Module, queries []ast.Body, qType queryType, level int) (*CompileResult, error) {
 	decls := make(map[string]*ast.Builtin, len(r.builtinDecls)+len(ast.BuiltinMap))
 
 	for k, v := range ast.BuiltinMap {
@@ -1427,6 +1437,7 @@ func (r *Rego) compileWasm(modules []*ast.Module, queries []ast.Body, qType quer
 		}).
 		WithModules(modules).
 		WithBuiltinDecls(decls).
+		WithOptimizationLevel(level).
 		WithDebug(r.dump)
 	policy, err := p.Plan()
 	if err != nil {
@@ -1561,7 +1572,7 @@ func (r *Rego) PrepareForEval(ctx context.Context, opts ...PrepareOption) (Prepa
 		}
 
 		// nolint: staticcheck // SA4006 false positive
-		cr, err := r.compileWasm(modules, queries, evalQueryType)
+		cr, err := r.compileWasm(modules, queries, evalQueryType, 0)
 		if err != nil {
 			_ = txnClose(ctx, err) // Ignore error
 			return PreparedEvalQuery{}, err
@@ -1154,6 +1154,30 @@ func TestPrepareAndCompile(t *testing.T) {
 	}
 }
 
+func TestCompileOptimizationLevel(t *testing.T) {
+	module := `
+	package test
+	x { upper("a") == "A"; input.y }
+	`
+	ctx := context.Background()
+	plan := func(opts ...CompileOption) string {
+		t.Helper()
+		var buf bytes.Buffer
+		r := New(Query("data.test.x"), Module("", module), Dump(&buf))
+		if _, err := r.Compile(ctx, opts...); err != nil {
+			t.Fatalf("Unexpected error when compiling: %s", err.Error())
+		}
+		return buf.String()[strings.Index(buf.String(), "PLAN:"):]
+	}
+
+	if p := plan(); !strings.Contains(p, "upper") {
+		t.Errorf("expected call of upper, got:\n%s", p)
+	}
+	if p := plan(CompileOptimizationLevel(1)); strings.Contains(p, "upper") {
+		t.Errorf("expected call of upper to be evaluated, got:\n%s", p)
+	}
+}
+
 func TestPartialResultWithInput(t *testing.T) {
 	mod := `
 	package test